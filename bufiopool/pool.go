@@ -25,7 +25,12 @@ const (
 
 // New make a new buff io pool
 // min read / write buffer size is set if they are
-// smaller than MinReadBufferSize / MinWriteBufferSize
+// smaller than MinReadBufferSize / MinWriteBufferSize,
+// e.g. New(0, 0) is the same as NewDefault.
+//
+// The read buffer holds the whole request or response header as long as it
+// fits, which is parsed without copying, larger headers are accumulated in
+// an extra buffer, so size it by the common header size of the traffic.
 func New(readBufferSize, writeBufferSize int) *Pool {
 	if readBufferSize < MinReadBufferSize {
 		readBufferSize = MinReadBufferSize
@@ -39,6 +44,12 @@ func New(readBufferSize, writeBufferSize int) *Pool {
 	}
 }
 
+// NewDefault make a new buff io pool with the min read / write buffer size,
+// which suits the common http traffic
+func NewDefault() *Pool {
+	return New(MinReadBufferSize, MinWriteBufferSize)
+}
+
 // AcquireReader acquire a buffered reader based on net connection
 func (p *Pool) AcquireReader(c io.Reader) *bufio.Reader {
 	v := p.readerPool.Get()
@@ -1,7 +1,10 @@
 package bufiopool
 
 import (
+	"bytes"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"strings"
 	"testing"
 
@@ -80,3 +83,60 @@ func TestBufioPool(t *testing.T) {
 		t.Fatal("expected buffer is 0")
 	}
 }
+
+func TestNewBufferSizes(t *testing.T) {
+	for _, c := range []struct {
+		readSize, writeSize         int
+		expectedRead, expectedWrite int
+	}{
+		{0, 0, MinReadBufferSize, MinWriteBufferSize},
+		{-1, 1, MinReadBufferSize, MinWriteBufferSize},
+		{8192, 16384, 8192, 16384},
+	} {
+		p := New(c.readSize, c.writeSize)
+		if size := p.AcquireReader(strings.NewReader("")).Size(); size != c.expectedRead {
+			t.Fatalf("expected read buffer size %d, got %d", c.expectedRead, size)
+		}
+		if size := p.AcquireWriter(ioutil.Discard).Size(); size != c.expectedWrite {
+			t.Fatalf("expected write buffer size %d, got %d", c.expectedWrite, size)
+		}
+	}
+}
+
+func TestNewDefault(t *testing.T) {
+	p := NewDefault()
+	raw := "POST http://example.com/path?q=1 HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+		"Cookie: " + strings.Repeat("k=v; ", 200) + "\r\n" +
+		"Content-Length: 4\r\n\r\nbody"
+	r := p.AcquireReader(strings.NewReader(raw))
+	defer p.ReleaseReader(r)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if req.Host != "example.com" || string(body) != "body" {
+		t.Fatalf("unexpected request of host %q with body %q", req.Host, body)
+	}
+
+	// write it back with the body read
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var b bytes.Buffer
+	w := p.AcquireWriter(&b)
+	defer p.ReleaseWriter(w)
+	if err := req.Write(w); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(b.String(), "POST /path?q=1 HTTP/1.1\r\nHost: example.com\r\n") {
+		t.Fatalf("unexpected request written %q", b.String())
+	}
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -28,6 +29,10 @@ import (
 var ErrConnectionClosed = errors.New("the server closed connection before returning the first response byte. " +
 	"Make sure the server returns 'Connection: close' response header before closing the connection")
 
+// ErrTunnelDurationExceeded the tunnel is closed since it lasts longer
+// than MaxTunnelDuration
+var ErrTunnelDurationExceeded = errors.New("tunnel duration exceeded")
+
 // Request http request used for client
 type Request interface {
 	// Method request method in UPPER case
@@ -71,6 +76,19 @@ type Response interface {
 	ConnectionClose() bool
 }
 
+// UpgradeResponse a Response which may switch protocols, e.g. WebSocket,
+// the connection switched protocols is handed over to it rather than reused
+type UpgradeResponse interface {
+	Response
+
+	// IsUpgraded is the protocol switched by the response read
+	IsUpgraded() bool
+
+	// OnUpgrade takes over the connection switched protocols,
+	// the connection should be closed by it
+	OnUpgrade(conn net.Conn)
+}
+
 // Client implements http client.
 //
 // Copying Client by value is prohibited. Create new instance instead.
@@ -99,6 +117,46 @@ type Client struct {
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// TLSClientCertificate returns the certificate presented to the TLS
+	// target host (with port) when it requests one, e.g. a mTLS origin.
+	//
+	// No certificate is presented if not set or nil returned.
+	TLSClientCertificate func(host string) *tls.Certificate
+
+	// NextProtos ALPN protocols offered to the TLS target hosts.
+	//
+	// DefaultNextProtos is used if not set.
+	NextProtos []string
+
+	// RetryAfterMax max delay honored for the Retry-After header of 503 and
+	// 429 responses, the GET or HEAD request is retried after the delay capped
+	// by it rather than responded.
+	//
+	// Retry-After is not honored if not set.
+	RetryAfterMax time.Duration
+
+	// MaxTunnelDuration max wall-clock duration of the DoRaw tunnels,
+	// which are closed then regardless of the activity, unlike the idle
+	// timeout.
+	//
+	// The tunnels are never limited if not set.
+	MaxTunnelDuration time.Duration
+
+	// LocalAddr the local address the connections to target hosts are bound
+	// to, e.g. `192.0.2.10:0` choosing the egress IP on a multi-homed host.
+	// The connections to super proxies are bound by SuperProxy.LocalAddr.
+	//
+	// The system chooses it if not set.
+	LocalAddr *net.TCPAddr
+
+	// PermitTargetIP reports whether the target IP is permitted to connect,
+	// e.g. refusing the private networks, the direct connections are made
+	// to the permitted addresses resolved only, transport.ErrNoPermittedAddr
+	// is returned if none. The connections to super proxies are not checked.
+	//
+	// All the addresses are permitted if not set.
+	PermitTargetIP func(ip net.IP) bool
+
 	hostClientsLock sync.Mutex
 	// host clients pool, separate common and TLS clients
 	hostClients    map[string]*HostClient
@@ -151,6 +209,13 @@ func (c *Client) DoFake(req Request, resp Response, fakeRespReader io.Reader) (r
 // DoRaw make simple raw traffic forwarding
 func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
 	targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
+	return c.DoRawWithOptions(rw, sProxy, targetWithPort, nil, onTunnelMade)
+}
+
+// DoRawWithOptions DoRaw with the per request options, of which only the
+// LocalAddr applies to the raw traffic, nil opts overrides nothing
+func (c *Client) DoRawWithOptions(rw io.ReadWriter, sProxy *superproxy.SuperProxy, targetWithPort string,
+	opts *RequestOptions, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
 	//TODO: TEST DoRaw, Do and DoFake with the same super proxy
 	if rw == nil {
 		return 0, 0, onTunnelMade(errNilReadWriter)
@@ -164,8 +229,14 @@ func (c *Client) DoRaw(rw io.ReadWriter, sProxy *superproxy.SuperProxy,
 		}
 		isConnectHostTLS = (sProxy.GetProxyType() == superproxy.ProxyTypeHTTPS)
 	}
-	return c.getHostClient(connectHostWithPort,
-		isConnectHostTLS).DoRaw(rw, sProxy, targetWithPort, onTunnelMade)
+	if opts != nil && opts.LocalAddr != nil {
+		// the TLS settings never apply to the raw traffic
+		opts = &RequestOptions{LocalAddr: opts.LocalAddr}
+	} else {
+		opts = nil
+	}
+	return c.getHostClient(connectHostWithPort, isConnectHostTLS,
+		opts.connOverride(targetWithPort)).DoRaw(rw, sProxy, targetWithPort, onTunnelMade)
 }
 
 // Do performs the given http request and fills the given http response.
@@ -201,14 +272,29 @@ func (c *Client) Do(req Request, resp Response) (reqReadNum, reqWriteNum, respNu
 		isConnectHostTLS = req.IsTLS()
 	}
 
-	return c.getHostClient(connectHostWithPort, isConnectHostTLS).Do(req, resp)
+	opts := requestOptions(req)
+	override := opts.connOverride(req.TargetWithPort())
+	key := connectHostWithPort
+	if req.IsTLS() {
+		// the TLS connections are made to the target with the server name, and
+		// cached for reuse by the requests with the same ones only
+		serverName := req.TLSServerName()
+		if opts != nil && len(opts.TLSServerName) > 0 {
+			serverName = opts.TLSServerName
+		}
+		key = connectHostWithPort + "|" + req.TargetWithPort() + "|" + serverName
+	}
+	return c.getHostClient(key, isConnectHostTLS, override).Do(req, resp)
 }
 
-// getHostClient get a host client with providing the host to connect
-// and whether it supports TLS. For a direct connection, connectHostWithPort
-// is the target server. For a proxy connection, connectHostWithPort is the proxy server
-func (c *Client) getHostClient(connectHostWithPort string,
-	isConnectHostTLS bool) *HostClient {
+// getHostClient get a host client with providing the key of host to connect
+// and whether it supports TLS. For a direct connection, the key is the target
+// server. For a proxy connection, the key is the proxy server. The TLS requests
+// are keyed by the target and server name too, so that the connections are
+// reused by the same ones only. The requests overriding the TLS or dialing
+// settings are served by the separate host clients
+func (c *Client) getHostClient(key string,
+	isConnectHostTLS bool, override *connOverride) *HostClient {
 	startCleaner := false
 
 	// add or get a host client
@@ -225,18 +311,35 @@ func (c *Client) getHostClient(connectHostWithPort string,
 		}
 		hostClients = c.hostClients
 	}
-	hc := hostClients[connectHostWithPort]
+	key = override.hostClientKey(key)
+	hc := hostClients[key]
 	if hc == nil {
 		hc = &HostClient{
 			BufioPool:    c.BufioPool,
 			ReadTimeout:  c.ReadTimeout,
 			WriteTimeout: c.WriteTimeout,
+
+			TLSClientCertificate: c.TLSClientCertificate,
+			NextProtos:           c.NextProtos,
+			RetryAfterMax:        c.RetryAfterMax,
+			MaxTunnelDuration:    c.MaxTunnelDuration,
+			LocalAddr:            c.LocalAddr,
+			PermitTargetIP:       c.PermitTargetIP,
 			ConnManager: transport.ConnManager{
 				MaxConns:            c.MaxConnsPerHost,
 				MaxIdleConnDuration: c.MaxIdleConnDuration,
 			},
 		}
-		hostClients[connectHostWithPort] = hc
+		if override != nil {
+			if cert := override.cert; cert != nil {
+				hc.TLSClientCertificate = func(string) *tls.Certificate { return cert }
+			}
+			hc.InsecureSkipVerify = override.insecure
+			if override.localAddr != nil {
+				hc.LocalAddr = override.localAddr
+			}
+		}
+		hostClients[key] = hc
 		if len(hostClients) == 1 {
 			startCleaner = true
 		}
@@ -299,6 +402,43 @@ type HostClient struct {
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// TLSClientCertificate returns the certificate presented to the TLS
+	// target host (with port) when it requests one.
+	//
+	// No certificate is presented if not set or nil returned.
+	TLSClientCertificate func(host string) *tls.Certificate
+
+	// NextProtos ALPN protocols offered to the TLS target host.
+	//
+	// DefaultNextProtos is used if not set.
+	NextProtos []string
+
+	// RetryAfterMax max delay honored for the Retry-After header of 503 and
+	// 429 responses, the GET or HEAD request is retried after the delay capped
+	// by it rather than responded.
+	//
+	// Retry-After is not honored if not set.
+	RetryAfterMax time.Duration
+
+	// MaxTunnelDuration max wall-clock duration of the DoRaw tunnels,
+	// which are closed then regardless of the activity, unlike the idle
+	// timeout.
+	//
+	// The tunnels are never limited if not set.
+	MaxTunnelDuration time.Duration
+
+	// LocalAddr the local address the connections to target host are bound to.
+	//
+	// The system chooses it if not set.
+	LocalAddr *net.TCPAddr
+
+	// PermitTargetIP reports whether the target IP is permitted to connect,
+	// all the addresses are permitted if not set, see Client.PermitTargetIP
+	PermitTargetIP func(ip net.IP) bool
+
+	// InsecureSkipVerify skips verifying the certificate of the TLS target host
+	InsecureSkipVerify bool
+
 	// ConnManager manager of the connections
 	ConnManager transport.ConnManager
 
@@ -315,7 +455,8 @@ func (c *HostClient) LastUseTime() time.Time {
 	return time.Unix(startTimeUnix+int64(n), 0)
 }
 
-// DoRaw make simple raw traffic forwarding
+// DoRaw make simple raw traffic forwarding, both the target connection
+// and rw, if it's an io.Closer, are closed on MaxTunnelDuration exceeded
 func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 	targetWithPort string, onTunnelMade func(error) error) (rwReadNum, rwWriteNum int64, err error) {
 	// set hostClient's last used time
@@ -325,7 +466,7 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 	var cc *transport.Conn
 	var netConn net.Conn
 	if superProxy == nil {
-		netConn, err = transport.Dial(targetWithPort)
+		netConn, err = transport.DialPermitted(targetWithPort, c.LocalAddr, c.PermitTargetIP)
 	} else {
 		netConn, err = superProxy.MakeTunnel(c.BufioPool, targetWithPort)
 	}
@@ -372,15 +513,33 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 		}
 	}
 
+	var durationExceeded int32
+	if c.MaxTunnelDuration > 0 {
+		// the deadlines are refreshed by the idle duration when forwarding,
+		// so the connections are closed to stop both directions
+		timer := time.AfterFunc(c.MaxTunnelDuration, func() {
+			atomic.StoreInt32(&durationExceeded, 1)
+			conn.Close()
+			if closer, ok := rw.(io.Closer); ok {
+				closer.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+
 	var wg sync.WaitGroup
 	var rwWriteErr, rwReadErr error
 	wg.Add(2)
+	// a side done sending, e.g. half-closed, is told to the other side,
+	// while the other direction is still forwarded till it's done too
 	go func() {
 		rwReadNum, rwReadErr = transport.Forward(conn, rw, c.ConnManager.MaxIdleConnDuration)
+		transport.CloseWrite(conn)
 		wg.Done()
 	}()
 	go func() {
 		rwWriteNum, rwWriteErr = transport.Forward(rw, conn, c.ConnManager.MaxIdleConnDuration)
+		transport.CloseWrite(rw)
 		wg.Done()
 	}()
 	wg.Wait()
@@ -391,6 +550,9 @@ func (c *HostClient) DoRaw(rw io.ReadWriter, superProxy *superproxy.SuperProxy,
 	if rwWriteErr != nil {
 		err = util.ErrWrapper(rwWriteErr, "error occurred when tunneling response")
 	}
+	if atomic.LoadInt32(&durationExceeded) == 1 {
+		err = ErrTunnelDurationExceeded
+	}
 
 	//TODO: should reuse these connections????? only close socks5 connections? more tests?
 	c.ConnManager.CloseConn(cc)
@@ -415,6 +577,7 @@ func (c *HostClient) Do(req Request, resp Response) (reqReadNum, reqWriteNum, re
 	}
 	const maxAttempts = 5
 	attempts := 0
+	opts := requestOptions(req)
 
 	atomic.AddUint64(&c.pendingRequests, 1)
 	buffer := bytebufferpool.Get()
@@ -423,7 +586,9 @@ func (c *HostClient) Do(req Request, resp Response) (reqReadNum, reqWriteNum, re
 	var currentReqWriteNum int
 	var currentRespNum int
 	for {
-		retry, currentReqReadNum, currentReqWriteNum, currentRespNum, err = c.do(req, resp, buffer)
+		// the response asking for retry is discarded, which is impossible for the last attempt
+		honorRetryAfter := c.RetryAfterMax > 0 && isHeadOrGet(req.Method()) && attempts+1 < maxAttempts
+		retry, currentReqReadNum, currentReqWriteNum, currentRespNum, err = c.do(req, resp, opts, buffer, honorRetryAfter)
 		reqReadNum += currentReqReadNum
 		reqWriteNum += currentReqWriteNum
 		respNum += currentRespNum
@@ -447,6 +612,9 @@ func (c *HostClient) Do(req Request, resp Response) (reqReadNum, reqWriteNum, re
 		if attempts >= maxAttempts {
 			break
 		}
+		if retryAfter, ok := err.(*retryAfterError); ok {
+			time.Sleep(retryAfter.delay)
+		}
 	}
 	bytebufferpool.Put(buffer)
 	atomic.AddUint64(&c.pendingRequests, ^uint64(0))
@@ -466,8 +634,9 @@ func (c *HostClient) PendingRequests() int {
 	return int(atomic.LoadUint64(&c.pendingRequests))
 }
 
-func (c *HostClient) do(req Request, resp Response,
-	reqCacheForRetry *bytebufferpool.ByteBuffer) (retry bool, reqReadNum, reqWriteNum, respNum int, err error) {
+func (c *HostClient) do(req Request, resp Response, opts *RequestOptions,
+	reqCacheForRetry *bytebufferpool.ByteBuffer,
+	honorRetryAfter bool) (retry bool, reqReadNum, reqWriteNum, respNum int, err error) {
 	// set hostClient's last used time
 	atomic.StoreUint32(&c.lastUseTime, uint32(servertime.CoarseTimeNow().Unix()-startTimeUnix))
 
@@ -475,21 +644,27 @@ func (c *HostClient) do(req Request, resp Response,
 	viaProxy := (req.GetProxy() != nil)
 
 	// get the connection
+	tlsServerName := req.TLSServerName()
+	if opts != nil && len(opts.TLSServerName) > 0 {
+		tlsServerName = opts.TLSServerName
+	}
 	cc, err := c.ConnManager.AcquireConn(c.makeDialer(req.GetProxy(),
-		req.TargetWithPort(), req.IsTLS(), req.TLSServerName()))
+		req.TargetWithPort(), req.IsTLS(), tlsServerName))
 	if err != nil {
 		return false, reqReadNum, reqWriteNum, respNum, err
 	}
 	conn := cc.Get()
 
-	// pre-setup
-	if c.WriteTimeout > 0 {
+	// pre-setup, the deadlines are always updated for the timeouts
+	// overridden, which may be shorter than the last ones
+	readTimeout, writeTimeout := opts.timeouts(c.ReadTimeout, c.WriteTimeout)
+	if writeTimeout > 0 {
 		// Optimization: update write deadline only if more than 25%
 		// of the last write deadline exceeded.
 		// See https:// github.com/golang/go/issues/15133 for details.
 		currentTime := servertime.CoarseTimeNow()
-		if currentTime.Sub(cc.LastWriteDeadlineTime) > (c.WriteTimeout >> 2) {
-			if err = conn.SetWriteDeadline(currentTime.Add(c.WriteTimeout)); err != nil {
+		if writeTimeout != c.WriteTimeout || currentTime.Sub(cc.LastWriteDeadlineTime) > (writeTimeout>>2) {
+			if err = conn.SetWriteDeadline(currentTime.Add(writeTimeout)); err != nil {
 				c.ConnManager.CloseConn(cc)
 				return true, reqReadNum, reqWriteNum, respNum, err
 			}
@@ -543,13 +718,13 @@ func (c *HostClient) do(req Request, resp Response,
 	}
 
 	// get response
-	if c.ReadTimeout > 0 {
+	if readTimeout > 0 {
 		// Optimization: update read deadline only if more than 25%
 		// of the last read deadline exceeded.
 		// See https:// github.com/golang/go/issues/15133 for details.
 		currentTime := servertime.CoarseTimeNow()
-		if currentTime.Sub(cc.LastReadDeadlineTime) > (c.ReadTimeout >> 2) {
-			if err = conn.SetReadDeadline(currentTime.Add(c.ReadTimeout)); err != nil {
+		if readTimeout != c.ReadTimeout || currentTime.Sub(cc.LastReadDeadlineTime) > (readTimeout>>2) {
+			if err = conn.SetReadDeadline(currentTime.Add(readTimeout)); err != nil {
 				c.ConnManager.CloseConn(cc)
 				return true, reqReadNum, reqWriteNum, respNum, err
 			}
@@ -566,6 +741,17 @@ func (c *HostClient) do(req Request, resp Response,
 	} else if len(b) == 0 {
 		return true, reqReadNum, reqWriteNum, respNum, io.EOF
 	}
+	if honorRetryAfter {
+		if delay, ok := peekRetryAfter(br); ok {
+			// the response is skipped along with the connection
+			c.BufioPool.ReleaseReader(br)
+			c.ConnManager.CloseConn(cc)
+			if delay > c.RetryAfterMax {
+				delay = c.RetryAfterMax
+			}
+			return true, reqReadNum, reqWriteNum, respNum, &retryAfterError{delay: delay}
+		}
+	}
 
 	n, err := resp.ReadFrom(isHead(req.Method()), br)
 	if err != nil {
@@ -574,6 +760,18 @@ func (c *HostClient) do(req Request, resp Response,
 		return false, reqReadNum, reqWriteNum, respNum, err
 	}
 	respNum += n
+	if upgradeResp, ok := resp.(UpgradeResponse); ok && upgradeResp.IsUpgraded() {
+		// the bytes following the response are already sent in new protocol
+		conn := c.ConnManager.DetachConn(cc)
+		if br.Buffered() > 0 {
+			buffered, _ := br.Peek(br.Buffered())
+			conn = &upgradedConn{Conn: conn,
+				reader: io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), conn)}
+		}
+		c.BufioPool.ReleaseReader(br)
+		upgradeResp.OnUpgrade(conn)
+		return false, reqReadNum, reqWriteNum, respNum, nil
+	}
 	c.BufioPool.ReleaseReader(br)
 
 	// release or close connection
@@ -587,6 +785,17 @@ func (c *HostClient) do(req Request, resp Response,
 	return false, reqReadNum, reqWriteNum, respNum, err
 }
 
+// upgradedConn a connection switched protocols, which reads the bytes
+// already buffered firstly
+type upgradedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
 func (c *HostClient) writeData(data []byte, w io.Writer) (int, error) {
 	bw := c.BufioPool.AcquireWriter(w)
 	defer c.BufioPool.ReleaseWriter(bw)
@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -12,10 +13,12 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/mitm"
 	"github.com/haxii/fastproxy/superproxy"
 )
 
@@ -59,6 +62,112 @@ func TestClientDo(t *testing.T) {
 	testClientDoFake(t)
 }
 
+// Test client do with a target host requiring client certificate
+func TestClientDoWithClientCertificate(t *testing.T) {
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	clientCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"fastproxy client"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:4434", &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "Hello %s!", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+
+	var requestedHost string
+	c := &Client{
+		BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize),
+		TLSClientCertificate: func(host string) *tls.Certificate {
+			requestedHost = host
+			return clientCert
+		},
+	}
+	req := &HTTPSRequest{targetwithport: "127.0.0.1:4434"}
+	resp := &SimpleResponse{}
+	if _, _, _, err = c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if requestedHost != "127.0.0.1:4434" {
+		t.Fatalf("unexpected host for client certificate: %s", requestedHost)
+	}
+	if !bytes.Contains(resp.GetBody(), []byte("Hello fastproxy client!")) {
+		t.Fatalf("unexpected response body: %s", resp.GetBody())
+	}
+
+	// no client certificate presented
+	c = &Client{
+		BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize),
+	}
+	if _, _, _, err = c.Do(req, &SimpleResponse{}); err == nil {
+		t.Fatal("expected error when no client certificate presented")
+	}
+}
+
+func TestClientDoNextProtos(t *testing.T) {
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// an origin preferring h2
+	ln, err := tls.Listen("tcp4", "127.0.0.1:4438", &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		NextProtos:   []string{"h2", "x-test", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if _, err := nethttp.ReadRequest(bufio.NewReader(tlsConn)); err != nil {
+					return
+				}
+				body := fmt.Sprintf("Hello %s!", tlsConn.ConnectionState().NegotiatedProtocol)
+				fmt.Fprintf(tlsConn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+					len(body), body)
+			}()
+		}
+	}()
+
+	for _, c := range []struct {
+		nextProtos []string
+		expected   string
+	}{
+		{nil, "Hello http/1.1!"},
+		{[]string{"x-test", "http/1.1"}, "Hello x-test!"},
+	} {
+		client := &Client{
+			BufioPool:  bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize),
+			NextProtos: c.nextProtos,
+		}
+		req := &HTTPSRequest{targetwithport: "127.0.0.1:4438"}
+		resp := &SimpleResponse{}
+		if _, _, _, err = client.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error with next protos %v: %s", c.nextProtos, err)
+		}
+		if !bytes.Contains(resp.GetBody(), []byte(c.expected)) {
+			t.Fatalf("expected %q with next protos %v, got %q", c.expected, c.nextProtos, resp.GetBody())
+		}
+	}
+}
+
 // Test Client do with big header or big body
 func TestClientDoWithBigHeaderOrBody(t *testing.T) {
 	go func() {
@@ -77,7 +186,7 @@ func TestClientDoWithBigHeaderOrBody(t *testing.T) {
 	testClientDoWithBigBodyResponse(t)
 }
 
-//test client do with default parameters
+// test client do with default parameters
 func testClientDoByDefaultParameters(t *testing.T) {
 	var err error
 	bPool := bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize)
@@ -1067,6 +1176,9 @@ func (r *HTTPSRequest) Method() []byte {
 }
 
 func (r *HTTPSRequest) TargetWithPort() string {
+	if len(r.targetwithport) > 0 {
+		return r.targetwithport
+	}
 	return "127.0.0.1:4433"
 }
 func (r *HTTPSRequest) SetTargetWithPort(s string) {}
@@ -1122,3 +1234,359 @@ func (r *HTTPSRequest) AddReadSize(n int) {
 
 func (r *HTTPSRequest) AddWriteSize(n int) {
 }
+
+// Test client honoring the Retry-After of 503 and 429 responses
+func TestClientDoRetryAfter(t *testing.T) {
+	var lock sync.Mutex
+	var requestTimes []time.Time
+	ln, err := net.Listen("tcp4", "127.0.0.1:10011")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		lock.Lock()
+		requestTimes = append(requestTimes, time.Now())
+		attempt := len(requestTimes)
+		lock.Unlock()
+		switch r.URL.Query().Get("retry") {
+		case "seconds":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(nethttp.StatusServiceUnavailable)
+				fmt.Fprint(w, "Unavailable!")
+				return
+			}
+		case "date":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", time.Now().Add(2*time.Second).UTC().Format(nethttp.TimeFormat))
+				w.WriteHeader(nethttp.StatusTooManyRequests)
+				fmt.Fprint(w, "Too many!")
+				return
+			}
+		case "forever":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(nethttp.StatusServiceUnavailable)
+			fmt.Fprint(w, "Unavailable!")
+			return
+		}
+		fmt.Fprint(w, "Hello world!")
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	testClientDoRetryAfter := func(retry string, retryAfterMax time.Duration,
+		expAttempts int, expMinDelay, expMaxDelay time.Duration, expBody string) {
+		lock.Lock()
+		requestTimes = nil
+		lock.Unlock()
+		c := &Client{
+			BufioPool:     bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize),
+			RetryAfterMax: retryAfterMax,
+		}
+		req := &RetryAfterRequest{retry: retry}
+		req.SetTargetWithPort("127.0.0.1:10011")
+		resp := &SimpleResponse{}
+		if _, _, _, err := c.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Contains(resp.GetBody(), []byte(expBody)) {
+			t.Fatalf("expected body %q for retry %s, got %q", expBody, retry, resp.GetBody())
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if len(requestTimes) != expAttempts {
+			t.Fatalf("expected %d attempts for retry %s, got %d", expAttempts, retry, len(requestTimes))
+		}
+		if expAttempts < 2 {
+			return
+		}
+		delay := requestTimes[1].Sub(requestTimes[0])
+		if delay < expMinDelay || delay > expMaxDelay {
+			t.Fatalf("expected retry delay between %s and %s for retry %s, got %s",
+				expMinDelay, expMaxDelay, retry, delay)
+		}
+	}
+	testClientDoRetryAfter("seconds", 5*time.Second, 2, time.Second, 2*time.Second, "Hello world!")
+	// the HTTP-date loses the sub second part
+	testClientDoRetryAfter("date", 5*time.Second, 2, time.Second, 3*time.Second, "Hello world!")
+	// the delay is capped, the last response is responded
+	testClientDoRetryAfter("forever", 100*time.Millisecond, 5, 100*time.Millisecond, time.Second, "Unavailable!")
+	// not honored when disabled
+	testClientDoRetryAfter("seconds", 0, 1, 0, 0, "Unavailable!")
+}
+
+// RetryAfterRequest a GET request asking the server for a Retry-After response
+type RetryAfterRequest struct {
+	SimpleRequest
+	retry string
+}
+
+func (r *RetryAfterRequest) PathWithQueryFragment() []byte {
+	return []byte("/?retry=" + r.retry)
+}
+
+// Test the per request options overriding the ones of client
+func TestClientDoWithRequestOptions(t *testing.T) {
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"options.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:4435", &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "Hello world!")
+	}))
+
+	c := &Client{
+		BufioPool: bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize),
+	}
+	// the certificate not trusted by default
+	req := &OptionsHTTPSRequest{HTTPSRequest: HTTPSRequest{targetwithport: "127.0.0.1:4435"}}
+	if _, _, _, err = c.Do(req, &SimpleResponse{}); err == nil {
+		t.Fatal("expected error verifying the untrusted certificate")
+	}
+
+	req.options = &RequestOptions{InsecureSkipVerify: true}
+	resp := &SimpleResponse{}
+	if _, _, _, err = c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Contains(resp.GetBody(), []byte("Hello world!")) {
+		t.Fatalf("unexpected response body: %s", resp.GetBody())
+	}
+
+	req.options = &RequestOptions{InsecureSkipVerify: true, ReadTimeout: 50 * time.Millisecond}
+	_, _, _, err = c.Do(req, &SimpleResponse{})
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	// the insecure connections are never shared with the default requests
+	req.options = nil
+	if _, _, _, err = c.Do(req, &SimpleResponse{}); err == nil {
+		t.Fatal("expected error verifying the untrusted certificate")
+	}
+}
+
+// OptionsHTTPSRequest a HTTPS request carrying options
+type OptionsHTTPSRequest struct {
+	HTTPSRequest
+	options *RequestOptions
+}
+
+func (r *OptionsHTTPSRequest) TLSServerName() string {
+	return "options.test"
+}
+
+func (r *OptionsHTTPSRequest) Options() *RequestOptions {
+	return r.options
+}
+
+// serveTLSConnCounting serves a TLS server of the names on addr, which
+// responds the server name of each request, the connections made are counted
+func serveTLSConnCounting(t testing.TB, addr string, names []string) (*int64, func()) {
+	caCertPEM, caKeyPEM, err := mitm.MakeMITMCertAuthority("", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(&ca, names)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", addr, &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conns := new(int64)
+	server := &nethttp.Server{
+		Handler: nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			if r.TLS.ServerName == "close.test" {
+				w.Header().Set("Connection", "close")
+			}
+			// SimpleResponse reads till the '!'
+			fmt.Fprint(w, r.TLS.ServerName+"!")
+		}),
+		ConnState: func(c net.Conn, state nethttp.ConnState) {
+			if state == nethttp.StateNew {
+				atomic.AddInt64(conns, 1)
+			}
+		},
+	}
+	go server.Serve(ln)
+	return conns, func() { server.Close() }
+}
+
+// SNIHTTPSRequest a HTTPS request to the server name
+type SNIHTTPSRequest struct {
+	HTTPSRequest
+	serverName string
+	options    *RequestOptions
+}
+
+func (r *SNIHTTPSRequest) TLSServerName() string {
+	return r.serverName
+}
+
+func (r *SNIHTTPSRequest) Options() *RequestOptions {
+	return r.options
+}
+
+// skipVerifyOptions requests the test servers signed by an untrusted authority
+var skipVerifyOptions = &RequestOptions{InsecureSkipVerify: true}
+
+func TestClientDoReusesTLSConnsByServerName(t *testing.T) {
+	conns, stop := serveTLSConnCounting(t, "127.0.0.1:4436",
+		[]string{"a.test", "b.test", "close.test"})
+	defer stop()
+	time.Sleep(time.Millisecond * 10)
+
+	c := &Client{BufioPool: bufiopool.NewDefault()}
+	// the same target with different server names, e.g. behind a CDN
+	for _, serverName := range []string{"a.test", "b.test", "a.test", "b.test", "close.test", "close.test"} {
+		req := &SNIHTTPSRequest{HTTPSRequest: HTTPSRequest{targetwithport: "127.0.0.1:4436"},
+			serverName: serverName, options: skipVerifyOptions}
+		resp := &SimpleResponse{}
+		if _, _, _, err := c.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.HasSuffix(resp.GetBody(), []byte("\r\n\r\n"+serverName+"!")) {
+			t.Fatalf("expected the response of %s, got %q", serverName, resp.GetBody())
+		}
+	}
+	// the connections are reused by the same server name, the one closed
+	// by the target is found closed before reuse and made again
+	if n := atomic.LoadInt64(conns); n != 4 {
+		t.Fatalf("expected 4 connections made, got %d", n)
+	}
+}
+
+// ProxiedSNIHTTPSRequest a HTTPS request to the server name through proxy
+type ProxiedSNIHTTPSRequest struct {
+	SNIHTTPSRequest
+	proxy *superproxy.SuperProxy
+}
+
+func (r *ProxiedSNIHTTPSRequest) GetProxy() *superproxy.SuperProxy {
+	return r.proxy
+}
+
+// serveConnectProxy serves a plain HTTP proxy making the CONNECT tunnels on addr
+func serveConnectProxy(t *testing.T, addr string) func() {
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := nethttp.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				target, err := net.Dial("tcp4", req.Host)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return func() { ln.Close() }
+}
+
+func TestClientDoVerifiesTLSThroughProxy(t *testing.T) {
+	_, stop := serveTLSConnCounting(t, "127.0.0.1:4440", []string{"a.test"})
+	defer stop()
+	stopProxy := serveConnectProxy(t, "127.0.0.1:4441")
+	defer stopProxy()
+	time.Sleep(time.Millisecond * 10)
+	sProxy, err := superproxy.NewSuperProxy("127.0.0.1", 4441, superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	newRequest := func(options *RequestOptions) Request {
+		return &ProxiedSNIHTTPSRequest{SNIHTTPSRequest: SNIHTTPSRequest{
+			HTTPSRequest: HTTPSRequest{targetwithport: "127.0.0.1:4440"},
+			serverName:   "a.test", options: options}, proxy: sProxy}
+	}
+
+	// verified as the direct ones, sending the server name
+	c := &Client{BufioPool: bufiopool.NewDefault()}
+	_, _, _, err = c.Do(newRequest(nil), &SimpleResponse{})
+	if err == nil || !strings.Contains(err.Error(), "unknown authority") {
+		t.Fatalf("expected error verifying the untrusted certificate, got %v", err)
+	}
+	resp := &SimpleResponse{}
+	if _, _, _, err := c.Do(newRequest(skipVerifyOptions), resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.HasSuffix(resp.GetBody(), []byte("\r\n\r\na.test!")) {
+		t.Fatalf("unexpected response %q", resp.GetBody())
+	}
+}
+
+func TestRequestOptionsCertKey(t *testing.T) {
+	leaf, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"a.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	another, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"b.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyOf := func(cert *tls.Certificate) string {
+		opts := &RequestOptions{TLSClientCertificate: func(host string) *tls.Certificate {
+			// a new certificate made for every request
+			c := *cert
+			return &c
+		}}
+		return opts.connOverride("a.test:443").hostClientKey("a.test:443")
+	}
+	if keyOf(leaf) != keyOf(leaf) {
+		t.Fatal("expected the same key of the same certificate made again")
+	}
+	if keyOf(leaf) == keyOf(another) {
+		t.Fatal("expected different keys of different certificates")
+	}
+}
+
+func BenchmarkClientDoTLS(b *testing.B) {
+	conns, stop := serveTLSConnCounting(b, "127.0.0.1:4437", []string{"a.test"})
+	defer stop()
+	time.Sleep(time.Millisecond * 10)
+
+	bench := func(b *testing.B, newClient bool) {
+		c := &Client{BufioPool: bufiopool.NewDefault()}
+		atomic.StoreInt64(conns, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if newClient {
+				c = &Client{BufioPool: c.BufioPool}
+			}
+			req := &SNIHTTPSRequest{HTTPSRequest: HTTPSRequest{targetwithport: "127.0.0.1:4437"},
+				serverName: "a.test", options: skipVerifyOptions}
+			if _, _, _, err := c.Do(req, &SimpleResponse{}); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "handshakes/op")
+	}
+	b.Run("Reused", func(b *testing.B) { bench(b, false) })
+	b.Run("NewClient", func(b *testing.B) { bench(b, true) })
+}
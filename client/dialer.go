@@ -49,40 +49,90 @@ func parseRequestType(superProxy *superproxy.SuperProxy, isHTTPS bool) requestTy
 	return rt
 }
 
+// DefaultNextProtos ALPN protocols offered to the TLS target hosts when
+// NextProtos not set, only HTTP/1.x is parsed, so that h2 is never offered
+var DefaultNextProtos = []string{"http/1.1"}
+
+// makeDialer makes the dialer of the connection to target, which is dialed
+// only when no idle connection is available for reuse
 func (c *HostClient) makeDialer(superProxy *superproxy.SuperProxy,
 	targetWithPort string, isTargetHTTPS bool, targetTLSServerName string) transport.Dialer {
+	return func() (net.Conn, error) {
+		return c.dial(superProxy, targetWithPort, isTargetHTTPS, targetTLSServerName)
+	}
+}
+
+func (c *HostClient) dial(superProxy *superproxy.SuperProxy,
+	targetWithPort string, isTargetHTTPS bool, targetTLSServerName string) (net.Conn, error) {
 	reqType := parseRequestType(superProxy, isTargetHTTPS)
 	//set https tls config
 	switch reqType {
 	case requestDirectHTTP:
-		return dialerWrapper(transport.Dial(targetWithPort))
+		return transport.DialPermitted(targetWithPort, c.LocalAddr, c.PermitTargetIP)
 	case requestDirectHTTPS:
 		if c.tlsServerConfig == nil {
-			c.tlsServerConfig = cert.MakeClientTLSConfig("", targetTLSServerName)
+			c.tlsServerConfig = c.makeTLSServerConfig(targetTLSServerName)
 		}
-		return dialerWrapper(transport.DialTLS(targetWithPort, c.tlsServerConfig))
+		return transport.DialTLSPermitted(targetWithPort, c.tlsConfigFor(targetWithPort),
+			c.LocalAddr, c.PermitTargetIP)
 	case requestProxyHTTP:
-		return dialerWrapper(transport.Dial(superProxy.HostWithPort()))
+		return superProxy.Dial()
 	case requestProxyHTTPS:
+		// the TLS requests are served by the host clients of the target and
+		// server name, whether through a super proxy or not
 		if c.tlsServerConfig == nil {
-			c.tlsServerConfig = &tls.Config{
-				ClientSessionCache: tls.NewLRUClientSessionCache(0),
-				InsecureSkipVerify: true, //TODO: cache every host config in more safe way in a concurrent map
-			}
+			c.tlsServerConfig = c.makeTLSServerConfig(targetTLSServerName)
 		}
 		fallthrough
 	case requestProxySOCKS5:
 		tunnelConn, err := superProxy.MakeTunnel(c.BufioPool, targetWithPort)
 		if err != nil {
-			return dialerWrapper(nil, err)
+			return nil, err
 		}
 		if reqType == requestProxyHTTPS {
-			conn := tls.Client(tunnelConn, c.tlsServerConfig)
-			return dialerWrapper(conn, nil)
+			conn := tls.Client(tunnelConn, c.tlsConfigFor(targetWithPort))
+			return conn, nil
+		}
+		return tunnelConn, nil
+	}
+	return nil, errors.New("request type not implemented")
+}
+
+// makeTLSServerConfig makes the config of the TLS target host verified with
+// the server name
+func (c *HostClient) makeTLSServerConfig(targetTLSServerName string) *tls.Config {
+	tlsConfig := cert.MakeClientTLSConfig("", targetTLSServerName)
+	tlsConfig.NextProtos = c.nextProtos()
+	if c.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig
+}
+
+func (c *HostClient) nextProtos() []string {
+	if len(c.NextProtos) == 0 {
+		return DefaultNextProtos
+	}
+	return c.NextProtos
+}
+
+// tlsConfigFor returns the cached TLS server config, with the client
+// certificate of target host set if TLSClientCertificate provided
+func (c *HostClient) tlsConfigFor(targetWithPort string) *tls.Config {
+	if c.TLSClientCertificate == nil {
+		return c.tlsServerConfig
+	}
+	// the cached config is shared by different targets when using a super proxy,
+	// so a copy is made, which still shares the client session cache
+	tlsConfig := c.tlsServerConfig.Clone()
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if cert := c.TLSClientCertificate(targetWithPort); cert != nil {
+			return cert, nil
 		}
-		return dialerWrapper(tunnelConn, nil)
+		// an empty certificate means no certificate is sent
+		return &tls.Certificate{}, nil
 	}
-	return dialerWrapper(nil, errors.New("request type not implemented"))
+	return tlsConfig
 }
 
 // wrap a connection and error into a transport Dialer
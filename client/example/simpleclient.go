@@ -116,7 +116,7 @@ func main() {
 	// Do
 	time.Sleep(time.Second)
 	fmt.Println()
-	client := &client.Client{BufioPool: bufiopool.New(1, 1)}
+	client := &client.Client{BufioPool: bufiopool.NewDefault()}
 	fmt.Println(client.Do(&simpleReq{}, &simpleResp{}))
 
 	// Do Fake
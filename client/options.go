@@ -0,0 +1,107 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RequestOptions per request settings overriding the ones of the client,
+// the zero value overrides nothing
+type RequestOptions struct {
+	// ReadTimeout maximum duration for full response reading
+	ReadTimeout time.Duration
+	// WriteTimeout maximum duration for full request writing
+	WriteTimeout time.Duration
+
+	// TLSClientCertificate returns the certificate presented to the TLS
+	// target host (with port), overrides Client.TLSClientCertificate
+	TLSClientCertificate func(host string) *tls.Certificate
+	// TLSServerName the server name sent to and verified for the TLS
+	// target host instead of the one of request
+	TLSServerName string
+	// InsecureSkipVerify skips verifying the certificate of the TLS target host
+	InsecureSkipVerify bool
+
+	// LocalAddr the local address the connections to target host are bound
+	// to, overrides Client.LocalAddr, e.g. for rotating the egress IPs
+	LocalAddr *net.TCPAddr
+}
+
+// OptionsRequest a Request carrying the per request options
+type OptionsRequest interface {
+	Request
+
+	// Options returns the options of the request, nil for none
+	Options() *RequestOptions
+}
+
+// requestOptions returns the options of req if any
+func requestOptions(req Request) *RequestOptions {
+	if optsReq, ok := req.(OptionsRequest); ok {
+		return optsReq.Options()
+	}
+	return nil
+}
+
+// connOverride the TLS and dialing settings of a request overriding the
+// client's, the connections made with them are never shared with the other
+// requests
+type connOverride struct {
+	cert *tls.Certificate
+	// certID identifies cert by the leaf, since the callback could make a
+	// new one of the same for every request
+	certID     string
+	serverName string
+	insecure   bool
+	localAddr  *net.TCPAddr
+}
+
+// connOverride returns the settings overridden for the target, nil if none
+func (o *RequestOptions) connOverride(targetWithPort string) *connOverride {
+	if o == nil || (o.TLSClientCertificate == nil && len(o.TLSServerName) == 0 &&
+		!o.InsecureSkipVerify && o.LocalAddr == nil) {
+		return nil
+	}
+	override := &connOverride{serverName: o.TLSServerName, insecure: o.InsecureSkipVerify,
+		localAddr: o.LocalAddr}
+	if o.TLSClientCertificate != nil {
+		override.cert = o.TLSClientCertificate(targetWithPort)
+		override.certID = certFingerprint(override.cert)
+	}
+	return override
+}
+
+// certFingerprint the SHA-256 fingerprint of the leaf of cert, empty if none
+func certFingerprint(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// hostClientKey the key of the host clients using the settings
+func (o *connOverride) hostClientKey(key string) string {
+	if o == nil {
+		return key
+	}
+	return fmt.Sprintf("%s|%s|%t|%s|%s", key, o.serverName, o.insecure, o.certID, o.localAddr)
+}
+
+// timeouts returns the read and write timeouts overridden by o
+func (o *RequestOptions) timeouts(readTimeout, writeTimeout time.Duration) (time.Duration, time.Duration) {
+	if o == nil {
+		return readTimeout, writeTimeout
+	}
+	if o.ReadTimeout > 0 {
+		readTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout > 0 {
+		writeTimeout = o.WriteTimeout
+	}
+	return readTimeout, writeTimeout
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+// retryAfterError the response asks for retrying the request after delay
+type retryAfterError struct {
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("target host asks for retry after %s", e.delay)
+}
+
+// peekRetryAfter peeks the response status and headers buffered in br, returns
+// the delay of the Retry-After header of the 503 or 429 response if any
+func peekRetryAfter(br *bufio.Reader) (time.Duration, bool) {
+	for n := 1; ; {
+		if _, err := br.Peek(n); err != nil {
+			return 0, false
+		}
+		b := util.PeekBuffered(br)
+		lineEnd := bytes.IndexByte(b, '\n')
+		if lineEnd >= 0 && !isRetryAfterStatus(b[:lineEnd]) {
+			return 0, false
+		}
+		if lineEnd >= 0 {
+			headers := b[lineEnd+1:]
+			end := bytes.Index(headers, []byte("\r\n\r\n"))
+			if end < 0 {
+				end = bytes.Index(headers, []byte("\n\n"))
+			}
+			if end >= 0 {
+				retryAfter := http.GetHeaderValue(headers[:end+1], "Retry-After")
+				if retryAfter == nil {
+					return 0, false
+				}
+				return http.ParseRetryAfter(retryAfter, time.Now())
+			}
+		}
+		// the headers are longer than the buffer
+		if len(b) >= br.Size() {
+			return 0, false
+		}
+		n = len(b) + 1
+	}
+}
+
+// isRetryAfterStatus is the status of the response line 503 or 429
+func isRetryAfterStatus(respLine []byte) bool {
+	fields := bytes.Fields(respLine)
+	if len(fields) < 2 {
+		return false
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return false
+	}
+	return status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests
+}
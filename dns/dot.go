@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultDoTPort port of the DNS-over-TLS servers, see RFC 7858
+const DefaultDoTPort = "853"
+
+var errDoTTimeout = errors.New("dns over tls query timed out")
+
+// maxDoTTimeouts the queries timed out in a row closing the connection,
+// whose server is regarded as not replying any more
+const maxDoTTimeouts = 3
+
+// DoT the backend querying the DNS-over-TLS server at Addr, e.g.
+// `1.1.1.1:853`, the connection is kept and reused by the following
+// queries, which are pipelined and matched with the replies by ID.
+// Add multiple DoT backends into Resolver.Backends for the failover
+// between the servers.
+type DoT struct {
+	// Addr host with optional port of the DoT server,
+	// DefaultDoTPort is used if no port given
+	Addr string
+
+	// TLSConfig verifies the server certificate, the ServerName is the host
+	// of Addr if not set, e.g. the IP for the certificates with IP SANs.
+	// The system roots are used if not set.
+	TLSConfig *tls.Config
+
+	// ClientSubnet the EDNS Client Subnet sent in the queries, see Server
+	ClientSubnet *net.IPNet
+
+	// lock guards conn only, the queries are sent and read by conn
+	lock sync.Mutex
+	conn *dotConn
+}
+
+// Lookup queries the A records of host
+func (d *DoT) Lookup(host string, deadline time.Time) ([]net.IP, error) {
+	// the id is set by the connection, unique among the queries pending
+	query, err := appendQuery(nil, 0, host, d.ClientSubnet)
+	if err != nil {
+		return nil, err
+	}
+	conn, reused, err := d.getConn(deadline)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := conn.exchange(query, deadline)
+	if _, ok := err.(RcodeError); err != nil && !ok && reused && time.Now().Before(deadline) {
+		// the idle connection kept could be closed by the server
+		if conn, _, err = d.getConn(deadline); err != nil {
+			return nil, err
+		}
+		ips, err = conn.exchange(query, deadline)
+	}
+	return ips, err
+}
+
+// getConn returns the connection kept, dialing a new one if none or failed
+func (d *DoT) getConn(deadline time.Time) (conn *dotConn, reused bool, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.conn != nil && !d.conn.failed() {
+		return d.conn, true, nil
+	}
+	c, err := d.dial(deadline)
+	if err != nil {
+		return nil, false, err
+	}
+	d.conn = newDoTConn(c)
+	return d.conn, false, nil
+}
+
+func (d *DoT) dial(deadline time.Time) (net.Conn, error) {
+	addr := d.Addr
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, DefaultDoTPort)
+	}
+	var config *tls.Config
+	if d.TLSConfig != nil {
+		config = d.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = host
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+// Close closes the connection kept
+func (d *DoT) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.close(io.ErrClosedPipe)
+	d.conn = nil
+	return err
+}
+
+// dotConn a DoT connection, the queries are written one by one and the
+// replies are read by readLoop, which are passed to the queries pending
+// of the same ID. The connection is closed on failure, failing all the
+// queries pending, or after maxDoTTimeouts queries timed out in a row.
+type dotConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	lock     sync.Mutex
+	pending  map[uint16]chan []byte
+	timeouts int
+	err      error
+}
+
+func newDoTConn(conn net.Conn) *dotConn {
+	c := &dotConn{conn: conn, pending: make(map[uint16]chan []byte)}
+	go c.readLoop()
+	return c
+}
+
+// exchange sends query with a new ID and waits for its reply until deadline
+func (c *dotConn) exchange(query []byte, deadline time.Time) ([]net.IP, error) {
+	id, replyCh, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	binary.BigEndian.PutUint16(msg[2:], id)
+
+	c.writeLock.Lock()
+	c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(msg)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case reply, ok := <-replyCh:
+		if !ok {
+			return nil, c.failure()
+		}
+		ips, truncated, err := parseReply(reply, id)
+		if err == nil && truncated {
+			err = errMalformedReply
+		}
+		return ips, err
+	case <-timer.C:
+		c.timeout(id)
+		return nil, errDoTTimeout
+	}
+}
+
+// timeout gives up the query of id timed out, the other queries pending are
+// still replied, unless the server is not replying any more
+func (c *dotConn) timeout(id uint16) {
+	c.lock.Lock()
+	delete(c.pending, id)
+	c.timeouts++
+	timeouts := c.timeouts
+	c.lock.Unlock()
+	if timeouts >= maxDoTTimeouts {
+		c.close(errDoTTimeout)
+	}
+}
+
+// register makes a new query ID not pending, and the channel its reply sent to
+func (c *dotConn) register() (uint16, chan []byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	for {
+		id, err := newQueryID()
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := c.pending[id]; !ok {
+			replyCh := make(chan []byte, 1)
+			c.pending[id] = replyCh
+			return id, replyCh, nil
+		}
+	}
+}
+
+// readLoop reads the replies and passes them to the queries pending,
+// until the connection is closed or fails
+func (c *dotConn) readLoop() {
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			c.close(err)
+			return
+		}
+		reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.conn, reply); err != nil {
+			c.close(err)
+			return
+		}
+		if len(reply) < headerSize {
+			c.close(errMalformedReply)
+			return
+		}
+		id := binary.BigEndian.Uint16(reply)
+		c.lock.Lock()
+		replyCh := c.pending[id]
+		delete(c.pending, id)
+		c.timeouts = 0
+		c.lock.Unlock()
+		if replyCh != nil {
+			replyCh <- reply
+		}
+	}
+}
+
+// close closes the connection failed by err, the queries pending fail then
+func (c *dotConn) close(err error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	c.err = err
+	for id, replyCh := range c.pending {
+		close(replyCh)
+		delete(c.pending, id)
+	}
+	return c.conn.Close()
+}
+
+// failed is the connection closed or failed
+func (c *dotConn) failed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err != nil
+}
+
+// failure the error the connection failed by
+func (c *dotConn) failure() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
@@ -0,0 +1,261 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/mitm"
+)
+
+// listenStubDoT listens on addr with a cert for 127.0.0.1,
+// returns the roots verifying the server cert
+func listenStubDoT(t *testing.T, addr string) (*x509.CertPool, net.Listener) {
+	caCertPEM, caKeyPEM, err := mitm.MakeMITMCertAuthority("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := mitm.SignLeafCert(mitm.CertAuthoritySigner{CertAuthority: &ca}, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCertPEM)
+	ln, err := tls.Listen("tcp4", addr, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return roots, ln
+}
+
+// serveStubDoT serves the stub DoT server on addr, the connections are
+// closed after the first reply if closeAfterReply, returns the roots
+// verifying the server cert and the connections accepted
+func serveStubDoT(t *testing.T, addr string, closeAfterReply bool, ip net.IP) (*x509.CertPool, *int32, func()) {
+	roots, ln := listenStubDoT(t, addr)
+	var accepted int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer c.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(c, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(c, query); err != nil {
+						return
+					}
+					reply := makeReply(query, 0, false, ip)
+					c.Write(append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...))
+					if closeAfterReply {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return roots, &accepted, func() { ln.Close() }
+}
+
+func TestDoTLookup(t *testing.T) {
+	roots, accepted, stop := serveStubDoT(t, "127.0.0.1:9474", false, net.IPv4(10, 0, 0, 7))
+	defer stop()
+	d := &DoT{Addr: "127.0.0.1:9474", TLSConfig: &tls.Config{RootCAs: roots}}
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		ips, err := d.Lookup("example.com", time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 7)) {
+			t.Fatalf("unexpected ips %v", ips)
+		}
+	}
+	// the connection is reused
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	// the server cert is verified
+	untrusted := &DoT{Addr: "127.0.0.1:9474"}
+	if _, err := untrusted.Lookup("example.com", time.Now().Add(time.Second)); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+}
+
+func TestDoTLookupReconnect(t *testing.T) {
+	roots, accepted, stop := serveStubDoT(t, "127.0.0.1:9475", true, net.IPv4(10, 0, 0, 8))
+	defer stop()
+	d := &DoT{Addr: "127.0.0.1:9475", TLSConfig: &tls.Config{RootCAs: roots}}
+	defer d.Close()
+	for i := 0; i < 2; i++ {
+		ips, err := d.Lookup("example.com", time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 8)) {
+			t.Fatalf("unexpected ips %v", ips)
+		}
+	}
+	// the connection closed by server is dialed again
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Fatalf("expected 2 connections, got %d", n)
+	}
+
+	// failover from the server unreachable
+	r := &Resolver{
+		Backends: []Backend{
+			&DoT{Addr: "127.0.0.1:1"},
+			d,
+		},
+		Timeout: time.Second,
+	}
+	if ip := r.LookupIP(nil, "example.com"); !ip.Equal(net.IPv4(10, 0, 0, 8)) {
+		t.Fatalf("unexpected ip %v", ip)
+	}
+}
+
+func TestDoTLookupPipelined(t *testing.T) {
+	roots, ln := listenStubDoT(t, "127.0.0.1:9476")
+	defer ln.Close()
+	const queries = 4
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// all the queries are read before replied in the reverse order,
+		// the host qN.example.com is resolved to 10.0.0.N
+		var pending [][]byte
+		for len(pending) < queries {
+			var length [2]byte
+			if _, err := io.ReadFull(c, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(c, query); err != nil {
+				return
+			}
+			pending = append(pending, query)
+		}
+		for i := len(pending) - 1; i >= 0; i-- {
+			query := pending[i]
+			reply := makeReply(query, 0, false, net.IPv4(10, 0, 0, query[headerSize+2]-'0'))
+			c.Write(append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...))
+		}
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	d := &DoT{Addr: "127.0.0.1:9476", TLSConfig: &tls.Config{RootCAs: roots}}
+	defer d.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ips, err := d.Lookup(fmt.Sprintf("q%d.example.com", i), time.Now().Add(5*time.Second))
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, byte(i))) {
+				t.Errorf("unexpected ips %v of query %d", ips, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDoTLookupTimeout(t *testing.T) {
+	roots, ln := listenStubDoT(t, "127.0.0.1:0")
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer c.Close()
+				// the host slow.example.com is never replied,
+				// the others are replied later
+				var writeLock sync.Mutex
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(c, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(c, query); err != nil {
+						return
+					}
+					if query[headerSize+1] == 's' {
+						continue
+					}
+					go func() {
+						time.Sleep(100 * time.Millisecond)
+						reply := makeReply(query, 0, false, net.IPv4(10, 0, 0, 9))
+						writeLock.Lock()
+						c.Write(append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...))
+						writeLock.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+
+	d := &DoT{Addr: ln.Addr().String(), TLSConfig: &tls.Config{RootCAs: roots}}
+	defer d.Close()
+	if _, err := d.Lookup("fast.example.com", time.Now().Add(5*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the query timed out never fails the others pending
+	fast := make(chan error, 1)
+	go func() {
+		_, err := d.Lookup("fast.example.com", time.Now().Add(5*time.Second))
+		fast <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := d.Lookup("slow.example.com", time.Now().Add(20*time.Millisecond)); err != errDoTTimeout {
+		t.Fatalf("expected error %q, got %v", errDoTTimeout, err)
+	}
+	if err := <-fast; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	// the server not replying in a row is dialed again
+	for i := 0; i < maxDoTTimeouts; i++ {
+		d.Lookup("slow.example.com", time.Now().Add(20*time.Millisecond))
+	}
+	if _, err := d.Lookup("fast.example.com", time.Now().Add(5*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Fatalf("expected 2 connections, got %d", n)
+	}
+}
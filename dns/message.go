@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	headerSize = 12
+
+	typeA   = 1
+	typeOPT = 41
+	classIN = 1
+
+	// ednsPayloadSize UDP payload size advertised by the OPT record
+	ednsPayloadSize = 1232
+	// optionClientSubnet the EDNS Client Subnet option code, see RFC 7871
+	optionClientSubnet = 8
+
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagRecursion = 1 << 8
+	rcodeMask     = 0xf
+	rcodeNXDomain = 3
+)
+
+var (
+	errInvalidName    = errors.New("invalid domain name")
+	errMalformedReply = errors.New("malformed dns reply")
+	errReplyMismatch  = errors.New("dns reply id mismatch")
+)
+
+// SuppressClientSubnet the client subnet with source prefix length 0,
+// which asks the resolvers not to send any client subnet to the
+// authoritative servers, see RFC 7871 section 7.1.2
+var SuppressClientSubnet = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+
+// RcodeError the error code responded by the DNS server
+type RcodeError int
+
+func (e RcodeError) Error() string {
+	if e == rcodeNXDomain {
+		return "no such host"
+	}
+	return fmt.Sprintf("dns server failure, rcode %d", int(e))
+}
+
+// newQueryID a random query ID, which must be unpredictable
+// against the reply spoofing, see RFC 5452
+func newQueryID() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+// appendQuery appends the query of the A records of host to dst, with the
+// EDNS Client Subnet option of clientSubnet if not nil
+func appendQuery(dst []byte, id uint16, host string, clientSubnet *net.IPNet) ([]byte, error) {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return dst, errInvalidName
+	}
+	var header [headerSize]byte
+	binary.BigEndian.PutUint16(header[0:], id)
+	binary.BigEndian.PutUint16(header[2:], flagRecursion)
+	binary.BigEndian.PutUint16(header[4:], 1) // question count
+	if clientSubnet != nil {
+		binary.BigEndian.PutUint16(header[10:], 1) // additional count
+	}
+	dst = append(dst, header[:]...)
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return dst, errInvalidName
+		}
+		dst = append(dst, byte(len(label)))
+		dst = append(dst, label...)
+	}
+	dst = append(dst, 0, 0, typeA, 0, classIN)
+	if clientSubnet != nil {
+		dst = appendClientSubnet(dst, clientSubnet)
+	}
+	return dst, nil
+}
+
+// appendClientSubnet appends the OPT record with the client subnet option,
+// only the bytes covered by the source prefix of the address are sent
+func appendClientSubnet(dst []byte, subnet *net.IPNet) []byte {
+	family, ip := 1, subnet.IP.To4()
+	if ip == nil {
+		family, ip = 2, subnet.IP.To16()
+	}
+	prefix, bits := subnet.Mask.Size()
+	if family == 1 && bits == 8*net.IPv6len {
+		// IPv4 in IPv6 mask
+		prefix -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	if prefix < 0 || bits == 0 {
+		// non-canonical mask
+		prefix = 0
+	}
+	addr := ip.Mask(net.CIDRMask(prefix, len(ip)*8))[:(prefix+7)/8]
+	optionLen := 4 + len(addr)
+	// root name, type, payload size as class, zero extended rcode and flags
+	dst = append(dst, 0, 0, typeOPT, ednsPayloadSize>>8, ednsPayloadSize&0xff, 0, 0, 0, 0)
+	dst = append(dst, byte((4+optionLen)>>8), byte(4+optionLen))
+	dst = append(dst, 0, optionClientSubnet, byte(optionLen>>8), byte(optionLen))
+	// family, source prefix length and scope prefix length 0
+	dst = append(dst, 0, byte(family), byte(prefix), 0)
+	return append(dst, addr...)
+}
+
+// parseReply parses the A records answered in the reply msg to query id,
+// truncated is true if the reply is truncated, e.g. too large for UDP
+func parseReply(msg []byte, id uint16) (ips []net.IP, truncated bool, err error) {
+	if len(msg) < headerSize {
+		return nil, false, errMalformedReply
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, false, errReplyMismatch
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagResponse == 0 {
+		return nil, false, errMalformedReply
+	}
+	if flags&flagTruncated != 0 {
+		return nil, true, nil
+	}
+	if rcode := flags & rcodeMask; rcode != 0 {
+		return nil, false, RcodeError(rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	off := headerSize
+	for i := 0; i < questions; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, false, err
+		}
+		off += 4 // type and class
+	}
+	for i := 0; i < answers; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, false, err
+		}
+		if off+10 > len(msg) {
+			return nil, false, errMalformedReply
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rrClass := binary.BigEndian.Uint16(msg[off+2:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, false, errMalformedReply
+		}
+		// CNAMEs are followed by the records of the name aliased,
+		// so only the addresses are picked up
+		if rrType == typeA && rrClass == classIN && length == net.IPv4len {
+			ips = append(ips, net.IPv4(msg[off], msg[off+1], msg[off+2], msg[off+3]))
+		}
+		off += length
+	}
+	return ips, false, nil
+}
+
+// skipName returns the offset after the name starting at off
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errMalformedReply
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			// compression pointer ends the name
+			if off+2 > len(msg) {
+				return 0, errMalformedReply
+			}
+			return off + 2, nil
+		case n&0xc0 != 0:
+			return 0, errMalformedReply
+		}
+		off += n + 1
+	}
+}
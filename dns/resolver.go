@@ -0,0 +1,248 @@
+// Package dns resolves the target hosts with pluggable backends, e.g. the
+// system resolver, a specific DNS server, DNS-over-HTTPS or DNS-over-TLS,
+// tried in order.
+// Plug Resolver.LookupIP into proxy.Handler.LookupIP.
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"time"
+
+	"github.com/haxii/fastproxy/proxy"
+)
+
+// DefaultTimeout timeout of each backend when Resolver.Timeout not set
+const DefaultTimeout = 5 * time.Second
+
+// maxMessageSize max size of the DNS messages
+const maxMessageSize = 65535
+
+var errNoAddress = errors.New("no ip address found")
+
+// Backend looks up the IPv4 addresses of host before deadline
+type Backend interface {
+	Lookup(host string, deadline time.Time) ([]net.IP, error)
+}
+
+// Resolver looks up the hosts with Backends in order, falling back to the
+// next one when failed, the error of the last one is returned if all failed
+type Resolver struct {
+	// Backends tried in order, System is used if not set
+	Backends []Backend
+
+	// Timeout of each backend, DefaultTimeout is used if not set
+	Timeout time.Duration
+}
+
+// Lookup looks up the IPv4 addresses of host
+func (r *Resolver) Lookup(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	backends := r.Backends
+	if len(backends) == 0 {
+		backends = []Backend{System{}}
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	var err error
+	for _, backend := range backends {
+		var ips []net.IP
+		ips, err = backend.Lookup(host, time.Now().Add(timeout))
+		if err == nil && len(ips) == 0 {
+			err = errNoAddress
+		}
+		if err == nil {
+			return ips, nil
+		}
+	}
+	return nil, err
+}
+
+// LookupIP returns the first IPv4 address of domain, nil if failed,
+// which can be used as proxy.Handler.LookupIP
+func (r *Resolver) LookupIP(userdata *proxy.UserData, domain string) net.IP {
+	ips, err := r.Lookup(domain)
+	if err != nil {
+		return nil
+	}
+	return ips[0]
+}
+
+// System the backend looking up with the system resolver
+type System struct{}
+
+// Lookup looks up the IPv4 addresses of host with the system resolver
+func (System) Lookup(host string, deadline time.Time) ([]net.IP, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return filterIPv4(addrs), nil
+}
+
+func filterIPv4(addrs []net.IPAddr) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Server the backend querying the DNS server at Addr directly, e.g. `8.8.8.8:53`
+type Server struct {
+	// Addr host with port of the DNS server
+	Addr string
+
+	// Network `udp` or `tcp`, udp is used if not set, the truncated
+	// replies over udp are queried again over tcp
+	Network string
+
+	// ClientSubnet the EDNS Client Subnet sent in the queries, e.g.
+	// SuppressClientSubnet. None sent if nil, the resolver may then send
+	// the subnet of the proxy to the authoritative servers
+	ClientSubnet *net.IPNet
+}
+
+// Lookup queries the A records of host
+func (s Server) Lookup(host string, deadline time.Time) ([]net.IP, error) {
+	network := s.Network
+	if len(network) == 0 {
+		network = "udp"
+	}
+	ips, truncated, err := s.query(network, host, deadline)
+	if err == nil && truncated && network == "udp" {
+		ips, truncated, err = s.query("tcp", host, deadline)
+	}
+	if err == nil && truncated {
+		err = errMalformedReply
+	}
+	return ips, err
+}
+
+func (s Server) query(network, host string, deadline time.Time) ([]net.IP, bool, error) {
+	id, err := newQueryID()
+	if err != nil {
+		return nil, false, err
+	}
+	query, err := appendQuery(nil, id, host, s.ClientSubnet)
+	if err != nil {
+		return nil, false, err
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial(network, s.Addr)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if !strings.HasPrefix(network, "udp") {
+		return exchangeStream(conn, query, id)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, false, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, false, err
+		}
+		ips, truncated, err := parseReply(buf[:n], id)
+		if err == errReplyMismatch {
+			// stale or spoofed reply
+			continue
+		}
+		return ips, truncated, err
+	}
+}
+
+// exchangeStream sends query over a stream connection, e.g. tcp or tls,
+// and reads its reply, the messages are prefixed with the length
+func exchangeStream(conn net.Conn, query []byte, id uint16) ([]net.IP, bool, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, false, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, false, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, false, err
+	}
+	return parseReply(reply, id)
+}
+
+// DoH the backend querying the DNS-over-HTTPS server at URL, e.g.
+// `https://1.1.1.1/dns-query`, which avoids the local DNS tampering
+type DoH struct {
+	// URL of the DoH endpoint, queried with POST as RFC 8484
+	URL string
+
+	// Client sends the queries, nethttp.DefaultClient is used if not set
+	Client *nethttp.Client
+
+	// ClientSubnet the EDNS Client Subnet sent in the queries, see Server
+	ClientSubnet *net.IPNet
+}
+
+// dohContentType the MIME type of DoH messages
+const dohContentType = "application/dns-message"
+
+// Lookup queries the A records of host
+func (d DoH) Lookup(host string, deadline time.Time) ([]net.IP, error) {
+	// the id is always 0 for the http caches, see RFC 8484 section 4.1
+	query, err := appendQuery(nil, 0, host, d.ClientSubnet)
+	if err != nil {
+		return nil, err
+	}
+	req, err := nethttp.NewRequest(nethttp.MethodPost, d.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	client := d.Client
+	if client == nil {
+		client = nethttp.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, fmt.Errorf("doh server responded status %d", resp.StatusCode)
+	}
+	reply, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	ips, truncated, err := parseReply(reply, 0)
+	if err == nil && truncated {
+		err = errMalformedReply
+	}
+	return ips, err
+}
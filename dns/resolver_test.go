@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// makeReply replies query with the IPv4 addresses, rcode and truncated flag,
+// the additional records of query, e.g. OPT, are not echoed back
+func makeReply(query []byte, rcode int, truncated bool, ips ...net.IP) []byte {
+	questionEnd, _ := skipName(query, headerSize)
+	reply := append([]byte(nil), query[:questionEnd+4]...)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	flags := uint16(flagResponse|flagRecursion) | uint16(rcode)
+	if truncated {
+		flags |= flagTruncated
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(ips)))
+	for _, ip := range ips {
+		// the name points to the question at offset 12
+		reply = append(reply, 0xc0, headerSize, 0, typeA, 0, classIN, 0, 0, 0, 60, 0, net.IPv4len)
+		reply = append(reply, ip.To4()...)
+	}
+	return reply
+}
+
+// serveMockDNS serves the mock DNS server over both udp and tcp on addr,
+// the replies over udp are truncated if truncateUDP
+func serveMockDNS(t *testing.T, addr string, truncateUDP bool, rcode int, ips ...net.IP) func() {
+	pc, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(makeReply(buf[:n], rcode, truncateUDP, ips...), raddr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			if _, err := io.ReadFull(c, length[:]); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(c, query); err == nil {
+					reply := makeReply(query, rcode, false, ips...)
+					c.Write(append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...))
+				}
+			}
+			c.Close()
+		}
+	}()
+	return func() {
+		pc.Close()
+		ln.Close()
+	}
+}
+
+func TestServerLookup(t *testing.T) {
+	stop := serveMockDNS(t, "127.0.0.1:9469", false, 0, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2))
+	defer stop()
+	for _, network := range []string{"", "udp", "tcp"} {
+		ips, err := Server{Addr: "127.0.0.1:9469", Network: network}.Lookup("example.com", time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error over %q: %s", network, err)
+		}
+		if len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) || !ips[1].Equal(net.IPv4(10, 0, 0, 2)) {
+			t.Fatalf("unexpected ips %v over %q", ips, network)
+		}
+	}
+}
+
+func TestServerLookupTruncated(t *testing.T) {
+	stop := serveMockDNS(t, "127.0.0.1:9470", true, 0, net.IPv4(10, 0, 0, 3))
+	defer stop()
+	// queried again over tcp
+	ips, err := Server{Addr: "127.0.0.1:9470"}.Lookup("example.com", time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Fatalf("unexpected ips %v", ips)
+	}
+}
+
+func TestServerLookupNXDomain(t *testing.T) {
+	stop := serveMockDNS(t, "127.0.0.1:9471", false, rcodeNXDomain)
+	defer stop()
+	_, err := Server{Addr: "127.0.0.1:9471"}.Lookup("example.com", time.Now().Add(time.Second))
+	if err != RcodeError(rcodeNXDomain) {
+		t.Fatalf("expected no such host error, got %v", err)
+	}
+}
+
+func TestDoHLookup(t *testing.T) {
+	s := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path != "/dns-query" {
+			w.WriteHeader(nethttp.StatusNotFound)
+			return
+		}
+		if r.Method != nethttp.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(makeReply(query, 0, false, net.IPv4(10, 0, 0, 4)))
+	}))
+	defer s.Close()
+	ips, err := DoH{URL: s.URL + "/dns-query"}.Lookup("example.com", time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 4)) {
+		t.Fatalf("unexpected ips %v", ips)
+	}
+
+	if _, err := (DoH{URL: s.URL + "/404"}).Lookup("example.com", time.Now().Add(time.Second)); err == nil {
+		t.Fatal("expected error on status 404")
+	}
+}
+
+func TestResolverFallback(t *testing.T) {
+	// a DNS server never replying
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:9472")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer pc.Close()
+	stop := serveMockDNS(t, "127.0.0.1:9473", false, 0, net.IPv4(10, 0, 0, 5))
+	defer stop()
+
+	r := &Resolver{
+		Backends: []Backend{
+			Server{Addr: "127.0.0.1:9472"},
+			Server{Addr: "127.0.0.1:9473"},
+		},
+		Timeout: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	if ip := r.LookupIP(nil, "example.com"); !ip.Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Fatalf("unexpected ip %v", ip)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("expected the first backend timed out, took %s", d)
+	}
+
+	// the error of the last backend is returned if all failed
+	r.Backends = r.Backends[:1]
+	if _, err := r.Lookup("example.com"); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if ip := r.LookupIP(nil, "example.com"); ip != nil {
+		t.Fatalf("expected no ip, got %v", ip)
+	}
+
+	// the IPs are never looked up
+	if ip := r.LookupIP(nil, "10.0.0.6"); !ip.Equal(net.IPv4(10, 0, 0, 6)) {
+		t.Fatalf("unexpected ip %v", ip)
+	}
+}
+
+// queryClientSubnet returns the data of the EDNS Client Subnet option of query
+func queryClientSubnet(t *testing.T, query []byte) []byte {
+	if binary.BigEndian.Uint16(query[10:]) == 0 {
+		return nil
+	}
+	off, _ := skipName(query, headerSize)
+	// question type and class, root name of OPT
+	off += 4 + 1
+	if binary.BigEndian.Uint16(query[off:]) != typeOPT {
+		t.Fatalf("unexpected additional record in query %v", query)
+	}
+	// type, class, ttl, rdata length and option code and length
+	off += 10
+	if binary.BigEndian.Uint16(query[off:]) != optionClientSubnet {
+		t.Fatalf("unexpected option in query %v", query)
+	}
+	length := int(binary.BigEndian.Uint16(query[off+2:]))
+	return query[off+4 : off+4+length]
+}
+
+func TestClientSubnet(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:9476")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer pc.Close()
+	queries := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries <- append([]byte(nil), buf[:n]...)
+			pc.WriteTo(makeReply(buf[:n], 0, false, net.IPv4(10, 0, 0, 9)), raddr)
+		}
+	}()
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return subnet
+	}
+	for _, c := range []struct {
+		subnet *net.IPNet
+		option []byte
+	}{
+		{nil, nil},
+		{SuppressClientSubnet, []byte{0, 1, 0, 0}},
+		{mustParseCIDR("192.0.2.0/24"), []byte{0, 1, 24, 0, 192, 0, 2}},
+		{&net.IPNet{IP: net.ParseIP("198.51.100.7"), Mask: net.CIDRMask(116, 128)},
+			[]byte{0, 1, 20, 0, 198, 51, 96}},
+		{mustParseCIDR("2001:db8:1234::/36"), []byte{0, 2, 36, 0, 0x20, 0x01, 0x0d, 0xb8, 0x10}},
+	} {
+		s := Server{Addr: "127.0.0.1:9476", ClientSubnet: c.subnet}
+		ips, err := s.Lookup("example.com", time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 9)) {
+			t.Fatalf("unexpected ips %v", ips)
+		}
+		if option := queryClientSubnet(t, <-queries); !bytes.Equal(option, c.option) {
+			t.Fatalf("expected client subnet option %v for %v, got %v", c.option, c.subnet, option)
+		}
+	}
+}
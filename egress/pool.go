@@ -0,0 +1,213 @@
+// Package egress rotates the local IPs the outbound connections are bound to,
+// e.g. the addresses of a multi-homed host for scraping or anonymization.
+// Plug Pool.LocalAddrFor into proxy.Handler.LocalAddrFor.
+package egress
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/proxy"
+)
+
+// Strategy how the pool selects the next IP
+type Strategy int
+
+const (
+	// RoundRobin selects the IPs in turn by the order added
+	RoundRobin Strategy = iota
+	// Random selects the IPs randomly
+	Random
+)
+
+// DefaultRetryAfter duration an IP failed is excluded for when
+// Pool.RetryAfter not set
+const DefaultRetryAfter = time.Minute
+
+// Pool selects the local IPs from a set, excluding the failed ones, e.g. not
+// bindable as the address removed from the host, till retried after a while.
+//
+// It is safe calling Pool methods from concurrently running go routines.
+type Pool struct {
+	// RetryAfter duration a failed IP is excluded for, DefaultRetryAfter is
+	// used if not set. It should be set before the pool is used.
+	RetryAfter time.Duration
+
+	strategy Strategy
+
+	lock sync.Mutex
+	ips  []*member
+	next int
+}
+
+// member an IP of pool with its health
+type member struct {
+	ip       net.IP
+	failures int
+	// excluded from selection till it
+	retryAt time.Time
+}
+
+func (m *member) healthy(now time.Time) bool {
+	return !now.Before(m.retryAt)
+}
+
+// NewPool makes a pool of ips selected by strategy
+func NewPool(strategy Strategy, ips ...net.IP) *Pool {
+	p := &Pool{strategy: strategy}
+	for _, ip := range ips {
+		p.Add(ip)
+	}
+	return p
+}
+
+// Add adds ip into pool, nothing changes if it's already added
+func (p *Pool) Add(ip net.IP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.find(ip) != nil {
+		return
+	}
+	p.ips = append(p.ips, &member{ip: ip})
+}
+
+// Remove removes ip from pool
+func (p *Pool) Remove(ip net.IP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, m := range p.ips {
+		if m.ip.Equal(ip) {
+			p.ips = append(p.ips[:i], p.ips[i+1:]...)
+			return
+		}
+	}
+}
+
+// IPs returns the IPs in pool by the order added, including the excluded ones
+func (p *Pool) IPs() []net.IP {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ips := make([]net.IP, len(p.ips))
+	for i, m := range p.ips {
+		ips[i] = m.ip
+	}
+	return ips
+}
+
+// Next selects the next healthy IP, nil if the pool is empty. When all the
+// IPs are excluded, they are still selected rather than the system's, which
+// the connections would leave the pool from otherwise.
+func (p *Pool) Next() net.IP {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := len(p.ips)
+	if n == 0 {
+		return nil
+	}
+	now := time.Now()
+	if p.strategy == Random {
+		healthy := make([]*member, 0, n)
+		for _, m := range p.ips {
+			if m.healthy(now) {
+				healthy = append(healthy, m)
+			}
+		}
+		if len(healthy) == 0 {
+			return p.ips[rand.Intn(n)].ip
+		}
+		return healthy[rand.Intn(len(healthy))].ip
+	}
+	for i := 0; i < n; i++ {
+		m := p.ips[(p.next+i)%n]
+		if m.healthy(now) {
+			p.next = (p.next + i + 1) % n
+			return m.ip
+		}
+	}
+	m := p.ips[p.next%n]
+	p.next = (p.next + 1) % n
+	return m.ip
+}
+
+// LocalAddr returns the next IP as the local address with any port,
+// nil if the pool is empty
+func (p *Pool) LocalAddr() *net.TCPAddr {
+	ip := p.Next()
+	if ip == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// LocalAddrFor returns the next IP as the local address of every request,
+// which can be used as proxy.Handler.LocalAddrFor
+func (p *Pool) LocalAddrFor(userdata *proxy.UserData, hostWithPort string) *net.TCPAddr {
+	return p.LocalAddr()
+}
+
+// MarkFailed excludes ip for RetryAfter, e.g. on failing to bind to it
+func (p *Pool) MarkFailed(ip net.IP) {
+	retryAfter := p.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if m := p.find(ip); m != nil {
+		m.failures++
+		m.retryAt = time.Now().Add(retryAfter)
+	}
+}
+
+// MarkHealthy selects ip again and resets its failures
+func (p *Pool) MarkHealthy(ip net.IP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if m := p.find(ip); m != nil {
+		m.failures = 0
+		m.retryAt = time.Time{}
+	}
+}
+
+// Healthy is ip in pool and not excluded
+func (p *Pool) Healthy(ip net.IP) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	m := p.find(ip)
+	return m != nil && m.healthy(time.Now())
+}
+
+// Failures times ip failed since it was healthy
+func (p *Pool) Failures(ip net.IP) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if m := p.find(ip); m != nil {
+		return m.failures
+	}
+	return 0
+}
+
+// Check tries binding to every IP in pool, marking the IPs failed or healthy,
+// e.g. called periodically for the addresses added to or removed from host
+func (p *Pool) Check() {
+	for _, ip := range p.IPs() {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+		if err != nil {
+			p.MarkFailed(ip)
+			continue
+		}
+		ln.Close()
+		p.MarkHealthy(ip)
+	}
+}
+
+func (p *Pool) find(ip net.IP) *member {
+	for _, m := range p.ips {
+		if m.ip.Equal(ip) {
+			return m
+		}
+	}
+	return nil
+}
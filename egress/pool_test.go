@@ -0,0 +1,103 @@
+package egress
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+var loopbackAliases = []net.IP{
+	net.IPv4(127, 0, 0, 2),
+	net.IPv4(127, 0, 0, 3),
+	net.IPv4(127, 0, 0, 4),
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	sources := make(chan net.IP)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			sources <- conn.RemoteAddr().(*net.TCPAddr).IP
+		}
+	}()
+
+	p := NewPool(RoundRobin, loopbackAliases...)
+	for i := 0; i < 2*len(loopbackAliases); i++ {
+		conn, err := transport.DialLocal(ln.Addr().String(), p.LocalAddrFor(nil, ""))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.Close()
+		expected := loopbackAliases[i%len(loopbackAliases)]
+		if ip := <-sources; !ip.Equal(expected) {
+			t.Fatalf("expected connection %d from %s, got %s", i, expected, ip)
+		}
+	}
+}
+
+func TestPoolRandom(t *testing.T) {
+	p := NewPool(Random, loopbackAliases...)
+	selected := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		selected[p.Next().String()]++
+	}
+	if len(selected) != len(loopbackAliases) {
+		t.Fatalf("expected all the %d IPs selected, got %v", len(loopbackAliases), selected)
+	}
+}
+
+func TestPoolExcluded(t *testing.T) {
+	// not assigned to any interface, so never bindable
+	unbindable := net.IPv4(192, 0, 2, 1)
+	p := NewPool(RoundRobin, loopbackAliases[0], unbindable, loopbackAliases[1])
+	p.RetryAfter = 50 * time.Millisecond
+	p.Check()
+	if p.Healthy(unbindable) || p.Failures(unbindable) != 1 {
+		t.Fatalf("expected %s excluded on failing to bind", unbindable)
+	}
+	if !p.Healthy(loopbackAliases[0]) || !p.Healthy(loopbackAliases[1]) {
+		t.Fatal("expected the loopback aliases healthy")
+	}
+	for i := 0; i < 4; i++ {
+		if ip := p.Next(); ip.Equal(unbindable) {
+			t.Fatalf("expected %s never selected while excluded", unbindable)
+		}
+	}
+
+	// retried after a while
+	time.Sleep(60 * time.Millisecond)
+	selected := false
+	for i := 0; i < 3; i++ {
+		selected = selected || p.Next().Equal(unbindable)
+	}
+	if !selected {
+		t.Fatalf("expected %s retried after excluded", unbindable)
+	}
+
+	// still selected when all excluded
+	p.MarkFailed(loopbackAliases[0])
+	p.MarkFailed(loopbackAliases[1])
+	p.MarkFailed(unbindable)
+	if p.Next() == nil {
+		t.Fatal("expected an IP selected when all excluded")
+	}
+	p.MarkHealthy(unbindable)
+	if p.Failures(unbindable) != 0 || !p.Healthy(unbindable) {
+		t.Fatalf("expected %s healthy once marked", unbindable)
+	}
+
+	if NewPool(RoundRobin).Next() != nil {
+		t.Fatal("expected no IP from an empty pool")
+	}
+}
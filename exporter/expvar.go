@@ -0,0 +1,83 @@
+// Package exporter exports the proxy usage and stats for monitoring
+package exporter
+
+import (
+	"expvar"
+
+	"github.com/haxii/fastproxy/proxy"
+)
+
+// LatencyHistogram the latency histogram published, with the cumulative
+// counts of the durations not greater than the bucket bounds, keyed by the
+// bounds formatted like `250ms` and `+Inf` at last
+type LatencyHistogram struct {
+	Buckets    map[string]uint64 `json:"buckets"`
+	Count      uint64            `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+}
+
+// PublishExpvar publishes the live usage and stats of proxy as an expvar map
+// named name, which appears at `/debug/vars` once expvar's handler served.
+//
+// The values are read from the counters whenever the map is visited, nothing
+// is copied ahead. Like expvar.Publish, it panics if the name is already used.
+func PublishExpvar(name string, p *proxy.Proxy) *expvar.Map {
+	errors := new(expvar.Map).Init()
+	errors.Set("rejected_conns", uint64Func(p.Stats.GetRejectedConns))
+	errors.Set("bad_requests", uint64Func(p.Stats.GetBadRequests))
+	errors.Set("upstream", uint64Func(p.Stats.GetUpstreamErrors))
+	errors.Set("tunnel", uint64Func(p.Stats.GetTunnelErrors))
+	handshake := new(expvar.Map).Init()
+	for _, reason := range []proxy.HandshakeFailure{
+		proxy.HandshakeFailureClientClosed, proxy.HandshakeFailureUnsupportedVersion,
+		proxy.HandshakeFailureCertRejected, proxy.HandshakeFailureOther,
+	} {
+		reason := reason
+		handshake.Set(reason.String(), expvar.Func(func() interface{} {
+			return p.Stats.GetHandshakeFailures(reason)
+		}))
+	}
+	errors.Set("tls_handshake", handshake)
+	latency := new(expvar.Map).Init()
+	latency.Set("connect", histogramFunc(func() *proxy.Histogram { return p.Stats.ConnectLatency }))
+	latency.Set("tls_handshake", histogramFunc(func() *proxy.Histogram { return p.Stats.HandshakeLatency }))
+	latency.Set("first_byte", histogramFunc(func() *proxy.Histogram { return p.Stats.FirstByteLatency }))
+
+	m := expvar.NewMap(name)
+	m.Set("active_conns", expvar.Func(func() interface{} { return p.Stats.GetActiveConns() }))
+	m.Set("total_conns", uint64Func(p.Stats.GetTotalConns))
+	m.Set("total_requests", uint64Func(p.Stats.GetTotalRequests))
+	m.Set("bytes_in", uint64Func(p.Usage.GetIncomingSize))
+	m.Set("bytes_out", uint64Func(p.Usage.GetOutgoingSize))
+	m.Set("errors", errors)
+	m.Set("latency", latency)
+	return m
+}
+
+func uint64Func(f func() uint64) expvar.Func {
+	return func() interface{} { return f() }
+}
+
+// histogramFunc reads the histogram when visited, since the histograms of
+// stats are made only when the proxy serves
+func histogramFunc(f func() *proxy.Histogram) expvar.Func {
+	return func() interface{} {
+		h := f()
+		bounds, counts := h.Bounds(), h.Counts()
+		histogram := LatencyHistogram{
+			Buckets:    make(map[string]uint64, len(counts)),
+			Count:      h.Count(),
+			SumSeconds: h.Sum().Seconds(),
+		}
+		var cumulative uint64
+		for i, count := range counts {
+			cumulative += count
+			if i < len(bounds) {
+				histogram.Buckets[bounds[i].String()] = cumulative
+			} else {
+				histogram.Buckets["+Inf"] = cumulative
+			}
+		}
+		return histogram
+	}
+}
@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/proxy"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	p := &proxy.Proxy{}
+	p.Usage.AddIncomingSize(10)
+	p.Usage.AddOutgoingSize(20)
+	PublishExpvar("fastproxy_test", p)
+
+	var vars map[string]interface{}
+	if err := json.Unmarshal([]byte(expvar.Get("fastproxy_test").String()), &vars); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, key := range []string{"active_conns", "total_conns", "total_requests", "bytes_in", "bytes_out", "errors", "latency"} {
+		if _, ok := vars[key]; !ok {
+			t.Fatalf("key %s not published", key)
+		}
+	}
+	errors, ok := vars["errors"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected errors %v", vars["errors"])
+	}
+	for _, key := range []string{"rejected_conns", "bad_requests", "upstream", "tunnel", "tls_handshake"} {
+		if _, ok := errors[key]; !ok {
+			t.Fatalf("error key %s not published", key)
+		}
+	}
+	if vars["bytes_in"] != float64(10) || vars["bytes_out"] != float64(20) {
+		t.Fatalf("unexpected bytes in %v and out %v", vars["bytes_in"], vars["bytes_out"])
+	}
+
+	// read live rather than copied when published
+	p.Usage.AddIncomingSize(5)
+	if err := json.Unmarshal([]byte(expvar.Get("fastproxy_test").String()), &vars); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if vars["bytes_in"] != float64(15) {
+		t.Fatalf("expected bytes in 15, got %v", vars["bytes_in"])
+	}
+}
+
+func TestPublishExpvarLatency(t *testing.T) {
+	p := &proxy.Proxy{}
+	p.Stats.ConnectLatency = proxy.NewHistogram(10*time.Millisecond, 100*time.Millisecond)
+	PublishExpvar("fastproxy_latency_test", p)
+	for _, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond,
+		50 * time.Millisecond, time.Second} {
+		p.Stats.ConnectLatency.Observe(d)
+	}
+
+	var vars struct {
+		Latency map[string]LatencyHistogram `json:"latency"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("fastproxy_latency_test").String()), &vars); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	connect := vars.Latency["connect"]
+	expected := map[string]uint64{"10ms": 2, "100ms": 3, "+Inf": 4}
+	if !reflect.DeepEqual(connect.Buckets, expected) {
+		t.Fatalf("expected connect buckets %v, got %v", expected, connect.Buckets)
+	}
+	if connect.Count != 4 || connect.SumSeconds != 1.061 {
+		t.Fatalf("unexpected connect count %d and sum %v", connect.Count, connect.SumSeconds)
+	}
+	// not made yet without serving
+	if handshake, ok := vars.Latency["tls_handshake"]; !ok || handshake.Count != 0 ||
+		len(handshake.Buckets) != 0 {
+		t.Fatalf("unexpected tls handshake latency %v", handshake)
+	}
+}
@@ -2,6 +2,8 @@ package http
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -11,7 +13,41 @@ import (
 )
 
 // Body http body
-type Body struct{}
+type Body struct {
+	// maxChunkSize max size of a chunk, see SetMaxChunkSize
+	maxChunkSize int
+	// maxChunkLineSize max length of a chunk size line, see SetMaxChunkLineSize
+	maxChunkLineSize int
+}
+
+// ErrChunkTooLarge chunk size exceeds the limit set by SetMaxChunkSize
+var ErrChunkTooLarge = errors.New("chunk too large")
+
+// ErrChunkLineTooLong chunk size line exceeds the limit set by SetMaxChunkLineSize
+var ErrChunkLineTooLong = errors.New("chunk size line too long")
+
+// SetMaxChunkSize sets the max size in bytes of every chunk of the chunked
+// body parsed by Parse, zero means no limit other than the hex digits of the
+// chunk size. ErrChunkTooLarge returned when exceeded, before the chunk is
+// read. The limit is cleared by Reset.
+func (b *Body) SetMaxChunkSize(max int) {
+	b.maxChunkSize = max
+}
+
+// SetMaxChunkLineSize sets the max length in bytes of every chunk size line of
+// the chunked body parsed by Parse, i.e. the chunk size with the extensions,
+// excluding the CRLF, zero means no limit other than the reader's buffer size.
+// ErrChunkLineTooLong returned when exceeded, before the line is read beyond
+// the limit. The limit is cleared by Reset.
+func (b *Body) SetMaxChunkLineSize(max int) {
+	b.maxChunkLineSize = max
+}
+
+// Reset reset body info into default val
+func (b *Body) Reset() {
+	b.maxChunkSize = 0
+	b.maxChunkLineSize = 0
+}
 
 // BodyType how http body is formed
 type BodyType int
@@ -37,7 +73,7 @@ func (b *Body) Parse(reader *bufio.Reader, bodyType BodyType,
 			return parseBodyFixedSize(reader, w, contentLength)
 		}
 	case BodyTypeChunked:
-		return parseBodyChunked(reader, w)
+		return parseBodyChunked(reader, w, b.maxChunkSize, b.maxChunkLineSize)
 	case BodyTypeIdentity:
 		return parseBodyIdentity(reader, w)
 	}
@@ -82,21 +118,29 @@ func parseBodyFixedSize(src *bufio.Reader, w BodyWrapper, contentLength int64) (
 	}
 }
 
-func parseBodyChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
+func parseBodyChunked(src *bufio.Reader, w BodyWrapper, maxChunkSize, maxLineSize int) (int, error) {
 	buffer := bytebufferpool.Get()
 	defer bytebufferpool.Put(buffer)
 	var wn, n int
 	for {
 		// read and calculate chunk size
 		buffer.Reset()
-		chunkSize, err := parseChunkSize(src, buffer)
+		chunkSize, err := parseChunkSize(src, buffer, maxLineSize)
 		if err != nil {
 			return wn, err
 		}
+		if maxChunkSize > 0 && chunkSize > maxChunkSize {
+			return wn, ErrChunkTooLarge
+		}
 		if n, err = w(true, buffer.B); err != nil {
 			return wn, err
 		}
 		wn += n
+		if chunkSize == 0 {
+			// copy the trailer following the last chunk
+			n, err = parseChunkTrailer(src, w)
+			return wn + n, err
+		}
 		// copy the chunk
 		if n, err = parseBodyFixedSize(src, w,
 			// 2 means the length of `\r\n` i.e. CRLF
@@ -104,7 +148,24 @@ func parseBodyChunked(src *bufio.Reader, w BodyWrapper) (int, error) {
 			return wn, err
 		}
 		wn += n
-		if chunkSize == 0 {
+	}
+}
+
+// parseChunkTrailer copies the trailer fields after the last chunk, until
+// the empty line ending the chunked body, see RFC 7230 4.1.2
+func parseChunkTrailer(src *bufio.Reader, w BodyWrapper) (int, error) {
+	var wn int
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			return wn, fmt.Errorf("cannot read chunked body trailer: %s", err)
+		}
+		n, err := w(true, line)
+		wn += n
+		if err != nil {
+			return wn, err
+		}
+		if len(line) == 1 || (len(line) == 2 && line[0] == '\r') {
 			return wn, nil
 		}
 	}
@@ -123,10 +184,36 @@ func parseBodyIdentity(src *bufio.Reader, w BodyWrapper) (int, error) {
 	return n, nil
 }
 
-func parseChunkSize(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer) (int, error) {
+// parseChunkSize parses the chunk size line into buffer, the line length is
+// limited by maxLineSize if positive
+func parseChunkSize(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer, maxLineSize int) (int, error) {
 	n, err := util.ReadHexInt(r, buffer)
 	if err != nil {
-		return -1, err
+		if err == io.EOF {
+			return -1, err
+		}
+		return -1, fmt.Errorf("invalid chunk size: %s", err)
+	}
+	if maxLineSize > 0 && buffer.Len() > maxLineSize {
+		return -1, ErrChunkLineTooLong
+	}
+	// the chunk extensions, maybe preceded by whitespaces, are copied as they are
+	if b, _ := r.Peek(1); len(b) == 1 && (b[0] == ';' || b[0] == ' ' || b[0] == '\t') {
+		if maxLineSize > 0 {
+			// the extensions left with the CR ending them
+			limit := maxLineSize - buffer.Len() + 1
+			if b, _ := r.Peek(limit); len(b) == limit && bytes.IndexByte(b, '\r') < 0 {
+				return -1, ErrChunkLineTooLong
+			}
+		}
+		ext, err := r.ReadSlice('\r')
+		if err != nil {
+			return -1, fmt.Errorf("cannot read chunk extensions: %s", err)
+		}
+		if _, e := buffer.Write(ext[:len(ext)-1]); e != nil {
+			return -1, e
+		}
+		r.UnreadByte()
 	}
 	c, err := r.ReadByte()
 	if err != nil {
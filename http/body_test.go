@@ -48,3 +48,124 @@ func testParseBodyFieldWithErrorBody(t *testing.T, bt BodyType, s, expErr string
 		t.Fatalf("expected error: %s, but get unexpected error: %s", expErr, err.Error())
 	}
 }
+
+func TestParseChunkedBodyMaxChunkLineSize(t *testing.T) {
+	var copied []byte
+	w := func(isChunkHeader bool, data []byte) (int, error) {
+		copied = append(copied, data...)
+		return len(data), nil
+	}
+	body := &Body{}
+	body.SetMaxChunkLineSize(16)
+	s := "5;ext=1234567890\r\nasdfg\r\n0\r\n\r\n"
+	if _, err := body.Parse(bufio.NewReader(strings.NewReader(s)), BodyTypeChunked, -1, w); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(copied) != s {
+		t.Fatalf("unexpected body copied %q", copied)
+	}
+	for _, s := range []string{
+		"5;ext=12345678901\r\nasdfg\r\n0\r\n\r\n",
+		// never terminated
+		"5;" + strings.Repeat("a", 1<<20),
+	} {
+		copied = nil
+		_, err := body.Parse(bufio.NewReader(strings.NewReader(s)), BodyTypeChunked, -1, w)
+		if err != ErrChunkLineTooLong {
+			t.Fatalf("expected error %s, got %v", ErrChunkLineTooLong, err)
+		}
+		if len(copied) != 0 {
+			t.Fatalf("expected nothing copied, got %q", copied)
+		}
+	}
+	// the chunk size itself
+	body.SetMaxChunkLineSize(2)
+	_, err := body.Parse(bufio.NewReader(strings.NewReader("00005\r\nasdfg\r\n0\r\n\r\n")),
+		BodyTypeChunked, -1, w)
+	if err != ErrChunkLineTooLong {
+		t.Fatalf("expected error %s, got %v", ErrChunkLineTooLong, err)
+	}
+	body.Reset()
+	if body.maxChunkLineSize != 0 {
+		t.Fatalf("max chunk line size should be cleared after reset")
+	}
+}
+
+func TestParseChunkedBodyMaxChunkSize(t *testing.T) {
+	w := func(isChunkHeader bool, data []byte) (int, error) {
+		return len(data), nil
+	}
+	body := &Body{}
+	body.SetMaxChunkSize(8)
+	for _, s := range []string{"8\r\nasdfghjk\r\n0\r\n\r\n", "5;ext=1\r\nasdfg\r\n0\r\n\r\n"} {
+		if _, err := body.Parse(bufio.NewReader(strings.NewReader(s)), BodyTypeChunked, -1, w); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// the oversized chunk is rejected before it's read
+	var copied []byte
+	w = func(isChunkHeader bool, data []byte) (int, error) {
+		copied = append(copied, data...)
+		return len(data), nil
+	}
+	_, err := body.Parse(bufio.NewReader(strings.NewReader("5\r\nasdfg\r\n9\r\nasdfghjkl\r\n0\r\n\r\n")),
+		BodyTypeChunked, -1, w)
+	if err != ErrChunkTooLarge {
+		t.Fatalf("expected error %s, got %v", ErrChunkTooLarge, err)
+	}
+	if string(copied) != "5\r\nasdfg\r\n" {
+		t.Fatalf("unexpected body copied %q", copied)
+	}
+	// a huge chunk size declared
+	_, err = body.Parse(bufio.NewReader(strings.NewReader("7fffffff\r\nasdfg")), BodyTypeChunked, -1, w)
+	if err != ErrChunkTooLarge {
+		t.Fatalf("expected error %s, got %v", ErrChunkTooLarge, err)
+	}
+	body.Reset()
+	if body.maxChunkSize != 0 {
+		t.Fatalf("max chunk size should be cleared after reset")
+	}
+
+	noop := func(isChunkHeader bool, data []byte) (int, error) {
+		return 0, nil
+	}
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "ffffffffffffffffff\r\n", "invalid chunk size: too large hex number", noop)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "zz\r\nasdfg\r\n0\r\n\r\n", "invalid chunk size: empty hex number", noop)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "-5\r\nasdfg\r\n0\r\n\r\n", "invalid chunk size: empty hex number", noop)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "\xff\r\nasdfg\r\n0\r\n\r\n", "invalid chunk size: empty hex number", noop)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5g\r\nasdfg\r\n0\r\n\r\n", `unexpected char 'g' at the end of chunk size`, noop)
+}
+
+func TestParseChunkedBodyExtensionsTrailer(t *testing.T) {
+	testParseChunkedBodyCopied(t, "5;name=value\r\nasdfg\r\n0\r\n\r\n")
+	testParseChunkedBodyCopied(t, "5 ;a=1; b=\"x y\"\r\nasdfg\r\nA;c\r\n0123456789\r\n0\r\n\r\n")
+	testParseChunkedBodyCopied(t, "5\r\nasdfg\r\n0;last\r\nExpires: 0\r\nX-Checksum: 42\r\n\r\n")
+
+	w := func(isChunkHeader bool, data []byte) (int, error) {
+		return 0, nil
+	}
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5;name=value", "cannot read chunk extensions", w)
+	testParseBodyFieldWithErrorBody(t, BodyTypeChunked, "5\r\nasdfg\r\n0\r\nExpires: 0\r\n", "cannot read chunked body trailer", w)
+}
+
+// testParseChunkedBodyCopied the chunked body is copied exactly, and the bytes
+// following it are left in reader
+func testParseChunkedBodyCopied(t *testing.T, s string) {
+	body := &Body{}
+	br := bufio.NewReader(strings.NewReader(s + "GET / HTTP/1.1\r\n"))
+	var copied []byte
+	w := func(isChunkHeader bool, data []byte) (int, error) {
+		copied = append(copied, data...)
+		return len(data), nil
+	}
+	n, err := body.Parse(br, BodyTypeChunked, -1, w)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(copied) != s || n != len(s) {
+		t.Fatalf("expected %q copied, got %q with %d bytes", s, copied, n)
+	}
+	if left, _ := br.ReadString('\n'); left != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("unexpected bytes left %q", left)
+	}
+}
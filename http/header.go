@@ -7,23 +7,79 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/util"
 )
 
 // Header header part of http request & response
 type Header struct {
-	isConnectionClose      bool
-	isProxyConnectionClose bool
-	contentLength          int64
-	contentType            string
+	isConnectionClose          bool
+	isConnectionKeepAlive      bool
+	isProxyConnectionClose     bool
+	isProxyConnectionKeepAlive bool
+	isExpectContinue           bool
+	contentLength              int64
+	isContentLengthSet         bool
+	contentType                string
+	via                        []byte
+	connection                 []byte
+
+	// limits of the header, zero means no limit
+	maxSize   int
+	maxFields int
+
+	// strict rejects the header lines not ended by CRLF, see SetStrict
+	strict bool
+
+	// raw the header larger than the reader's buffer, accumulated and
+	// consumed from reader, nil when the header parsed in the buffer
+	raw *bytebufferpool.ByteBuffer
 }
 
 // Reset reset header info into default val
 func (header *Header) Reset() {
 	header.isConnectionClose = false
+	header.isConnectionKeepAlive = false
+	header.isProxyConnectionClose = false
+	header.isProxyConnectionKeepAlive = false
+	header.isExpectContinue = false
 	header.contentLength = 0
+	header.isContentLengthSet = false
 	header.contentType = ""
+	header.via = header.via[:0]
+	header.connection = header.connection[:0]
+	header.maxSize = 0
+	header.maxFields = 0
+	header.strict = false
+	if header.raw != nil {
+		bytebufferpool.Put(header.raw)
+		header.raw = nil
+	}
+}
+
+// DefaultMaxHeaderSize max size in bytes of the header larger than reader's
+// buffer accumulated by ParseHeaderFields when no max size set
+const DefaultMaxHeaderSize = 1024 * 1024
+
+// SetLimits sets the max size in bytes and the max field count of the header
+// parsed by ParseHeaderFields, zero means no limit, except the header larger
+// than reader's buffer, which is limited by DefaultMaxHeaderSize then.
+// ErrHeaderTooLarge or ErrTooManyHeaderFields returned when exceeded.
+// Limits are cleared by Reset.
+func (header *Header) SetLimits(maxSize, maxFields int) {
+	header.maxSize = maxSize
+	header.maxFields = maxFields
+}
+
+// SetStrict requires every header line parsed by ParseHeaderFields ended by
+// CRLF, rejecting bare LF, bare CR and NUL in the header, and control chars
+// or whitespaces in the field names, which are interpreted differently by the
+// servers and used for request smuggling. ErrMalformedHeader returned when
+// rejected. Strict mode is cleared by Reset.
+func (header *Header) SetStrict(strict bool) {
+	header.strict = strict
 }
 
 // IsConnectionClose is connection header set to `close`
@@ -31,11 +87,27 @@ func (header *Header) IsConnectionClose() bool {
 	return header.isConnectionClose
 }
 
+// IsConnectionKeepAlive is connection header set to `keep-alive`
+func (header *Header) IsConnectionKeepAlive() bool {
+	return header.isConnectionKeepAlive
+}
+
 // IsProxyConnectionClose is Proxy-Connection header set to `close`
 func (header *Header) IsProxyConnectionClose() bool {
 	return header.isProxyConnectionClose
 }
 
+// IsProxyConnectionKeepAlive is Proxy-Connection header set to `keep-alive`,
+// which is sent by the older clients instead of the Connection header
+func (header *Header) IsProxyConnectionKeepAlive() bool {
+	return header.isProxyConnectionKeepAlive
+}
+
+// IsExpectContinue is Expect header set to `100-continue`
+func (header *Header) IsExpectContinue() bool {
+	return header.isExpectContinue
+}
+
 // ContentType content type in header
 func (header *Header) ContentType() string {
 	return header.contentType
@@ -49,6 +121,22 @@ func (header *Header) ContentLength() int64 {
 	return 0
 }
 
+// Via values of the Via headers in order, joined by comma
+func (header *Header) Via() []byte {
+	return header.via
+}
+
+// Connection values of the Connection headers in order, joined by comma
+func (header *Header) Connection() []byte {
+	return header.connection
+}
+
+// IsContentLengthSet is the Content-Length header present, which tells
+// an empty body apart from a body without length declared
+func (header *Header) IsContentLengthSet() bool {
+	return header.isContentLengthSet
+}
+
 // BodyType return body type parsed from header
 func (header *Header) BodyType() BodyType {
 	// negative means transfer encoding: -1 means chunked;  -2 means identity
@@ -81,7 +169,15 @@ func (header *Header) IsBodyIdentity() bool {
 // Each header field consists of a case-insensitive field name followed
 // by a colon (":"), optional leading whitespace, the field value, and
 // optional trailing whitespace.
+//
+// The header is parsed in reader's buffer without consuming it, unless it's
+// larger than the buffer, which is then accumulated and consumed from reader,
+// use PeekRaw and DiscardRaw to get the raw header parsed in either case.
 func (header *Header) ParseHeaderFields(reader *bufio.Reader) (int, error) {
+	if header.raw != nil {
+		// accumulated and consumed by the previous parsing
+		return header.raw.Len(), nil
+	}
 	n := 1
 	readNum := 0
 
@@ -94,10 +190,105 @@ func (header *Header) ParseHeaderFields(reader *bufio.Reader) (int, error) {
 		if err != errNeedMore {
 			return readNum, err
 		}
+		// the header is longer than all the bytes buffered
+		if header.maxSize > 0 && reader.Buffered() >= header.maxSize {
+			return readNum, ErrHeaderTooLarge
+		}
 		n = reader.Buffered() + 1
+		if n > reader.Size() {
+			return header.readLargeHeader(reader)
+		}
+	}
+}
+
+// readLargeHeader accumulates the header larger than reader's buffer line by
+// line, exactly the header is consumed from reader, leaving the body unread
+func (header *Header) readLargeHeader(reader *bufio.Reader) (int, error) {
+	maxSize := header.maxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxHeaderSize
+	}
+	raw := bytebufferpool.Get()
+	lineStart := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		raw.Write(line)
+		if raw.Len() > maxSize {
+			bytebufferpool.Put(raw)
+			return 0, ErrHeaderTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			// the rest of the line is still unread
+			continue
+		}
+		if err != nil {
+			bytebufferpool.Put(raw)
+			return 0, err
+		}
+		if isEmptyLine(raw.B[lineStart:]) {
+			break
+		}
+		lineStart = raw.Len()
+	}
+	if _, err := header.readHeaders(raw.B); err != nil {
+		bytebufferpool.Put(raw)
+		return 0, err
 	}
+	header.raw = raw
+	return raw.Len(), nil
 }
 
+// isEmptyLine is line the empty line ending the header
+func isEmptyLine(line []byte) bool {
+	return len(line) == 1 || (len(line) == 2 && line[0] == '\r')
+}
+
+// PeekRaw returns the raw header of length n parsed by ParseHeaderFields
+// without consuming it from reader
+func (header *Header) PeekRaw(reader *bufio.Reader, n int) ([]byte, error) {
+	if header.raw != nil {
+		return header.raw.B, nil
+	}
+	return reader.Peek(n)
+}
+
+// PeekBody returns the first size bytes of the body following the raw header
+// of length n parsed by ParseHeaderFields without consuming them, the bytes
+// are valid only until the next read of reader. bufio.ErrBufferFull returned
+// if the header and size bytes are larger than reader's buffer
+func (header *Header) PeekBody(reader *bufio.Reader, n, size int) ([]byte, error) {
+	if header.raw != nil {
+		// the header is consumed by the parsing already
+		n = 0
+	}
+	b, err := reader.Peek(n + size)
+	if len(b) < n {
+		return nil, err
+	}
+	return b[n:], err
+}
+
+// DiscardRaw consumes the raw header of length n parsed by ParseHeaderFields
+// from reader, nothing is discarded if it's consumed by the parsing already
+func (header *Header) DiscardRaw(reader *bufio.Reader, n int) (int, error) {
+	if header.raw != nil {
+		return header.raw.Len(), nil
+	}
+	return reader.Discard(n)
+}
+
+var (
+	// ErrHeaderTooLarge header size exceeds the limit set by SetLimits
+	ErrHeaderTooLarge = errors.New("header too large")
+
+	// ErrTooManyHeaderFields header field count exceeds the limit set by SetLimits
+	ErrTooManyHeaderFields = errors.New("too many header fields")
+
+	// ErrMalformedHeader header line rejected in strict mode set by SetStrict,
+	// or the Content-Length invalid or conflicting with a previous one
+	ErrMalformedHeader = errors.New("malformed header")
+)
+
 var errNeedMore = errors.New("need more data: cannot find trailing LF")
 
 func (header *Header) tryRead(reader *bufio.Reader, n int) (int, error) {
@@ -118,10 +309,15 @@ func (header *Header) tryRead(reader *bufio.Reader, n int) (int, error) {
 		}
 		return headersLen, errParse
 	}
+	if header.maxSize > 0 && headersLen > header.maxSize {
+		return 0, ErrHeaderTooLarge
+	}
 	return headersLen, nil
 }
 
 func (header *Header) readHeaders(buf []byte) (headerLength int, err error) {
+	// the content length parsed, compared with the repeated ones
+	contentLengthSeen, contentLength := false, int64(0)
 	parseBuffer := func(rawHeaderLine []byte) error {
 		// Connection, Authenticate and Authorization are single hop Header:
 		// http:// www.w3.org/Protocols/rfc2616/rfc2616.txt
@@ -129,19 +325,30 @@ func (header *Header) readHeaders(buf []byte) (headerLength int, err error) {
 		// The Connection general-header field allows the sender to specify
 		// options that are desired for that particular connection and MUST NOT
 		// be communicated by proxies over further connections.
+		// the raw header line is forwarded as it is, never modified here
 		if isConnectionHeader(rawHeaderLine) {
-			changeToLowerCase(rawHeaderLine)
-			if bytes.Contains(rawHeaderLine, []byte("close")) {
+			value := headerLineValue(rawHeaderLine)
+			if hasHeaderToken(value, closeToken) {
 				header.isConnectionClose = true
 			}
+			if hasHeaderToken(value, keepAliveToken) {
+				header.isConnectionKeepAlive = true
+			}
+			if len(header.connection) > 0 {
+				header.connection = append(header.connection, ", "...)
+			}
+			header.connection = append(header.connection, value...)
 			return nil
 		}
 
 		if isProxyConnectionHeader(rawHeaderLine) {
-			changeToLowerCase(rawHeaderLine)
-			if bytes.Contains(rawHeaderLine, []byte("close")) {
+			value := headerLineValue(rawHeaderLine)
+			if hasHeaderToken(value, closeToken) {
 				header.isProxyConnectionClose = true
 			}
+			if hasHeaderToken(value, keepAliveToken) {
+				header.isProxyConnectionKeepAlive = true
+			}
 			return nil
 		}
 
@@ -150,21 +357,41 @@ func (header *Header) readHeaders(buf []byte) (headerLength int, err error) {
 		// content length < 0 means the transfer encoding is set,
 		// -1 means chunked
 		// -2 means identity
-		if isContentLengthHeader(rawHeaderLine) && header.contentLength >= 0 {
+		if isContentLengthHeader(rawHeaderLine) {
+			// the invalid or conflicting content lengths make the message
+			// framing ambiguous, which must be rejected, see RFC 7230 3.3.3
+			length, ok := parseContentLength(headerLineValue(rawHeaderLine))
+			if !ok || (contentLengthSeen && length != contentLength) {
+				return ErrMalformedHeader
+			}
+			contentLengthSeen = true
+			contentLength = length
 			// content-length header can only be set with transfer encoding unset
-			lengthBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
-			if lengthBytesIndex > 0 {
-				lengthBytes := rawHeaderLine[lengthBytesIndex+1:]
-				length, _ := strconv.ParseInt(strings.TrimSpace(string(lengthBytes)), 10, 64)
-				if length > 0 {
-					header.contentLength = length
-				}
+			if header.contentLength >= 0 {
+				header.isContentLengthSet = true
+				header.contentLength = length
 			}
 		} else if isTransferEncodingHeader(rawHeaderLine) {
-			if bytes.Contains(rawHeaderLine, []byte("chunked")) {
-				header.contentLength = -1
-			} else if bytes.Contains(rawHeaderLine, []byte("identity")) {
-				header.contentLength = -2
+			if coding := finalTransferCoding(headerLineValue(rawHeaderLine)); len(coding) > 0 {
+				if equalIgnoreCase(coding, chunkedTransferCoding) {
+					header.contentLength = -1
+				} else {
+					// response body not chunked finally is delimited by
+					// closing the connection, while such a request is
+					// malformed and should be rejected, see RFC 7230 3.3.3
+					header.contentLength = -2
+				}
+			}
+		} else if IsViaHeader(rawHeaderLine) {
+			// multiple Via headers are combined into a comma separated list
+			if len(header.via) > 0 {
+				header.via = append(header.via, ", "...)
+			}
+			header.via = append(header.via,
+				headerLineValue(rawHeaderLine)...)
+		} else if isExpectHeader(rawHeaderLine) {
+			if hasHeaderToken(headerLineValue(rawHeaderLine), continueToken) {
+				header.isExpectContinue = true
 			}
 		} else if isContentTypeHeader(rawHeaderLine) {
 			contentTypeBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
@@ -177,6 +404,19 @@ func (header *Header) readHeaders(buf []byte) (headerLength int, err error) {
 		return nil
 	}
 
+	// headers are parsed from the beginning every time when more data needed
+	header.via = header.via[:0]
+	header.connection = header.connection[:0]
+
+	fields := 0
+	countField := func() error {
+		fields++
+		if header.maxFields > 0 && fields > header.maxFields {
+			return ErrTooManyHeaderFields
+		}
+		return nil
+	}
+
 	// read 1st line
 	n := bytes.IndexByte(buf, '\n')
 	if n < 0 {
@@ -184,9 +424,18 @@ func (header *Header) readHeaders(buf []byte) (headerLength int, err error) {
 	}
 	if (n == 1 && buf[0] == '\r') || n == 0 {
 		// empty headers, write \n or \r\n
+		if header.strict && n == 0 {
+			return 0, ErrMalformedHeader
+		}
 		return n + 1, nil
 	}
 	n++
+	if header.strict && !isStrictHeaderLine(buf[:n]) {
+		return 0, ErrMalformedHeader
+	}
+	if e := countField(); e != nil {
+		return 0, e
+	}
 	if e := parseBuffer(buf[:n]); e != nil {
 		return 0, e
 	}
@@ -201,43 +450,197 @@ func (header *Header) readHeaders(buf []byte) (headerLength int, err error) {
 			return 0, errNeedMore
 		}
 		m++
-		if e := parseBuffer(b[:m]); e != nil {
-			return 0, e
-		}
 		n += m
 		if (m == 2 && b[0] == '\r') || m == 1 {
+			if header.strict && m == 1 {
+				return 0, ErrMalformedHeader
+			}
 			return n, nil
 		}
+		if header.strict && !isStrictHeaderLine(b[:m]) {
+			return 0, ErrMalformedHeader
+		}
+		if e := countField(); e != nil {
+			return 0, e
+		}
+		if e := parseBuffer(b[:m]); e != nil {
+			return 0, e
+		}
 	}
 }
 
+// isStrictHeaderLine is the header line ended by CRLF, without any other CR
+// or NUL, and named by a non-empty field name without control chars or
+// whitespaces, which also rejects the obsolete line folding
+func isStrictHeaderLine(line []byte) bool {
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return false
+	}
+	line = line[:len(line)-2]
+	if bytes.IndexByte(line, '\r') >= 0 || bytes.IndexByte(line, 0) >= 0 {
+		return false
+	}
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range line[:i] {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+var closeToken = []byte("close")
+var keepAliveToken = []byte("keep-alive")
+var continueToken = []byte("100-continue")
+
 var connectionHeader = []byte("Connection")
 var proxyConnectionHeader = []byte("Proxy-Connection")
 
 func isConnectionHeader(header []byte) bool {
-	return hasPrefixIgnoreCase(header, connectionHeader)
+	return isHeaderNamed(header, connectionHeader)
 }
 
 func isProxyConnectionHeader(header []byte) bool {
-	return hasPrefixIgnoreCase(header, proxyConnectionHeader)
+	return isHeaderNamed(header, proxyConnectionHeader)
 }
 
 var contentLengthHeader = []byte("Content-Length")
 
 func isContentLengthHeader(header []byte) bool {
-	return hasPrefixIgnoreCase(header, contentLengthHeader)
+	return isHeaderNamed(header, contentLengthHeader)
+}
+
+// parseContentLength parses the Content-Length value of decimal digits only,
+// rejecting the empty, signed or comma separated values
+func parseContentLength(value []byte) (int64, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	length, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return length, true
+}
+
+// IsContentLengthHeader is the given header a Content-Length header
+func IsContentLengthHeader(header []byte) bool {
+	return isContentLengthHeader(header)
 }
 
 var contentTypeHeader = []byte("Content-Type")
 
 func isContentTypeHeader(header []byte) bool {
-	return hasPrefixIgnoreCase(header, contentTypeHeader)
+	return isHeaderNamed(header, contentTypeHeader)
+}
+
+var expectHeader = []byte("Expect")
+
+func isExpectHeader(header []byte) bool {
+	return isHeaderNamed(header, expectHeader)
 }
 
 var transferEncoding = []byte("Transfer-Encoding")
+var chunkedTransferCoding = []byte("chunked")
 
 func isTransferEncodingHeader(header []byte) bool {
-	return hasPrefixIgnoreCase(header, transferEncoding)
+	return isHeaderNamed(header, transferEncoding)
+}
+
+// finalTransferCoding the last coding name of the comma separated
+// Transfer-Encoding value, without the transfer parameters, e.g.
+// `chunked` of `gzip, chunked`, nil if there are no codings
+func finalTransferCoding(value []byte) []byte {
+	var coding []byte
+	for _, c := range bytes.Split(value, []byte(",")) {
+		if i := bytes.IndexByte(c, ';'); i >= 0 {
+			c = c[:i]
+		}
+		if c = bytes.TrimSpace(c); len(c) > 0 {
+			coding = c
+		}
+	}
+	return coding
+}
+
+var viaHeader = []byte("Via")
+
+// IsViaHeader is the given header a Via header
+func IsViaHeader(header []byte) bool {
+	return isHeaderNamed(header, viaHeader)
+}
+
+// ViaContains reports whether the proxy named as name appears in the Via
+// header value, i.e. the value has a `received-protocol name` hop
+func ViaContains(via []byte, name string) bool {
+	for _, hop := range bytes.Split(via, []byte(",")) {
+		fields := bytes.Fields(hop)
+		if len(fields) >= 2 && equalIgnoreCase(fields[1], []byte(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHeaderValue returns the value of the first header named key in the raw
+// header, nil is returned if no such header found
+func GetHeaderValue(rawHeader []byte, key string) []byte {
+	for i := 0; i < len(rawHeader); {
+		m := bytes.IndexByte(rawHeader[i:], '\n')
+		if m < 0 {
+			m = len(rawHeader) - i
+		}
+		line := rawHeader[i : i+m]
+		if len(line) > len(key) && line[len(key)] == ':' &&
+			hasPrefixIgnoreCase(line, []byte(key)) {
+			return bytes.TrimSpace(line[len(key)+1:])
+		}
+		i += m + 1
+	}
+	return nil
+}
+
+// retryAfterDateFormats the HTTP-date formats, see RFC 7231 7.1.1.1
+var retryAfterDateFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",  // IMF-fixdate
+	"Monday, 02-Jan-06 15:04:05 GMT", // obsolete RFC 850 format
+	"Mon Jan _2 15:04:05 2006",       // ANSI C's asctime() format
+}
+
+// ParseRetryAfter parses the Retry-After header value in either delta-seconds
+// or HTTP-date form into the delay from now, see RFC 7231 7.1.3. A date
+// already passed makes a zero delay, false is returned for invalid values
+func ParseRetryAfter(value []byte, now time.Time) (time.Duration, bool) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if value[0] >= '0' && value[0] <= '9' {
+		seconds, err := strconv.ParseUint(string(value), 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	for _, format := range retryAfterDateFormats {
+		date, err := time.Parse(format, string(value))
+		if err != nil {
+			continue
+		}
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
 }
 
 var proxyHeaders = [][]byte{
@@ -250,6 +653,41 @@ var proxyHeaders = [][]byte{
 	[]byte("Proxy-Authorization"),
 }
 
+// hopByHopHeaders are meaningful only for a single transport-level connection
+// thus never forwarded, see RFC 7230 6.1. Upgrade is not one of them since
+// it's forwarded along with the Connection header for the WebSocket handshake
+var hopByHopHeaders = [][]byte{
+	[]byte("TE:"),
+	[]byte("Trailer:"),
+	[]byte("Keep-Alive:"),
+}
+
+// IsHopByHopHeader is the given header a hop-by-hop header
+// which should not be forwarded
+func IsHopByHopHeader(header []byte) bool {
+	for _, hopByHopHeaderKey := range hopByHopHeaders {
+		if hasPrefixIgnoreCase(header, hopByHopHeaderKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsConnectionOption is the given header named as one of the connection
+// options, i.e. the comma separated Connection header values, which makes
+// it hop-by-hop and never forwarded, see RFC 7230 6.1. Upgrade is excluded
+// since it's forwarded along with the Connection header
+func IsConnectionOption(connection, header []byte) bool {
+	i := bytes.IndexByte(header, ':')
+	if i <= 0 {
+		return false
+	}
+	name := bytes.TrimSpace(header[:i])
+	return !equalIgnoreCase(name, upgradeHeader) && hasHeaderToken(connection, name)
+}
+
+var upgradeHeader = []byte("Upgrade")
+
 // IsProxyHeader is the given header a proxy related header
 func IsProxyHeader(header []byte) bool {
 	for _, proxyHeaderKey := range proxyHeaders {
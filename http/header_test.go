@@ -3,17 +3,19 @@ package http
 import (
 	"bufio"
 	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseHeaderFields(t *testing.T) {
-	//TODO: large header
 	//TODO: more error return tests
 	//t.Fatal("fix todo")
 	header1 := "Host: www.google.com\r\nUser-Agent: curl/7.54.0\r\n\r\n"
 	testParseHeaderFields(t, -1, header1, len(header1), nil, false, false, 0, "")
-	testParseHeaderFields(t, 10, header1, 0, bufio.ErrBufferFull, false, false, 0, "")
+	// larger than the reader's buffer
+	testParseHeaderFields(t, 10, header1, len(header1), nil, false, false, 0, "")
 	header1_1 := "Host: www.google.com\nUser-Agent: curl/7.54.0\n\r\n"
 	testParseHeaderFields(t, -1, header1_1, len(header1_1), nil, false, false, 0, "")
 	header1_2 := "Host: www.google.com\nUser-Agent: curl/7.54.0\n\n"
@@ -40,6 +42,33 @@ func TestParseHeaderFields(t *testing.T) {
 	testParseHeaderFields(t, -1, header6, len(header6), nil, false, false, -1, "text/html; charset=ISO-8859-1")
 	header7 := "Connection: Close\r\nServer: Microsoft-IIS/10.0\r\nTransfer-Encoding: identity\r\n\r\n"
 	testParseHeaderFields(t, -1, header7, len(header7), nil, true, false, -2, "")
+	header7_1 := "Transfer-Encoding: gzip, chunked\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_1, len(header7_1), nil, false, false, -1, "")
+	header7_2 := "Transfer-Encoding: chunked, gzip\r\nContent-Length: 10\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_2, len(header7_2), nil, false, false, -2, "")
+	header7_3 := "Transfer-Encoding: gzip\r\ntransfer-encoding: CHUNKED\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_3, len(header7_3), nil, false, false, -1, "")
+	// the word chunked in other headers is never the transfer coding
+	header7_4 := "X-Transfer-Encoding: chunked\r\nTransfer-Encoding-Hint: chunked\r\n" +
+		"X-Note: chunked\r\nContent-Length: 10\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_4, len(header7_4), nil, false, false, 10, "")
+	header7_5 := "Transfer-Encoding: x-notchunked\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_5, len(header7_5), nil, false, false, -2, "")
+	// header names in any case
+	header7_9 := "content-length: 10\r\nCONNECTION: Keep-Alive, CLOSE\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_9, len(header7_9), nil, true, false, 10, "")
+	header7_10 := "cOnTeNt-LeNgTh: 10\r\ntRaNsFeR-eNcOdInG: ChUnKeD\r\npRoXy-CoNnEcTiOn: ClOsE\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_10, len(header7_10), nil, false, true, -1, "")
+	header7_11 := "transfer-encoding: chunked\r\ncontent-length: 10\r\nconnection: x-closed\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_11, len(header7_11), nil, false, false, -1, "")
+	// look-alike header names are never parsed as the fields
+	header7_6 := "X-Content-Length: 20\r\nContent-Length-Foo: 30\r\nContent-Length : 5\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_6, len(header7_6), nil, false, false, 5, "")
+	header7_7 := "Content-LengthX: 20\r\nConnection-Foo: close\r\nProxy-ConnectionX: close\r\n" +
+		"Content-Types: text/html\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_7, len(header7_7), nil, false, false, 0, "")
+	header7_8 := "Connection\t: close\r\nTransfer-Encodings: chunked\r\n\r\n"
+	testParseHeaderFields(t, -1, header7_8, len(header7_8), nil, true, false, 0, "")
 	header8 := "\n"
 	testParseHeaderFields(t, -1, header8, len(header8), nil, false, false, 0, "")
 	header8_1 := "\nextra"
@@ -91,3 +120,381 @@ func testParseHeaderFields(t *testing.T, bufioBufferSize int, sampleHeader strin
 			header.contentType, expectingContentType)
 	}
 }
+
+func TestParseHeaderFieldsKeepAlive(t *testing.T) {
+	for sampleHeader, expected := range map[string][2]bool{
+		"Connection: Keep-Alive\r\n\r\n":       {true, false},
+		"Proxy-Connection: keep-alive\r\n\r\n": {false, true},
+		"Connection: close\r\n\r\n":            {false, false},
+	} {
+		header := &Header{}
+		if _, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader(sampleHeader))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if header.IsConnectionKeepAlive() != expected[0] || header.IsProxyConnectionKeepAlive() != expected[1] {
+			t.Fatalf("expected keep-alive %t and proxy keep-alive %t parsed from %q, got %t and %t",
+				expected[0], expected[1], sampleHeader,
+				header.IsConnectionKeepAlive(), header.IsProxyConnectionKeepAlive())
+		}
+	}
+}
+
+func TestParseHeaderFieldsRawUnmodified(t *testing.T) {
+	sampleHeader := "Connection: Keep-Alive, Close\r\nProxy-Connection: CLOSE\r\nExpect: 100-Continue\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(sampleHeader))
+	header := &Header{}
+	n, err := header.ParseHeaderFields(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !header.IsConnectionClose() || !header.IsProxyConnectionClose() || !header.IsExpectContinue() {
+		t.Fatalf("expected close, proxy close and expect continue parsed")
+	}
+	raw, err := header.PeekRaw(reader, n)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(raw) != sampleHeader {
+		t.Fatalf("expected raw header %q forwarded as it is, got %q", sampleHeader, raw)
+	}
+}
+
+func TestParseHeaderFieldsStrict(t *testing.T) {
+	for _, sampleHeader := range []string{
+		"Host: www.google.com\r\nUser-Agent: curl/7.54.0\r\n\r\n",
+		"\r\n",
+		"Host:www.google.com\r\nX-Empty:\r\nX-Tab:\tvalue\r\n\r\n",
+	} {
+		testParseHeaderFieldsStrict(t, sampleHeader, nil)
+	}
+	for _, sampleHeader := range []string{
+		// bare LF
+		"Host: www.google.com\nUser-Agent: curl/7.54.0\r\n\r\n",
+		"Host: www.google.com\r\nUser-Agent: curl/7.54.0\r\n\n",
+		"\n",
+		// bare CR
+		"Host: www.google.com\rUser-Agent: curl/7.54.0\r\n\r\n",
+		"Host: www.google.com\r\r\n\r\n",
+		// NUL
+		"Host: www.google.com\r\nX-Foo\x00: bar\r\n\r\n",
+		"Host: www.google.com\x00\r\n\r\n",
+		// control chars and whitespaces in field name
+		"Host: www.google.com\r\nX-\x01Foo: bar\r\n\r\n",
+		"Host: www.google.com\r\nContent-Length : 10\r\n\r\n",
+		"Host: www.google.com\r\n\tfolded\r\n\r\n",
+		"Host: www.google.com\r\n: no name\r\n\r\n",
+		"Host: www.google.com\r\nno colon\r\n\r\n",
+	} {
+		testParseHeaderFieldsStrict(t, sampleHeader, ErrMalformedHeader)
+	}
+
+	// the same headers are accepted without strict mode
+	header := &Header{}
+	if _, err := header.ParseHeaderFields(bufio.NewReader(
+		strings.NewReader("Host: www.google.com\nX-Foo\x00: bar\n\n"))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func testParseHeaderFieldsStrict(t *testing.T, sampleHeader string, expectingError error) {
+	// both parsed in the buffer and accumulated for the larger header
+	for _, size := range []int{len(sampleHeader) * 2, 16} {
+		header := &Header{}
+		header.SetStrict(true)
+		_, err := header.ParseHeaderFields(bufio.NewReaderSize(strings.NewReader(sampleHeader), size))
+		if err != expectingError {
+			t.Fatalf("unexpected error %v for %q, expecting %v", err, sampleHeader, expectingError)
+		}
+		header.Reset()
+	}
+}
+
+func TestParseHeaderFieldsContentLength(t *testing.T) {
+	header1 := "Content-Length: 5\r\nContent-Length: 5\r\n\r\n"
+	testParseHeaderFields(t, -1, header1, len(header1), nil, false, false, 5, "")
+	header2 := "Content-Length: 0\r\n\r\n"
+	testParseHeaderFields(t, -1, header2, len(header2), nil, false, false, 0, "")
+	for _, sampleHeader := range []string{
+		// conflicting
+		"Content-Length: 5\r\nContent-Length: 10\r\n\r\n",
+		"Content-Length: 5\r\nContent-Length: 0\r\n\r\n",
+		"Content-Length: 0\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n",
+		// not a number
+		"Content-Length: abc\r\n\r\n",
+		"Content-Length: \r\n\r\n",
+		"Content-Length: 5a\r\n\r\n",
+		"Content-Length: 99999999999999999999\r\n\r\n",
+		// negative or signed
+		"Content-Length: -5\r\n\r\n",
+		"Content-Length: +5\r\n\r\n",
+		// comma list
+		"Content-Length: 5, 10\r\n\r\n",
+		"Content-Length: 5, 5\r\n\r\n",
+	} {
+		testParseHeaderFieldsStrict(t, sampleHeader, ErrMalformedHeader)
+		// rejected without strict mode too
+		header := &Header{}
+		if _, err := header.ParseHeaderFields(bufio.NewReader(
+			strings.NewReader(sampleHeader))); err != ErrMalformedHeader {
+			t.Fatalf("unexpected error %v for %q, expecting %v", err, sampleHeader, ErrMalformedHeader)
+		}
+	}
+}
+
+func TestParseHeaderFieldsVia(t *testing.T) {
+	testParseHeaderFieldsVia(t, "Host: www.google.com\r\n\r\n", "")
+	testParseHeaderFieldsVia(t, "Via: 1.0 fred\r\nHost: www.google.com\r\n\r\n", "1.0 fred")
+	testParseHeaderFieldsVia(t, "via:1.0 fred\r\nVia: 1.1 nowhere.com (Apache/1.1) \r\n\r\n",
+		"1.0 fred, 1.1 nowhere.com (Apache/1.1)")
+	testParseHeaderFieldsVia(t, "Via-Foo: 1.0 fred\r\nX-Via: 1.0 joe\r\nVia : 1.1 bob\r\n\r\n", "1.1 bob")
+}
+
+func testParseHeaderFieldsVia(t *testing.T, sampleHeader, expectingVia string) {
+	header := &Header{}
+	if _, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader(sampleHeader))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(header.Via()) != expectingVia {
+		t.Fatalf("expected via %q, got %q", expectingVia, header.Via())
+	}
+	header.Reset()
+	if len(header.Via()) > 0 {
+		t.Fatalf("via should be empty after reset, got %q", header.Via())
+	}
+}
+
+func TestParseHeaderFieldsExpectContinue(t *testing.T) {
+	testParseHeaderFieldsExpectContinue(t, "Host: www.google.com\r\n\r\n", false)
+	testParseHeaderFieldsExpectContinue(t, "Expect: 100-continue\r\nHost: www.google.com\r\n\r\n", true)
+	testParseHeaderFieldsExpectContinue(t, "expect:100-Continue\r\n\r\n", true)
+	testParseHeaderFieldsExpectContinue(t, "Expect: something-else\r\n\r\n", false)
+}
+
+func testParseHeaderFieldsExpectContinue(t *testing.T, sampleHeader string, expectingContinue bool) {
+	header := &Header{}
+	if _, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader(sampleHeader))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.IsExpectContinue() != expectingContinue {
+		t.Fatalf("expected expect continue %t for %q", expectingContinue, sampleHeader)
+	}
+	header.Reset()
+	if header.IsExpectContinue() {
+		t.Fatalf("expect continue should be cleared after reset")
+	}
+}
+
+func TestParseHeaderFieldsWithLimits(t *testing.T) {
+	header := "Host: www.google.com\r\nUser-Agent: curl/7.54.0\r\n\r\n"
+	testParseHeaderFieldsWithLimits(t, header, 0, 0, len(header), nil)
+	testParseHeaderFieldsWithLimits(t, header, len(header), 2, len(header), nil)
+	testParseHeaderFieldsWithLimits(t, header, len(header)-1, 0, 0, ErrHeaderTooLarge)
+	testParseHeaderFieldsWithLimits(t, header, 0, 1, 0, ErrTooManyHeaderFields)
+	// header never ends
+	endless := "Host: www.google.com\r\nX-Large: " + strings.Repeat("a", 1000)
+	testParseHeaderFieldsWithLimits(t, endless, 100, 0, 0, ErrHeaderTooLarge)
+	manyFields := strings.Repeat("X-Field: a\r\n", 100)
+	testParseHeaderFieldsWithLimits(t, manyFields, 0, 10, 0, ErrTooManyHeaderFields)
+}
+
+func TestParseHeaderFieldsLargerThanBuffer(t *testing.T) {
+	header := "Host: www.google.com\r\n" +
+		"X-Large: " + strings.Repeat("a", 3000) + "\r\n" +
+		strings.Repeat("X-Field: abcdefghijklmnopqrstuvwxyz\r\n", 100) +
+		"Content-Length: 4\r\nVia: 1.0 fred\r\n\r\n"
+	// the smallest buffer of bufio, far less than the header
+	reader := bufio.NewReaderSize(strings.NewReader(header+"body"), 1)
+	h := &Header{}
+	headerLen, err := h.ParseHeaderFields(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if headerLen != len(header) {
+		t.Fatalf("unexpected header length %d, expecting %d", headerLen, len(header))
+	}
+	if h.ContentLength() != 4 || string(h.Via()) != "1.0 fred" {
+		t.Fatalf("unexpected content length %d or via %q", h.ContentLength(), h.Via())
+	}
+	// parsing again gives the header accumulated
+	if n, err := h.ParseHeaderFields(reader); err != nil || n != len(header) {
+		t.Fatalf("unexpected header length %d with error %v", n, err)
+	}
+	raw, err := h.PeekRaw(reader, headerLen)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(raw) != header {
+		t.Fatalf("unexpected raw header %q", raw)
+	}
+	if _, err := h.DiscardRaw(reader, headerLen); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// exactly the header is consumed, leaving the body
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "body" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	h.Reset()
+	if h.raw != nil {
+		t.Fatalf("accumulated header should be released by reset")
+	}
+
+	// the limits are still applied
+	h.SetLimits(1000, 0)
+	reader = bufio.NewReaderSize(strings.NewReader(header), 1)
+	if _, err := h.ParseHeaderFields(reader); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrHeaderTooLarge)
+	}
+	h.Reset()
+	h.SetLimits(0, 10)
+	reader = bufio.NewReaderSize(strings.NewReader(header), 1)
+	if _, err := h.ParseHeaderFields(reader); err != ErrTooManyHeaderFields {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrTooManyHeaderFields)
+	}
+	// never accumulated beyond the default size without limits
+	h.Reset()
+	endless := io.MultiReader(strings.NewReader("X-Endless: "),
+		strings.NewReader(strings.Repeat("a", DefaultMaxHeaderSize)))
+	reader = bufio.NewReaderSize(endless, 4096)
+	if _, err := h.ParseHeaderFields(reader); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrHeaderTooLarge)
+	}
+}
+
+func testParseHeaderFieldsWithLimits(t *testing.T, sampleHeader string, maxSize, maxFields int,
+	expectingHeaderLen int, expectingError error) {
+	header := &Header{}
+	header.SetLimits(maxSize, maxFields)
+	bufReader := bufio.NewReaderSize(strings.NewReader(sampleHeader), 2*len(sampleHeader))
+	headerLen, err := header.ParseHeaderFields(bufReader)
+	if err != expectingError {
+		t.Fatalf("unexpected error %v, expecting %v", err, expectingError)
+	}
+	if headerLen != expectingHeaderLen {
+		t.Fatalf("unexpected header length %d, expecting %d", headerLen, expectingHeaderLen)
+	}
+	header.Reset()
+	if header.maxSize != 0 || header.maxFields != 0 {
+		t.Fatalf("limits should be cleared by reset")
+	}
+}
+
+func TestPeekBody(t *testing.T) {
+	for _, header := range []string{
+		"Host: www.google.com\r\nContent-Length: 4\r\n\r\n",
+		// larger than the buffer, consumed by the parsing
+		"X-Large: " + strings.Repeat("a", 100) + "\r\nContent-Length: 4\r\n\r\n",
+	} {
+		reader := bufio.NewReaderSize(strings.NewReader(header+"body"), 64)
+		h := &Header{}
+		headerLen, err := h.ParseHeaderFields(reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := h.PeekBody(reader, headerLen, 4)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != "body" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		// nothing consumed by peeking
+		raw, err := h.PeekRaw(reader, headerLen)
+		if err != nil || string(raw) != header {
+			t.Fatalf("unexpected raw header %q with error %v", raw, err)
+		}
+		if _, err := h.PeekBody(reader, headerLen, 64); err != bufio.ErrBufferFull && err != io.EOF {
+			t.Fatalf("unexpected error %v when larger than buffer", err)
+		}
+	}
+}
+
+func TestViaContains(t *testing.T) {
+	via := []byte("1.0 fred, 1.1 nowhere.com (Apache/1.1), HTTP/1.1 FastProxy")
+	for _, name := range []string{"fred", "nowhere.com", "fastproxy"} {
+		if !ViaContains(via, name) {
+			t.Fatalf("%s expected in via %q", name, via)
+		}
+	}
+	for _, name := range []string{"1.0", "Apache/1.1", "fastproxy2", ""} {
+		if ViaContains(via, name) {
+			t.Fatalf("%s not expected in via %q", name, via)
+		}
+	}
+	if ViaContains(nil, "fred") {
+		t.Fatal("nothing expected in empty via")
+	}
+}
+
+func TestIsHopByHopHeader(t *testing.T) {
+	for _, header := range []string{"TE: trailers\r\n", "te: deflate\r\n",
+		"Trailer: Expires\r\n", "Keep-Alive: timeout=5, max=1000\r\n", "keep-alive: timeout=5\r\n"} {
+		if !IsHopByHopHeader([]byte(header)) {
+			t.Fatalf("%q expected to be hop-by-hop header", header)
+		}
+	}
+	for _, header := range []string{"Upgrade: websocket\r\n", "Connection: Upgrade\r\n",
+		"Test: true\r\n", "Transfer-Encoding: chunked\r\n", "Host: www.google.com\r\n"} {
+		if IsHopByHopHeader([]byte(header)) {
+			t.Fatalf("%q expected not to be hop-by-hop header", header)
+		}
+	}
+}
+
+func TestIsConnectionOption(t *testing.T) {
+	connection := []byte("Keep-Alive, X-Hop , upgrade")
+	for _, header := range []string{"X-Hop: 1\r\n", "x-hop : 1\r\n", "keep-alive: timeout=5\r\n"} {
+		if !IsConnectionOption(connection, []byte(header)) {
+			t.Fatalf("%q expected to be connection option", header)
+		}
+	}
+	for _, header := range []string{"Upgrade: websocket\r\n", "X-Hop-Foo: 1\r\n",
+		"Connection: X-Hop\r\n", "X-Hop\r\n", "Host: www.google.com\r\n"} {
+		if IsConnectionOption(connection, []byte(header)) {
+			t.Fatalf("%q expected not to be connection option", header)
+		}
+	}
+}
+
+func TestGetHeaderValue(t *testing.T) {
+	rawHeader := []byte("Host: www.google.com\r\nX-Request-Id-Extra: no\r\n" +
+		"x-request-id:  abc \r\nX-Request-Id: def\r\n\r\n")
+	if v := GetHeaderValue(rawHeader, "X-Request-Id"); string(v) != "abc" {
+		t.Fatalf("unexpected header value %q", v)
+	}
+	if v := GetHeaderValue(rawHeader, "Host"); string(v) != "www.google.com" {
+		t.Fatalf("unexpected header value %q", v)
+	}
+	if v := GetHeaderValue(rawHeader, "User-Agent"); v != nil {
+		t.Fatalf("unexpected header value %q", v)
+	}
+	if v := GetHeaderValue([]byte("Host: localhost"), "Host"); string(v) != "localhost" {
+		t.Fatalf("unexpected header value %q", v)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC)
+	testParseRetryAfter(t, now, "120", 120*time.Second, true)
+	testParseRetryAfter(t, now, " 0 ", 0, true)
+	testParseRetryAfter(t, now, "Wed, 21 Oct 2015 07:29:00 GMT", time.Minute, true)
+	testParseRetryAfter(t, now, "Wednesday, 21-Oct-15 07:28:30 GMT", 30*time.Second, true)
+	testParseRetryAfter(t, now, "Wed Oct 21 07:38:00 2015", 10*time.Minute, true)
+	// date passed already
+	testParseRetryAfter(t, now, "Wed, 21 Oct 2015 07:00:00 GMT", 0, true)
+	testParseRetryAfter(t, now, "", 0, false)
+	testParseRetryAfter(t, now, "-1", 0, false)
+	testParseRetryAfter(t, now, "1.5", 0, false)
+	testParseRetryAfter(t, now, "99999999999", 0, false)
+	testParseRetryAfter(t, now, "tomorrow", 0, false)
+}
+
+func testParseRetryAfter(t *testing.T, now time.Time, value string, expDelay time.Duration, expOK bool) {
+	delay, ok := ParseRetryAfter([]byte(value), now)
+	if ok != expOK || delay != expDelay {
+		t.Fatalf("expected delay %s, %v for %q, got %s, %v", expDelay, expOK, value, delay, ok)
+	}
+}
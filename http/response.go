@@ -0,0 +1,105 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+)
+
+// ResponseBuilder builds a response with the pooled byte buffers, e.g. an
+// error, static or rewritten response, the Content-Length header is always
+// set by the body length.
+//
+// Release the builder when the response built is no longer used.
+type ResponseBuilder struct {
+	statusCode int
+	header     *bytebufferpool.ByteBuffer
+	body       *bytebufferpool.ByteBuffer
+	response   *bytebufferpool.ByteBuffer
+}
+
+// NewResponseBuilder makes a response builder of the status code
+func NewResponseBuilder(statusCode int) *ResponseBuilder {
+	return &ResponseBuilder{
+		statusCode: statusCode,
+		header:     bytebufferpool.Get(),
+		body:       bytebufferpool.Get(),
+		response:   bytebufferpool.Get(),
+	}
+}
+
+// AddHeader adds a header field, Content-Length is ignored
+// since it's set by the body
+func (b *ResponseBuilder) AddHeader(key, value string) {
+	if equalIgnoreCase([]byte(key), []byte("Content-Length")) {
+		return
+	}
+	b.header.WriteString(key)
+	b.header.WriteString(": ")
+	b.header.WriteString(value)
+	b.header.WriteString("\r\n")
+}
+
+// AddRawHeader adds the raw header lines ending with CRLF
+func (b *ResponseBuilder) AddRawHeader(rawHeader []byte) {
+	b.header.Write(rawHeader)
+}
+
+// SetBody sets the body, replacing the one set before, the Content-Length
+// header is written by the body length when the response built
+func (b *ResponseBuilder) SetBody(body []byte) {
+	b.body.Set(body)
+}
+
+// RawHeader returns the header lines added, Content-Length
+// excluded since it's written when the response built
+func (b *ResponseBuilder) RawHeader() []byte {
+	return b.header.B
+}
+
+// Bytes returns the response built, which is valid until the builder released
+func (b *ResponseBuilder) Bytes() []byte {
+	b.build(false)
+	return b.response.B
+}
+
+// HeadBytes returns the response built without body, e.g. for a HEAD request,
+// which is valid until the builder released
+func (b *ResponseBuilder) HeadBytes() []byte {
+	b.build(true)
+	return b.response.B
+}
+
+// Reader returns a reader of the response built, e.g. for a hijacked
+// response, which is valid until the builder released
+func (b *ResponseBuilder) Reader() io.Reader {
+	return bytes.NewReader(b.Bytes())
+}
+
+// WriteTo writes the response built into w
+func (b *ResponseBuilder) WriteTo(w io.Writer) (int64, error) {
+	b.build(false)
+	return b.response.WriteTo(w)
+}
+
+// Release puts the buffers back into pool, the builder
+// and the response built must not be used any more
+func (b *ResponseBuilder) Release() {
+	bytebufferpool.Put(b.header)
+	bytebufferpool.Put(b.body)
+	bytebufferpool.Put(b.response)
+	b.header, b.body, b.response = nil, nil, nil
+}
+
+func (b *ResponseBuilder) build(omitBody bool) {
+	b.response.Set(StatusLine(b.statusCode))
+	b.response.Write(b.header.B)
+	b.response.WriteString("Content-Length: ")
+	b.response.B = strconv.AppendInt(b.response.B, int64(len(b.body.B)), 10)
+	b.response.WriteString("\r\n\r\n")
+	if !omitBody {
+		b.response.Write(b.body.B)
+	}
+}
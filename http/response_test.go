@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestResponseBuilder(t *testing.T) {
+	testResponseBuilder(t, StatusOK, []string{"Content-Type", "text/html"}, "<h1>Hello</h1>")
+	testResponseBuilder(t, StatusNotFound, []string{"Connection", "close"}, "")
+	testResponseBuilder(t, StatusBadGateway, []string{"Content-Type", "text/plain",
+		"Content-Length", "1000", "Via", "1.1 fastproxy"}, "Fail to forward the request.\n")
+}
+
+func TestResponseBuilderSetBodyTwice(t *testing.T) {
+	b := NewResponseBuilder(StatusOK)
+	defer b.Release()
+	b.SetBody([]byte("first body"))
+	b.AddHeader("Content-Type", "text/plain")
+	b.SetBody([]byte("second"))
+
+	reader := bufio.NewReader(b.Reader())
+	var respLine ResponseLine
+	if err := respLine.Parse(reader); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var header Header
+	headerLen, err := header.ParseHeaderFields(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.ContentLength() != int64(len("second")) {
+		t.Fatalf("expected content length of the last body, got %d", header.ContentLength())
+	}
+	rawHeader, _ := reader.Peek(headerLen)
+	if n := bytes.Count(rawHeader, []byte("Content-Length:")); n != 1 {
+		t.Fatalf("expected a single Content-Length header, got %d", n)
+	}
+	reader.Discard(headerLen)
+	if respBody, _ := ioutil.ReadAll(reader); string(respBody) != "second" {
+		t.Fatalf("expected body %q, got %q", "second", respBody)
+	}
+}
+
+func testResponseBuilder(t *testing.T, statusCode int, headers []string, body string) {
+	b := NewResponseBuilder(statusCode)
+	defer b.Release()
+	for i := 0; i < len(headers); i += 2 {
+		b.AddHeader(headers[i], headers[i+1])
+	}
+	if len(body) > 0 {
+		b.SetBody([]byte(body))
+	}
+
+	// parse the response built back
+	reader := bufio.NewReader(b.Reader())
+	var respLine ResponseLine
+	if err := respLine.Parse(reader); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if respLine.GetStatusCode() != statusCode {
+		t.Fatalf("expected status %d, got %d", statusCode, respLine.GetStatusCode())
+	}
+	var header Header
+	headerLen, err := header.ParseHeaderFields(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rawHeader, _ := reader.Peek(headerLen)
+	for i := 0; i < len(headers); i += 2 {
+		if headers[i] == "Content-Length" {
+			continue
+		}
+		if v := GetHeaderValue(rawHeader, headers[i]); string(v) != headers[i+1] {
+			t.Fatalf("expected header %s: %s, got %s", headers[i], headers[i+1], v)
+		}
+	}
+	if header.ContentLength() != int64(len(body)) {
+		t.Fatalf("expected content length %d, got %d", len(body), header.ContentLength())
+	}
+	if n := bytes.Count(rawHeader, []byte("Content-Length:")); n != 1 {
+		t.Fatalf("expected a single Content-Length header, got %d", n)
+	}
+	reader.Discard(headerLen)
+	respBody, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(respBody) != body {
+		t.Fatalf("expected body %q, got %q", body, respBody)
+	}
+
+	// the response without body
+	full := append([]byte(nil), b.Bytes()...)
+	if head := b.HeadBytes(); !bytes.Equal(head, full[:len(full)-len(body)]) {
+		t.Fatalf("expected head %q, got %q", full[:len(full)-len(body)], head)
+	}
+	var w bytes.Buffer
+	if n, err := b.WriteTo(&w); err != nil || int(n) != len(full) {
+		t.Fatalf("expected %d bytes written, got %d with error %v", len(full), n, err)
+	}
+	if !bytes.Equal(w.Bytes(), full) {
+		t.Fatalf("expected %q written, got %q", full, w.Bytes())
+	}
+}
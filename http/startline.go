@@ -63,7 +63,7 @@ var (
 // result of the server's attempt to understand and satisfy the client's
 // corresponding request
 func (l *ResponseLine) Parse(reader *bufio.Reader) error {
-	respLineWithCRLF, err := parseStartline(reader)
+	respLineWithCRLF, err := parseStartline(reader, 0)
 	if err != nil {
 		return err
 	}
@@ -105,6 +105,9 @@ type RequestLine struct {
 	method   []byte
 	uri      uri.URI
 	protocol []byte
+
+	// maxLength max length of request line, zero means no limit
+	maxLength int
 }
 
 // ParseRequestLine parse request line in stand-alone mode
@@ -123,8 +126,11 @@ func ParseRequestLine(reader *bufio.Reader) (*RequestLine, error) {
 // (SP), the request-target, another single space (SP), the protocol
 // version, and ends with CRLF.
 func (l *RequestLine) Parse(reader *bufio.Reader) error {
-	reqLineWithCRLF, err := parseStartline(reader)
+	reqLineWithCRLF, err := parseStartline(reader, l.maxLength)
 	if err != nil {
+		if err == errNotStartLine {
+			return ErrMalformedRequestLine
+		}
 		return err
 	}
 
@@ -138,7 +144,7 @@ func (l *RequestLine) Parse(reader *bufio.Reader) error {
 	// method token
 	methodEndIndex := bytes.IndexByte(reqLine, ' ')
 	if methodEndIndex <= 0 {
-		return errors.New("no method provided")
+		return ErrMalformedRequestLine
 	}
 	method := reqLine[:methodEndIndex]
 	changeToUpperCase(method)
@@ -147,7 +153,7 @@ func (l *RequestLine) Parse(reader *bufio.Reader) error {
 	reqURIStartIndex := methodEndIndex + 1
 	reqURIEndIndex := reqURIStartIndex + bytes.IndexByte(reqLine[reqURIStartIndex:], ' ')
 	if reqURIEndIndex <= reqURIStartIndex {
-		return errors.New("no request uri provided")
+		return ErrMalformedRequestLine
 	}
 	reqURI := reqLine[reqURIStartIndex:reqURIEndIndex]
 	isConnect := IsMethodConnect(method)
@@ -169,12 +175,28 @@ func (l *RequestLine) GetRequestLine() []byte {
 	return l.fullLine
 }
 
+// SetMaxLength sets the max length in bytes of the request line parsed by
+// Parse, zero means no limit. ErrRequestLineTooLong returned when exceeded.
+// The limit is cleared by Reset.
+func (l *RequestLine) SetMaxLength(maxLength int) {
+	l.maxLength = maxLength
+}
+
 // Reset reset request line to nil
 func (l *RequestLine) Reset() {
 	l.fullLine = l.fullLine[:0]
 	l.method = l.method[:0]
 	l.uri.Reset()
 	l.protocol = l.protocol[:0]
+	l.maxLength = 0
+}
+
+// IsAbsoluteForm whether the request target is in absolute-form, i.e.
+// `GET http://www.example.com/path HTTP/1.1` which a proxy receives for
+// plain HTTP, the host info is parsed from the request target then, other
+// than the origin-form `GET /path HTTP/1.1` received in decrypted HTTPS
+func (l *RequestLine) IsAbsoluteForm() bool {
+	return l.uri.IsAbsoluteForm()
 }
 
 // Method request method
@@ -197,16 +219,39 @@ func (l *RequestLine) HostInfo() *uri.HostInfo {
 	return l.uri.HostInfo()
 }
 
-func parseStartline(reader *bufio.Reader) ([]byte, error) {
-	startLineWithCRLF, err := reader.ReadBytes('\n')
-	if err != nil {
+var (
+	// ErrRequestLineTooLong request line exceeds the limit set by SetMaxLength
+	ErrRequestLineTooLong = errors.New("request line too long")
+
+	// ErrMalformedRequestLine request line has no method or request target
+	ErrMalformedRequestLine = errors.New("malformed request line")
+
+	errNotStartLine = errors.New("not a http start line")
+)
+
+func parseStartline(reader *bufio.Reader, maxLength int) ([]byte, error) {
+	var startLineWithCRLF []byte
+	for {
+		// do NOT use reader.ReadBytes here,
+		// which reads the whole line whatever long it is
+		b, err := reader.ReadSlice('\n')
+		startLineWithCRLF = append(startLineWithCRLF, b...)
+		if maxLength > 0 && len(startLineWithCRLF) > maxLength {
+			return nil, ErrRequestLineTooLong
+		}
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
 		if err == io.EOF {
 			return nil, err
 		}
 		return nil, util.ErrWrapper(err, "fail to read start line")
 	}
 	if len(startLineWithCRLF) <= 2 {
-		return nil, errors.New("not a http start line")
+		return nil, errNotStartLine
 	}
 	return startLineWithCRLF, nil
 }
@@ -46,3 +46,74 @@ func testRespLineParse(t *testing.T, line string, expErr error, expProtocol stri
 		t.Fatalf("unexpected status msg %s, expecting %s,", resp.GetStatusMessage(), expMsg)
 	}
 }
+
+func TestReqLine(t *testing.T) {
+	// absolute-form, sent to proxy for plain HTTP
+	testReqLineParse(t, "GET http://www.example.com:8080/path?q=xx HTTP/1.1\r\n",
+		"GET", true, "www.example.com:8080", "/path?q=xx", "HTTP/1.1")
+	testReqLineParse(t, "get http://www.example.com HTTP/1.0\n",
+		"GET", true, "www.example.com:80", "/", "HTTP/1.0")
+	// origin-form, sent in decrypted HTTPS
+	testReqLineParse(t, "GET /path?q=xx#frag HTTP/1.1\r\n",
+		"GET", false, "", "/path?q=xx#frag", "HTTP/1.1")
+	// authority-form, sent with CONNECT
+	testReqLineParse(t, "CONNECT www.example.com:443 HTTP/1.1\r\n",
+		"CONNECT", false, "www.example.com:443", "", "HTTP/1.1")
+}
+
+func testReqLineParse(t *testing.T, line string, expMethod string, expAbsoluteForm bool,
+	expHostWithPort, expPathWithQueryFragment, expProtocol string) {
+	req := &RequestLine{}
+	if err := req.Parse(bufio.NewReader(strings.NewReader(line))); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !bytes.Equal(req.Method(), []byte(expMethod)) {
+		t.Fatalf("unexpected method %s, expecting %s", req.Method(), expMethod)
+	}
+	if req.IsAbsoluteForm() != expAbsoluteForm {
+		t.Fatalf("unexpected absolute-form %v, expecting %v", req.IsAbsoluteForm(), expAbsoluteForm)
+	}
+	if req.HostInfo().HostWithPort() != expHostWithPort {
+		t.Fatalf("unexpected host %s, expecting %s", req.HostInfo().HostWithPort(), expHostWithPort)
+	}
+	if !bytes.Equal(req.PathWithQueryFragment(), []byte(expPathWithQueryFragment)) {
+		t.Fatalf("unexpected path %s, expecting %s", req.PathWithQueryFragment(), expPathWithQueryFragment)
+	}
+	if !bytes.Equal(req.Protocol(), []byte(expProtocol)) {
+		t.Fatalf("unexpected protocol %s, expecting %s", req.Protocol(), expProtocol)
+	}
+}
+
+func TestReqLineMaxLength(t *testing.T) {
+	line := "GET http://www.google.com/" + strings.Repeat("a", 100*1024) + " HTTP/1.1\r\n"
+	testReqLineMaxLength(t, line, 0, nil)
+	testReqLineMaxLength(t, line, len(line), nil)
+	testReqLineMaxLength(t, line, len(line)-1, ErrRequestLineTooLong)
+	testReqLineMaxLength(t, line, 8192, ErrRequestLineTooLong)
+}
+
+func testReqLineMaxLength(t *testing.T, line string, maxLength int, expErr error) {
+	reqLine := &RequestLine{}
+	reqLine.SetMaxLength(maxLength)
+	// the line is longer than reader's buffer
+	err := reqLine.Parse(bufio.NewReaderSize(strings.NewReader(line), 4096))
+	if err != expErr {
+		t.Fatalf("unexpected error %v, expecting %v", err, expErr)
+	}
+	if err == nil && string(reqLine.GetRequestLine()) != line {
+		t.Fatalf("request line %q parsed from %q", reqLine.GetRequestLine(), line)
+	}
+	reqLine.Reset()
+	if reqLine.maxLength != 0 {
+		t.Fatalf("max length should be cleared by reset")
+	}
+}
+
+func TestReqLineMalformed(t *testing.T) {
+	for _, line := range []string{"\r\n", "GET\r\n", "/ HTTP/1.1\r\n", " / HTTP/1.1\r\n", "GET /\r\n", "garbage\n"} {
+		reqLine := &RequestLine{}
+		if err := reqLine.Parse(bufio.NewReader(strings.NewReader(line))); err != ErrMalformedRequestLine {
+			t.Fatalf("unexpected error %v of %q, expecting %v", err, line, ErrMalformedRequestLine)
+		}
+	}
+}
@@ -18,17 +18,53 @@ func changeToUpperCase(s []byte) {
 	}
 }
 
-func changeToLowerCase(s []byte) {
-	for i, b := range s {
-		if 'A' <= b && b <= 'Z' {
-			b += 'a' - 'A'
-			s[i] = b
+func hasPrefixIgnoreCase(s, prefix []byte) bool {
+	return len(s) >= len(prefix) && equalIgnoreCase(s[0:len(prefix)], prefix)
+}
+
+// isHeaderNamed is the header line named exactly name ignoring case, i.e.
+// the name followed by optional whitespaces and the colon, so that neither
+// `Content-Length-Foo:` nor `X-Content-Length:` is named `Content-Length`
+func isHeaderNamed(header, name []byte) bool {
+	if !hasPrefixIgnoreCase(header, name) {
+		return false
+	}
+	for _, c := range header[len(name):] {
+		switch c {
+		case ':':
+			return true
+		case ' ', '\t':
+		default:
+			return false
 		}
 	}
+	return false
 }
 
-func hasPrefixIgnoreCase(s, prefix []byte) bool {
-	return len(s) >= len(prefix) && equalIgnoreCase(s[0:len(prefix)], prefix)
+// hasHeaderToken is token one of the comma separated header value tokens,
+// compared ignoring case byte by byte without allocating
+func hasHeaderToken(value, token []byte) bool {
+	for len(value) > 0 {
+		t := value
+		if i := bytes.IndexByte(value, ','); i >= 0 {
+			t, value = value[:i], value[i+1:]
+		} else {
+			value = nil
+		}
+		if equalIgnoreCase(bytes.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerLineValue the trimmed value following the colon of the header line
+func headerLineValue(header []byte) []byte {
+	i := bytes.IndexByte(header, ':')
+	if i < 0 {
+		return nil
+	}
+	return bytes.TrimSpace(header[i+1:])
 }
 
 // equalIgnoreCase better performance than bytes.EqualBold
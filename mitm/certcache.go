@@ -0,0 +1,214 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCertGenerationWindow is the time window MaxGenerations applied
+	// to when no GenerationWindow is set
+	DefaultCertGenerationWindow = time.Second
+
+	// leafCertRenewBefore a cached cert is signed again when it expires
+	// in this duration, so that no cert is expired during a handshake
+	leafCertRenewBefore = time.Hour
+)
+
+// ErrCertGenerationLimited is returned by CertCache when a new cert
+// is required beyond the generation limit of the current time window
+var ErrCertGenerationLimited = errors.New("fake server cert generation limited")
+
+// CertCache caches the fake server certificates signed by HijackTLSConnection,
+// so that the hosts hijacked again are served without signing new certs.
+//
+// Both the certs cached and the certs newly signed are limited, protecting
+// from the memory and CPU exhaustion caused by a flood of unique SNIs, e.g.
+// subdomain fuzzing. It is safe calling CertCache methods from concurrently
+// running go routines.
+type CertCache struct {
+	// MaxCerts max number of certs cached, the least recently used cert is
+	// evicted when exceeded.
+	//
+	// No cert is cached if not set, then only the generations are limited.
+	MaxCerts int
+
+	// MaxGenerations max number of certs newly signed in a GenerationWindow,
+	// ErrCertGenerationLimited is returned for the certs beyond.
+	//
+	// No limit if not set.
+	MaxGenerations int
+
+	// GenerationWindow the time window MaxGenerations applied to.
+	//
+	// DefaultCertGenerationWindow is used if not set.
+	GenerationWindow time.Duration
+
+	lock        sync.Mutex
+	certs       map[string]*list.Element
+	lru         list.List
+	windowStart time.Time
+	generations int
+	// reserved generations counted by Reserve of the certs not signed by Get yet
+	reserved map[string]int
+}
+
+type cachedCert struct {
+	key  string
+	cert *tls.Certificate
+}
+
+// Get returns the cert covering names signed by signer, the cached one
+// if any, otherwise a newly signed one unless the generation is limited.
+// The signer must be able to be told apart, see CheckCertSigner
+func (c *CertCache) Get(signer CertSigner, names []string) (*tls.Certificate, error) {
+	key, err := certCacheKey(signer, names)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	if cert := c.lookup(key); cert != nil {
+		c.lock.Unlock()
+		return cert, nil
+	}
+	available := c.generationAvailable()
+	if n := c.reserved[key]; n > 0 {
+		// counted as generation already by Reserve
+		if n == 1 {
+			delete(c.reserved, key)
+		} else {
+			c.reserved[key] = n - 1
+		}
+	} else if available {
+		c.generations++
+	} else {
+		c.lock.Unlock()
+		return nil, ErrCertGenerationLimited
+	}
+	c.lock.Unlock()
+
+	// sign outside the lock, which takes much longer than the lookup
+	cert, err := SignLeafCert(signer, names)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.add(key, cert)
+	c.lock.Unlock()
+	return cert, nil
+}
+
+// Available reports whether Get is able to return the cert covering names
+// signed by signer right now, i.e. the cert is cached or the generation
+// is not limited. Nothing is signed or counted as generation
+func (c *CertCache) Available(signer CertSigner, names []string) bool {
+	key, err := certCacheKey(signer, names)
+	if err != nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lookup(key) != nil || c.generationAvailable()
+}
+
+// Reserve reports whether Get is able to return the cert covering names
+// signed by signer, just like Available, except that the generation of the
+// cert not cached is counted right now and reserved for the following Get,
+// so that the concurrent calls never go beyond the generation limit between
+// Reserve and Get. The reservation not used is dropped with its window
+func (c *CertCache) Reserve(signer CertSigner, names []string) bool {
+	key, err := certCacheKey(signer, names)
+	if err != nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lookup(key) != nil || c.MaxGenerations <= 0 {
+		return true
+	}
+	if !c.generationAvailable() {
+		return false
+	}
+	c.generations++
+	if c.reserved == nil {
+		c.reserved = make(map[string]int)
+	}
+	c.reserved[key]++
+	return true
+}
+
+// Len number of certs cached
+func (c *CertCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// lookup returns the cached cert of key as the most recently used one,
+// the cert about to expire is removed and never returned
+func (c *CertCache) lookup(key string) *tls.Certificate {
+	e, ok := c.certs[key]
+	if !ok {
+		return nil
+	}
+	cert := e.Value.(*cachedCert).cert
+	if cert.Leaf == nil || time.Now().Add(leafCertRenewBefore).After(cert.Leaf.NotAfter) {
+		c.lru.Remove(e)
+		delete(c.certs, key)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return cert
+}
+
+// add caches cert of key, evicting the least recently used certs beyond MaxCerts
+func (c *CertCache) add(key string, cert *tls.Certificate) {
+	if c.MaxCerts <= 0 {
+		return
+	}
+	if c.certs == nil {
+		c.certs = make(map[string]*list.Element)
+	}
+	if e, ok := c.certs[key]; ok {
+		// signed concurrently by another go routine
+		e.Value.(*cachedCert).cert = cert
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.certs[key] = c.lru.PushFront(&cachedCert{key: key, cert: cert})
+	for c.lru.Len() > c.MaxCerts {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.certs, e.Value.(*cachedCert).key)
+	}
+}
+
+// generationAvailable is a new cert able to be signed in the current window
+func (c *CertCache) generationAvailable() bool {
+	if c.MaxGenerations <= 0 {
+		return true
+	}
+	window := c.GenerationWindow
+	if window <= 0 {
+		window = DefaultCertGenerationWindow
+	}
+	if now := time.Now(); now.Sub(c.windowStart) >= window {
+		c.windowStart = now
+		c.generations = 0
+		c.reserved = nil
+	}
+	return c.generations < c.MaxGenerations
+}
+
+// certCacheKey the cache key of the cert covering names signed by signer
+func certCacheKey(signer CertSigner, names []string) (string, error) {
+	signerKey, err := certSignerKey(signer)
+	if err != nil {
+		return "", err
+	}
+	return signerKey + "|" + strings.Join(names, ","), nil
+}
@@ -1,6 +1,7 @@
 package mitm
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -14,41 +15,127 @@ import (
 	"net"
 	"strings"
 	"time"
-
-	"github.com/haxii/fastproxy/util"
 )
 
 var (
 	errWrongDomain = errors.New("wrong domain")
+	errNoSNI       = errors.New("client didn't provide a target server name")
 )
 
+// HijackConfig settings of the fake TLS server made by HijackTLSConnection
+type HijackConfig struct {
+	// CertAuthority root certificate authority used to sign the fake server
+	// certificates, default MITM certificate authority is used if not set
+	CertAuthority *tls.Certificate
+
+	// CertSigner signs the fake server certificates instead of CertAuthority
+	// when set, e.g. by an HSM holding the certificate authority key
+	CertSigner CertSigner
+
+	// SessionTicketKeys shared session ticket keys which make the session
+	// resumption across connections available, see SessionTicketKeyRing.
+	// Session resumption is only available in the same connection if not set
+	SessionTicketKeys [][32]byte
+
+	// CertNamesFor returns the domain names the fake server certificate covers
+	// for the hijacked domain and client hello, the server name in client hello,
+	// or the hijacked domain if client sends no SNI, is used when nothing returned
+	CertNamesFor func(domainName string, hello *tls.ClientHelloInfo) []string
+
+	// RequireSNI fails the handshake when client sends no SNI, e.g. legacy
+	// clients or connections to IP literals, rather than falling back to the
+	// hijacked domain for both certificate and target server name
+	RequireSNI bool
+
+	// CertCache caches and limits the fake server certificates signed,
+	// every handshake signs a new certificate if not set
+	CertCache *CertCache
+
+	// CipherSuites the cipher suites of TLS 1.2 and below the fake server
+	// accepts, e.g. only the AEAD ones for compliance. TLS 1.3 suites are not
+	// configurable. Go's secure default cipher suites are used if not set
+	CipherSuites []uint16
+}
+
+// ReserveCert reports whether the fake server certificate for the hijacked
+// domain and the server name sent by client is able to be made by the
+// following HijackTLSConnection, i.e. it's cached or its generation is
+// reserved by CertCache, see CertCache.Reserve. Always true without CertCache
+func (config *HijackConfig) ReserveCert(domainName, serverName string) bool {
+	if config.CertCache == nil {
+		return true
+	}
+	hello := &tls.ClientHelloInfo{ServerName: serverName}
+	return config.CertCache.Reserve(config.certSigner(),
+		config.certNames(domainName, serverName, hello))
+}
+
+// certSigner the signer of the fake server certificates, see CertSigner
+func (config *HijackConfig) certSigner() CertSigner {
+	if config.CertSigner != nil {
+		return config.CertSigner
+	}
+	return CertAuthoritySigner{CertAuthority: config.CertAuthority}
+}
+
+// certNames the domain names the fake server certificate covers, see CertNamesFor
+func (config *HijackConfig) certNames(domainName, targetServerName string,
+	hello *tls.ClientHelloInfo) []string {
+	if config.CertNamesFor != nil {
+		if names := config.CertNamesFor(domainName, hello); len(names) > 0 {
+			return names
+		}
+	}
+	if len(targetServerName) == 0 {
+		return []string{domainName}
+	}
+	return []string{targetServerName}
+}
+
 // HijackTLSConnection hijacks the given TLS connection by setting up a fake TLS server using MITM
 // then return the fake server connection and the targetServerName ( a.k.a. server name declared in TLS
 // handshake if the clients support SNI see http://tools.ietf.org/html/rfc4366#section-3.1 )
+// config is the fake server settings, nil config means the default settings.
 // onHandshake is called before the fake server handshaking is made with the connection
-func HijackTLSConnection(certAuthority *tls.Certificate, c net.Conn, domainName string,
+func HijackTLSConnection(config *HijackConfig, c net.Conn, domainName string,
 	onHandshake func(error) error) (serverConn *tls.Conn, targetServerName string, err error) {
+	if config == nil {
+		config = &HijackConfig{}
+	}
 	targetServerName = domainName
-	if len(domainName) == 0 || strings.Contains(domainName, ":") {
+	// the IPv6 literals are covered by IP addresses of certs
+	if len(domainName) == 0 || (strings.Contains(domainName, ":") && net.ParseIP(domainName) == nil) {
 		err = onHandshake(errWrongDomain)
 		return
 	}
-	// make a cert for the provided domain
-	var fakeTargetServerCert *tls.Certificate
-	fakeTargetServerCert, err = SignLeafCertUsingCertAuthority(certAuthority, []string{domainName})
-	if err != nil {
-		err = onHandshake(err)
-		return
+	// make sure the cert authority is able to sign certs before handshaking
+	if config.CertSigner == nil {
+		if _, err = validCertAuthority(config.CertAuthority); err != nil {
+			err = onHandshake(err)
+			return
+		}
 	}
+	// certs are always made by GetCertificate, even if client sends no SNI
 	fakeTargetServerTLSConfig := &tls.Config{
-		Certificates: []tls.Certificate{*fakeTargetServerCert},
 		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			if len(hello.ServerName) > 0 {
 				targetServerName = hello.ServerName
+			} else if config.RequireSNI {
+				return nil, errNoSNI
 			}
-			return SignLeafCertUsingCertAuthority(certAuthority, []string{targetServerName})
+			certNames := config.certNames(domainName, targetServerName, hello)
+			if config.CertCache != nil {
+				return config.CertCache.Get(config.certSigner(), certNames)
+			}
+			return SignLeafCert(config.certSigner(), certNames)
 		},
 	}
+	if len(config.CipherSuites) > 0 {
+		fakeTargetServerTLSConfig.CipherSuites = config.CipherSuites
+	}
+	if len(config.SessionTicketKeys) > 0 {
+		fakeTargetServerTLSConfig.SetSessionTicketKeys(config.SessionTicketKeys)
+	}
 	// perform the fake handshake with the connection given
 	serverConn = tls.Server(c, fakeTargetServerTLSConfig)
 	if onHandshake != nil {
@@ -170,40 +257,28 @@ const (
 // certificate authority default MITM certificate is used when no cert authority provided
 func SignLeafCertUsingCertAuthority(certAuthority *tls.Certificate,
 	domainNames []string) (*tls.Certificate, error) {
+	return SignLeafCert(CertAuthoritySigner{CertAuthority: certAuthority}, domainNames)
+}
+
+// validCertAuthority returns the cert authority if it's able to sign leaf certs,
+// default MITM certificate is returned when no cert authority provided
+func validCertAuthority(certAuthority *tls.Certificate) (*tls.Certificate, error) {
 	if certAuthority == nil {
-		certAuthority = defaultMITMCertAuthority
+		return defaultMITMCertAuthority, nil
 	}
-	now := time.Now().Add(-1 * time.Hour).UTC()
-	if !certAuthority.Leaf.IsCA {
+	if certAuthority.Leaf == nil || !certAuthority.Leaf.IsCA {
 		return nil, errors.New("invalid certificate authority provided: not a CA")
 	}
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		return nil, util.ErrWrapper(err, "failed to generate serial number")
+	if _, ok := certAuthority.PrivateKey.(crypto.Signer); !ok {
+		return nil, errors.New("invalid certificate authority provided: no private key")
 	}
-	template := &x509.Certificate{
-		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{CommonName: domainNames[0]},
-		NotBefore:             now,
-		NotAfter:              now.Add(leafCertMaxAge),
-		KeyUsage:              leafCertUsage,
-		BasicConstraintsValid: true,
-		DNSNames:              domainNames,
-		SignatureAlgorithm:    x509.ECDSAWithSHA512,
-	}
-	key, err := genECDSAKeyPair()
-	if err != nil {
-		return nil, err
-	}
-	x, err := x509.CreateCertificate(rand.Reader, template,
-		certAuthority.Leaf, key.Public(), certAuthority.PrivateKey)
-	if err != nil {
-		return nil, err
-	}
-	cert := new(tls.Certificate)
-	cert.Certificate = append(cert.Certificate, x)
-	cert.PrivateKey = key
-	cert.Leaf, _ = x509.ParseCertificate(x)
-	return cert, nil
+	return certAuthority, nil
+}
+
+// CheckCertAuthority returns the error if the certificate authority is not
+// able to sign the fake server certificates, e.g. it's not a CA or has no
+// private key, nil cert authority means the default MITM certificate
+func CheckCertAuthority(certAuthority *tls.Certificate) error {
+	_, err := validCertAuthority(certAuthority)
+	return err
 }
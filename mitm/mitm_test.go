@@ -2,6 +2,7 @@ package mitm
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -169,6 +172,213 @@ func TestHijackTLSConnection(t *testing.T) {
 	}
 }
 
+// makeTestCertAuthority makes a new cert authority as well as the cert pool trusting it
+func makeTestCertAuthority(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	caCertPEM, caKeyPEM, err := MakeMITMCertAuthority("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+	rootCA := x509.NewCertPool()
+	rootCA.AppendCertsFromPEM(caCertPEM)
+	return &ca, rootCA
+}
+
+// hijackTestTLSConnection hijacks a connection to domainName using config,
+// then returns the fake server certificate got by client
+func hijackTestTLSConnection(config *HijackConfig, domainName string,
+	clientConfig *tls.Config) (*x509.Certificate, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer clientConn.Close()
+	serverConn, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		fakeConn, _, err := HijackTLSConnection(config, serverConn, domainName, nil)
+		if err == nil {
+			fakeConn.Close()
+		}
+		serverErr <- err
+	}()
+	tlsClientConn := tls.Client(clientConn, clientConfig)
+	if err := tlsClientConn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := <-serverErr; err != nil {
+		return nil, err
+	}
+	return tlsClientConn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestHijackTLSConnectionCertNames(t *testing.T) {
+	ca, _ := makeTestCertAuthority(t)
+	config := &HijackConfig{
+		CertAuthority: ca,
+		CertNamesFor: func(domainName string, hello *tls.ClientHelloInfo) []string {
+			if len(hello.ServerName) == 0 {
+				return nil
+			}
+			return []string{hello.ServerName, domainName}
+		},
+	}
+
+	// no SNI sent, falls back to the hijacked domain
+	cert, err := hijackTestTLSConnection(config, "localhost",
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "localhost" {
+		t.Fatalf("expected cert names [localhost], got %v", cert.DNSNames)
+	}
+
+	// SNI sent, both names are covered
+	cert, err = hijackTestTLSConnection(config, "localhost",
+		&tls.Config{InsecureSkipVerify: true, ServerName: "another-localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 2 || cert.DNSNames[0] != "another-localhost" ||
+		cert.DNSNames[1] != "localhost" {
+		t.Fatalf("expected cert names [another-localhost localhost], got %v", cert.DNSNames)
+	}
+}
+
+func TestHijackTLSConnectionWithoutSNI(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	// go client sends no SNI for IP literals
+	clientConfig := &tls.Config{RootCAs: rootCA, ServerName: "127.0.0.1"}
+	cert, err := hijackTestTLSConnection(&HijackConfig{CertAuthority: ca}, "127.0.0.1", clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("expected cert ip addresses [127.0.0.1], got %v", cert.IPAddresses)
+	}
+	cert, err = hijackTestTLSConnection(&HijackConfig{CertAuthority: ca}, "2001:db8::1",
+		&tls.Config{RootCAs: rootCA, ServerName: "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected cert ip addresses [2001:db8::1], got %v", cert.IPAddresses)
+	}
+
+	if _, err := hijackTestTLSConnection(&HijackConfig{CertAuthority: ca, RequireSNI: true},
+		"127.0.0.1", clientConfig); err == nil {
+		t.Fatal("expected error when SNI is required")
+	}
+}
+
+func TestHijackTLSConnectionSessionResumption(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	clientConfig := &tls.Config{
+		RootCAs:            rootCA,
+		ServerName:         "localhost",
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	var keyRing SessionTicketKeyRing
+	handshake := func() (bool, error) {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		serverErr := make(chan error, 1)
+		go func() {
+			defer serverConn.Close()
+			keys, err := keyRing.Keys()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			fakeConn, _, err := HijackTLSConnection(&HijackConfig{
+				CertAuthority:     ca,
+				SessionTicketKeys: keys,
+			}, serverConn, "localhost", nil)
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			defer fakeConn.Close()
+			_, err = fakeConn.Write(fakeServerMessage)
+			serverErr <- err
+		}()
+		tlsClientConn := tls.Client(clientConn, clientConfig)
+		if err := tlsClientConn.Handshake(); err != nil {
+			return false, err
+		}
+		// read the message to make sure the session ticket is received
+		msg, err := ioutil.ReadAll(tlsClientConn)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(fakeServerMessage, msg) {
+			return false, fmt.Errorf("expected %s, got %s", fakeServerMessage, msg)
+		}
+		if err := <-serverErr; err != nil {
+			return false, err
+		}
+		return tlsClientConn.ConnectionState().DidResume, nil
+	}
+
+	if resumed, err := handshake(); err != nil {
+		t.Fatal(err)
+	} else if resumed {
+		t.Fatal("first handshake should not be resumed")
+	}
+	if resumed, err := handshake(); err != nil {
+		t.Fatal(err)
+	} else if !resumed {
+		t.Fatal("second handshake should be resumed")
+	}
+}
+
+func TestSessionTicketKeyRing(t *testing.T) {
+	keyRing := SessionTicketKeyRing{RotateInterval: time.Millisecond}
+	keys1, err := keyRing.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys1) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys1))
+	}
+	time.Sleep(2 * time.Millisecond)
+	keys2, err := keyRing.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys2) != 2 || keys2[0] == keys1[0] || keys2[1] != keys1[0] {
+		t.Fatal("expected a new key rotated in front of the old one")
+	}
+
+	fixedKey := [32]byte{1}
+	keyRing.SetKeys([][32]byte{fixedKey})
+	time.Sleep(2 * time.Millisecond)
+	keys3, err := keyRing.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys3) != 1 || keys3[0] != fixedKey {
+		t.Fatal("expected the fixed key without rotation")
+	}
+}
+
 // spellcheck-off
 var (
 	realServerCertPEM = []byte(`
@@ -222,3 +432,280 @@ WZoEro0kBysFz36m27Pa32CMlWZhkD8gdi7gC2bJA8fM1dTU9GUJiQ==
 -----END RSA PRIVATE KEY-----
 `)
 )
+
+func TestCertCacheFloodOfUniqueNames(t *testing.T) {
+	certAuthority, _ := makeTestCertAuthority(t)
+	ca := CertAuthoritySigner{CertAuthority: certAuthority}
+	cache := &CertCache{MaxCerts: 10, MaxGenerations: 30, GenerationWindow: time.Hour}
+	signed := 0
+	for i := 0; i < 100; i++ {
+		_, err := cache.Get(ca, []string{fmt.Sprintf("fuzz%d.example.com", i)})
+		if err == ErrCertGenerationLimited {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed++
+		if cache.Len() > 10 {
+			t.Fatalf("expected at most 10 certs cached, got %d", cache.Len())
+		}
+	}
+	if signed != 30 {
+		t.Fatalf("expected 30 certs signed in window, got %d", signed)
+	}
+	if cache.Len() != 10 {
+		t.Fatalf("expected 10 certs cached, got %d", cache.Len())
+	}
+	// the most recently signed certs are still served beyond the limit
+	if !cache.Available(ca, []string{"fuzz29.example.com"}) {
+		t.Fatal("cached cert should be available")
+	}
+	if _, err := cache.Get(ca, []string{"fuzz29.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Available(ca, []string{"fuzz0.example.com"}) {
+		t.Fatal("evicted cert should not be available beyond the limit")
+	}
+}
+
+func TestCertCacheLRU(t *testing.T) {
+	certAuthority, _ := makeTestCertAuthority(t)
+	ca := CertAuthoritySigner{CertAuthority: certAuthority}
+	cache := &CertCache{MaxCerts: 2, MaxGenerations: 3, GenerationWindow: time.Hour}
+	a, err := cache.Get(ca, []string{"a.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Get(ca, []string{"b.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// a is used again, so b is the least recently used one
+	if cert, err := cache.Get(ca, []string{"a.example.com"}); err != nil || cert != a {
+		t.Fatalf("expected the cached cert, got error %v", err)
+	}
+	if _, err = cache.Get(ca, []string{"c.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.Available(ca, []string{"a.example.com"}) {
+		t.Fatal("recently used cert should be cached")
+	}
+	if _, err = cache.Get(ca, []string{"b.example.com"}); err != ErrCertGenerationLimited {
+		t.Fatalf("expected b evicted and generation limited, got error %v", err)
+	}
+
+	// the certs signed by another authority are cached separately
+	anotherAuthority, _ := makeTestCertAuthority(t)
+	another := CertAuthoritySigner{CertAuthority: anotherAuthority}
+	if cache.Available(another, []string{"a.example.com"}) {
+		t.Fatal("cert of another authority should not be cached")
+	}
+}
+
+func TestCertCacheReserve(t *testing.T) {
+	certAuthority, _ := makeTestCertAuthority(t)
+	ca := CertAuthoritySigner{CertAuthority: certAuthority}
+	cache := &CertCache{MaxCerts: 10, MaxGenerations: 3, GenerationWindow: time.Hour}
+
+	// the concurrent reservations never go beyond the limit, and the
+	// certs reserved are always signed by Get
+	var wg sync.WaitGroup
+	var reserved, signed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(names []string) {
+			defer wg.Done()
+			if !cache.Reserve(ca, names) {
+				return
+			}
+			atomic.AddInt32(&reserved, 1)
+			if _, err := cache.Get(ca, names); err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			atomic.AddInt32(&signed, 1)
+		}([]string{fmt.Sprintf("fuzz%d.example.com", i)})
+	}
+	wg.Wait()
+	if reserved != 3 || signed != 3 {
+		t.Fatalf("expected 3 certs reserved and signed, got %d and %d", reserved, signed)
+	}
+	if cache.Len() != 3 {
+		t.Fatalf("expected 3 certs cached, got %d", cache.Len())
+	}
+	if cache.Reserve(ca, []string{"another.example.com"}) {
+		t.Fatal("cert should not be reserved beyond the generation limit")
+	}
+}
+
+func TestHijackTLSConnectionCertCache(t *testing.T) {
+	ca, _ := makeTestCertAuthority(t)
+	config := &HijackConfig{
+		CertAuthority: ca,
+		CertCache:     &CertCache{MaxCerts: 10, MaxGenerations: 1, GenerationWindow: time.Hour},
+	}
+	if !config.ReserveCert("localhost", "") {
+		t.Fatal("cert should be reserved before signed")
+	}
+	cert1, err := hijackTestTLSConnection(config, "localhost", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert2, err := hijackTestTLSConnection(config, "localhost", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert1.Equal(cert2) {
+		t.Fatal("expected the cached cert for the same host")
+	}
+	if config.ReserveCert("localhost", "another-localhost") {
+		t.Fatal("cert should not be reserved beyond the generation limit")
+	}
+	if _, err := hijackTestTLSConnection(config, "localhost",
+		&tls.Config{InsecureSkipVerify: true, ServerName: "another-localhost"}); err == nil {
+		t.Fatal("expected handshake error beyond the generation limit")
+	}
+}
+
+func TestHijackTLSConnectionCipherSuites(t *testing.T) {
+	ca, _ := makeTestCertAuthority(t)
+	config := &HijackConfig{
+		CertAuthority: ca,
+		CipherSuites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	// suites are only configurable up to TLS 1.2
+	if _, err := hijackTestTLSConnection(config, "localhost", &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hijackTestTLSConnection(config, "localhost", &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	}); err == nil {
+		t.Fatal("expected handshake error when client offers only the suites excluded")
+	}
+}
+
+func TestCheckCertAuthority(t *testing.T) {
+	if err := CheckCertAuthority(nil); err != nil {
+		t.Fatalf("expected the default cert authority valid, got %s", err)
+	}
+	ca, _ := makeTestCertAuthority(t)
+	if err := CheckCertAuthority(ca); err != nil {
+		t.Fatal(err)
+	}
+	withoutKey := &tls.Certificate{Certificate: ca.Certificate, Leaf: ca.Leaf}
+	if err := CheckCertAuthority(withoutKey); err == nil {
+		t.Fatal("expected error for cert authority without private key")
+	}
+	leaf, err := SignLeafCertUsingCertAuthority(ca, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCertAuthority(leaf); err == nil {
+		t.Fatal("expected error for a leaf certificate")
+	}
+}
+
+// recordingSigner signs as CertAuthoritySigner, recording the names signed
+type recordingSigner struct {
+	CertAuthoritySigner
+	lock  sync.Mutex
+	names [][]string
+}
+
+func (s *recordingSigner) SignLeafCert(domainNames []string,
+	publicKey crypto.PublicKey) ([]byte, error) {
+	s.lock.Lock()
+	s.names = append(s.names, domainNames)
+	s.lock.Unlock()
+	return s.CertAuthoritySigner.SignLeafCert(domainNames, publicKey)
+}
+
+func TestHijackTLSConnectionCertSigner(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	signer := &recordingSigner{CertAuthoritySigner: CertAuthoritySigner{CertAuthority: ca}}
+	config := &HijackConfig{
+		// the cert authority without private key is never used to sign
+		CertAuthority: &tls.Certificate{Certificate: ca.Certificate, Leaf: ca.Leaf},
+		CertSigner:    signer,
+		CertCache:     &CertCache{MaxCerts: 10},
+	}
+	for i := 0; i < 2; i++ {
+		cert, err := hijackTestTLSConnection(config, "signer.example.com", &tls.Config{
+			RootCAs:    rootCA,
+			ServerName: "signer.example.com",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Subject.CommonName != "signer.example.com" {
+			t.Fatalf("unexpected cert common name %s", cert.Subject.CommonName)
+		}
+	}
+	// signed once, the cert is cached for the second handshake
+	if len(signer.names) != 1 || len(signer.names[0]) != 1 ||
+		signer.names[0][0] != "signer.example.com" {
+		t.Fatalf("unexpected names signed %v", signer.names)
+	}
+}
+
+// valueSigner a signer of non-pointer type
+type valueSigner struct {
+	CertAuthority *tls.Certificate
+}
+
+func (s valueSigner) SignLeafCert(domainNames []string, publicKey crypto.PublicKey) ([]byte, error) {
+	return CertAuthoritySigner{CertAuthority: s.CertAuthority}.SignLeafCert(domainNames, publicKey)
+}
+
+// keyedSigner a signer of non-pointer type told apart by key
+type keyedSigner struct {
+	valueSigner
+	key string
+}
+
+func (s keyedSigner) SignerKey() string {
+	return s.key
+}
+
+func TestCertCacheSignerKey(t *testing.T) {
+	certAuthority, _ := makeTestCertAuthority(t)
+	cache := &CertCache{MaxCerts: 10}
+	names := []string{"a.example.com"}
+
+	// the signers of non-pointer types are unable to be told apart
+	unkeyed := valueSigner{CertAuthority: certAuthority}
+	if err := CheckCertSigner(unkeyed); err == nil {
+		t.Fatal("expected error of the signer of non-pointer type")
+	}
+	if _, err := cache.Get(unkeyed, names); err == nil {
+		t.Fatal("expected error caching the certs of the signer of non-pointer type")
+	}
+	if cache.Reserve(unkeyed, names) {
+		t.Fatal("expected the certs of the signer of non-pointer type never reserved")
+	}
+	if err := CheckCertSigner(&unkeyed); err != nil {
+		t.Fatalf("unexpected error of the pointer signer: %s", err)
+	}
+
+	// the signers of the same key share the certs cached
+	signer := keyedSigner{valueSigner: unkeyed, key: "a"}
+	if err := CheckCertSigner(signer); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert, err := cache.Get(signer, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := cache.Get(keyedSigner{valueSigner: unkeyed, key: "a"}, names); err != nil || cached != cert {
+		t.Fatalf("expected the cert cached of the same key, got error %v", err)
+	}
+	if another, err := cache.Get(keyedSigner{valueSigner: unkeyed, key: "b"}, names); err != nil || another == cert {
+		t.Fatalf("expected a new cert of another key, got error %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/haxii/fastproxy/util"
+)
+
+// CertSigner signs the fake server certificates, e.g. by an HSM or a remote
+// signing service holding the certificate authority key rather than in-process.
+//
+// The certs cached by CertCache are told apart by the signer identity, so
+// the signer must be a pointer unless it's a KeyedCertSigner.
+type CertSigner interface {
+	// SignLeafCert returns the DER encoded leaf certificate covering
+	// domainNames for the public key of the fake server
+	SignLeafCert(domainNames []string, publicKey crypto.PublicKey) ([]byte, error)
+}
+
+// KeyedCertSigner a CertSigner told apart from the others by SignerKey rather
+// than its identity, e.g. a signer of non-pointer type
+type KeyedCertSigner interface {
+	CertSigner
+
+	// SignerKey identifies the signer, the signers of the same key are
+	// assumed signing by the same certificate authority
+	SignerKey() string
+}
+
+var errCertSignerNotKeyed = errors.New("cert signer neither a pointer nor a KeyedCertSigner")
+
+// CertAuthoritySigner signs the fake server certificates using the local
+// certificate authority, default MITM certificate is used if not set
+type CertAuthoritySigner struct {
+	CertAuthority *tls.Certificate
+}
+
+// SignLeafCert signs the leaf certificate covering domainNames, the IP
+// literals are covered by IP addresses rather than DNS names
+func (s CertAuthoritySigner) SignLeafCert(domainNames []string,
+	publicKey crypto.PublicKey) ([]byte, error) {
+	if len(domainNames) == 0 {
+		return nil, errWrongDomain
+	}
+	certAuthority, err := validCertAuthority(s.CertAuthority)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Add(-1 * time.Hour).UTC()
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, util.ErrWrapper(err, "failed to generate serial number")
+	}
+	var dnsNames []string
+	var ipAddresses []net.IP
+	for _, name := range domainNames {
+		if ip := net.ParseIP(name); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: domainNames[0]},
+		NotBefore:             now,
+		NotAfter:              now.Add(leafCertMaxAge),
+		KeyUsage:              leafCertUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ipAddresses,
+		SignatureAlgorithm:    x509.ECDSAWithSHA512,
+	}
+	return x509.CreateCertificate(rand.Reader, template,
+		certAuthority.Leaf, publicKey, certAuthority.PrivateKey)
+}
+
+// SignLeafCert makes the fake server certificate covering domainNames, whose
+// key pair is generated in-process, while the certificate is signed by signer
+func SignLeafCert(signer CertSigner, domainNames []string) (*tls.Certificate, error) {
+	if len(domainNames) == 0 {
+		return nil, errWrongDomain
+	}
+	key, err := genECDSAKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	x, err := signer.SignLeafCert(domainNames, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	cert := new(tls.Certificate)
+	cert.Certificate = append(cert.Certificate, x)
+	cert.PrivateKey = key
+	if cert.Leaf, err = x509.ParseCertificate(x); err != nil {
+		return nil, util.ErrWrapper(err, "invalid leaf certificate signed")
+	}
+	return cert, nil
+}
+
+// CheckCertSigner checks whether signer is able to be told apart by CertCache,
+// i.e. a CertAuthoritySigner, a KeyedCertSigner or a pointer
+func CheckCertSigner(signer CertSigner) error {
+	_, err := certSignerKey(signer)
+	return err
+}
+
+// certSignerKey tells the signers apart, by the certificate authority for
+// CertAuthoritySigner, by SignerKey for KeyedCertSigner, by the identity for
+// the other pointers. The other signers are unable to be told apart.
+func certSignerKey(signer CertSigner) (string, error) {
+	switch s := signer.(type) {
+	case CertAuthoritySigner:
+		return fmt.Sprintf("%p", s.CertAuthority), nil
+	case KeyedCertSigner:
+		return "key|" + s.SignerKey(), nil
+	}
+	if reflect.ValueOf(signer).Kind() != reflect.Ptr {
+		return "", errCertSignerNotKeyed
+	}
+	return fmt.Sprintf("%T|%p", signer, signer), nil
+}
@@ -0,0 +1,77 @@
+package mitm
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionTicketKeyRotateInterval is the duration before a new
+	// session ticket key is generated when no RotateInterval is set
+	DefaultSessionTicketKeyRotateInterval = 24 * time.Hour
+
+	// maxSessionTicketKeys is the number of keys kept in key ring, the
+	// rotated out keys are still able to decrypt the tickets issued before
+	maxSessionTicketKeys = 3
+)
+
+// SessionTicketKeyRing holds the session ticket keys shared by every fake TLS
+// server, so that a client reconnecting to a hijacked host can resume its
+// previous session rather than making a full handshake.
+//
+// Keys are generated and rotated automatically unless they are provided with
+// SetKeys. It is safe calling SessionTicketKeyRing methods from concurrently
+// running go routines.
+type SessionTicketKeyRing struct {
+	// RotateInterval duration before a new session ticket key is generated.
+	//
+	// DefaultSessionTicketKeyRotateInterval is used if not set.
+	RotateInterval time.Duration
+
+	lock        sync.Mutex
+	keys        [][32]byte
+	rotatedTime time.Time
+	fixed       bool
+}
+
+// SetKeys sets the session ticket keys and stops the auto rotation, the first
+// key is used for ticket encryption while all of them are tried for decryption.
+// Providing no keys resumes the auto rotation.
+func (r *SessionTicketKeyRing) SetKeys(keys [][32]byte) {
+	r.lock.Lock()
+	r.keys = append(r.keys[:0:0], keys...)
+	r.fixed = len(keys) > 0
+	r.lock.Unlock()
+}
+
+// Keys returns the current session ticket keys, a new key is generated
+// when the last one is older than RotateInterval
+func (r *SessionTicketKeyRing) Keys() ([][32]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fixed {
+		return r.keys, nil
+	}
+	rotateInterval := r.RotateInterval
+	if rotateInterval <= 0 {
+		rotateInterval = DefaultSessionTicketKeyRotateInterval
+	}
+	if len(r.keys) > 0 && time.Since(r.rotatedTime) < rotateInterval {
+		return r.keys, nil
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	// always make a new slice, since the old one may still be in use
+	keys := make([][32]byte, 0, maxSessionTicketKeys)
+	keys = append(keys, key)
+	for i := 0; i < len(r.keys) && len(keys) < maxSessionTicketKeys; i++ {
+		keys = append(keys, r.keys[i])
+	}
+	r.keys = keys
+	r.rotatedTime = time.Now()
+	return r.keys, nil
+}
@@ -0,0 +1,95 @@
+// Package pac serves the proxy auto-config (PAC) file directing the clients
+// to the super proxies
+package pac
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+// ContentType the MIME type of PAC file
+const ContentType = "application/x-ns-proxy-autoconfig"
+
+// Handler serves a PAC file with the FindProxyForURL function generated
+// from the super proxies, mount it on an endpoint like `/proxy.pac`.
+//
+// The script is generated on every request, so it always reflects
+// the current super proxies, e.g. of a StickyBalancer.
+type Handler struct {
+	// Proxies returns the super proxies tried by the clients in order,
+	// e.g. StickyBalancer.Proxies. The clients connect directly if not set
+	// or no super proxies returned
+	Proxies func() []*superproxy.SuperProxy
+
+	// BypassHosts host patterns connected directly, matched by shExpMatch,
+	// e.g. `*.local` or `10.*`
+	BypassHosts []string
+
+	// FallbackDirect lets the clients connect directly when all super proxies fail
+	FallbackDirect bool
+}
+
+// ServeHTTP serves the PAC file
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	script := h.Script()
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(script)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(script)
+}
+
+// Script generates the PAC file script
+func (h *Handler) Script() []byte {
+	var b bytes.Buffer
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, pattern := range h.BypassHosts {
+		fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) {\n\t\treturn \"DIRECT\";\n\t}\n",
+			strconv.Quote(pattern))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", strconv.Quote(h.proxyList()))
+	return b.Bytes()
+}
+
+// proxyList makes the proxy list returned by FindProxyForURL,
+// e.g. `PROXY 10.0.0.1:3128; SOCKS5 10.0.0.2:1080; DIRECT`
+func (h *Handler) proxyList() string {
+	var proxies []*superproxy.SuperProxy
+	if h.Proxies != nil {
+		proxies = h.Proxies()
+	}
+	var b bytes.Buffer
+	for _, p := range proxies {
+		if b.Len() > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(proxyKeyword(p.GetProxyType()))
+		b.WriteByte(' ')
+		b.WriteString(p.HostWithPort())
+	}
+	if b.Len() == 0 {
+		return "DIRECT"
+	}
+	if h.FallbackDirect {
+		b.WriteString("; DIRECT")
+	}
+	return b.String()
+}
+
+// proxyKeyword the PAC keyword of the super proxy type
+func proxyKeyword(proxyType superproxy.ProxyType) string {
+	switch proxyType {
+	case superproxy.ProxyTypeHTTPS:
+		return "HTTPS"
+	case superproxy.ProxyTypeSOCKS5:
+		return "SOCKS5"
+	default:
+		return "PROXY"
+	}
+}
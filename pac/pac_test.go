@@ -0,0 +1,75 @@
+package pac
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestHandler(t *testing.T) {
+	httpProxy, err := superproxy.NewSuperProxy("10.0.0.1", 3128, superproxy.ProxyTypeHTTP, "user", "pass", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	socksProxy, err := superproxy.NewSuperProxy("10.0.0.2", 1080, superproxy.ProxyTypeSOCKS5, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	balancer := superproxy.NewStickyBalancer(0, httpProxy, socksProxy)
+	h := &Handler{
+		Proxies:        balancer.Proxies,
+		BypassHosts:    []string{"*.local"},
+		FallbackDirect: true,
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	script := testFetchPAC(t, server.URL+"/proxy.pac")
+	if !strings.Contains(script, "function FindProxyForURL(url, host)") {
+		t.Fatalf("expected FindProxyForURL defined, got %s", script)
+	}
+	if !strings.Contains(script, `return "PROXY 10.0.0.1:3128; SOCKS5 10.0.0.2:1080; DIRECT";`) {
+		t.Fatalf("expected the super proxies returned, got %s", script)
+	}
+	if !strings.Contains(script, `shExpMatch(host, "*.local")`) {
+		t.Fatalf("expected the bypass hosts matched, got %s", script)
+	}
+	if strings.Contains(script, "pass") {
+		t.Fatalf("expected no credentials in the script, got %s", script)
+	}
+
+	// the super proxy removed is no longer returned
+	balancer.Remove(httpProxy)
+	script = testFetchPAC(t, server.URL+"/proxy.pac")
+	if !strings.Contains(script, `return "SOCKS5 10.0.0.2:1080; DIRECT";`) {
+		t.Fatalf("expected the super proxy removed, got %s", script)
+	}
+	balancer.Remove(socksProxy)
+	script = testFetchPAC(t, server.URL+"/proxy.pac")
+	if !strings.Contains(script, `return "DIRECT";`) {
+		t.Fatalf("expected direct connection without super proxies, got %s", script)
+	}
+}
+
+func testFetchPAC(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		t.Fatalf("expected content type %s, got %s", ContentType, ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return string(body)
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// DefaultAuditRedactHeaders headers redacted by Handler.AuditLog
+// when Handler.AuditRedactHeaders not set
+var DefaultAuditRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// AuditRedacted the value of the headers redacted in AuditRecord
+const AuditRedacted = "[REDACTED]"
+
+// AuditHeader a header line recorded by Handler.AuditLog
+type AuditHeader struct {
+	Name  string
+	Value string
+}
+
+// AuditRecord the audit record of an http request forwarded,
+// see Handler.AuditLog
+type AuditRecord struct {
+	// RequestID unique ID of the request
+	RequestID string
+	// ClientAddr address of the client sending the request
+	ClientAddr net.Addr
+	// Host target host with port
+	Host string
+
+	// RequestLine the request line from the client, without the CRLF, see
+	// Handler.AuditRedactRequestLine
+	RequestLine string
+	// StatusLine the raw status line from the target host, without the CRLF,
+	// empty if no response read from it, e.g. failed to forward the request
+	// or the response hijacked
+	StatusLine string
+
+	// RequestHeaders the request headers in Handler.AuditHeaders, in order
+	RequestHeaders []AuditHeader
+	// ResponseHeaders the response headers in Handler.AuditHeaders, in order
+	ResponseHeaders []AuditHeader
+}
+
+// auditHijacker records the request and response of an audit record,
+// while the traffic is still given to the hijacker wrapped
+type auditHijacker struct {
+	Hijacker
+	record  *AuditRecord
+	headers []string
+	redact  []string
+}
+
+func (h *auditHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	h.record.RequestHeaders = h.auditHeaders(rawHeader)
+	return h.Hijacker.OnRequest(header, rawHeader)
+}
+
+func (h *auditHijacker) OnResponse(statusLine http.ResponseLine,
+	header http.Header, rawHeader []byte) io.Writer {
+	h.record.StatusLine = string(trimCRLF(statusLine.GetResponseLine()))
+	h.record.ResponseHeaders = h.auditHeaders(rawHeader)
+	return h.Hijacker.OnResponse(statusLine, header, rawHeader)
+}
+
+// auditHeaders the header lines named in headers, redacted if named in redact
+func (h *auditHijacker) auditHeaders(rawHeader []byte) []AuditHeader {
+	var headers []AuditHeader
+	for len(rawHeader) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(rawHeader, '\n'); i >= 0 {
+			line, rawHeader = rawHeader[:i+1], rawHeader[i+1:]
+		} else {
+			line, rawHeader = rawHeader, nil
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		name := string(bytes.TrimSpace(line[:colon]))
+		if !containsFold(h.headers, name) {
+			continue
+		}
+		value := string(bytes.TrimSpace(line[colon+1:]))
+		if containsFold(h.redact, name) {
+			value = AuditRedacted
+		}
+		headers = append(headers, AuditHeader{Name: name, Value: value})
+	}
+	return headers
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func trimCRLF(line []byte) []byte {
+	return bytes.TrimRight(line, "\r\n")
+}
+
+// redactRequestLine the request line with the userinfo and the query, as
+// well as the fragment following, of the request target redacted, which
+// could carry the credentials or tokens
+func redactRequestLine(line []byte) string {
+	start := bytes.IndexByte(line, ' ')
+	end := bytes.LastIndexByte(line, ' ')
+	if start < 0 || end <= start {
+		return string(line)
+	}
+	target := line[start+1 : end]
+	redacted := make([]byte, 0, len(line))
+	redacted = append(redacted, line[:start+1]...)
+	if i := bytes.IndexAny(target, "?#"); i >= 0 {
+		target = append(target[:i+1:i+1], AuditRedacted...)
+	}
+	if i := bytes.Index(target, []byte("://")); i >= 0 {
+		authority := target[i+3:]
+		if j := bytes.IndexAny(authority, "/?#"); j >= 0 {
+			authority = authority[:j]
+		}
+		if at := bytes.LastIndexByte(authority, '@'); at >= 0 {
+			redacted = append(redacted, target[:i+3]...)
+			redacted = append(redacted, AuditRedacted...)
+			target = target[i+3+at:]
+		}
+	}
+	redacted = append(redacted, target...)
+	redacted = append(redacted, line[end:]...)
+	return string(redacted)
+}
+
+// auditHijacker wraps hijacker recording the audit record of req,
+// which is logged by Handler.AuditLog once the request forwarded
+func (p *Proxy) auditHijacker(c net.Conn, req *Request, hijacker Hijacker) (Hijacker, *AuditRecord) {
+	record := &AuditRecord{
+		RequestID:   req.ID(),
+		ClientAddr:  c.RemoteAddr(),
+		Host:        req.reqLine.HostInfo().HostWithPort(),
+		RequestLine: string(trimCRLF(req.reqLine.GetRequestLine())),
+	}
+	if p.Handler.AuditRedactRequestLine {
+		record.RequestLine = redactRequestLine(trimCRLF(req.reqLine.GetRequestLine()))
+	}
+	redact := p.Handler.AuditRedactHeaders
+	if redact == nil {
+		redact = DefaultAuditRedactHeaders
+	}
+	return &auditHijacker{
+		Hijacker: hijacker,
+		record:   record,
+		headers:  p.Handler.AuditHeaders,
+		redact:   redact,
+	}, record
+}
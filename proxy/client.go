@@ -4,10 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/servertime"
 	"github.com/haxii/fastproxy/superproxy"
 	"github.com/haxii/fastproxy/util"
 )
@@ -78,6 +86,29 @@ type Request struct {
 	isTLS         bool
 	tlsServerName string
 
+	// via hop appended to the Via header, nil means Via header untouched
+	via []byte
+
+	// options forwarding the request, nil means the proxy's settings
+	options *client.RequestOptions
+
+	// id unique request ID, injected as X-Request-Id header if injectID is set
+	id       string
+	injectID bool
+
+	// forwarded element added as a Forwarded header, empty means none
+	forwarded string
+
+	// closeConnection the client connection should be closed after the
+	// response written, e.g. the response body is delimited by the close
+	closeConnection bool
+
+	// drainLimit max size of the body drained by WriteBodyTo, which is
+	// discarded for a hijacked response, the body exceeding it is left
+	// unread and the client connection closed. Zero means no limit,
+	// negative means nothing drained.
+	drainLimit int
+
 	// userdata
 	userdata *UserData
 }
@@ -87,13 +118,21 @@ func (r *Request) Reset() {
 	r.reader = nil
 	r.reqLine.Reset()
 	r.header.Reset()
-	if r.userdata != nil {
-		r.userdata.Reset()
-	}
+	r.body.Reset()
+	// pooled separately, never aliased by the request reused
+	r.userdata = nil
 	r.hijacker = nil
+	r.hijackerBodyWriter = nil
 	r.proxy = nil
 	r.isTLS = false
 	r.tlsServerName = ""
+	r.via = nil
+	r.options = nil
+	r.id = ""
+	r.injectID = false
+	r.forwarded = ""
+	r.closeConnection = false
+	r.drainLimit = 0
 }
 
 // parseStartLine inits request with provided reader
@@ -108,9 +147,12 @@ func (r *Request) parseStartLine(reader *bufio.Reader) (int, error) {
 		return rn, errors.New("nil reader provided")
 	}
 	if err := r.reqLine.Parse(reader); err != nil {
-		if err == io.EOF {
+		if err == io.EOF || err == http.ErrRequestLineTooLong {
 			return rn, err
 		}
+		if err == http.ErrMalformedRequestLine {
+			return rn, errMalformedRequestLine
+		}
 		return rn, util.ErrWrapper(err, "fail to read start line of request")
 	}
 	rn += len(r.reqLine.GetRequestLine())
@@ -119,6 +161,68 @@ func (r *Request) parseStartLine(reader *bufio.Reader) (int, error) {
 	return rn, nil
 }
 
+// peekHeader parses the request headers and returns the raw header
+// without consuming it, the header is still written by WriteHeaderTo.
+// The request body transfer-encoded but not chunked finally is malformed,
+// since its length can't be determined, see RFC 7230 3.3.3
+func (r *Request) peekHeader() ([]byte, error) {
+	if r.reader == nil {
+		return nil, errors.New("Empty request, nothing to read")
+	}
+	n, err := r.header.ParseHeaderFields(r.reader)
+	if err != nil {
+		if isHeaderLimitExceeded(err) {
+			return nil, errRequestHeaderTooLarge
+		}
+		if err == http.ErrMalformedHeader {
+			return nil, errMalformedRequestHeader
+		}
+		return nil, util.ErrWrapper(err, "fail to parse http headers")
+	}
+	if r.header.BodyType() == http.BodyTypeIdentity {
+		return nil, errMalformedRequestHeader
+	}
+	return r.header.PeekRaw(r.reader, n)
+}
+
+// discardHeader parses and consumes the request headers,
+// used when the headers are not forwarded, e.g. a CONNECT request
+func (r *Request) discardHeader() (int, error) {
+	if r.reader == nil {
+		return 0, errors.New("Empty request, nothing to read")
+	}
+	n, err := r.header.ParseHeaderFields(r.reader)
+	if err != nil {
+		return n, util.ErrWrapper(err, "fail to parse http headers")
+	}
+	return r.header.DiscardRaw(r.reader, n)
+}
+
+// peekBody returns the request body of Content-Length no more than max
+// following the header of length headerLen parsed by peekHeader, without
+// consuming it. Nil returned when the body is chunked, larger than max or
+// the reader's buffer, or expected to be sent after 100 Continue
+func (r *Request) peekBody(headerLen, max int) ([]byte, error) {
+	if r.header.BodyType() != http.BodyTypeFixedSize || r.header.IsExpectContinue() {
+		return nil, nil
+	}
+	size := r.header.ContentLength()
+	if size <= 0 || size > int64(max) {
+		return nil, nil
+	}
+	body, err := r.header.PeekBody(r.reader, headerLen, int(size))
+	if err == bufio.ErrBufferFull {
+		// streamed without peeking
+		return nil, nil
+	}
+	return body, err
+}
+
+// ID unique ID of this request
+func (r *Request) ID() string {
+	return r.id
+}
+
 // SetTLS set request as TLS
 func (r *Request) SetTLS(tlsServerName string) {
 	r.isTLS = true
@@ -135,6 +239,22 @@ func (r *Request) SetProxy(p *superproxy.SuperProxy) {
 	r.proxy = p
 }
 
+// SetVia set the hop appended to the Via header of this request
+func (r *Request) SetVia(via []byte) {
+	r.via = via
+}
+
+// SetOptions set the options forwarding this request
+func (r *Request) SetOptions(options *client.RequestOptions) {
+	r.options = options
+}
+
+// Options options forwarding this request
+// implemented client's options request interface
+func (r *Request) Options() *client.RequestOptions {
+	return r.options
+}
+
 // GetProxy get super proxy for this request
 func (r *Request) GetProxy() *superproxy.SuperProxy {
 	return r.proxy
@@ -166,8 +286,15 @@ func (r *Request) WriteHeaderTo(writer *bufio.Writer) (int, int, error) {
 	if r.reader == nil {
 		return 0, 0, errors.New("Empty request, nothing to write")
 	}
+	var extra []byte
+	if r.injectID && len(r.id) > 0 {
+		extra = []byte(requestIDHeader + ": " + r.id + "\r\n")
+	}
+	if len(r.forwarded) > 0 {
+		extra = append(extra, forwardedHeader+": "+r.forwarded+"\r\n"...)
+	}
 	// read & write the headers
-	return copyHeader(&r.header, r.reader, writer,
+	return copyHeader(&r.header, r.via, extra, r.reader, writer,
 		func(rawHeader []byte) {
 			r.hijackerBodyWriter = r.hijacker.OnRequest(r.header, rawHeader)
 		},
@@ -180,14 +307,51 @@ func (r *Request) WriteBodyTo(writer *bufio.Writer) (int, error) {
 	if r.reader == nil {
 		return 0, errors.New("Empty request, nothing to write")
 	}
+	if r.drainLimit != 0 {
+		return r.drainBodyTo(writer)
+	}
 	// write the request body (if any)
-	return copyBody(&r.header, &r.body, r.reader, writer,
-		func(rawBody []byte) {
-			if _, err := util.WriteWithValidation(r.hijackerBodyWriter, rawBody); err != nil {
-				// TODO: log the sniffer error
-			}
-		},
-	)
+	return copyBody(&r.header, r.header.BodyType(), &r.body, r.reader, writer,
+		hijackerBodyDst(r.hijackerBodyWriter))
+}
+
+// drainBodyTo writes the request body within drainLimit to writer, the
+// client connection is closed if the rest is left unread
+func (r *Request) drainBodyTo(writer *bufio.Writer) (int, error) {
+	bodyType := r.header.BodyType()
+	if r.drainLimit < 0 || (bodyType == http.BodyTypeFixedSize &&
+		r.header.ContentLength() > int64(r.drainLimit)) {
+		r.closeConnection = true
+		return 0, nil
+	}
+	dst := &limitedWriter{w: writer, remaining: r.drainLimit}
+	n, err := copyBody(&r.header, bodyType, &r.body, r.reader, dst,
+		hijackerBodyDst(r.hijackerBodyWriter))
+	if dst.exceeded {
+		r.closeConnection = true
+		return n, nil
+	}
+	return n, err
+}
+
+var errWriteLimitExceeded = errors.New("write limit exceeded")
+
+// limitedWriter writes at most remaining bytes to w, exceeded is set and
+// errWriteLimitExceeded returned when more written
+type limitedWriter struct {
+	w         io.Writer
+	remaining int
+	exceeded  bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.remaining {
+		l.exceeded = true
+		return 0, errWriteLimitExceeded
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= n
+	return n, err
 }
 
 // ConnectionClose if the request's "Connection" or "Proxy-Connection" header value is set as "close".
@@ -197,6 +361,24 @@ func (r *Request) ConnectionClose() bool {
 	return r.header.IsConnectionClose() || r.header.IsProxyConnectionClose()
 }
 
+var http10 = []byte("HTTP/1.0")
+
+// clientKeepAlive is the HTTP/1.0 client connection asked to be kept alive
+// by the "Connection" or "Proxy-Connection" header, the latter is sent by the
+// older clients and still never forwarded
+func (r *Request) clientKeepAlive() bool {
+	return r.header.IsConnectionKeepAlive() || r.header.IsProxyConnectionKeepAlive()
+}
+
+// clientConnectionClose should the client connection be closed once the
+// request served, the HTTP/1.0 ones are persistent only when kept alive
+func (r *Request) clientConnectionClose() bool {
+	if r.ConnectionClose() {
+		return true
+	}
+	return bytes.Equal(r.Protocol(), http10) && !r.clientKeepAlive()
+}
+
 // IsTLS is tls requests
 func (r *Request) IsTLS() bool {
 	return r.isTLS
@@ -226,13 +408,53 @@ type Response struct {
 
 	// body http body parser
 	body http.Body
+
+	// status rewriter and the host it applied to, see Handler.RewriteStatus
+	host           string
+	statusRewriter func(host string, status int) (newStatus int, body []byte, rewrite bool)
+
+	// via hop appended to the Via header, nil means Via header untouched
+	via []byte
+
+	// closeDelimited the response body is delimited by the connection close
+	closeDelimited bool
+
+	// keepAlive tells the HTTP/1.0 client asking for keep-alive the
+	// connection is kept, unless the target tells otherwise
+	keepAlive bool
+
+	// headersAdder returns the headers added to response from host,
+	// see Handler.AddResponseHeaders
+	headersAdder func(host string) map[string]string
+
+	// upgradedConn the target connection switched protocols, e.g. WebSocket
+	upgradedConn net.Conn
+
+	// discardContinue discards the 100 Continue responses of target, since
+	// the client is already told to continue, see Handler.AutoContinue
+	discardContinue bool
+
+	// startedAt when the start line of the final response is read,
+	// zero if never read
+	startedAt time.Time
 }
 
 // Reset reset response
 func (r *Response) Reset() {
 	r.writer = nil
+	r.hijacker = nil
 	r.respLine.Reset()
 	r.header.Reset()
+	r.body.Reset()
+	r.host = ""
+	r.statusRewriter = nil
+	r.via = nil
+	r.closeDelimited = false
+	r.keepAlive = false
+	r.headersAdder = nil
+	r.upgradedConn = nil
+	r.discardContinue = false
+	r.startedAt = time.Time{}
 }
 
 // WriteTo init response with writer which would write to
@@ -254,14 +476,54 @@ func (r *Response) SetHijacker(h Hijacker) {
 	r.hijacker = h
 }
 
+// SetVia set the hop appended to the Via header of this response
+func (r *Response) SetVia(via []byte) {
+	r.via = via
+}
+
+// SetStatusRewriter set the status rewriter of response from host
+func (r *Response) SetStatusRewriter(host string,
+	rewriter func(host string, status int) (newStatus int, body []byte, rewrite bool)) {
+	r.host = host
+	r.statusRewriter = rewriter
+}
+
+// SetHeadersAdder set the adder of headers added to the response from host
+func (r *Response) SetHeadersAdder(host string, adder func(host string) map[string]string) {
+	r.host = host
+	r.headersAdder = adder
+}
+
 // ReadFrom read data from http response got
 func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (int, error) {
 	var num, wn int
 	var err error
+	if r.discardContinue {
+		if err = discardContinueResponses(reader); err != nil {
+			return num, util.ErrWrapper(err, "fail to discard 100 continue response")
+		}
+	}
 	// write back the start line to writer(i.e. net/connection)
 	if err = r.respLine.Parse(reader); err != nil {
 		return num, util.ErrWrapper(err, "fail to read start line of response")
 	}
+	r.startedAt = time.Now()
+	// parse the headers ahead to find out how the body is delimited
+	var headerLen int
+	if headerLen, err = r.header.ParseHeaderFields(reader); err != nil {
+		if isHeaderLimitExceeded(err) {
+			return num, ErrResponseHeaderTooLarge
+		}
+		return num, util.ErrWrapper(err, "fail to parse http headers")
+	}
+	r.closeDelimited = !discardBody &&
+		isCloseDelimited(&r.header, r.respLine.GetStatusCode())
+	if r.statusRewriter != nil {
+		if status, body, rewrite := r.statusRewriter(r.host,
+			r.respLine.GetStatusCode()); rewrite {
+			return r.rewriteFrom(discardBody, reader, status, body)
+		}
+	}
 
 	// rebuild  the start line
 	respLineBytes := r.respLine.GetResponseLine()
@@ -271,9 +533,21 @@ func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (int, error)
 	}
 	num += wn
 
+	// tell the client the body ends with the connection
+	var extra []byte
+	if r.closeDelimited && !r.header.IsConnectionClose() {
+		extra = connectionCloseHeader
+	} else if r.keepAlive && !r.closeDelimited && len(r.header.Connection()) == 0 {
+		extra = connectionKeepAliveHeader
+	}
+	if r.headersAdder != nil {
+		// should NOT have any errors, since the header is parsed
+		rawHeader, _ := r.header.PeekRaw(reader, headerLen)
+		extra = r.appendAddedHeaders(extra, rawHeader)
+	}
 	// read & write the headers
 	var hijackerBodyWriter io.Writer
-	if _, wn, err = copyHeader(&r.header, reader, r.writer,
+	if _, wn, err = copyHeader(&r.header, r.via, extra, reader, r.writer,
 		func(rawHeader []byte) {
 			hijackerBodyWriter = r.hijacker.OnResponse(
 				r.respLine, r.header, rawHeader)
@@ -288,27 +562,200 @@ func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) (int, error)
 	}
 
 	// write the request body (if any)
-	wn, err = copyBody(&r.header, &r.body, reader, r.writer,
-		func(rawBody []byte) {
-			if _, err := util.WriteWithValidation(hijackerBodyWriter, rawBody); err != nil {
-				// TODO: log the sniffer error
-			}
-		},
-	)
+	wn, err = copyBody(&r.header, r.bodyType(), &r.body, reader, r.writer,
+		hijackerBodyDst(hijackerBodyWriter))
 	num += wn
 	return num, err
 }
 
-// ConnectionClose if the request's "Connection" header value is set as "Close"
+// discardContinueResponses discards the interim 100 Continue responses
+// ahead of the final one, which has no body but the headers
+func discardContinueResponses(reader *bufio.Reader) error {
+	for {
+		b, err := reader.Peek(len("HTTP/1.1 100 "))
+		if err != nil || !bytes.HasPrefix(b, []byte("HTTP/1.")) ||
+			!bytes.Equal(b[8:12], []byte(" 100")) || (b[12] != ' ' && b[12] != '\r') {
+			// not a 100 Continue, left to the response parser
+			return nil
+		}
+		// the status line, then the header lines till the empty one
+		for {
+			line, err := reader.ReadSlice('\n')
+			if err != nil {
+				return err
+			}
+			if isHeaderEnd(line) {
+				break
+			}
+		}
+	}
+}
+
+// rewriteFrom drains the http response got, then writes a response
+// with the given status and body instead
+func (r *Response) rewriteFrom(discardBody bool, reader *bufio.Reader,
+	status int, body []byte) (int, error) {
+	// the original response is still given to hijacker
+	var hijackerBodyWriter io.Writer
+	if _, _, err := copyHeader(&r.header, nil, nil, reader, ioutil.Discard,
+		func(rawHeader []byte) {
+			hijackerBodyWriter = r.hijacker.OnResponse(
+				r.respLine, r.header, rawHeader)
+		},
+	); err != nil {
+		return 0, err
+	}
+	if !discardBody {
+		if _, err := copyBody(&r.header, r.bodyType(), &r.body, reader, ioutil.Discard,
+			hijackerBodyDst(hijackerBodyWriter)); err != nil {
+			return 0, util.ErrWrapper(err, "fail to drain the rewritten response body")
+		}
+	}
+
+	b := http.NewResponseBuilder(status)
+	defer b.Release()
+	if len(r.via) > 0 {
+		b.AddHeader("Via", string(r.via))
+	}
+	b.AddHeader("Date", fmt.Sprintf("%s", servertime.ServerDate()))
+	b.SetBody(body)
+	if r.headersAdder != nil {
+		b.AddRawHeader(r.appendAddedHeaders(nil, b.RawHeader()))
+	}
+	resp := b.Bytes()
+	if discardBody {
+		resp = b.HeadBytes()
+	}
+	num, err := util.WriteWithValidation(r.writer, resp)
+	if err != nil {
+		return num, util.ErrWrapper(err, "fail to write rewritten response")
+	}
+	return num, nil
+}
+
+// unaddableHeaders the framing and hop-by-hop headers never added to the
+// responses, since the body framing is already decided when added
+var unaddableHeaders = []string{
+	"Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive",
+	"Proxy-Connection", "TE", "Trailer", "Upgrade",
+}
+
+func isUnaddableHeader(key string) bool {
+	for _, h := range unaddableHeaders {
+		if strings.EqualFold(key, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendAddedHeaders appends the header lines added to response into dst,
+// the headers already in rawHeader and the unaddableHeaders are never added
+func (r *Response) appendAddedHeaders(dst, rawHeader []byte) []byte {
+	headers := r.headersAdder(r.host)
+	if len(headers) == 0 {
+		return dst
+	}
+	// keep a stable order of the added headers
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// never modify the shared bytes, e.g. connectionCloseHeader
+	dst = dst[:len(dst):len(dst)]
+	for _, key := range keys {
+		if len(key) == 0 || isUnaddableHeader(key) ||
+			http.GetHeaderValue(rawHeader, key) != nil {
+			continue
+		}
+		dst = append(dst, key...)
+		dst = append(dst, ": "...)
+		dst = append(dst, headers[key]...)
+		dst = append(dst, "\r\n"...)
+	}
+	return dst
+}
+
+// IsUpgraded is the protocol switched by response, e.g. WebSocket
+func (r *Response) IsUpgraded() bool {
+	return r.respLine.GetStatusCode() == http.StatusSwitchingProtocols
+}
+
+// OnUpgrade takes over the target connection switched protocols
+func (r *Response) OnUpgrade(conn net.Conn) {
+	r.upgradedConn = conn
+}
+
+// ConnectionClose if the response body is delimited by the connection close,
 // this determines how the client reusing the connections
 func (r *Response) ConnectionClose() bool {
+	return r.closeDelimited
+}
+
+// bodyType how the response body is formed
+func (r *Response) bodyType() http.BodyType {
+	if r.closeDelimited {
+		return http.BodyTypeIdentity
+	}
+	return r.header.BodyType()
+}
+
+var connectionCloseHeader = []byte("Connection: close\r\n")
+var connectionKeepAliveHeader = []byte("Connection: keep-alive\r\n")
+
+var (
+	// ErrResponseHeaderTooLarge upstream response header exceeds
+	// Proxy.MaxHeaderSize or Proxy.MaxHeaderFields
+	ErrResponseHeaderTooLarge = errors.New("upstream response header too large")
+
+	errRequestHeaderTooLarge = errors.New("request header too large")
+
+	errMalformedRequestLine = errors.New("fail to read start line of request: malformed request line")
+
+	errMalformedRequestHeader = errors.New("malformed request header")
+)
+
+// isHeaderLimitExceeded is err returned by header parsing for limits exceeded
+func isHeaderLimitExceeded(err error) bool {
+	return err == http.ErrHeaderTooLarge || err == http.ErrTooManyHeaderFields
+}
+
+// isCloseDelimited is a response with status and header has a body which
+// is read until the connection close, i.e. a response which is allowed to
+// have a body, but has neither content length nor transfer encoding,
+// see RFC 7230 3.3.3
+func isCloseDelimited(header *http.Header, status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusNotModified {
+		return false
+	}
+	switch header.BodyType() {
+	case http.BodyTypeIdentity:
+		return true
+	case http.BodyTypeFixedSize:
+		return !header.IsContentLengthSet()
+	}
 	return false
 }
 
 // additionalDst used by copyHeader and copyBody for additional write
 type additionalDst func([]byte)
 
-func copyHeader(header *http.Header,
+// hijackerBodyDst writes the body into the hijacker body writer w,
+// nil returned if w is nil, so that nothing is written concurrently
+func hijackerBodyDst(w io.Writer) additionalDst {
+	if w == nil {
+		return nil
+	}
+	return func(rawBody []byte) {
+		// a failed sniffer never fails the forwarding, the hijacker owning
+		// w is left to report its own errors
+		util.WriteWithValidation(w, rawBody)
+	}
+}
+
+func copyHeader(header *http.Header, via, extra []byte,
 	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, int, error) {
 	// read and write header
 	var orginalHeaderLen, copiedHeaderLen int
@@ -317,51 +764,77 @@ func copyHeader(header *http.Header,
 		return orginalHeaderLen, 0, util.ErrWrapper(err, "fail to parse http headers")
 	}
 	var rawHeader []byte
-	rawHeader, err = src.Peek(orginalHeaderLen)
+	rawHeader, err = header.PeekRaw(src, orginalHeaderLen)
 	if err != nil {
 		// should NOT have any errors
 		return orginalHeaderLen, 0, util.ErrWrapper(err, "fail to reader raw headers")
 	}
-	defer src.Discard(orginalHeaderLen)
+	defer header.DiscardRaw(src, orginalHeaderLen)
 
-	copiedHeaderLen, err = parallelWriteHeader(dst1, dst2, rawHeader)
+	// Transfer-Encoding overrides Content-Length when parsed, which
+	// must be removed then before forwarding, see RFC 7230 3.3.3
+	copiedHeaderLen, err = parallelWriteHeader(dst1, dst2, rawHeader,
+		header.Connection(), header.BodyType() != http.BodyTypeFixedSize, via, extra)
 	return orginalHeaderLen, copiedHeaderLen, err
 }
 
-// parallelWriteBody write body data to dst1 dst2 concurrently
+// parallelWriteHeader write header data to dst1 dst2 concurrently,
+// the headers named in connection are stripped from dst1, so is the
+// Content-Length header if transferEncoded, or merged into the first one
+// if repeated, whose values are never conflicting since rejected when
+// parsed, see RFC 7230 3.3.2. The hop via
+// is appended to the Via header and the extra raw header lines are
+// added to the end of header written to dst1 if provided.
+// dst2 is written in a new go routine, while dst1 in the current one.
 // TODO: @daizong with timeout
-func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte) (int, error) {
+func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst,
+	header, connection []byte, transferEncoded bool, via, extra []byte) (int, error) {
 	var wg sync.WaitGroup
 	var wn int
 	var err error
-	wg.Add(2)
-	go func() {
-		m := 0
-		unReadHeader := header
-		for {
-			unReadHeader = unReadHeader[m:]
-			m = bytes.IndexByte(unReadHeader, '\n')
-			if m < 0 {
-				break
-			}
-			m++
-			headerLine := unReadHeader[:m]
-			if !http.IsProxyHeader(headerLine) {
-				n, e := util.WriteWithValidation(dst1, headerLine)
-				wn += n
-				if e != nil {
-					err = e
-					break
-				}
-			}
-
+	if dst2 != nil {
+		wg.Add(1)
+		go func() {
+			dst2(header)
+			wg.Done()
+		}()
+	}
+	// via is appended to the last Via header, or a new Via header
+	// is added before the end of header if there is none
+	lastViaLine := -1
+	if len(via) > 0 {
+		lastViaLine = lastViaHeaderLine(header)
+	}
+	contentLengthWritten := false
+	for i := 0; i < len(header); {
+		m := bytes.IndexByte(header[i:], '\n')
+		if m < 0 {
+			break
 		}
-		wg.Done()
-	}()
-	go func() {
-		dst2(header)
-		wg.Done()
-	}()
+		m++
+		headerLine := header[i : i+m]
+		isContentLength := http.IsContentLengthHeader(headerLine)
+		var n int
+		var e error
+		switch {
+		case http.IsProxyHeader(headerLine), http.IsHopByHopHeader(headerLine),
+			len(connection) > 0 && http.IsConnectionOption(connection, headerLine),
+			isContentLength && (transferEncoded || contentLengthWritten):
+		case i == lastViaLine:
+			n, e = writeViaHeaderLine(dst1, bytes.TrimRight(headerLine, "\r\n"), via)
+		case isHeaderEnd(headerLine) && (len(extra) > 0 || (len(via) > 0 && lastViaLine < 0)):
+			n, e = writeHeaderEnd(dst1, headerLine, lastViaLine < 0, via, extra)
+		default:
+			n, e = util.WriteWithValidation(dst1, headerLine)
+			contentLengthWritten = contentLengthWritten || isContentLength
+		}
+		wn += n
+		if e != nil {
+			err = e
+			break
+		}
+		i += m
+	}
 	wg.Wait()
 	if err != nil {
 		return wn, util.ErrWrapper(err, "error occurred when write to dst")
@@ -369,29 +842,86 @@ func parallelWriteHeader(dst1 io.Writer, dst2 additionalDst, header []byte) (int
 	return wn, nil
 }
 
-func copyBody(header *http.Header, body *http.Body,
+var viaHeaderName = []byte("Via:")
+
+// lastViaHeaderLine returns the offset of the last Via header line in header
+func lastViaHeaderLine(header []byte) int {
+	last := -1
+	for i := 0; i < len(header); {
+		m := bytes.IndexByte(header[i:], '\n')
+		if m < 0 {
+			break
+		}
+		if http.IsViaHeader(header[i:]) {
+			last = i
+		}
+		i += m + 1
+	}
+	return last
+}
+
+// isHeaderEnd is the header line the empty line ending the header
+func isHeaderEnd(headerLine []byte) bool {
+	return len(headerLine) == 1 || (len(headerLine) == 2 && headerLine[0] == '\r')
+}
+
+// writeHeaderEnd writes the extra header lines and the Via header
+// if addVia before the empty line ending the header
+func writeHeaderEnd(dst io.Writer, headerEnd []byte, addVia bool, via, extra []byte) (int, error) {
+	var wn, n int
+	var err error
+	if addVia && len(via) > 0 {
+		if n, err = writeViaHeaderLine(dst, viaHeaderName, via); err != nil {
+			return wn, err
+		}
+		wn += n
+	}
+	if len(extra) > 0 {
+		if n, err = util.WriteWithValidation(dst, extra); err != nil {
+			return wn, err
+		}
+		wn += n
+	}
+	n, err = util.WriteWithValidation(dst, headerEnd)
+	wn += n
+	return wn, err
+}
+
+// writeViaHeaderLine writes the via header line with hop via appended
+func writeViaHeaderLine(dst io.Writer, viaLine, via []byte) (int, error) {
+	sep := ", "
+	if bytes.Equal(viaLine, viaHeaderName) {
+		sep = " "
+	}
+	return fmt.Fprintf(dst, "%s%s%s\r\n", viaLine, sep, via)
+}
+
+func copyBody(header *http.Header, bodyType http.BodyType, body *http.Body,
 	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, error) {
 	w := func(isChunkHeader bool, data []byte) (int, error) {
 		return parallelWriteBody(dst1, dst2, data)
 	}
-	return body.Parse(src, header.BodyType(), header.ContentLength(), w)
+	return body.Parse(src, bodyType, header.ContentLength(), w)
 }
 
-// parallelWriteBody write body data to dst1 dst2 concurrently
+// parallelWriteBody write body data to dst1 dst2 concurrently, dst2 is
+// written in a new go routine only if provided, while dst1 in the current one
 // TODO: @daizong with timeout
 func parallelWriteBody(dst1 io.Writer, dst2 additionalDst, data []byte) (int, error) {
+	if dst2 == nil {
+		wn, err := util.WriteWithValidation(dst1, data)
+		if err != nil {
+			return wn, util.ErrWrapper(err, "error occurred when write to dst")
+		}
+		return wn, nil
+	}
 	var wg sync.WaitGroup
-	var wn int
-	var err error
-	wg.Add(2)
-	go func() {
-		wn, err = util.WriteWithValidation(dst1, data)
-		wg.Done()
-	}()
+	wg.Add(1)
 	go func() {
 		dst2(data)
 		wg.Done()
 	}()
+	wn, err := util.WriteWithValidation(dst1, data)
 	wg.Wait()
 	if err != nil {
 		return wn, util.ErrWrapper(err, "error occurred when write to dst")
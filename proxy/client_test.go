@@ -5,8 +5,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	nethttp "net/http"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -30,10 +33,82 @@ func TestParallelWriteHeader(t *testing.T) {
 	testParallelWriteHeader(t, nil, fixedsizebytebuffer, []byte("Host: www.google.com\r\nProxy-Connection: Keep-Alive\r\nUser-Agent: curl/7.54.0\r\n\r\n"), "error short buffer", "")
 }
 
+func TestParallelWriteHeaderHopByHop(t *testing.T) {
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	header := "Host: www.google.com\r\nTE: trailers, deflate\r\n" +
+		"Keep-Alive: timeout=5\r\nTrailer: Expires\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	if _, err := parallelWriteHeader(buffer, func(p []byte) {}, []byte(header), nil, false, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expResult := "Host: www.google.com\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	if string(buffer.B) != expResult {
+		t.Fatalf("expected header %q, got %q", expResult, buffer.B)
+	}
+}
+
+func TestParallelWriteHeaderTransferEncoded(t *testing.T) {
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	header := "Host: www.google.com\r\nContent-Length: 3\r\n" +
+		"Transfer-Encoding: chunked\r\ncontent-length: 5\r\n\r\n"
+	if _, err := parallelWriteHeader(buffer, func(p []byte) {}, []byte(header), nil, true, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expResult := "Host: www.google.com\r\nTransfer-Encoding: chunked\r\n\r\n"
+	if string(buffer.B) != expResult {
+		t.Fatalf("expected header %q, got %q", expResult, buffer.B)
+	}
+}
+
+func TestParallelWriteHeaderRepeatedContentLength(t *testing.T) {
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	header := "Host: www.google.com\r\nContent-Length: 3\r\n" +
+		"User-Agent: curl/7.54.0\r\ncontent-length: 3\r\n\r\n"
+	if _, err := parallelWriteHeader(buffer, func(p []byte) {}, []byte(header), nil, false, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expResult := "Host: www.google.com\r\nContent-Length: 3\r\nUser-Agent: curl/7.54.0\r\n\r\n"
+	if string(buffer.B) != expResult {
+		t.Fatalf("expected header %q, got %q", expResult, buffer.B)
+	}
+}
+
+func TestParallelWriteHeaderWithVia(t *testing.T) {
+	testParallelWriteHeaderWithVia(t, "Host: www.google.com\r\n\r\n",
+		"Host: www.google.com\r\nVia: 1.1 fastproxy\r\n\r\n")
+	testParallelWriteHeaderWithVia(t, "Host: www.google.com\n\n",
+		"Host: www.google.com\nVia: 1.1 fastproxy\r\n\n")
+	testParallelWriteHeaderWithVia(t, "Via: 1.0 fred\r\nHost: www.google.com\r\n\r\n",
+		"Via: 1.0 fred, 1.1 fastproxy\r\nHost: www.google.com\r\n\r\n")
+	testParallelWriteHeaderWithVia(t, "via: 1.0 fred\r\nHost: www.google.com\r\nVia: 1.1 nowhere.com (Apache/1.1)\r\n\r\n",
+		"via: 1.0 fred\r\nHost: www.google.com\r\nVia: 1.1 nowhere.com (Apache/1.1), 1.1 fastproxy\r\n\r\n")
+	testParallelWriteHeaderWithVia(t, "Via:\r\nProxy-Connection: Keep-Alive\r\n\r\n",
+		"Via: 1.1 fastproxy\r\n\r\n")
+}
+
+func testParallelWriteHeaderWithVia(t *testing.T, header, expResult string) {
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	n, err := parallelWriteHeader(buffer, func(p []byte) {}, []byte(header), nil, false, []byte("1.1 fastproxy"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buffer.B) != expResult {
+		t.Fatalf("expected header %q, got %q", expResult, buffer.B)
+	}
+	if n != len(buffer.B) {
+		t.Fatalf("parallelWriteHeader function work error: %d != %d", n, len(buffer.B))
+	}
+}
+
 func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fixedsizeB *bytebufferpool.FixedSizeByteBuffer, header []byte, expErr, expResult string) {
 	var additionalDst string
 	if buffer != nil {
-		n, err := parallelWriteHeader(buffer, func(p []byte) { additionalDst += string(p) }, header)
+		n, err := parallelWriteHeader(buffer, func(p []byte) { additionalDst += string(p) }, header, nil, false, nil, nil)
 		if err != nil {
 			if !strings.Contains(err.Error(), expErr) {
 				t.Fatalf("expected error: error short buffer, but error: %s", err)
@@ -55,7 +130,7 @@ func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fi
 			}
 		}
 	} else {
-		_, err := parallelWriteHeader(fixedsizeB, func(p []byte) { additionalDst += string(p) }, header)
+		_, err := parallelWriteHeader(fixedsizeB, func(p []byte) { additionalDst += string(p) }, header, nil, false, nil, nil)
 		if err != nil {
 			if !strings.Contains(err.Error(), expErr) {
 				t.Fatalf("expected error: error short buffer, but error: %s", err)
@@ -64,6 +139,50 @@ func testParallelWriteHeader(t *testing.T, buffer *bytebufferpool.ByteBuffer, fi
 	}
 }
 
+func TestParallelWriteBody(t *testing.T) {
+	data := []byte(strings.Repeat("body", 64))
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	// nothing additional to write
+	n, err := parallelWriteBody(buffer, nil, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != len(data) || !bytes.Equal(buffer.B, data) {
+		t.Fatalf("expected %d bytes written, got %d", len(data), n)
+	}
+	buffer.Reset()
+	var additional []byte
+	n, err = parallelWriteBody(buffer, func(p []byte) { additional = append(additional, p...) }, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != len(data) || !bytes.Equal(buffer.B, data) || !bytes.Equal(additional, data) {
+		t.Fatalf("expected %d bytes written to both, got %d and %d", len(data), n, len(additional))
+	}
+	if hijackerBodyDst(nil) != nil {
+		t.Fatalf("nil hijacker body writer should make no additional dst")
+	}
+}
+
+func BenchmarkParallelWriteBody(b *testing.B) {
+	data := []byte(strings.Repeat("body", 1024))
+	b.Run("NoHijacker", func(b *testing.B) {
+		dst := hijackerBodyDst(nil)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parallelWriteBody(ioutil.Discard, dst, data)
+		}
+	})
+	b.Run("Hijacker", func(b *testing.B) {
+		dst := hijackerBodyDst(ioutil.Discard)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parallelWriteBody(ioutil.Discard, dst, data)
+		}
+	})
+}
+
 func TestHTTPRequest(t *testing.T) {
 	testRequest(t, "GET / HTTP/1.1\r\n\r\n", "GET", "HTTP/1.1", 16, "", 0)
 	testRequest(t, "GET / HTTP/1.1\n\n", "GET", "HTTP/1.1", 15, "", 0)
@@ -138,8 +257,14 @@ func testResponse(t *testing.T, respString string, expErr string, expSize int) {
 func TestHTTPResponse(t *testing.T) {
 	s := "HTTP/1.1 200 ok\r\n" +
 		"Cache-Control:no-cache\r\n" +
+		"Content-Length: 0\r\n" +
 		"\r\n"
 	testResponse(t, s, "", len(s))
+	// body read until connection close, which is told to client
+	s = "HTTP/1.1 200 ok\r\n" +
+		"Cache-Control:no-cache\r\n" +
+		"\r\n"
+	testResponse(t, s, "", len(s)+len("Connection: close\r\n"))
 	s = "HTTP/1.1 200 ok\n"
 	testResponse(t, s, "", len(s))
 	s = "HTTP/1.1 ok\r\nConnection:close\r\n\r\n"
@@ -152,6 +277,83 @@ func TestHTTPResponse(t *testing.T) {
 	testResponse(t, s, io.EOF.Error(), 0)
 }
 
+func TestResponseCloseDelimited(t *testing.T) {
+	testResponseCloseDelimited(t, "HTTP/1.1 200 OK\r\n\r\nbody", false, true, "body")
+	testResponseCloseDelimited(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nbody", false, true, "body")
+	testResponseCloseDelimited(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: identity\r\n\r\nbody", false, true, "body")
+	testResponseCloseDelimited(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false, false, "")
+	testResponseCloseDelimited(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", false, false, "ok")
+	testResponseCloseDelimited(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false, false, "")
+	testResponseCloseDelimited(t, "HTTP/1.1 204 No Content\r\n\r\n", false, false, "")
+	testResponseCloseDelimited(t, "HTTP/1.1 304 Not Modified\r\n\r\n", false, false, "")
+	testResponseCloseDelimited(t, "HTTP/1.1 200 OK\r\n\r\n", true, false, "")
+}
+
+func testResponseCloseDelimited(t *testing.T, respString string, discardBody, expClose bool, expBody string) {
+	resp := &Response{}
+	resp.SetHijacker(&hijacker{})
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	bw := bufio.NewWriter(buffer)
+	if err := resp.WriteTo(bw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := resp.ReadFrom(discardBody, bufio.NewReader(strings.NewReader(respString))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	bw.Flush()
+	if resp.ConnectionClose() != expClose {
+		t.Fatalf("expected connection close %v for response %q", expClose, respString)
+	}
+	if expClose && !bytes.Contains(bytes.ToLower(buffer.B), []byte("connection: close\r\n")) {
+		t.Fatalf("expected connection close header in response %q", buffer.B)
+	}
+	if !bytes.HasSuffix(buffer.B, []byte("\r\n\r\n"+expBody)) {
+		t.Fatalf("unexpected response %q", buffer.B)
+	}
+}
+
+func TestResponseAddHeaders(t *testing.T) {
+	adder := func(host string) map[string]string {
+		if host != "example.com:443" {
+			return nil
+		}
+		return map[string]string{"X-Proxy": "fastproxy", "Content-Length": "100",
+			"transfer-encoding": "chunked", "Connection": "keep-alive", "Upgrade": "h2c"}
+	}
+	testResponseAddHeaders(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", "example.com:443", adder,
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nX-Proxy: fastproxy\r\n\r\nok")
+	testResponseAddHeaders(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", "example.com:80", adder,
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	testResponseAddHeaders(t, "HTTP/1.1 200 OK\r\n\r\nok", "example.com:443", adder,
+		"HTTP/1.1 200 OK\r\nConnection: close\r\nX-Proxy: fastproxy\r\n\r\nok")
+}
+
+func testResponseAddHeaders(t *testing.T, respString, host string,
+	adder func(host string) map[string]string, expResult string) {
+	resp := &Response{}
+	resp.SetHijacker(&hijacker{})
+	resp.SetHeadersAdder(host, adder)
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	bw := bufio.NewWriter(buffer)
+	if err := resp.WriteTo(bw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	n, err := resp.ReadFrom(false, bufio.NewReader(strings.NewReader(respString)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	bw.Flush()
+	if string(buffer.B) != expResult {
+		t.Fatalf("expected response %q, got %q", expResult, buffer.B)
+	}
+	// the added headers are counted in usage
+	if n != len(buffer.B) {
+		t.Fatalf("expected %d bytes written, got %d", len(buffer.B), n)
+	}
+}
+
 func testWithClient(t *testing.T, reqString string) {
 	bPool := bufiopool.New(bufiopool.MinReadBufferSize, bufiopool.MinWriteBufferSize)
 	c := &client.Client{
@@ -190,6 +392,47 @@ func testWithClient(t *testing.T, reqString string) {
 	}
 }
 
+func TestGeneratedResponseDate(t *testing.T) {
+	// both the fast errors and the rewritten responses carry a valid date
+	var buffer bytes.Buffer
+	if err := writeFastError(&buffer, nethttp.StatusBadGateway, "bad gateway\n"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testGeneratedResponseDate(t, buffer.Bytes())
+
+	buffer.Reset()
+	writer := bufio.NewWriter(&buffer)
+	resp := &Response{}
+	if err := resp.WriteTo(writer); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.SetHijacker(defaultNilHijacker)
+	resp.SetStatusRewriter("example.com:80", func(host string, status int) (int, []byte, bool) {
+		return nethttp.StatusForbidden, []byte("forbidden"), true
+	})
+	if _, err := resp.ReadFrom(false, bufio.NewReader(strings.NewReader(
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	writer.Flush()
+	testGeneratedResponseDate(t, buffer.Bytes())
+}
+
+func testGeneratedResponseDate(t *testing.T, raw []byte) {
+	resp, err := nethttp.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	date, err := nethttp.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		t.Fatalf("invalid Date header %q: %s", resp.Header.Get("Date"), err)
+	}
+	if d := time.Since(date); d < -time.Minute || d > time.Minute {
+		t.Fatalf("unexpected Date header %q", resp.Header.Get("Date"))
+	}
+}
+
 func TestWithClient(t *testing.T) {
 	go func() {
 		nethttp.HandleFunc("/client", func(w nethttp.ResponseWriter, r *nethttp.Request) {
@@ -273,7 +516,7 @@ func TestCopyHeader(t *testing.T) {
 	testF := func(b []byte) {
 		return
 	}
-	n, _, err := copyHeader(h, br, bw, testF)
+	n, _, err := copyHeader(h, nil, nil, br, bw, testF)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -289,7 +532,7 @@ func TestCopyHeader(t *testing.T) {
 	testF = func(b []byte) {
 		return
 	}
-	n, _, err = copyHeader(h, ebr, bw, testF)
+	n, _, err = copyHeader(h, nil, nil, ebr, bw, testF)
 	if err == nil {
 		t.Fatalf("unexpected error: fail to parse header")
 	}
@@ -298,6 +541,27 @@ func TestCopyHeader(t *testing.T) {
 	}
 }
 
+func TestCopyHeaderConnectionOptions(t *testing.T) {
+	h := &http.Header{}
+	req := "Host: localhost:9678\r\nConnection: Keep-Alive, X-Hop\r\n" +
+		"X-Hop: 1\r\nX-End2End: 2\r\nCONNECTION: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	br := bufio.NewReader(strings.NewReader(req))
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	if _, _, err := copyHeader(h, nil, nil, br, buffer, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the Connection headers are forwarded in the original casing
+	expResult := "Host: localhost:9678\r\nConnection: Keep-Alive, X-Hop\r\n" +
+		"X-End2End: 2\r\nCONNECTION: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	if string(buffer.B) != expResult {
+		t.Fatalf("expected header %q, got %q", expResult, buffer.B)
+	}
+	if string(h.Connection()) != "Keep-Alive, X-Hop, Upgrade" {
+		t.Fatalf("unexpected connection options %q", h.Connection())
+	}
+}
+
 func TestRequestPool(t *testing.T) {
 	reqPool := &RequestPool{}
 	request := reqPool.Acquire()
@@ -358,12 +622,9 @@ func TestRequestPool(t *testing.T) {
 	if len(request.tlsServerName) != 0 {
 		t.Fatalf("request reset tlsServerName error")
 	}
-	if request.userdata == nil {
+	if request.userdata != nil {
 		t.Fatalf("request reset userdata error")
 	}
-	if request.userdata.Get("key") != nil {
-		t.Fatalf("request reset userdata data error")
-	}
 	reqPool.Release(request)
 }
 
@@ -413,6 +674,122 @@ func TestResponsePool(t *testing.T) {
 	respPool.Release(resp)
 }
 
+func TestRequestPoolResetAllFields(t *testing.T) {
+	reqPool := &RequestPool{}
+	request := reqPool.Acquire()
+	request.reader = bufio.NewReader(strings.NewReader("GET http://example.com/a?b=c#d HTTP/1.1\r\n" +
+		"Connection: close\r\nProxy-Connection: close\r\nContent-Length: 10\r\n" +
+		"Content-Type: text/plain\r\nVia: 1.0 fred\r\n\r\n"))
+	if err := request.reqLine.Parse(request.reader); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	request.reqLine.HostInfo().SetIP(net.ParseIP("127.0.0.1"))
+	request.header.SetLimits(1024, 10)
+	request.body.SetMaxChunkSize(1024)
+	request.body.SetMaxChunkLineSize(64)
+	if _, err := request.header.ParseHeaderFields(request.reader); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	request.SetHijacker(&simpleHijacker{})
+	request.hijackerBodyWriter = ioutil.Discard
+	request.SetProxy(&superproxy.SuperProxy{})
+	request.SetTLS("example.com")
+	request.SetVia([]byte("1.1 fastproxy"))
+	request.id = "id"
+	request.injectID = true
+	request.forwarded = "for=192.0.2.60"
+	request.closeConnection = true
+	request.drainLimit = 1
+	request.SetOptions(&client.RequestOptions{ReadTimeout: time.Second})
+	request.userdata = &UserData{}
+	request.userdata.Set("key", "value")
+	assertAllFieldsSet(t, request)
+
+	reqPool.Release(request)
+	request = reqPool.Acquire()
+	assertAllFieldsReset(t, request)
+}
+
+func TestResponsePoolResetAllFields(t *testing.T) {
+	respPool := &ResponsePool{}
+	resp := respPool.Acquire()
+	if err := resp.WriteTo(bufio.NewWriter(ioutil.Discard)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.SetHijacker(&simpleHijacker{})
+	resp.SetVia([]byte("1.1 fastproxy"))
+	resp.SetStatusRewriter("example.com:80",
+		func(host string, status int) (int, []byte, bool) { return 0, nil, false })
+	resp.SetHeadersAdder("example.com:80",
+		func(host string) map[string]string { return nil })
+	upgradedConn, _ := net.Pipe()
+	resp.OnUpgrade(upgradedConn)
+	resp.header.SetLimits(1024, 10)
+	resp.body.SetMaxChunkSize(1024)
+	resp.body.SetMaxChunkLineSize(64)
+	resp.discardContinue = true
+	resp.keepAlive = true
+	resp.startedAt = time.Now()
+	if _, err := resp.ReadFrom(false, bufio.NewReader(strings.NewReader("HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"Proxy-Connection: close\r\nContent-Type: text/plain\r\nVia: 1.0 fred\r\n\r\nbody"))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertAllFieldsSet(t, resp)
+
+	respPool.Release(resp)
+	resp = respPool.Acquire()
+	assertAllFieldsReset(t, resp)
+}
+
+// assertAllFieldsSet fails if any field of the struct pointed by v is empty,
+// making sure the reset test fills every field, including the new ones
+func assertAllFieldsSet(t *testing.T, v interface{}) {
+	s := reflect.ValueOf(v).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Field(i)
+		if f.Kind() == reflect.Struct && f.NumField() == 0 {
+			// nothing to fill, e.g. the http body parser
+			continue
+		}
+		if isEmptyValue(f) {
+			t.Fatalf("field %s of %s is not filled", s.Type().Field(i).Name, s.Type())
+		}
+	}
+}
+
+// assertAllFieldsReset fails if any field of the struct pointed by v,
+// including the nested struct fields, is not empty after reset
+func assertAllFieldsReset(t *testing.T, v interface{}, skipped ...string) {
+	s := reflect.ValueOf(v).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		name := s.Type().Field(i).Name
+		isSkipped := false
+		for _, skippedName := range skipped {
+			isSkipped = isSkipped || skippedName == name
+		}
+		if !isSkipped && !isEmptyValue(s.Field(i)) {
+			t.Fatalf("field %s of %s is not reset", name, s.Type())
+		}
+	}
+}
+
+// isEmptyValue is v zero, or an empty slice or a struct with every field empty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !isEmptyValue(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.IsZero()
+}
+
 type simpleHijacker struct{}
 
 func (s *simpleHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
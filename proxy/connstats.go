@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// connRateSlots number of slots the sliding window of ConnStats split into,
+// the bytes transferred are accumulated into the slot of current time
+const connRateSlots = 10
+
+// ConnStats live byte counters and transfer rates of a client connection
+// being served, see Proxy.ConnStatsWindow. It is safe calling the getters
+// concurrently with the serving
+type ConnStats struct {
+	// RemoteAddr address of the client
+	RemoteAddr net.Addr
+	// Start when the connection started being served
+	Start time.Time
+
+	read    rateCounter
+	written rateCounter
+}
+
+// BytesRead bytes read from client so far
+func (s *ConnStats) BytesRead() uint64 {
+	return s.read.total()
+}
+
+// BytesWritten bytes written to client so far
+func (s *ConnStats) BytesWritten() uint64 {
+	return s.written.total()
+}
+
+// ReadRate bytes read from client per second in the recent window
+func (s *ConnStats) ReadRate() float64 {
+	return s.read.rate(time.Now(), s.Start)
+}
+
+// WriteRate bytes written to client per second in the recent window
+func (s *ConnStats) WriteRate() float64 {
+	return s.written.rate(time.Now(), s.Start)
+}
+
+// rateCounter counts the bytes transferred into the slots of a sliding
+// window, the bytes of a Read or Write are counted as a whole, rather than
+// per byte, and the slots expired are only cleared on the next counting
+type rateCounter struct {
+	n uint64
+
+	lock     sync.Mutex
+	slotSize time.Duration
+	slots    [connRateSlots]uint64
+	// slot index since epoch of the latest slot counted
+	current int64
+}
+
+func (c *rateCounter) init(window time.Duration) {
+	c.slotSize = window / connRateSlots
+	if c.slotSize <= 0 {
+		c.slotSize = 1
+	}
+}
+
+func (c *rateCounter) total() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+func (c *rateCounter) add(n int, now time.Time) {
+	atomic.AddUint64(&c.n, uint64(n))
+	c.lock.Lock()
+	slot := c.advance(now)
+	c.slots[slot%connRateSlots] += uint64(n)
+	c.lock.Unlock()
+}
+
+// rate bytes per second in the window ending now, the window is never
+// longer than the duration since start
+func (c *rateCounter) rate(now, start time.Time) float64 {
+	c.lock.Lock()
+	slot := c.advance(now)
+	var sum uint64
+	for _, n := range c.slots {
+		sum += n
+	}
+	c.lock.Unlock()
+	// the full slots before plus the elapsed part of the current slot
+	window := time.Duration(connRateSlots-1)*c.slotSize +
+		time.Duration(now.UnixNano()-slot*int64(c.slotSize))
+	if elapsed := now.Sub(start); elapsed < window {
+		window = elapsed
+	}
+	if window <= 0 {
+		return 0
+	}
+	return float64(sum) / window.Seconds()
+}
+
+// advance moves the window to the slot of now, clearing the slots expired
+func (c *rateCounter) advance(now time.Time) int64 {
+	slot := now.UnixNano() / int64(c.slotSize)
+	if slot <= c.current {
+		return c.current
+	}
+	if slot-c.current >= connRateSlots {
+		c.slots = [connRateSlots]uint64{}
+	} else {
+		for i := c.current + 1; i <= slot; i++ {
+			c.slots[i%connRateSlots] = 0
+		}
+	}
+	c.current = slot
+	return slot
+}
+
+// statsConn counts the bytes read from and written to the client connection
+type statsConn struct {
+	net.Conn
+	stats *ConnStats
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stats.read.add(n, time.Now())
+	}
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.stats.written.add(n, time.Now())
+	}
+	return n, err
+}
+
+func (c *statsConn) CloseWrite() error {
+	return transport.CloseWrite(c.Conn)
+}
+
+// NetConn implements transport.WrappedConn
+func (c *statsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered implements transport.WrappedConn
+func (c *statsConn) Buffered() int {
+	return 0
+}
+
+// Spliced implements transport.WrappedConn, the bytes are still counted
+func (c *statsConn) Spliced(n int64, read bool) {
+	if read {
+		c.stats.read.add(int(n), time.Now())
+	} else {
+		c.stats.written.add(int(n), time.Now())
+	}
+}
+
+// trackConnStats wraps c counting the bytes transferred, which is listed
+// by ActiveConnStats until the returned untrack called
+func (p *Proxy) trackConnStats(c net.Conn) (net.Conn, func()) {
+	stats := &ConnStats{RemoteAddr: c.RemoteAddr(), Start: time.Now()}
+	stats.read.init(p.ConnStatsWindow)
+	stats.written.init(p.ConnStatsWindow)
+	p.connStats.Store(stats, struct{}{})
+	return &statsConn{Conn: c, stats: stats}, func() { p.connStats.Delete(stats) }
+}
+
+// ActiveConnStats the live stats of the client connections being served,
+// nothing is returned unless ConnStatsWindow set
+func (p *Proxy) ActiveConnStats() []*ConnStats {
+	var stats []*ConnStats
+	p.connStats.Range(func(key, value interface{}) bool {
+		stats = append(stats, key.(*ConnStats))
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateCounter(t *testing.T) {
+	var c rateCounter
+	c.init(time.Second)
+	start := time.Unix(1000, 0)
+	// 1000 bytes every 100ms for 2 seconds
+	now := start
+	for i := 0; i < 20; i++ {
+		now = start.Add(time.Duration(i) * 100 * time.Millisecond)
+		c.add(1000, now)
+	}
+	if n := c.total(); n != 20000 {
+		t.Fatalf("expected 20000 bytes counted, got %d", n)
+	}
+	now = now.Add(50 * time.Millisecond)
+	if rate := c.rate(now, start); rate < 9000 || rate > 11000 {
+		t.Fatalf("expected rate about 10000, got %.0f", rate)
+	}
+	// the slots expired are cleared
+	if rate := c.rate(now.Add(500*time.Millisecond), start); rate < 4000 || rate > 6000 {
+		t.Fatalf("expected rate about 5000 half a window later, got %.0f", rate)
+	}
+	if rate := c.rate(now.Add(time.Second), start); rate != 0 {
+		t.Fatalf("expected zero rate a window later, got %.0f", rate)
+	}
+
+	// the window is never longer than the duration since start
+	var d rateCounter
+	d.init(time.Second)
+	d.add(1000, start)
+	if rate := d.rate(start.Add(50*time.Millisecond), start); rate != 20000 {
+		t.Fatalf("expected rate 20000 since start, got %.0f", rate)
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// decryptCacheSweepSize number of hosts cached before sweeping the expired
+const decryptCacheSweepSize = 1024
+
+// decryptDecisionCache the ShouldDecryptHost decisions by host until expired
+type decryptDecisionCache struct {
+	lock      sync.Mutex
+	decisions map[string]decryptDecision
+	// the expired are swept when the cache grows to it
+	sweepSize int
+}
+
+type decryptDecision struct {
+	decrypt bool
+	expire  time.Time
+}
+
+// get the decision of host cached, ok is false if not cached or expired
+func (c *decryptDecisionCache) get(host string, now time.Time) (decrypt, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	d, ok := c.decisions[host]
+	if !ok || !now.Before(d.expire) {
+		return false, false
+	}
+	return d.decrypt, true
+}
+
+func (c *decryptDecisionCache) set(host string, decrypt bool, expire time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.decisions == nil {
+		c.decisions = make(map[string]decryptDecision)
+		c.sweepSize = decryptCacheSweepSize
+	}
+	if len(c.decisions) >= c.sweepSize {
+		now := time.Now()
+		for h, d := range c.decisions {
+			if !now.Before(d.expire) {
+				delete(c.decisions, h)
+			}
+		}
+		// never sweep again before the cache doubled
+		if c.sweepSize = 2 * len(c.decisions); c.sweepSize < decryptCacheSweepSize {
+			c.sweepSize = decryptCacheSweepSize
+		}
+	}
+	c.decisions[host] = decryptDecision{decrypt: decrypt, expire: expire}
+}
+
+// shouldDecryptHost decides the decryption of req by ShouldDecryptHost,
+// the decisions are cached by host when DecryptDecisionCacheTTL set
+func (p *Proxy) shouldDecryptHost(req *Request) bool {
+	host := req.reqLine.HostInfo().Domain()
+	ttl := p.Handler.DecryptDecisionCacheTTL
+	if ttl <= 0 {
+		return p.Handler.ShouldDecryptHost(req.userdata, host)
+	}
+	now := time.Now()
+	if decrypt, ok := p.decryptDecisions.get(host, now); ok {
+		return decrypt
+	}
+	decrypt := p.Handler.ShouldDecryptHost(req.userdata, host)
+	p.decryptDecisions.set(host, decrypt, now.Add(ttl))
+	return decrypt
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDecryptDecisionCacheSweep(t *testing.T) {
+	var c decryptDecisionCache
+	now := time.Now()
+	c.set("decrypt.test", true, now.Add(time.Hour))
+	if decrypt, ok := c.get("decrypt.test", now); !ok || !decrypt {
+		t.Fatalf("expected decrypt cached, got %v %v", decrypt, ok)
+	}
+	if _, ok := c.get("decrypt.test", now.Add(time.Hour)); ok {
+		t.Fatal("expected the decision expired")
+	}
+	// the expired are swept once the cache is full
+	for i := 0; i < decryptCacheSweepSize; i++ {
+		c.set(fmt.Sprintf("%d.test", i), false, now)
+	}
+	if n := len(c.decisions); n != 2 {
+		t.Fatalf("expected 2 decisions left after sweep, got %d", n)
+	}
+	if c.sweepSize != decryptCacheSweepSize {
+		t.Fatalf("unexpected sweep size %d", c.sweepSize)
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/haxii/fastproxy/client"
+)
+
+// localAddrFor the local address the direct connections of req are bound
+// to by Handler.LocalAddrFor, nil for the client's Handler.LocalAddr
+func (p *Proxy) localAddrFor(req *Request) *net.TCPAddr {
+	if p.Handler.LocalAddrFor == nil {
+		return nil
+	}
+	return p.Handler.LocalAddrFor(req.userdata, req.reqLine.HostInfo().HostWithPort())
+}
+
+// forwardOptions the options forwarding req, i.e. the Handler.ForwardOptions
+// with the local address of Handler.LocalAddrFor, nil if none
+func (p *Proxy) forwardOptions(req *Request) *client.RequestOptions {
+	var opts *client.RequestOptions
+	if p.Handler.ForwardOptions != nil {
+		opts = p.Handler.ForwardOptions(req.userdata, req.reqLine.HostInfo().HostWithPort())
+	}
+	localAddr := p.localAddrFor(req)
+	if localAddr == nil {
+		return opts
+	}
+	// never modify the options returned, which could be shared
+	var withLocalAddr client.RequestOptions
+	if opts != nil {
+		withLocalAddr = *opts
+	}
+	withLocalAddr.LocalAddr = localAddr
+	return &withLocalAddr
+}
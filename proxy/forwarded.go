@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+// forwardedHeader header carrying the forwarding information, see RFC 7239
+const forwardedHeader = "Forwarded"
+
+// setForwarded sets the Forwarded element of req when Handler.EmitForwarded,
+// c is the client connection and proto the protocol the request received by
+func (p *Proxy) setForwarded(c net.Conn, req *Request, proto string, rawHeader []byte) {
+	if !p.Handler.EmitForwarded {
+		return
+	}
+	req.forwarded = forwardedElement(c.RemoteAddr(), c.LocalAddr(),
+		proto, string(http.GetHeaderValue(rawHeader, "Host")))
+}
+
+// forwardedElement makes a forwarded-element of RFC 7239 section 4,
+// the empty parameters are omitted
+func forwardedElement(clientAddr, proxyAddr net.Addr, proto, host string) string {
+	var pairs []string
+	if node := forwardedNode(clientAddr); len(node) > 0 {
+		pairs = append(pairs, "for="+forwardedValue(node))
+	}
+	if node := forwardedNode(proxyAddr); len(node) > 0 {
+		pairs = append(pairs, "by="+forwardedValue(node))
+	}
+	if len(proto) > 0 {
+		pairs = append(pairs, "proto="+forwardedValue(proto))
+	}
+	if len(host) > 0 {
+		pairs = append(pairs, "host="+forwardedValue(host))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// forwardedNode makes the node name of addr, the IPv6 address is enclosed in
+// square brackets, see RFC 7239 section 6, the port is never disclosed
+func forwardedNode(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// forwardedValue returns v as is if it's a token,
+// otherwise the quoted string of v, e.g. an IPv6 node or a host with port
+func forwardedValue(v string) string {
+	isToken := len(v) > 0
+	for i := 0; i < len(v) && isToken; i++ {
+		isToken = isTokenChar(v[i])
+	}
+	if isToken {
+		return v
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		if v[i] == '"' || v[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(v[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isTokenChar is c a tchar of RFC 7230 section 3.2.6
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
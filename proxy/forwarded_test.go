@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardedElement(t *testing.T) {
+	tcpAddr := func(ip string, port int) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	for _, c := range []struct {
+		client, proxy net.Addr
+		proto, host   string
+		expected      string
+	}{
+		{tcpAddr("192.0.2.43", 47011), tcpAddr("203.0.113.60", 8080), "http", "example.com",
+			"for=192.0.2.43;by=203.0.113.60;proto=http;host=example.com"},
+		{tcpAddr("2001:db8:cafe::17", 47011), tcpAddr("::1", 8080), "https", "example.com:8443",
+			`for="[2001:db8:cafe::17]";by="[::1]";proto=https;host="example.com:8443"`},
+		{tcpAddr("::ffff:192.0.2.43", 1), nil, "http", "",
+			"for=192.0.2.43;proto=http"},
+		{&net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"}, nil, "", `a"b`,
+			`for=unknown;host="a\"b"`},
+	} {
+		if e := forwardedElement(c.client, c.proxy, c.proto, c.host); e != c.expected {
+			t.Fatalf("expected forwarded element %s, got %s", c.expected, e)
+		}
+	}
+}
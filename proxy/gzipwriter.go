@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+)
+
+// GzipBodyWriter compresses the recorded bodies with gzip on the fly before
+// written into the sink, e.g. wraps the body writers returned by a Hijacker.
+//
+// Bodies smaller than the threshold are written as they are, the compressed
+// ones are told apart by the gzip magic header `\x1f\x8b`.
+type GzipBodyWriter struct {
+	w         io.Writer
+	threshold int
+
+	// buffer holds the body until it exceeds threshold
+	buffer *bytebufferpool.ByteBuffer
+	gw     *gzip.Writer
+	closed bool
+}
+
+// NewGzipBodyWriter makes a GzipBodyWriter writing into w,
+// bodies with at most threshold bytes are never compressed
+func NewGzipBodyWriter(w io.Writer, threshold int) *GzipBodyWriter {
+	return &GzipBodyWriter{
+		w:         w,
+		threshold: threshold,
+		buffer:    bytebufferpool.Get(),
+	}
+}
+
+// Write writes the body into buffer, or into the gzip writer
+// once the body size exceeds threshold
+func (g *GzipBodyWriter) Write(p []byte) (int, error) {
+	if g.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if g.gw != nil {
+		return g.gw.Write(p)
+	}
+	if g.buffer.Len()+len(p) <= g.threshold {
+		return g.buffer.Write(p)
+	}
+	// threshold exceeded, compress the buffered and the following bytes
+	g.gw = gzip.NewWriter(g.w)
+	if _, err := g.gw.Write(g.buffer.B); err != nil {
+		return 0, err
+	}
+	g.buffer.Reset()
+	return g.gw.Write(p)
+}
+
+// Compressed is the body compressed
+func (g *GzipBodyWriter) Compressed() bool {
+	return g.gw != nil
+}
+
+// Close flushes the body into sink, then closes the sink if it's an io.Closer
+func (g *GzipBodyWriter) Close() error {
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	var err error
+	if g.gw != nil {
+		err = g.gw.Close()
+	} else if g.buffer.Len() > 0 {
+		_, err = g.w.Write(g.buffer.B)
+	}
+	bytebufferpool.Put(g.buffer)
+	g.buffer = nil
+	if c, ok := g.w.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
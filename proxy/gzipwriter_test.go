@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGzipBodyWriter(t *testing.T) {
+	body := strings.Repeat("recorded body ", 100)
+	testGzipBodyWriter(t, body, 100, true)
+	testGzipBodyWriter(t, body, len(body), false)
+	testGzipBodyWriter(t, "", 0, false)
+}
+
+func testGzipBodyWriter(t *testing.T, body string, threshold int, expectingCompressed bool) {
+	sink := &closeRecordingBuffer{}
+	w := NewGzipBodyWriter(sink, threshold)
+	// written in pieces like a streamed body
+	for i := 0; i < len(body); i += 7 {
+		end := i + 7
+		if end > len(body) {
+			end = len(body)
+		}
+		if _, err := w.Write([]byte(body[i:end])); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !sink.closed {
+		t.Fatalf("sink should be closed")
+	}
+	if w.Compressed() != expectingCompressed {
+		t.Fatalf("expected compressed %v, got %v", expectingCompressed, w.Compressed())
+	}
+	recorded := sink.Bytes()
+	if expectingCompressed {
+		r, err := gzip.NewReader(bytes.NewReader(recorded))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if recorded, err = ioutil.ReadAll(r); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if string(recorded) != body {
+		t.Fatalf("expected body %q, got %q", body, recorded)
+	}
+}
+
+type closeRecordingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeRecordingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
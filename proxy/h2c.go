@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"net"
+
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
+)
+
+// h2cPreface the client connection preface of HTTP/2, see RFC 7540 3.5, sent
+// firstly by the h2c clients with prior knowledge, e.g. the plain-text gRPC
+var h2cPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// detectH2C tells the h2c connections by the preface, which are served as the
+// raw tunnels to Handler.H2CTarget, see h2cConn. The bytes are read only as
+// long as they match the preface, so that the HTTP/1.x clients are never
+// blocked, and replayed by the connection returned otherwise. Nil means
+// nothing to serve.
+func (p *Proxy) detectH2C(c net.Conn) (net.Conn, error) {
+	var preface [24]byte
+	for n := 0; n < len(h2cPreface); n++ {
+		if _, err := io.ReadFull(c, preface[n:n+1]); err != nil {
+			if err == io.EOF && n == 0 {
+				return nil, nil
+			}
+			return nil, util.ErrWrapper(err, "fail to read the connection preface")
+		}
+		if preface[n] != h2cPreface[n] {
+			return &bufferedConn{Conn: c, replay: preface[:n+1]}, nil
+		}
+	}
+	hostWithPort := p.Handler.H2CTarget(c.RemoteAddr())
+	if len(hostWithPort) == 0 {
+		p.Handler.Logger.Warn("h2c connection refused without target",
+			field("client", c.RemoteAddr().String()))
+		return nil, nil
+	}
+	return newH2CConn(c, hostWithPort), nil
+}
+
+// h2cConn an h2c client connection served as an HTTP CONNECT request to the
+// target, like socksConn: the CONNECT request made is read firstly, followed
+// by the preface already read and the rest of connection, then the tunnel
+// message is swallowed, as well as anything written after a failure, since
+// h2c clients never speak HTTP/1.x. The tunnel is never decrypted.
+type h2cConn struct {
+	net.Conn
+	request []byte
+	replied bool
+	failed  bool
+}
+
+func newH2CConn(c net.Conn, hostWithPort string) *h2cConn {
+	request := []byte("CONNECT " + hostWithPort + " HTTP/1.1\r\n" +
+		"Host: " + hostWithPort + "\r\n\r\n")
+	return &h2cConn{
+		Conn:    c,
+		request: append(request, h2cPreface...),
+	}
+}
+
+func (c *h2cConn) Read(b []byte) (int, error) {
+	if len(c.request) > 0 {
+		n := copy(b, c.request)
+		c.request = c.request[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *h2cConn) Write(b []byte) (int, error) {
+	if c.replied {
+		if c.failed {
+			return len(b), nil
+		}
+		return c.Conn.Write(b)
+	}
+	c.replied = true
+	c.failed = responseStatus(b) != 200
+	return len(b), nil
+}
+
+func (c *h2cConn) CloseWrite() error {
+	return transport.CloseWrite(c.Conn)
+}
+
+// isH2CConn is c an h2c connection served as a tunnel, see h2cConn
+func isH2CConn(c net.Conn) bool {
+	_, ok := c.(*h2cConn)
+	return ok
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// HandshakeFailure coarse reason of a failed TLS handshake
+// with the client decrypted by proxy
+type HandshakeFailure int
+
+const (
+	// HandshakeFailureOther any other reason, e.g. timed out or no SNI sent
+	HandshakeFailureOther HandshakeFailure = iota
+	// HandshakeFailureClientClosed client closed the connection while handshaking
+	HandshakeFailureClientClosed
+	// HandshakeFailureUnsupportedVersion client offered no TLS version supported
+	HandshakeFailureUnsupportedVersion
+	// HandshakeFailureCertRejected client rejected the fake certificate, e.g. the
+	// certificate authority is not trusted or the certificate is pinned
+	HandshakeFailureCertRejected
+
+	numHandshakeFailures
+)
+
+// String name of the handshake failure reason
+func (f HandshakeFailure) String() string {
+	switch f {
+	case HandshakeFailureClientClosed:
+		return "client_closed"
+	case HandshakeFailureUnsupportedVersion:
+		return "unsupported_version"
+	case HandshakeFailureCertRejected:
+		return "cert_rejected"
+	}
+	return "other"
+}
+
+// handshakeFailureOf the handshake failure reason of err returned by the
+// handshake, the crypto/tls errors are told by their messages
+func handshakeFailureOf(err error) HandshakeFailure {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return HandshakeFailureClientClosed
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if opErr.Timeout() {
+			return HandshakeFailureOther
+		}
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			if sysErr.Err == syscall.ECONNRESET || sysErr.Err == syscall.EPIPE {
+				return HandshakeFailureClientClosed
+			}
+		}
+	}
+	// the alerts from client and the version negotiation are not exported
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "unsupported versions"),
+		strings.Contains(msg, "unsupported SSLv2"),
+		strings.Contains(msg, "tls: protocol version not supported"):
+		return HandshakeFailureUnsupportedVersion
+	case strings.HasPrefix(msg, "remote error: tls: ") && strings.Contains(msg, "certificate"):
+		// alerts of the certificate sent by client, e.g. bad certificate
+		// or unknown certificate authority
+		return HandshakeFailureCertRejected
+	}
+	return HandshakeFailureOther
+}
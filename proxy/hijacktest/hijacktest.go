@@ -0,0 +1,168 @@
+// Package hijacktest provides configurable hijackers and hijacker pools
+// for testing the hijack path of a proxy.Handler.
+package hijacktest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/proxy"
+)
+
+// Hijacker is a proxy.Hijacker recording the requests and responses it sniffs,
+// it returns a canned response instead of the target's one if Response is set
+type Hijacker struct {
+	// Response is the raw http response returned to the client
+	// without requesting the target server if not empty
+	Response []byte
+
+	mu             sync.Mutex
+	requestHeader  []byte
+	requestBody    bytes.Buffer
+	responseHeader []byte
+	responseBody   bytes.Buffer
+	statusCode     int
+}
+
+// OnRequest records the raw request header then the request body
+func (h *Hijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	h.mu.Lock()
+	h.requestHeader = append(h.requestHeader[:0], rawHeader...)
+	h.mu.Unlock()
+	return &lockedWriter{mu: &h.mu, w: &h.requestBody}
+}
+
+// OnResponse records the status code, the raw response header then the response body
+func (h *Hijacker) OnResponse(statusLine http.ResponseLine,
+	header http.Header, rawHeader []byte) io.Writer {
+	h.mu.Lock()
+	h.statusCode = statusLine.GetStatusCode()
+	h.responseHeader = append(h.responseHeader[:0], rawHeader...)
+	h.mu.Unlock()
+	return &lockedWriter{mu: &h.mu, w: &h.responseBody}
+}
+
+// HijackResponse returns the canned Response if any
+func (h *Hijacker) HijackResponse() io.Reader {
+	if len(h.Response) == 0 {
+		return nil
+	}
+	return bytes.NewReader(h.Response)
+}
+
+// RequestHeader returns the raw request header recorded
+func (h *Hijacker) RequestHeader() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]byte(nil), h.requestHeader...)
+}
+
+// RequestBody returns the request body recorded
+func (h *Hijacker) RequestBody() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]byte(nil), h.requestBody.Bytes()...)
+}
+
+// StatusCode returns the status code of the response recorded,
+// 0 if no response from the target server is sniffed
+func (h *Hijacker) StatusCode() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.statusCode
+}
+
+// ResponseHeader returns the raw response header recorded
+func (h *Hijacker) ResponseHeader() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]byte(nil), h.responseHeader...)
+}
+
+// ResponseBody returns the response body recorded
+func (h *Hijacker) ResponseBody() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]byte(nil), h.responseBody.Bytes()...)
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// Pool is a proxy.HijackerPool making a new Hijacker for every request,
+// it keeps track of the Get and Put calls
+type Pool struct {
+	// Response is the canned response of every hijacker made, see Hijacker.Response
+	Response []byte
+
+	// New makes the hijacker of the request to host if set,
+	// overriding the Response
+	New func(host string) *Hijacker
+
+	mu        sync.Mutex
+	hijackers []*Hijacker
+	hosts     []string
+	puts      int
+}
+
+// Get makes a new hijacker for the request
+func (p *Pool) Get(clientAddr net.Addr, host string, method, path []byte,
+	userdata *proxy.UserData) proxy.Hijacker {
+	var h *Hijacker
+	if p.New != nil {
+		h = p.New(host)
+	} else {
+		h = &Hijacker{Response: p.Response}
+	}
+	p.mu.Lock()
+	p.hijackers = append(p.hijackers, h)
+	p.hosts = append(p.hosts, host)
+	p.mu.Unlock()
+	return h
+}
+
+// Put records the hijacker is put back
+func (p *Pool) Put(proxy.Hijacker) {
+	p.mu.Lock()
+	p.puts++
+	p.mu.Unlock()
+}
+
+// Gets returns the number of Get calls
+func (p *Pool) Gets() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.hijackers)
+}
+
+// Puts returns the number of Put calls
+func (p *Pool) Puts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.puts
+}
+
+// Hijackers returns the hijackers made in order of the Get calls
+func (p *Pool) Hijackers() []*Hijacker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Hijacker(nil), p.hijackers...)
+}
+
+// Hosts returns the target hosts given to the Get calls
+func (p *Pool) Hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.hosts...)
+}
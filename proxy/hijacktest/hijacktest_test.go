@@ -0,0 +1,143 @@
+package hijacktest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/proxy"
+	"github.com/haxii/log"
+)
+
+func serveTestProxy(port int, pool proxy.HijackerPool) {
+	p := proxy.Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: proxy.Handler{
+			ShouldDecryptHost: func(userdata *proxy.UserData, host string) bool {
+				return false
+			},
+			RewriteURL: func(userdata *proxy.UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			HijackerPool: pool,
+		},
+	}
+	if err := p.Serve("tcp4", fmt.Sprintf("0.0.0.0:%d", port)); err != nil {
+		panic(err)
+	}
+}
+
+func proxyGet(t *testing.T, proxyPort int, target string) (int, string) {
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", proxyPort))
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	resp, err := httpClient.Post(target, "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// waitPuts waits the pool to get n hijackers back,
+// which is done after the response is sent to the client
+func waitPuts(t *testing.T, p *Pool, n int) {
+	for i := 0; i < 100 && p.Puts() < n; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if p.Puts() != n || p.Gets() != n {
+		t.Fatalf("expected %d gets and puts, got %d gets and %d puts", n, p.Gets(), p.Puts())
+	}
+}
+
+func TestPoolRecordingHijacker(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:9451")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("X-Target", "yes")
+		fmt.Fprint(w, "pong")
+	}))
+	pool := &Pool{}
+	go serveTestProxy(5106, pool)
+	time.Sleep(time.Millisecond * 10)
+
+	status, body := proxyGet(t, 5106, "http://127.0.0.1:9451/path")
+	if status != nethttp.StatusOK || body != "pong" {
+		t.Fatalf("expected the target response, got %d %q", status, body)
+	}
+	waitPuts(t, pool, 1)
+	if hosts := pool.Hosts(); len(hosts) != 1 || hosts[0] != "127.0.0.1:9451" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	h := pool.Hijackers()[0]
+	if !bytes.Contains(h.RequestHeader(), []byte("Content-Type: text/plain")) {
+		t.Fatalf("request header not recorded: %q", h.RequestHeader())
+	}
+	if string(h.RequestBody()) != "ping" {
+		t.Fatalf("expected request body %q, got %q", "ping", h.RequestBody())
+	}
+	if h.StatusCode() != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, h.StatusCode())
+	}
+	if !bytes.Contains(h.ResponseHeader(), []byte("X-Target: yes")) {
+		t.Fatalf("response header not recorded: %q", h.ResponseHeader())
+	}
+	if string(h.ResponseBody()) != "pong" {
+		t.Fatalf("expected response body %q, got %q", "pong", h.ResponseBody())
+	}
+}
+
+func TestPoolCannedResponse(t *testing.T) {
+	pool := &Pool{
+		Response: []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\nblocked"),
+	}
+	go serveTestProxy(5107, pool)
+	time.Sleep(time.Millisecond * 10)
+
+	// nothing listens on the target, the canned response is returned anyway
+	status, body := proxyGet(t, 5107, "http://127.0.0.1:9452/")
+	if status != nethttp.StatusForbidden || body != "blocked" {
+		t.Fatalf("expected the canned response, got %d %q", status, body)
+	}
+	waitPuts(t, pool, 1)
+	// the canned response is sniffed as the response of the target
+	if h := pool.Hijackers()[0]; h.StatusCode() != nethttp.StatusForbidden ||
+		string(h.ResponseBody()) != "blocked" {
+		t.Fatalf("canned response not recorded, got %d %q", h.StatusCode(), h.ResponseBody())
+	}
+}
+
+func TestPoolNew(t *testing.T) {
+	pool := &Pool{
+		New: func(host string) *Hijacker {
+			if strings.HasPrefix(host, "blocked.test") {
+				return &Hijacker{Response: []byte("HTTP/1.1 204 No Content\r\n\r\n")}
+			}
+			return &Hijacker{}
+		},
+	}
+	if h := pool.Get(nil, "blocked.test:80", nil, nil, nil); h.HijackResponse() == nil {
+		t.Fatalf("expected a canned response")
+	}
+	if h := pool.Get(nil, "allowed.test:80", nil, nil, nil); h.HijackResponse() != nil {
+		t.Fatalf("expected no canned response")
+	}
+	if pool.Gets() != 2 || pool.Puts() != 0 {
+		t.Fatalf("expected 2 gets and no puts, got %d and %d", pool.Gets(), pool.Puts())
+	}
+}
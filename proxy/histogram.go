@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets upper bounds of the latency histograms made when
+// serving, see Stats
+var DefaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
+// Histogram counts the durations observed by the buckets they fall in, a
+// duration falls in the first bucket with the upper bound not less than it,
+// or the overflow bucket beyond all the bounds.
+//
+// Observing is lock free and safe calling concurrently with the getters,
+// a nil Histogram observes nothing.
+type Histogram struct {
+	bounds []time.Duration
+	// counts per bucket, the last one is the overflow bucket
+	counts []uint64
+	count  uint64
+	// sum in nanoseconds
+	sum int64
+}
+
+// NewHistogram makes a histogram with the bucket upper bounds given in any
+// order, DefaultLatencyBuckets is used if none given
+func NewHistogram(bounds ...time.Duration) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBuckets
+	}
+	h := &Histogram{bounds: append([]time.Duration(nil), bounds...)}
+	sort.Slice(h.bounds, func(i, j int) bool { return h.bounds[i] < h.bounds[j] })
+	h.counts = make([]uint64, len(h.bounds)+1)
+	return h
+}
+
+// Observe counts d into its bucket
+func (h *Histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Bounds returns the bucket upper bounds in ascending order
+func (h *Histogram) Bounds() []time.Duration {
+	if h == nil {
+		return nil
+	}
+	return append([]time.Duration(nil), h.bounds...)
+}
+
+// Counts returns the counts per bucket in the order of Bounds, not
+// cumulative, followed by the count of overflow bucket
+func (h *Histogram) Counts() []uint64 {
+	if h == nil {
+		return nil
+	}
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return counts
+}
+
+// Count returns the number of durations observed
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of durations observed
+func (h *Histogram) Sum() time.Duration {
+	if h == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&h.sum))
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(100*time.Millisecond, 10*time.Millisecond, time.Second)
+	expectedBounds := []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+	if !reflect.DeepEqual(h.Bounds(), expectedBounds) {
+		t.Fatalf("expected bounds %v, got %v", expectedBounds, h.Bounds())
+	}
+	for _, d := range []time.Duration{
+		0, 5 * time.Millisecond, 10 * time.Millisecond, // the first bucket
+		11 * time.Millisecond,        // the second
+		time.Second,                  // the third
+		2 * time.Second, time.Minute, // beyond all
+	} {
+		h.Observe(d)
+	}
+	expectedCounts := []uint64{3, 1, 1, 2}
+	if !reflect.DeepEqual(h.Counts(), expectedCounts) {
+		t.Fatalf("expected counts %v, got %v", expectedCounts, h.Counts())
+	}
+	if h.Count() != 7 {
+		t.Fatalf("expected 7 observed, got %d", h.Count())
+	}
+	if sum := 63*time.Second + 26*time.Millisecond; h.Sum() != sum {
+		t.Fatalf("expected sum %s, got %s", sum, h.Sum())
+	}
+
+	if bounds := NewHistogram().Bounds(); !reflect.DeepEqual(bounds, DefaultLatencyBuckets) {
+		t.Fatalf("expected default buckets, got %v", bounds)
+	}
+
+	var nilHistogram *Histogram
+	nilHistogram.Observe(time.Second)
+	if nilHistogram.Count() != 0 || nilHistogram.Counts() != nil {
+		t.Fatal("expected nothing observed by nil histogram")
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// overrideTarget connects the target returned by HostOverride rather than the
+// host of req, the host is still sent to target in the Host header and SNI
+func (p *Proxy) overrideTarget(req *Request) error {
+	if p.Handler.HostOverride == nil {
+		return nil
+	}
+	hostInfo := req.reqLine.HostInfo()
+	newHost, ok := p.Handler.HostOverride(hostInfo.HostWithPort())
+	if !ok {
+		return nil
+	}
+	host, port := newHost, hostInfo.Port()
+	if h, p, err := net.SplitHostPort(newHost); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := transport.LookupTCPAddrs(net.JoinHostPort(host, port))
+		if err != nil {
+			return err
+		}
+		ip = addrs[0].IP
+	}
+	hostInfo.SetTarget(ip, port)
+	return nil
+}
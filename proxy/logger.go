@@ -0,0 +1,34 @@
+package proxy
+
+// EventLogger leveled logger for the proxy events, e.g. dial failure,
+// TLS handshake failure, rejected connections, tunnel start and end
+type EventLogger interface {
+	Debug(msg string, fields ...LogField)
+	Info(msg string, fields ...LogField)
+	Warn(msg string, fields ...LogField)
+	Error(msg string, err error, fields ...LogField)
+}
+
+// LogField structured field of an event log
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// field makes a log field
+func field(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+var defaultNopEventLogger = &nopEventLogger{}
+
+// nopEventLogger event logger which logs nothing
+type nopEventLogger struct{}
+
+func (*nopEventLogger) Debug(msg string, fields ...LogField) {}
+
+func (*nopEventLogger) Info(msg string, fields ...LogField) {}
+
+func (*nopEventLogger) Warn(msg string, fields ...LogField) {}
+
+func (*nopEventLogger) Error(msg string, err error, fields ...LogField) {}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// DefaultBlockedNetworks networks blocked by BlockPrivateNetworks when
+// Handler.BlockedNetworks not set, i.e. the private, loopback, link-local
+// and other reserved ranges
+var DefaultBlockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // RFC 1918
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, e.g. cloud metadata services
+	"172.16.0.0/12",  // RFC 1918
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // RFC 1918
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+var errPrivateNetworkBlocked = errors.New("target in private network blocked")
+
+// permittedTarget returns the first IP of the target of req not in networks,
+// the target is resolved by the dialer's cache if it's not an IP nor resolved
+// by LookupIP yet. errPrivateNetworkBlocked is returned with the first IP
+// blocked if none permitted.
+//
+// The direct connections are then made by client to exactly the permitted
+// addresses resolved, see client.Client.PermitTargetIP, rather than the IP
+// returned, which is pinned by the super proxies only.
+func permittedTarget(req *Request, networks []*net.IPNet) (net.IP, error) {
+	hostInfo := req.reqLine.HostInfo()
+	if ip := hostInfo.IP(); ip != nil {
+		if isIPBlocked(ip, networks) {
+			return ip, errPrivateNetworkBlocked
+		}
+		return ip, nil
+	}
+	addrs, err := transport.LookupTCPAddrs(hostInfo.HostWithPort())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !isIPBlocked(addr.IP, networks) {
+			return addr.IP, nil
+		}
+	}
+	return addrs[0].IP, errPrivateNetworkBlocked
+}
+
+// isIPBlocked is ip in one of the networks
+func isIPBlocked(ip net.IP, networks []*net.IPNet) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsIPBlocked(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1",
+		"169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		if !isIPBlocked(net.ParseIP(ip), DefaultBlockedNetworks) {
+			t.Fatalf("%s should be blocked", ip)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "93.184.216.34", "172.32.0.1", "2001:4860:4860::8888"} {
+		if isIPBlocked(net.ParseIP(ip), DefaultBlockedNetworks) {
+			t.Fatalf("%s should not be blocked", ip)
+		}
+	}
+}
+
+func TestPermittedTarget(t *testing.T) {
+	req := &Request{}
+	req.reqLine.HostInfo().ParseHostWithPort("localhost:80", false)
+	if ip, err := permittedTarget(req, DefaultBlockedNetworks); err != errPrivateNetworkBlocked || !ip.IsLoopback() {
+		t.Fatalf("expected loopback ip blocked, got %s and error %v", ip, err)
+	}
+	ip, err := permittedTarget(req, mustParseCIDRs("10.0.0.0/8"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ip.IsLoopback() {
+		t.Fatalf("expected loopback ip, got %s", ip)
+	}
+	// never pinned, the direct connections are dialed to every permitted address
+	if target := req.reqLine.HostInfo().TargetWithPort(); target != "localhost:80" {
+		t.Fatalf("unexpected target %s", target)
+	}
+}
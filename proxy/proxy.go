@@ -1,11 +1,19 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/haxii/fastproxy/bufiopool"
@@ -15,6 +23,7 @@ import (
 	"github.com/haxii/fastproxy/server"
 	"github.com/haxii/fastproxy/servertime"
 	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
 	"github.com/haxii/fastproxy/usage"
 	"github.com/haxii/fastproxy/util"
 	"github.com/haxii/log"
@@ -23,8 +32,23 @@ import (
 // DefaultServerShutdownWaitTime used when ServerShutdownWaitTime not set
 var DefaultServerShutdownWaitTime = time.Second * 30
 
+// DefaultConnectWriteTimeout used when ConnectWriteTimeout not set
+var DefaultConnectWriteTimeout = time.Second * 10
+
+// DefaultMaxDrainBodySize used when MaxDrainBodySize not set
+var DefaultMaxDrainBodySize = 64 * 1024
+
 // Proxy is a HTTP / HTTPS forward proxy with the ability to
 // sniff or modify the forwarding traffic
+//
+// Pipelined HTTP requests from a client connection are supported serially,
+// i.e. each request is forwarded and its response is written back before
+// the next one is read, responses are never reordered nor concurrent.
+//
+// Serve, or ServeListener with a listener owned by caller, is the entry point:
+// each accepted connection is checked by Handler.ShouldAllowConnection, then
+// its CONNECT requests are tunneled or decrypted, see Handler.ShouldDecryptHost,
+// while the others are forwarded as plain HTTP.
 type Proxy struct {
 	// ProxyLogger proxy error logger
 	Logger log.Logger
@@ -38,6 +62,49 @@ type Proxy struct {
 	// Default buffer size is used if not set.
 	ReadBufferSize int
 
+	// MaxHeaderSize max header size in bytes of both the requests and the
+	// upstream responses, the headers larger than ReadBufferSize are read
+	// up to it. Requests exceeding it are responded with 431, responses
+	// with 502.
+	//
+	// http.DefaultMaxHeaderSize is used for the headers larger than
+	// ReadBufferSize if not set.
+	MaxHeaderSize int
+
+	// MaxRequestLineLength max length in bytes of the request line, i.e.
+	// method, request target and protocol version, requests exceeding it
+	// are responded with 414. No limit if not set.
+	MaxRequestLineLength int
+
+	// MaxHeaderFields max header field count of both the requests and
+	// the upstream responses, no limit if not set.
+	MaxHeaderFields int
+
+	// StrictHeaderParsing rejects the headers of both the requests and the
+	// upstream responses with lines not ended by CRLF, bare CR, NUL or the
+	// malformed field names, defending the request smuggling caused by the
+	// servers parsing them differently. Requests rejected are responded with
+	// 400, responses with 502.
+	StrictHeaderParsing bool
+
+	// MaxChunkSize max size in bytes of every chunk of the chunked bodies of
+	// both the requests and the upstream responses, the forwarding fails
+	// when exceeded, before the chunk is read. No limit if not set.
+	MaxChunkSize int
+
+	// MaxChunkLineSize max length in bytes of every chunk size line, i.e.
+	// the chunk size with the extensions, of the chunked bodies of both the
+	// requests and the upstream responses, the forwarding fails when exceeded.
+	// No limit other than the read buffer size if not set.
+	MaxChunkLineSize int
+
+	// MaxDrainBodySize max size in bytes of the request body drained and
+	// discarded for a hijacked response, so that the next request on the
+	// client connection is read from its start. The body exceeding it is
+	// left unread and the connection closed after the response instead.
+	// DefaultMaxDrainBodySize is used when not set.
+	MaxDrainBodySize int
+
 	// Per-connection buffer size for responses' writing.
 	//
 	// Default buffer size is used if not set.
@@ -49,14 +116,17 @@ type Proxy struct {
 	// server basic connection server used by proxy
 	server server.Server
 
-	// MaxClientIdleDuration max idle duration for client connection
-	// TODO: http? @daizong refer fasthttp's idle handler
+	// ServerIdleDuration max idle duration for client connection waiting for
+	// the next request, the idle connection is responded with 408 then closed
 	ServerIdleDuration time.Duration
 
 	// ServerReadTimeout read timeout for server connection
 	ServerReadTimeout time.Duration
 	// ServerWriteTimeout write timeout for server connection
 	ServerWriteTimeout time.Duration
+	// ConnectWriteTimeout write timeout for the CONNECT response sent to client
+	// DefaultConnectWriteTimeout is used when not set
+	ConnectWriteTimeout time.Duration
 
 	// Concurrency max simultaneous connections per client
 	ServerConcurrency int
@@ -78,6 +148,11 @@ type Proxy struct {
 	ForwardReadTimeout time.Duration
 	// ForwardWriteTimeout write timeout for target forwarding host
 	ForwardWriteTimeout time.Duration
+
+	// ForwardRetryAfterMax max delay honored for the Retry-After of the 503 and
+	// 429 responses to GET and HEAD requests, which are retried after the delay
+	// instead of being responded. Retry-After is not honored when not set
+	ForwardRetryAfterMax time.Duration
 	//TODO: integrate this timeout with forwarding may be?
 
 	// used by server and client: http request and response pool
@@ -92,6 +167,46 @@ type Proxy struct {
 
 	// Usage usage
 	Usage usage.ProxyUsage
+
+	// Stats live counters of connections, requests and errors
+	Stats Stats
+
+	// ConnStatsWindow the sliding window of the transfer rates of every
+	// client connection being served, listed by ActiveConnStats, e.g. for
+	// spotting the stalled or runaway transfers. The connections are never
+	// spliced when set. No per connection stats kept if not set.
+	ConnStatsWindow time.Duration
+
+	// connStats stats of the client connections being served as keys
+	connStats sync.Map
+
+	// decryptDecisions cached by Handler.DecryptDecisionCacheTTL
+	decryptDecisions decryptDecisionCache
+
+	// mitmSessionTicketKeys session ticket keys for https decryption
+	mitmSessionTicketKeys mitm.SessionTicketKeyRing
+
+	// mitmCertAuthorityErr why Handler.MITMCertAuthority is unable to sign
+	// certs, the https decryption is disabled then, nil when valid
+	mitmCertAuthorityErr error
+
+	// mitmCertCache fake server certificates cached for https decryption,
+	// nil when neither Handler.MITMCertCacheSize nor the limit set
+	mitmCertCache *mitm.CertCache
+
+	// via the hop appended to Via headers, made from Handler.ProxyName
+	via []byte
+
+	// tunnelMadeOKayBytes the CONNECT success response,
+	// made from Handler.ConnectResponseHeaders
+	tunnelMadeOKayBytes []byte
+
+	// connSemaphore limits the concurrent connections of the whole proxy,
+	// nil when Handler.MaxConcurrentConns not set
+	connSemaphore chan struct{}
+
+	// socks5Only every connection is served as SOCKS5, see ServeSOCKS5
+	socks5Only bool
 }
 
 // Handler proxy handlers
@@ -102,43 +217,359 @@ type Handler struct {
 	// HTTPSDecryptEnable test if host's https connection should be decrypted
 	ShouldDecryptHost func(userdata *UserData, host string) bool
 
-	// RewriteURL rewrites url
+	// DecryptDecisionCacheTTL caches the decisions of ShouldDecryptHost by
+	// host for the duration, so that the repeated CONNECTs to a host skip
+	// the expensive callbacks. The decision is shared by all clients then,
+	// regardless of the userdata. Nothing cached if not set
+	DecryptDecisionCacheTTL time.Duration
+
+	// ShouldDecryptSNI decides the https decryption by the server name sent in
+	// the TLS ClientHello rather than the CONNECT host, i.e. ShouldDecryptHost
+	// is not used if set. The server name is empty if client sends no SNI.
+	//
+	// Since the ClientHello is peeked after the tunnel made message, failures
+	// of the tunnel or decryption close the connection without responses, and
+	// the tunnels of the protocols expecting server to speak first, e.g. SMTP,
+	// must be excluded by RawTunnelPorts.
+	ShouldDecryptSNI func(userdata *UserData, connectHost, serverName string) bool
+
+	// ClientHelloMaxSize max bytes buffered reading the ClientHello for
+	// ShouldDecryptSNI, the server name is empty for a larger ClientHello.
+	// DefaultClientHelloMaxSize is used if not set
+	ClientHelloMaxSize int
+
+	// EnforceHostMatch responds 421 to the decrypted requests whose SNI, Host
+	// header or absolute request URI host mismatches the CONNECT host, since the
+	// request is always sent to the CONNECT host, whatever host it claims
+	EnforceHostMatch bool
+
+	// HostMatches reports whether the host claimed by a decrypted request matches
+	// the CONNECT host when EnforceHostMatch set, e.g. allowing the subdomains.
+	// Hosts are compared case-insensitively if not set. Ports are excluded.
+	HostMatches func(connectHost, host string) bool
+
+	// ShouldBlockHost blocks the requests to the host by policy before
+	// RewriteURL, responded with 403, or the TunnelFailureBlocked response
+	// for CONNECT requests, see TunnelFailureResponse. Nothing blocked if not set
+	ShouldBlockHost func(userdata *UserData, hostWithPort string) bool
+
+	// RewriteURL rewrites url, the requests are responded with 512 session
+	// unavailable when empty returned
 	RewriteURL func(userdata *UserData, hostWithPort string) string
 
 	// URLProxy url specified proxy, nil path means this is a un-decrypted https traffic
 	URLProxy func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy
 
-	// LookupIP returns ip string, should not block for long time
+	// ClientURLProxy URLProxy with the client address, e.g. for routing the
+	// clients to different super proxies, see superproxy.StickyBalancer.
+	// URLProxy is used if not set.
+	ClientURLProxy func(clientAddr net.Addr, userdata *UserData,
+		hostWithPort string, path []byte) *superproxy.SuperProxy
+
+	// TunnelFallbackProxies the super proxies tried in order when failed to
+	// make the tunnel of a CONNECT request not decrypted with the one routed
+	// by ClientURLProxy, or directly if none routed, e.g. the rest of the
+	// pool. The tunnel made message is only sent once a tunnel made, and the
+	// failure message only when all failed. Never retried if not set
+	TunnelFallbackProxies func(userdata *UserData, hostWithPort string) []*superproxy.SuperProxy
+
+	// LookupIP returns ip string, should not block for long time. When nil
+	// returned, e.g. the local lookup failed, the domain is sent as it is,
+	// a SOCKS5 super proxy resolves it remotely then, while the direct
+	// connections resolve it by the dialer
 	LookupIP func(userdata *UserData, domain string) net.IP
 
+	// HostOverride returns the host with optional port connected instead of
+	// the target host with port when ok, like an in-process hosts file with
+	// port remapping. The original host is still sent in the Host header and
+	// SNI. A domain returned is resolved locally into the first IPv4 address.
+	HostOverride func(host string) (newHost string, ok bool)
+
+	// LocalAddr the local address the connections to the target hosts are
+	// bound to, e.g. `192.0.2.10:0` choosing the egress IP on a multi-homed
+	// host. The connections to super proxies are bound by their own
+	// SuperProxy.LocalAddr. The system chooses it if not set
+	LocalAddr *net.TCPAddr
+
+	// LocalAddrFor returns the local address the connections of a request to
+	// host with port are bound to instead of LocalAddr, e.g. for rotating the
+	// egress IPs, LocalAddr is used if not set or nil returned. The idle
+	// connections are only reused by the requests bound to the same address
+	LocalAddrFor func(userdata *UserData, hostWithPort string) *net.TCPAddr
+
+	// BlockPrivateNetworks refuses the requests to the targets in BlockedNetworks
+	// with 403, e.g. for preventing SSRF. The target domains not resolved by
+	// LookupIP are then resolved locally by the dialer, even for the super
+	// proxies, which connect the first permitted IP. The direct connections
+	// are made to the permitted addresses only, checked exactly as dialed,
+	// which defeats the DNS rebinding.
+	BlockPrivateNetworks bool
+
+	// BlockedNetworks networks refused by BlockPrivateNetworks,
+	// DefaultBlockedNetworks is used if not set
+	BlockedNetworks []*net.IPNet
+
+	// RewriteStatus rewrites the response status from host, when rewrite is true,
+	// the original response body is drained and discarded, then a response with
+	// the new status and body is sent to client instead
+	RewriteStatus func(host string, status int) (newStatus int, body []byte, rewrite bool)
+
+	// AddResponseHeaders returns the headers added to the responses from host
+	// before sent to client, e.g. Strict-Transport-Security, a header already
+	// in the response is never added again, nor the framing and hop-by-hop
+	// headers, e.g. Content-Length, Transfer-Encoding and Connection
+	AddResponseHeaders func(host string) map[string]string
+
+	// EmitUpstreamHeader adds the UpstreamHeader to the responses, naming the
+	// super proxy or UpstreamDirect serving the request, e.g. for diagnosing
+	// the routing. The one already in the response, e.g. from a chained proxy,
+	// is kept. The tunnels are never modified but logged with the upstream
+	EmitUpstreamHeader bool
+
+	// ForwardOptions returns the options forwarding the request to host, e.g.
+	// the timeouts or TLS settings of a specific target, which override the
+	// Forward* settings of proxy. Nothing is overridden if nil returned
+	ForwardOptions func(userdata *UserData, host string) *client.RequestOptions
+
 	// hijacker pool for making a hijacker for every incoming request
 	HijackerPool HijackerPool
 
-	// MITMCertAuthority root certificate authority used for https decryption
+	// AuditLog receives the audit record of every http request forwarded,
+	// including the decrypted ones, once the response is sent, e.g. for
+	// the compliance logging. It should not block for long. The tunnels are
+	// never audited
+	AuditLog func(record *AuditRecord)
+
+	// AuditHeaders names of the request and response headers recorded by
+	// AuditLog, matched case-insensitively. No headers recorded if not set
+	AuditHeaders []string
+
+	// AuditRedactHeaders names of the headers in AuditHeaders whose values are
+	// redacted as AuditRedacted, DefaultAuditRedactHeaders is used if nil
+	AuditRedactHeaders []string
+
+	// AuditRedactRequestLine redacts the userinfo and query of the request
+	// target in AuditRecord.RequestLine as AuditRedacted, which could carry
+	// the credentials or tokens. The request line is recorded as is if false
+	AuditRedactRequestLine bool
+
+	// MITMCertAuthority root certificate authority used for https decryption,
+	// the default MITM certificate authority is used if not set. The https
+	// requests are tunneled without decryption if it's unable to sign certs,
+	// e.g. not a CA or without private key, which is logged on serving
 	MITMCertAuthority *tls.Certificate
+
+	// MITMCertSigner signs the certificates used for https decryption instead
+	// of MITMCertAuthority when set, e.g. by an HSM or a remote signing service,
+	// so that the certificate authority private key never loaded by the proxy.
+	// It must be a pointer or a mitm.KeyedCertSigner when the certs cached or
+	// limited, the https requests are tunneled without decryption otherwise
+	MITMCertSigner mitm.CertSigner
+
+	// CertNamesFor returns the domain names covered by the certificate made for
+	// https decryption, using the CONNECT host and the client hello, the server name
+	// in client hello, or the CONNECT host if no SNI sent, is used if not set or
+	// nothing returned
+	CertNamesFor func(connectHost string, hello *tls.ClientHelloInfo) []string
+
+	// RawTunnelPorts CONNECT requests to these target ports are always tunneled
+	// as raw bytes and never decrypted, even if ShouldDecryptHost returns true,
+	// e.g. "80" for the clients tunneling plain HTTP
+	RawTunnelPorts []string
+
+	// MaxTunnelDuration closes the tunnels, i.e. the CONNECT requests not
+	// decrypted, lasting longer than it regardless of the activity, e.g. for
+	// preventing the abuse of the long-lived tunnels, while the idle ones are
+	// closed by Proxy.ForwardIdleConnDuration. Never limited if not set
+	MaxTunnelDuration time.Duration
+
+	// MITMRequireSNI fails the https decryption when client sends no SNI,
+	// otherwise the CONNECT host is used for both certificate and target
+	MITMRequireSNI bool
+
+	// MITMSessionTicketKeys session ticket keys shared by the https decryption
+	// fake servers, the first key is used for encryption. Keys are generated and
+	// rotated automatically if not set.
+	MITMSessionTicketKeys [][32]byte
+
+	// MITMCipherSuites the cipher suites of TLS 1.2 and below accepted by the
+	// https decryption fake servers, e.g. only the AEAD ones to match the
+	// compliance baseline. Go's secure defaults are used if not set.
+	MITMCipherSuites []uint16
+
+	// MITMCertCacheSize max number of the fake server certificates cached for
+	// the https decryption, the least recently used one is evicted when
+	// exceeded. Every handshake signs a new certificate if not set.
+	MITMCertCacheSize int
+
+	// MITMCertGenerationLimit max number of the fake server certificates newly
+	// signed in MITMCertGenerationWindow, e.g. against a flood of unique SNIs,
+	// the CONNECT requests beyond are tunneled without decryption. The
+	// ClientHello is read before the decryption for the server name of the
+	// cert then. No limit if not set.
+	MITMCertGenerationLimit int
+
+	// MITMCertGenerationWindow the time window MITMCertGenerationLimit applied
+	// to, mitm.DefaultCertGenerationWindow is used if not set.
+	MITMCertGenerationWindow time.Duration
+
+	// UpstreamClientCert returns the client certificate presented to the https
+	// target host (with port) when it requests one, no certificate is presented
+	// if not set or nil returned
+	UpstreamClientCert func(host string) *tls.Certificate
+
+	// UpstreamNextProtos ALPN protocols offered to the https target hosts,
+	// client.DefaultNextProtos, i.e. only http/1.1, is used if not set
+	UpstreamNextProtos []string
+
+	// MaxConcurrentConns max simultaneous connections served by the whole proxy,
+	// new connections are rejected with 503 when saturated, zero means unlimited
+	MaxConcurrentConns int
+
+	// DropOnConcurrencyLimit closes the rejected connections silently
+	// rather than responding 503 when MaxConcurrentConns exceeded
+	DropOnConcurrencyLimit bool
+
+	// ConnectResponseHeaders headers sent along with the `200 Connection
+	// Established` response of CONNECT requests, e.g. Proxy-Agent
+	ConnectResponseHeaders map[string]string
+
+	// TunnelFailureResponse returns the status and body responded to the failed
+	// CONNECT requests by the failure cause, the default status of cause, see
+	// TunnelFailure.Status, with a short message is used if not set or zero
+	// status returned
+	TunnelFailureResponse func(cause TunnelFailure, err error) (status int, body []byte)
+
+	// ProxyName appends `Via: 1.1 <ProxyName>` to both forwarded requests and
+	// returned responses when set, requests already via the proxy name are
+	// responded with 508 loop detected
+	ProxyName string
+
+	// Logger logs the proxy events such as dial and handshake failures,
+	// rejected connections as well as tunnel start and end, for observability
+	// purpose only. Nothing is logged if not set.
+	Logger EventLogger
+
+	// InjectRequestID adds the X-Request-Id header carrying the request's unique
+	// ID into the forwarded requests, unless the client already sent one. The ID
+	// is also given to hijackers by user data, see UserDataRequestIDKey.
+	InjectRequestID bool
+
+	// EmitForwarded adds a Forwarded header of RFC 7239 carrying the client
+	// address, the proxy address, the protocol and the host the request is
+	// received by into the forwarded requests. The Forwarded headers already
+	// sent by client are kept, the new one is added after them.
+	EmitForwarded bool
+
+	// RoutingBodySize reads ahead the HTTP request bodies of Content-Length
+	// no more than this size before choosing the super proxy, the bodies read
+	// ahead are given to ClientURLProxy and URLProxy by user data for content
+	// based routing, see UserDataRequestBodyKey, then still sent to target.
+	// The larger or chunked bodies, the bodies expected to be sent after 100
+	// Continue and the bodies beyond ReadBufferSize are streamed as usual.
+	// The decrypted HTTPS requests are routed along with their CONNECT
+	// requests, never by the bodies. No body is read ahead if not set.
+	RoutingBodySize int
+
+	// AutoContinue responds 100 Continue to the HTTP/1.1 clients sending the
+	// `Expect: 100-continue` header right away, then forwards the body without
+	// waiting for the target, which may never send a 100 Continue. The 100
+	// Continue sent by target is discarded then, client never gets two.
+	AutoContinue bool
+
+	// AutoDetectProtocol serves both the SOCKS5 and HTTP clients on the same
+	// listener, telling them by the first byte. Only the SOCKS5 CONNECT command
+	// is supported, it's served the same way as an HTTP CONNECT request to the
+	// target, the SOCKS4 clients are rejected.
+	AutoDetectProtocol bool
+
+	// H2CTarget returns the host with port the h2c connections of the client,
+	// i.e. the plain HTTP/2 with prior knowledge such as the plain-text gRPC,
+	// are tunneled to as raw bytes, since the HTTP/2 preface carries no target.
+	// They are told by the preface, then served as CONNECT requests to the
+	// target never decrypted, and closed if empty returned. The HTTP/2
+	// preface is parsed as HTTP/1.x if not set.
+	H2CTarget func(clientAddr net.Addr) string
+
+	// SOCKS5Authenticate requires the SOCKS5 clients to authenticate with
+	// username and password of RFC 1929 when set, the clients are accepted
+	// when it returns true. The username is then given by user data, see
+	// UserDataSOCKS5UserKey. No authentication is required if not set.
+	SOCKS5Authenticate func(user, pass string) bool
 }
 
+var errNoLogger = errors.New("no logger provided")
+
 // Serve serve on the provided ip address
 func (p *Proxy) Serve(network, addr string) error {
 	if p.Logger == nil {
-		return errors.New("no logger provided")
+		return errNoLogger
 	}
-	p.bufioPool = bufiopool.New(p.ReadBufferSize, p.WriteBufferSize)
+	ln, lnErr := net.Listen(network, addr)
+	if lnErr != nil {
+		return lnErr
+	}
+	return p.ServeListener(ln)
+}
 
-	// setup server
+// ServeSOCKS5 serves the SOCKS5 clients on the provided ip address, the
+// SOCKS5 CONNECT requests are served the same way as HTTP CONNECT requests,
+// see Handler.AutoDetectProtocol for serving both on the same address
+func (p *Proxy) ServeSOCKS5(network, addr string) error {
+	if p.Logger == nil {
+		return errNoLogger
+	}
 	ln, lnErr := net.Listen(network, addr)
 	if lnErr != nil {
 		return lnErr
 	}
-	if p.ServerShutdownWaitTime <= 0 {
-		p.ServerShutdownWaitTime = DefaultServerShutdownWaitTime
+	return p.ServeSOCKS5Listener(ln)
+}
+
+// ServeSOCKS5Listener serves the SOCKS5 clients accepted from ln, see ServeSOCKS5
+func (p *Proxy) ServeSOCKS5Listener(ln net.Listener) error {
+	p.socks5Only = true
+	return p.ServeListener(ln)
+}
+
+// ServeListener serves the connections accepted from ln, e.g. a listener owned
+// by the caller. The temporary accept errors are retried with exponential
+// backoff, while a permanent one stops the serving and is returned.
+func (p *Proxy) ServeListener(ln net.Listener) error {
+	if p.Logger == nil {
+		return errNoLogger
 	}
+	p.setup()
+
+	// setup server
 	p.server.Listener = server.NewGracefulListener(ln, p.ServerShutdownWaitTime)
 	p.server.Concurrency = p.ServerConcurrency
 	p.server.ServiceName = "ProxyMNG"
 	p.server.Logger = p.Logger
 	p.server.ConnHandler = p.serveConn
-	p.server.OnConcurrencyLimitExceeded = p.serveConnOnLimitExceeded
+	p.server.OnConcurrencyLimitExceeded = func(c net.Conn) {
+		p.Stats.addRejectedConn()
+		p.serveConnOnLimitExceeded(c)
+	}
+
+	return p.server.ListenAndServe()
+}
+
+// setup makes the proxy ready to serve the connections, filling the defaults
+// of the settings unset
+func (p *Proxy) setup() {
+	p.bufioPool = bufiopool.New(p.ReadBufferSize, p.WriteBufferSize)
+
+	if p.ServerShutdownWaitTime <= 0 {
+		p.ServerShutdownWaitTime = DefaultServerShutdownWaitTime
+	}
+	if p.ConnectWriteTimeout <= 0 {
+		p.ConnectWriteTimeout = DefaultConnectWriteTimeout
+	}
+	if p.MaxDrainBodySize <= 0 {
+		p.MaxDrainBodySize = DefaultMaxDrainBodySize
+	}
+	p.Stats.initLatency()
 
 	// setup client
 	p.client.BufioPool = p.bufioPool
@@ -146,6 +577,11 @@ func (p *Proxy) Serve(network, addr string) error {
 	p.client.MaxIdleConnDuration = p.ForwardIdleConnDuration
 	p.client.ReadTimeout = p.ForwardReadTimeout
 	p.client.WriteTimeout = p.ForwardWriteTimeout
+	p.client.RetryAfterMax = p.ForwardRetryAfterMax
+	p.client.TLSClientCertificate = p.Handler.UpstreamClientCert
+	p.client.NextProtos = p.Handler.UpstreamNextProtos
+	p.client.MaxTunnelDuration = p.Handler.MaxTunnelDuration
+	p.client.LocalAddr = p.Handler.LocalAddr
 
 	// setup handler
 	if p.Handler.ShouldAllowConnection == nil {
@@ -163,13 +599,61 @@ func (p *Proxy) Serve(network, addr string) error {
 			return nil
 		}
 	}
+	if p.Handler.ClientURLProxy == nil {
+		urlProxy := p.Handler.URLProxy
+		p.Handler.ClientURLProxy = func(clientAddr net.Addr, userdata *UserData,
+			hostWithPort string, path []byte) *superproxy.SuperProxy {
+			return urlProxy(userdata, hostWithPort, path)
+		}
+	}
 	if p.Handler.LookupIP == nil {
 		p.Handler.LookupIP = func(userdata *UserData, domain string) net.IP {
 			return nil
 		}
 	}
-
-	return p.server.ListenAndServe()
+	if p.Handler.ClientHelloMaxSize <= 0 {
+		p.Handler.ClientHelloMaxSize = DefaultClientHelloMaxSize
+	}
+	if p.Handler.BlockedNetworks == nil {
+		p.Handler.BlockedNetworks = DefaultBlockedNetworks
+	}
+	if p.Handler.BlockPrivateNetworks {
+		blockedNetworks := p.Handler.BlockedNetworks
+		p.client.PermitTargetIP = func(ip net.IP) bool {
+			return !isIPBlocked(ip, blockedNetworks)
+		}
+	}
+	if p.Handler.Logger == nil {
+		p.Handler.Logger = defaultNopEventLogger
+	}
+	p.mitmSessionTicketKeys.SetKeys(p.Handler.MITMSessionTicketKeys)
+	if p.Handler.MITMCertSigner == nil {
+		if p.mitmCertAuthorityErr = mitm.CheckCertAuthority(p.Handler.MITMCertAuthority); p.mitmCertAuthorityErr != nil {
+			p.Handler.Logger.Error("invalid mitm cert authority, https tunneled without decryption",
+				p.mitmCertAuthorityErr)
+		}
+	}
+	if p.Handler.MITMCertCacheSize > 0 || p.Handler.MITMCertGenerationLimit > 0 {
+		p.mitmCertCache = &mitm.CertCache{
+			MaxCerts:         p.Handler.MITMCertCacheSize,
+			MaxGenerations:   p.Handler.MITMCertGenerationLimit,
+			GenerationWindow: p.Handler.MITMCertGenerationWindow,
+		}
+		if p.Handler.MITMCertSigner != nil {
+			// the certs cached are told apart by the signer
+			if p.mitmCertAuthorityErr = mitm.CheckCertSigner(p.Handler.MITMCertSigner); p.mitmCertAuthorityErr != nil {
+				p.Handler.Logger.Error("invalid mitm cert signer, https tunneled without decryption",
+					p.mitmCertAuthorityErr)
+			}
+		}
+	}
+	if len(p.Handler.ProxyName) > 0 {
+		p.via = []byte("1.1 " + p.Handler.ProxyName)
+	}
+	p.tunnelMadeOKayBytes = makeTunnelMadeOKayBytes(p.Handler.ConnectResponseHeaders)
+	if p.Handler.MaxConcurrentConns > 0 {
+		p.connSemaphore = make(chan struct{}, p.Handler.MaxConcurrentConns)
+	}
 }
 
 // ShutDown shut down the server gracefully
@@ -183,16 +667,62 @@ func (p *Proxy) serveConnOnLimitExceeded(c net.Conn) {
 }
 
 func (p *Proxy) serveConn(c net.Conn) error {
+	if p.connSemaphore != nil {
+		select {
+		case p.connSemaphore <- struct{}{}:
+			defer func() { <-p.connSemaphore }()
+		default:
+			p.Stats.addRejectedConn()
+			p.Handler.Logger.Warn("connection rejected for concurrency limit exceeded",
+				field("client", c.RemoteAddr().String()))
+			if !p.Handler.DropOnConcurrencyLimit {
+				p.serveConnOnLimitExceeded(c)
+			}
+			return nil
+		}
+	}
 	if !p.Handler.ShouldAllowConnection(c.RemoteAddr()) {
+		p.Stats.addRejectedConn()
+		p.Handler.Logger.Warn("connection not allowed",
+			field("client", c.RemoteAddr().String()))
 		return nil
 	}
+	p.Stats.connStarted()
+	defer p.Stats.connEnded()
+	if p.ConnStatsWindow > 0 {
+		var untrack func()
+		c, untrack = p.trackConnStats(c)
+		defer untrack()
+	}
+	detectSOCKS := p.Handler.AutoDetectProtocol || p.socks5Only
+	detectH2C := p.Handler.H2CTarget != nil && !p.socks5Only
+	if detectSOCKS || detectH2C {
+		if p.ServerReadTimeout > 0 {
+			// the read deadline is then updated by the request loop
+			if err := c.SetReadDeadline(time.Now().Add(p.ServerReadTimeout)); err != nil {
+				return util.ErrWrapper(err, "BUG: error in SetReadDeadline(%s)", p.ServerReadTimeout)
+			}
+		}
+		var err error
+		if detectSOCKS {
+			if c, err = p.detectProtocol(c); c == nil {
+				return err
+			}
+		}
+		if _, isSOCKS := c.(*socksConn); detectH2C && !isSOCKS {
+			if c, err = p.detectH2C(c); c == nil {
+				return err
+			}
+		}
+	}
 	// convert c into a http request
 	reader := p.bufioPool.AcquireReader(c)
 	req := p.reqPool.Acquire()
-	req.userdata = p.userDataPool.Acquire()
+	userdata := p.userDataPool.Acquire()
+	req.userdata = userdata
 	releaseReqAndReader := func() {
-		p.userDataPool.Release(req.userdata)
 		p.reqPool.Release(req)
+		p.userDataPool.Release(userdata)
 		p.bufioPool.ReleaseReader(reader)
 	}
 	defer releaseReqAndReader()
@@ -203,6 +733,25 @@ func (p *Proxy) serveConn(c net.Conn) error {
 		lastWriteDeadlineTime time.Time
 	)
 	for {
+		if p.ServerIdleDuration > 0 {
+			if err = p.waitForRequest(c, reader); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					// idle out of max idle duration before any bytes of
+					// the next request, tell client before closing
+					if e := writeFastError(c, http.StatusRequestTimeout,
+						"Idle for too long waiting for the request.\n"); e != nil {
+						return util.ErrWrapper(e, "fail to response request timeout")
+					}
+					return nil
+				}
+				return util.ErrWrapper(err, "fail to wait for http request")
+			}
+			// the idle deadline is replaced by the read timeout below
+			lastReadDeadlineTime = time.Time{}
+		}
 		if p.ServerReadTimeout > 0 {
 			lastReadDeadlineTime, err = p.updateReadDeadline(c, servertime.CoarseTimeNow(), lastReadDeadlineTime)
 			if err != nil {
@@ -210,32 +759,36 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			}
 		}
 
-		// parse start line of the request: a.k.a. request line
-		if p.ServerIdleDuration == 0 {
-			rn, err = req.parseStartLine(reader)
-		} else {
-			idleChan := make(chan struct{})
-			go func() {
-				rn, err = req.parseStartLine(reader)
-				idleChan <- struct{}{}
-			}()
-			select {
-			case <-idleChan:
-			case <-time.After(p.ServerIdleDuration):
-				// idle out of max idle duration, return to close connection
-				return nil
-			}
-		}
+		// parse start line of the request: a.k.a. request line, a request
+		// timed out from here is in the middle, so closed without response
+		req.reqLine.SetMaxLength(p.MaxRequestLineLength)
+		rn, err = req.parseStartLine(reader)
 		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
+			if err == http.ErrRequestLineTooLong {
+				p.Stats.addBadRequest()
+				if e := writeFastError(c, http.StatusRequestURITooLong,
+					"Request line too long.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response request line too long")
+				}
+			}
+			if err == errMalformedRequestLine {
+				p.Stats.addBadRequest()
+				if e := writeFastError(c, http.StatusBadRequest,
+					"Malformed request line.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response malformed request line")
+				}
+			}
 			return util.ErrWrapper(err, "fail to read http request header")
 		}
 		p.Usage.AddIncomingSize(uint64(rn))
+		p.Stats.addRequest()
 
 		// discard direct HTTP requests
 		if len(req.reqLine.HostInfo().HostWithPort()) == 0 {
+			p.Stats.addBadRequest()
 			if e := writeFastError(c, http.StatusBadRequest,
 				"This is a proxy server. Does not respond to non-proxy requests.\n"); e != nil {
 				return util.ErrWrapper(e, "fail to response non-proxy request")
@@ -243,6 +796,70 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			return nil
 		}
 
+		// parse the headers ahead for request ID and loop detection
+		req.header.SetLimits(p.MaxHeaderSize, p.MaxHeaderFields)
+		req.header.SetStrict(p.StrictHeaderParsing)
+		req.body.SetMaxChunkSize(p.MaxChunkSize)
+		req.body.SetMaxChunkLineSize(p.MaxChunkLineSize)
+		var rawHeader []byte
+		if rawHeader, err = req.peekHeader(); err != nil {
+			if err == errRequestHeaderTooLarge {
+				p.Stats.addBadRequest()
+				if e := writeFastError(c, http.StatusRequestHeaderFieldsTooLarge,
+					"Request header too large.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response request header too large")
+				}
+			}
+			if err == errMalformedRequestHeader {
+				p.Stats.addBadRequest()
+				if e := writeFastError(c, http.StatusBadRequest,
+					"Malformed request header.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response malformed request header")
+				}
+			}
+			return util.ErrWrapper(err, "fail to read http request header")
+		}
+		p.setRequestID(req, rawHeader)
+		p.setForwarded(c, req, "http", rawHeader)
+		req.userdata.Set(UserDataClientAddrKey, c.RemoteAddr())
+		if sc, ok := c.(*socksConn); ok && len(sc.user) > 0 {
+			req.userdata.Set(UserDataSOCKS5UserKey, sc.user)
+		}
+
+		// detect the forwarding loop using Via headers
+		if len(p.via) > 0 && http.ViaContains(req.header.Via(), p.Handler.ProxyName) {
+			p.Handler.Logger.Warn("request loop detected",
+				field("request_id", req.ID()),
+				field("client", c.RemoteAddr().String()),
+				field("host", req.reqLine.HostInfo().HostWithPort()),
+				field("via", string(req.header.Via())))
+			if e := writeFastError(c, http.StatusLoopDetected,
+				"Request loop detected via this proxy.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response loop detected")
+			}
+			return nil
+		}
+
+		if p.Handler.ShouldBlockHost != nil &&
+			p.Handler.ShouldBlockHost(req.userdata, req.reqLine.HostInfo().HostWithPort()) {
+			p.Handler.Logger.Info("host blocked by policy",
+				field("request_id", req.ID()),
+				field("client", c.RemoteAddr().String()),
+				field("host", req.reqLine.HostInfo().HostWithPort()))
+			if http.IsMethodConnect(req.Method()) {
+				if _, e := p.sendTunnelMessage(c, TunnelFailureBlocked,
+					errHostBlocked); e != errHostBlocked {
+					return util.ErrWrapper(e, "fail to response host blocked")
+				}
+				return nil
+			}
+			if e := writeFastError(c, http.StatusForbidden,
+				"Access to the target host is forbidden.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response host blocked")
+			}
+			return nil
+		}
+
 		newHostWithPort := p.Handler.RewriteURL(req.userdata, req.reqLine.HostInfo().HostWithPort())
 		if len(newHostWithPort) == 0 {
 			if e := writeFastError(c, http.StatusSessionUnavailable,
@@ -261,10 +878,74 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			ip := p.Handler.LookupIP(req.userdata, domain)
 			req.reqLine.HostInfo().SetIP(ip)
 		}
+		if err := p.overrideTarget(req); err != nil {
+			p.Handler.Logger.Warn("host override resolve failed",
+				field("request_id", req.ID()),
+				field("host", req.reqLine.HostInfo().HostWithPort()),
+				field("error", err.Error()))
+			if e := writeFastError(c, http.StatusBadGateway,
+				"Fail to resolve target host.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response target resolve failure")
+			}
+			return nil
+		}
+
+		// read the body ahead for content based routing
+		if p.Handler.RoutingBodySize > 0 {
+			body, err := req.peekBody(len(rawHeader), p.Handler.RoutingBodySize)
+			if err != nil {
+				return util.ErrWrapper(err, "fail to read http request body ahead")
+			}
+			if body != nil {
+				// copied since the reader's buffer is reused later
+				req.userdata.Set(UserDataRequestBodyKey, append([]byte(nil), body...))
+			}
+		}
 
 		// set requests proxy
-		superProxy := p.Handler.URLProxy(req.userdata, req.reqLine.HostInfo().HostWithPort(), req.PathWithQueryFragment())
+		superProxy := p.Handler.ClientURLProxy(c.RemoteAddr(), req.userdata,
+			req.reqLine.HostInfo().HostWithPort(), req.PathWithQueryFragment())
 		req.SetProxy(superProxy)
+
+		// refuse the targets in private networks
+		if p.Handler.BlockPrivateNetworks {
+			ip, err := permittedTarget(req, p.Handler.BlockedNetworks)
+			if err != nil && err != errPrivateNetworkBlocked {
+				p.Handler.Logger.Warn("target resolve failed",
+					field("request_id", req.ID()),
+					field("host", req.reqLine.HostInfo().HostWithPort()),
+					field("error", err.Error()))
+				if e := writeFastError(c, http.StatusBadGateway,
+					"Fail to resolve target host.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response target resolve failure")
+				}
+				return nil
+			}
+			if err == errPrivateNetworkBlocked {
+				p.Handler.Logger.Warn("private network blocked",
+					field("request_id", req.ID()),
+					field("client", c.RemoteAddr().String()),
+					field("host", req.reqLine.HostInfo().HostWithPort()),
+					field("ip", ip.String()))
+				if http.IsMethodConnect(req.Method()) {
+					if _, e := p.sendTunnelMessage(c, TunnelFailureBlocked,
+						errPrivateNetworkBlocked); e != errPrivateNetworkBlocked {
+						return util.ErrWrapper(e, "fail to response private network forbidden")
+					}
+					return nil
+				}
+				if e := writeFastError(c, http.StatusForbidden,
+					"Access to private network is forbidden.\n"); e != nil {
+					return util.ErrWrapper(e, "fail to response private network forbidden")
+				}
+				return nil
+			}
+			if superProxy != nil {
+				// the super proxies connect exactly the IP checked
+				req.reqLine.HostInfo().SetIP(ip)
+			}
+		}
+
 		if superProxy != nil { //set up super proxy concurrency limits
 			superProxy.AcquireToken()
 		}
@@ -280,7 +961,9 @@ func (p *Proxy) serveConn(c net.Conn) error {
 		}
 
 		err = p.do(c, req)
-		if superProxy != nil {
+		// the token is held by the super proxy finally used, which could
+		// be another one when the tunnel failed over
+		if superProxy := req.GetProxy(); superProxy != nil {
 			superProxy.PushBackToken()
 		}
 		if err != nil {
@@ -288,11 +971,19 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			return util.ErrWrapper(err, "error HTTP traffic")
 		}
 
-		if req.ConnectionClose() {
+		if req.clientConnectionClose() || req.closeConnection {
 			break
 		}
 		req.Reset()
-		reader.Reset(c)
+		// the user data of connection is emptied for the next request
+		userdata.Reset()
+		req.userdata = userdata
+		// HTTP pipelining is served serially: the requests pipelined by
+		// client are left in reader's buffer, then read and responded in
+		// order by the following loops, so never drop the buffered bytes
+		if reader.Buffered() == 0 {
+			reader.Reset(c)
+		}
 	}
 
 	return nil
@@ -304,16 +995,148 @@ func (p *Proxy) do(c net.Conn, req *Request) error {
 		return p.proxyHTTP(c, req)
 	}
 
-	// TODO: where did I jumper over the rest http headers? @zichao
+	// the connection is taken over by the tunnel, never served as http again
+	req.closeConnection = true
+
+	// consume the rest of CONNECT request headers, the bytes following them
+	// may be already buffered by reader, e.g. a TLS ClientHello sent without
+	// waiting for the tunnel made message, which must be replayed to tunnel
+	headerLen, err := req.discardHeader()
+	p.Usage.AddIncomingSize(uint64(headerLen))
+	if err != nil {
+		return err
+	}
+
+	decrypt, messageSent := false, false
+	var serverName string
+	var replay []byte
+	switch {
+	case isH2CConn(c), p.isRawTunnelPort(req.reqLine.HostInfo().Port()):
+	case p.Handler.ShouldDecryptSNI != nil:
+		if serverName, replay, err = p.readTunnelClientHello(c, req); err != nil {
+			return err
+		}
+		messageSent = true
+		decrypt = p.Handler.ShouldDecryptSNI(req.userdata, req.reqLine.HostInfo().Domain(), serverName)
+	default:
+		decrypt = p.shouldDecryptHost(req)
+		if decrypt && p.Handler.MITMCertGenerationLimit > 0 && p.mitmCertAuthorityErr == nil {
+			// the cert reserved must cover the same names as the one
+			// made in handshake, which depend on the server name
+			if serverName, replay, err = p.readTunnelClientHello(c, req); err != nil {
+				return err
+			}
+			messageSent = true
+		}
+	}
+	if decrypt && p.mitmCertAuthorityErr != nil {
+		// never fail the requests for the misconfiguration
+		decrypt = false
+		p.Handler.Logger.Debug("mitm disabled by invalid cert authority, tunneled without decryption",
+			field("request_id", req.ID()),
+			field("host", req.reqLine.HostInfo().HostWithPort()))
+	}
+	if decrypt && !p.reserveMITMCert(req, serverName) {
+		// never sign certs beyond the limit, e.g. for a flood of unique SNIs
+		decrypt = false
+		p.Handler.Logger.Warn("mitm cert generation limited, tunneled without decryption",
+			field("request_id", req.ID()),
+			field("client", c.RemoteAddr().String()),
+			field("host", req.reqLine.HostInfo().HostWithPort()),
+			field("sni", serverName))
+	}
+	if len(replay) > 0 || req.reader.Buffered() > 0 {
+		c = &bufferedConn{Conn: c, replay: replay, reader: req.reader}
+	}
 
 	// make the tunnel HTTPS requests
-	if !p.Handler.ShouldDecryptHost(req.userdata, req.reqLine.HostInfo().Domain()) {
-		return p.tunnelHTTPS(c, req)
+	if !decrypt {
+		return p.tunnelHTTPS(c, req, messageSent)
+	}
+
+	return p.decryptHTTPS(c, req, messageSent)
+}
+
+// readTunnelClientHello sends the tunnel made message and reads the ClientHello
+// sent by client only after the tunnel is made, the ClientHello read is
+// returned for replaying to the tunnel or the decryption
+func (p *Proxy) readTunnelClientHello(c net.Conn, req *Request) (serverName string, replay []byte, err error) {
+	wn, err := p.sendTunnelMessage(c, 0, nil)
+	p.Usage.AddOutgoingSize(uint64(wn))
+	if err != nil {
+		return "", nil, util.ErrWrapper(err, "fail to write tunnel made message")
+	}
+	serverName, replay, _ = readClientHello(req.reader, p.Handler.ClientHelloMaxSize)
+	return serverName, replay, nil
+}
+
+// reserveMITMCert reserves the fake server certificate of the CONNECT request
+// for the decryption made next, false if it's unable to be made right now,
+// see Handler.MITMCertGenerationLimit
+func (p *Proxy) reserveMITMCert(req *Request, serverName string) bool {
+	if p.mitmCertCache == nil {
+		return true
 	}
+	hijackConfig := &mitm.HijackConfig{
+		CertAuthority: p.Handler.MITMCertAuthority,
+		CertSigner:    p.Handler.MITMCertSigner,
+		CertNamesFor:  p.Handler.CertNamesFor,
+		CertCache:     p.mitmCertCache,
+	}
+	return hijackConfig.ReserveCert(req.reqLine.HostInfo().Domain(), serverName)
+}
+
+// isRawTunnelPort is port one of Handler.RawTunnelPorts
+func (p *Proxy) isRawTunnelPort(port string) bool {
+	for _, rawTunnelPort := range p.Handler.RawTunnelPorts {
+		if rawTunnelPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn a connection reads the bytes to replay and
+// then the bytes buffered by reader if any firstly
+type bufferedConn struct {
+	net.Conn
+	replay []byte
+	reader *bufio.Reader
+}
 
-	return p.decryptHTTPS(c, req)
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	if c.reader != nil && c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
 }
 
+func (c *bufferedConn) CloseWrite() error {
+	return transport.CloseWrite(c.Conn)
+}
+
+// NetConn implements transport.WrappedConn
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered implements transport.WrappedConn
+func (c *bufferedConn) Buffered() int {
+	n := len(c.replay)
+	if c.reader != nil {
+		n += c.reader.Buffered()
+	}
+	return n
+}
+
+// Spliced implements transport.WrappedConn
+func (c *bufferedConn) Spliced(n int64, read bool) {}
+
 func (p *Proxy) proxyHTTP(c net.Conn, req *Request) error {
 	// convert connection into a http response
 	writer := p.bufioPool.AcquireWriter(c)
@@ -324,6 +1147,10 @@ func (p *Proxy) proxyHTTP(c net.Conn, req *Request) error {
 	if err := resp.WriteTo(writer); err != nil {
 		return err
 	}
+	resp.header.SetLimits(p.MaxHeaderSize, p.MaxHeaderFields)
+	resp.header.SetStrict(p.StrictHeaderParsing)
+	resp.body.SetMaxChunkSize(p.MaxChunkSize)
+	resp.body.SetMaxChunkLineSize(p.MaxChunkLineSize)
 	// set hijacker
 	var hijacker Hijacker
 	if p.Handler.HijackerPool == nil {
@@ -333,37 +1160,245 @@ func (p *Proxy) proxyHTTP(c net.Conn, req *Request) error {
 			req.Method(), req.PathWithQueryFragment(), req.UserData())
 		defer p.Handler.HijackerPool.Put(hijacker)
 	}
+	if p.Handler.AuditLog != nil {
+		var record *AuditRecord
+		hijacker, record = p.auditHijacker(c, req, hijacker)
+		defer p.Handler.AuditLog(record)
+	}
 	req.SetHijacker(hijacker)
 	resp.SetHijacker(hijacker)
+	resp.keepAlive = bytes.Equal(req.Protocol(), http10) && req.clientKeepAlive()
+	if len(p.via) > 0 {
+		req.SetVia(p.via)
+		resp.SetVia(p.via)
+	}
+	if p.Handler.RewriteStatus != nil {
+		resp.SetStatusRewriter(req.reqLine.HostInfo().HostWithPort(), p.Handler.RewriteStatus)
+	}
+	if p.Handler.AddResponseHeaders != nil || p.Handler.EmitUpstreamHeader {
+		resp.SetHeadersAdder(req.reqLine.HostInfo().HostWithPort(), p.responseHeadersAdder(req))
+	}
+	if opts := p.forwardOptions(req); opts != nil {
+		req.SetOptions(opts)
+	}
+	continueN, err := p.autoContinue(writer, req, resp)
+	if err != nil {
+		return util.ErrWrapper(err, "fail to write 100 continue response")
+	}
+	p.Usage.AddOutgoingSize(uint64(continueN))
 	if hijackedRespReader := hijacker.HijackResponse(); hijackedRespReader != nil {
+		// the body is never sent by the client still expecting 100 Continue
+		if req.header.IsExpectContinue() && continueN == 0 {
+			req.drainLimit = -1
+		} else {
+			req.drainLimit = p.MaxDrainBodySize
+		}
 		reqReadN, _, respN, err := p.client.DoFake(req, resp, hijackedRespReader)
+		req.closeConnection = req.closeConnection || resp.ConnectionClose()
 		p.Usage.AddIncomingSize(uint64(reqReadN))
 		p.Usage.AddOutgoingSize(uint64(respN))
 		return err
 	}
 	// make the request
+	forwardedAt := time.Now()
 	reqReadN, reqWriteN, respN, err := p.client.Do(req, resp)
+	if !resp.startedAt.IsZero() {
+		p.Stats.FirstByteLatency.Observe(resp.startedAt.Sub(forwardedAt))
+	}
+	req.closeConnection = req.closeConnection || resp.ConnectionClose()
+	if err == nil && resp.upgradedConn != nil {
+		// the response switching protocols must be sent before the new protocol
+		if err = writer.Flush(); err != nil {
+			resp.upgradedConn.Close()
+			return util.ErrWrapper(err, "fail to write switching protocols response")
+		}
+		rn, wn := p.forwardUpgraded(c, req, resp.upgradedConn)
+		reqReadN += rn
+		reqWriteN += rn
+		respN += wn
+	}
 	p.Usage.AddIncomingSize(uint64(reqReadN))
 	p.Usage.AddOutgoingSize(uint64(respN))
 	if req.GetProxy() != nil {
 		req.GetProxy().Usage.AddIncomingSize(uint64(respN))
 		req.GetProxy().Usage.AddOutgoingSize(uint64(reqWriteN))
 	}
+	if err == ErrResponseHeaderTooLarge {
+		// nothing written to client yet, since the headers are parsed ahead
+		req.closeConnection = true
+		if e := writeFastError(writer, http.StatusBadGateway,
+			"Upstream response header too large.\n"); e != nil {
+			err = util.ErrWrapper(e, "fail to response upstream header too large")
+		}
+	} else if err != nil && respN == 0 && writer.Buffered() == 0 {
+		// nothing responded yet, e.g. fail to dial the target
+		req.closeConnection = true
+		e := writeFastError(writer, http.StatusBadGateway,
+			"Fail to forward the request to the target host.\n")
+		if e == nil {
+			// flushed to find the client gone
+			e = writer.Flush()
+		}
+		if e != nil {
+			err = util.ErrWrapper(e, "fail to response forward failure (%s)", err)
+		}
+	}
+	if err != nil {
+		p.Stats.addUpstreamError()
+		p.Handler.Logger.Error("fail to forward http request", err,
+			field("request_id", req.ID()),
+			field("client", c.RemoteAddr().String()),
+			field("host", req.reqLine.HostInfo().HostWithPort()),
+			field("upstream", upstreamOf(req)))
+	} else {
+		p.Handler.Logger.Debug("http request forwarded",
+			field("request_id", req.ID()),
+			field("client", c.RemoteAddr().String()),
+			field("host", req.reqLine.HostInfo().HostWithPort()),
+			field("upstream", upstreamOf(req)))
+	}
 	return err
 }
 
-func (p *Proxy) tunnelHTTPS(c net.Conn, req *Request) error {
-	// TODO: add traffic calculation
-	rwReadNum, rwWriteNum, err := p.client.DoRaw(
-		c, req.GetProxy(), req.TargetWithPort(),
-		func(fail error) error { // on tunnel made, return the tunnel made or failed message
-			_, err := sendTunnelMessage(c, fail)
-			return err
-		},
-	)
+var http11 = []byte("HTTP/1.1")
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// autoContinue tells the client expecting 100-continue to send the body
+// when Handler.AutoContinue, the 100 Continue of target is discarded then
+func (p *Proxy) autoContinue(writer *bufio.Writer, req *Request, resp *Response) (int, error) {
+	if !p.Handler.AutoContinue || !req.header.IsExpectContinue() ||
+		!bytes.Equal(req.Protocol(), http11) {
+		return 0, nil
+	}
+	resp.discardContinue = true
+	n, err := util.WriteWithValidation(writer, continueResponse)
+	if err != nil {
+		return n, err
+	}
+	return n, writer.Flush()
+}
+
+// forwardUpgraded forwards the bytes in the switched protocol, e.g. WebSocket,
+// between client and target until either of them closed, returns the bytes
+// read from client and written to client
+func (p *Proxy) forwardUpgraded(c net.Conn, req *Request, upgradedConn net.Conn) (int, int) {
+	// the connection is taken over by the new protocol, never served as http again
+	req.closeConnection = true
+	defer upgradedConn.Close()
+	var clientConn net.Conn = c
+	if req.reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: c, reader: req.reader}
+	}
+	// the connections live as long as the new protocol goes
+	var zero time.Time
+	c.SetDeadline(zero)
+	upgradedConn.SetDeadline(zero)
+	p.Handler.Logger.Info("protocol switched",
+		field("request_id", req.ID()),
+		field("client", c.RemoteAddr().String()),
+		field("host", req.reqLine.HostInfo().HostWithPort()))
+
+	var readNum, writeNum int64
+	done := make(chan struct{})
+	go func() {
+		readNum, _ = transport.Forward(upgradedConn, clientConn, 0)
+		// stop the other side
+		upgradedConn.SetReadDeadline(time.Now())
+		close(done)
+	}()
+	writeNum, _ = transport.Forward(c, upgradedConn, 0)
+	c.SetReadDeadline(time.Now())
+	<-done
+	p.Handler.Logger.Info("switched protocol ended",
+		field("request_id", req.ID()),
+		field("client", c.RemoteAddr().String()),
+		field("host", req.reqLine.HostInfo().HostWithPort()),
+		field("incoming", readNum), field("outgoing", writeNum))
+	return int(readNum), int(writeNum)
+}
+
+// tunnelHTTPS tunnels the CONNECT request, the tunnel made or failed message
+// is sent to client unless messageSent
+func (p *Proxy) tunnelHTTPS(c net.Conn, req *Request, messageSent bool) error {
+	// count the client side traffic, including the tunnel message
+	rw := newCountingConn(c)
+	defer func() {
+		p.Usage.AddIncomingSize(rw.incoming.Count())
+		p.Usage.AddOutgoingSize(rw.outgoing.Count())
+	}()
+
+	requestID := field("request_id", req.ID())
+	clientAddr := field("client", c.RemoteAddr().String())
+	host := field("host", req.reqLine.HostInfo().HostWithPort())
+	tunnelMade := false
+	startedAt := time.Now()
+	onTunnelMade := func(fail error) error { // return the tunnel made or failed message
+		if fail != nil {
+			p.Stats.addTunnelError()
+			p.Handler.Logger.Error("fail to make tunnel", fail, requestID, clientAddr, host)
+		} else {
+			tunnelMade = true
+			p.Stats.ConnectLatency.Observe(time.Since(startedAt))
+			p.Handler.Logger.Info("tunnel started", requestID, clientAddr, host,
+				field("upstream", upstreamOf(req)))
+		}
+		if messageSent {
+			// too late to tell client the failure, closed directly
+			return fail
+		}
+		cause := tunnelMakingFailure(fail, req.GetProxy() != nil)
+		_, err := p.sendTunnelMessage(rw, cause, fail)
+		return err
+	}
+
+	var fallbacks []*superproxy.SuperProxy
+	if p.Handler.TunnelFallbackProxies != nil {
+		fallbacks = p.Handler.TunnelFallbackProxies(req.userdata, req.reqLine.HostInfo().HostWithPort())
+	}
+	var opts *client.RequestOptions
+	if localAddr := p.localAddrFor(req); localAddr != nil {
+		opts = &client.RequestOptions{LocalAddr: localAddr}
+	}
+	var rwReadNum, rwWriteNum int64
+	var err error
+	for {
+		rwReadNum, rwWriteNum, err = p.client.DoRawWithOptions(rw, req.GetProxy(), req.TargetWithPort(), opts,
+			func(fail error) error {
+				if fail != nil && len(fallbacks) > 0 {
+					// nothing sent to client yet, try the next one
+					p.Handler.Logger.Warn("fail to make tunnel, retrying", requestID, clientAddr, host,
+						field("upstream", upstreamOf(req)), field("error", fail.Error()))
+					return errTunnelRetry
+				}
+				return onTunnelMade(fail)
+			},
+		)
+		if err != errTunnelRetry {
+			break
+		}
+		// the token of the failed super proxy is pushed back before taking
+		// the next one's, which is then pushed back once the request done
+		if superProxy := req.GetProxy(); superProxy != nil {
+			superProxy.PushBackToken()
+		}
+		req.SetProxy(fallbacks[0])
+		fallbacks = fallbacks[1:]
+		if superProxy := req.GetProxy(); superProxy != nil {
+			superProxy.AcquireToken()
+		}
+	}
+	if err == client.ErrTunnelDurationExceeded {
+		// closed by the policy rather than failed
+		p.Handler.Logger.Warn("tunnel closed on max duration exceeded", requestID, clientAddr, host,
+			field("max_duration", p.Handler.MaxTunnelDuration.String()))
+		err = nil
+	}
+	if tunnelMade {
+		p.Handler.Logger.Info("tunnel ended", requestID, clientAddr, host,
+			field("incoming", rwReadNum), field("outgoing", rwWriteNum))
+	}
 
-	p.Usage.AddIncomingSize(uint64(rwReadNum))
-	p.Usage.AddOutgoingSize(uint64(rwWriteNum))
 	if req.GetProxy() != nil {
 		req.GetProxy().Usage.AddIncomingSize(uint64(rwWriteNum))
 		req.GetProxy().Usage.AddOutgoingSize(uint64(rwReadNum))
@@ -371,42 +1406,242 @@ func (p *Proxy) tunnelHTTPS(c net.Conn, req *Request) error {
 	return err
 }
 
-func (p *Proxy) decryptHTTPS(c net.Conn, req *Request) error {
+// decryptHTTPS decrypts the CONNECT request, the tunnel made or failed
+// message is sent to client unless messageSent
+func (p *Proxy) decryptHTTPS(c net.Conn, req *Request, messageSent bool) error {
+	sessionTicketKeys, err := p.mitmSessionTicketKeys.Keys()
+	if err != nil {
+		// session resumption is an optimization, go on without it
+		sessionTicketKeys = nil
+	}
+	hijackConfig := &mitm.HijackConfig{
+		CertAuthority:     p.Handler.MITMCertAuthority,
+		CertSigner:        p.Handler.MITMCertSigner,
+		SessionTicketKeys: sessionTicketKeys,
+		CertNamesFor:      p.Handler.CertNamesFor,
+		RequireSNI:        p.Handler.MITMRequireSNI,
+		CertCache:         p.mitmCertCache,
+		CipherSuites:      p.Handler.MITMCipherSuites,
+	}
 	// hijack this TLS connection firstly
+	handshaking := false
+	var handshakeStartedAt time.Time
 	hijackedConn, serverName, err := mitm.HijackTLSConnection(
-		p.Handler.MITMCertAuthority, c, req.reqLine.HostInfo().Domain(),
+		hijackConfig, c, req.reqLine.HostInfo().Domain(),
 		func(fail error) error { // before handshaking with client, return the tunnel made or failed message
-			wn, err := sendTunnelMessage(c, fail)
+			handshakeStartedAt = time.Now()
+			if messageSent {
+				handshaking = fail == nil
+				return fail
+			}
+			wn, err := p.sendTunnelMessage(c, TunnelFailureDecrypt, fail)
 			p.Usage.AddOutgoingSize(uint64(wn))
+			handshaking = fail == nil && err == nil
 			return err
 		},
 	)
 	if err != nil {
+		p.Stats.addTunnelError()
+		if handshaking {
+			reason := handshakeFailureOf(err)
+			p.Stats.addHandshakeFailure(reason)
+			p.Handler.Logger.Warn("tls handshake with client failed",
+				field("request_id", req.ID()),
+				field("client", c.RemoteAddr().String()),
+				field("host", req.reqLine.HostInfo().HostWithPort()),
+				field("reason", reason.String()),
+				field("error", err.Error()))
+		} else {
+			p.Handler.Logger.Error("fail to hijack tls connection", err,
+				field("request_id", req.ID()),
+				field("client", c.RemoteAddr().String()),
+				field("host", req.reqLine.HostInfo().HostWithPort()))
+		}
 		if hijackedConn != nil {
 			hijackedConn.Close()
 		}
 		return err
 	}
+	p.Stats.HandshakeLatency.Observe(time.Since(handshakeStartedAt))
 	//TODO: should reuse this decrypted connection?
 	defer hijackedConn.Close()
 
 	// reset request to a new one for hijacked request purpose
-	hostWithPort := req.reqLine.HostInfo().TargetWithPort()
+	hostWithPort := req.reqLine.HostInfo().HostWithPort()
+	connectHost := req.reqLine.HostInfo().Domain()
 	ip := req.reqLine.HostInfo().IP()
 	hijackedConnreader := p.bufioPool.AcquireReader(hijackedConn)
 	defer p.bufioPool.ReleaseReader(hijackedConnreader)
 
 	req.reqLine.Reset()
+	req.header.Reset()
 	req.reader = nil
+	req.reqLine.SetMaxLength(p.MaxRequestLineLength)
 	reqReadNum, err := req.parseStartLine(hijackedConnreader)
 	p.Usage.AddIncomingSize(uint64(reqReadNum))
 	if err != nil {
+		if err == http.ErrRequestLineTooLong {
+			p.Stats.addBadRequest()
+			if e := writeFastError(hijackedConn, http.StatusRequestURITooLong,
+				"Request line too long.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response request line too long")
+			}
+		}
+		if err == errMalformedRequestLine {
+			p.Stats.addBadRequest()
+			if e := writeFastError(hijackedConn, http.StatusBadRequest,
+				"Malformed request line.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response malformed request line")
+			}
+		}
+		return util.ErrWrapper(err, "fail to read fake tls server request header")
+	}
+	p.Stats.addRequest()
+	req.header.SetLimits(p.MaxHeaderSize, p.MaxHeaderFields)
+	req.header.SetStrict(p.StrictHeaderParsing)
+	req.body.SetMaxChunkSize(p.MaxChunkSize)
+	req.body.SetMaxChunkLineSize(p.MaxChunkLineSize)
+	rawHeader, err := req.peekHeader()
+	if err != nil {
+		if err == errRequestHeaderTooLarge {
+			p.Stats.addBadRequest()
+			if e := writeFastError(hijackedConn, http.StatusRequestHeaderFieldsTooLarge,
+				"Request header too large.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response request header too large")
+			}
+		}
+		if err == errMalformedRequestHeader {
+			p.Stats.addBadRequest()
+			if e := writeFastError(hijackedConn, http.StatusBadRequest,
+				"Malformed request header.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response malformed request header")
+			}
+		}
 		return util.ErrWrapper(err, "fail to read fake tls server request header")
 	}
+	p.setRequestID(req, rawHeader)
+	p.setForwarded(c, req, "https", rawHeader)
+	if p.Handler.EnforceHostMatch {
+		if host, ok := p.misdirectedHost(connectHost, serverName, req, rawHeader); !ok {
+			p.Stats.addBadRequest()
+			p.Handler.Logger.Warn("misdirected request",
+				field("request_id", req.ID()),
+				field("client", c.RemoteAddr().String()),
+				field("host", hostWithPort),
+				field("request_host", host))
+			if e := writeFastError(hijackedConn, http.StatusMisdirectedRequest,
+				"Request host does not match the CONNECT host.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response misdirected request")
+			}
+			return nil
+		}
+	}
 	req.SetTLS(serverName)
 	req.reqLine.HostInfo().ParseHostWithPort(hostWithPort, true)
 	req.reqLine.HostInfo().SetIP(ip)
-	return p.proxyHTTP(c, req)
+	if err := p.overrideTarget(req); err != nil {
+		p.Handler.Logger.Warn("host override resolve failed",
+			field("request_id", req.ID()),
+			field("host", hostWithPort),
+			field("error", err.Error()))
+		if e := writeFastError(hijackedConn, http.StatusBadGateway,
+			"Fail to resolve target host.\n"); e != nil {
+			return util.ErrWrapper(e, "fail to response target resolve failure")
+		}
+		return nil
+	}
+	// response must be written back to the hijacked connection
+	return p.proxyHTTP(hijackedConn, req)
+}
+
+// misdirectedHost checks the hosts claimed by the decrypted request against the
+// CONNECT host, returns the first mismatched one and false if any
+func (p *Proxy) misdirectedHost(connectHost, serverName string, req *Request, rawHeader []byte) (string, bool) {
+	matches := p.Handler.HostMatches
+	if matches == nil {
+		matches = strings.EqualFold
+	}
+	hosts := [...]string{
+		serverName,
+		req.reqLine.HostInfo().Domain(), // of the absolute request URI
+		hostWithoutPort(string(http.GetHeaderValue(rawHeader, "Host"))),
+	}
+	for _, host := range hosts {
+		if len(host) > 0 && !matches(connectHost, host) {
+			return host, false
+		}
+	}
+	return "", true
+}
+
+// hostWithoutPort strips the port from host if any
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// requestIDHeader header carrying the request ID
+const requestIDHeader = "X-Request-Id"
+
+// UserDataRequestIDKey user data key of the unique request ID,
+// i.e. the value is the ID of the request the user data belongs to
+const UserDataRequestIDKey = "fastproxy.request_id"
+
+// UserDataRequestBodyKey user data key of the request body read ahead for
+// routing, i.e. the value is a []byte, see Handler.RoutingBodySize
+const UserDataRequestBodyKey = "fastproxy.request_body"
+
+// UserDataSOCKS5UserKey user data key of the username the SOCKS5 client
+// authenticated with, see Handler.SOCKS5Authenticate
+const UserDataSOCKS5UserKey = "fastproxy.socks5_user"
+
+// UserDataClientAddrKey user data key of the client address, i.e. the value
+// is the net.Addr of the client connection, e.g. for the sticky balancing
+const UserDataClientAddrKey = "fastproxy.client_addr"
+
+// setRequestID sets the unique ID of request, the X-Request-Id header sent by
+// client is reused, otherwise a random one is generated if not set yet
+func (p *Proxy) setRequestID(req *Request, rawHeader []byte) {
+	if id := http.GetHeaderValue(rawHeader, requestIDHeader); len(id) > 0 {
+		req.id = string(id)
+		req.injectID = false
+	} else {
+		if len(req.id) == 0 {
+			req.id = newRequestID()
+		}
+		req.injectID = p.Handler.InjectRequestID
+	}
+	req.userdata.Set(UserDataRequestIDKey, req.id)
+}
+
+// newRequestID generates a random 16-byte request ID in hex
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// should never happen, be unique at least
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// waitForRequest waits for the first byte of the next request on the client
+// connection for at most ServerIdleDuration, the read deadline is cleared after
+func (p *Proxy) waitForRequest(c net.Conn, reader *bufio.Reader) error {
+	if reader.Buffered() > 0 {
+		return nil
+	}
+	if err := c.SetReadDeadline(time.Now().Add(p.ServerIdleDuration)); err != nil {
+		return util.ErrWrapper(err, "BUG: error in SetReadDeadline(%s)", p.ServerIdleDuration)
+	}
+	if _, err := reader.Peek(1); err != nil {
+		return err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return util.ErrWrapper(err, "BUG: error in SetReadDeadline(%s)", time.Time{})
+	}
+	return nil
 }
 
 func (p *Proxy) updateReadDeadline(c net.Conn, currentTime time.Time, lastDeadlineTime time.Time) (time.Time, error) {
@@ -438,35 +1673,103 @@ func (p *Proxy) updateWriteDeadline(c net.Conn, currentTime time.Time, lastDeadl
 	return lastDeadlineTime, nil
 }
 
-var (
-	httpTunnelMadeOKayBytes   = []byte("HTTP/1.1 200 OK\r\n\r\n")
-	httpTunnelMadeFailedBytes = []byte("HTTP/1.1 501 Bad Gateway\r\n\r\n")
-)
+var httpTunnelMadeOKayBytes = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
 
-func sendTunnelMessage(c net.Conn, fail error) (int, error) {
+// makeTunnelMadeOKayBytes makes the CONNECT success response with headers
+func makeTunnelMadeOKayBytes(headers map[string]string) []byte {
+	if len(headers) == 0 {
+		return httpTunnelMadeOKayBytes
+	}
+	// keep a stable order of the headers
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := []byte("HTTP/1.1 200 Connection Established\r\n")
+	for _, key := range keys {
+		b = append(b, key...)
+		b = append(b, ": "...)
+		b = append(b, headers[key]...)
+		b = append(b, "\r\n"...)
+	}
+	return append(b, "\r\n"...)
+}
+
+// sendTunnelMessage sends the tunnel made message, or the failure
+// response of cause if fail is not nil, within ConnectWriteTimeout,
+// the ServerWriteTimeout applied again afterwards, if set
+func (p *Proxy) sendTunnelMessage(c net.Conn, cause TunnelFailure, fail error) (int, error) {
+	now := time.Now()
+	deadline := now.Add(p.ConnectWriteTimeout)
+	var restored time.Time
+	if p.ServerWriteTimeout > 0 {
+		restored = now.Add(p.ServerWriteTimeout)
+	}
 	if fail != nil {
-		n, err := util.WriteWithValidation(c, httpTunnelMadeFailedBytes)
+		n, err := util.WriteWithDeadline(c, p.makeTunnelFailedBytes(cause, fail), deadline, restored)
 		if err == nil {
 			return n, fail
 		}
 		err = util.ErrWrapper(fail, "fail to write error message to client with error %s", err)
 		return n, err
 	}
-	return util.WriteWithValidation(c, httpTunnelMadeOKayBytes)
+	return util.WriteWithDeadline(c, p.tunnelMadeOKayBytes, deadline, restored)
 }
 
-func writeFastError(w io.Writer, statusCode int, msg string) error {
-	var err error
-	_, err = w.Write(http.StatusLine(statusCode))
-	if err != nil {
-		return err
+// countingConn counts the traffic read from and written into the client conn
+type countingConn struct {
+	net.Conn
+	incoming *util.CountingReader
+	outgoing *util.CountingWriter
+}
+
+func newCountingConn(c net.Conn) *countingConn {
+	return &countingConn{
+		Conn:     c,
+		incoming: util.NewCountingReader(c),
+		outgoing: util.NewCountingWriter(c),
+	}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	return c.incoming.Read(b)
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	return c.outgoing.Write(b)
+}
+
+func (c *countingConn) CloseWrite() error {
+	return transport.CloseWrite(c.Conn)
+}
+
+// NetConn implements transport.WrappedConn
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered implements transport.WrappedConn
+func (c *countingConn) Buffered() int {
+	return 0
+}
+
+// Spliced implements transport.WrappedConn, the bytes are still counted
+func (c *countingConn) Spliced(n int64, read bool) {
+	if read {
+		c.incoming.Add(uint64(n))
+	} else {
+		c.outgoing.Add(uint64(n))
 	}
-	_, err = fmt.Fprintf(w, "Connection: close\r\n"+
-		"Date: %s\r\n"+
-		"Content-Type: text/plain\r\n"+
-		"Content-Length: %d\r\n"+
-		"\r\n"+
-		"%s",
-		servertime.ServerDate(), len(msg), msg)
+}
+
+func writeFastError(w io.Writer, statusCode int, msg string) error {
+	b := http.NewResponseBuilder(statusCode)
+	defer b.Release()
+	b.AddHeader("Connection", "close")
+	b.AddHeader("Date", fmt.Sprintf("%s", servertime.ServerDate()))
+	b.AddHeader("Content-Type", "text/plain")
+	b.SetBody([]byte(msg))
+	_, err := b.WriteTo(w)
 	return err
 }
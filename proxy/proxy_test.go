@@ -3,22 +3,33 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	slog "log"
 	"net"
 	nethttp "net/http"
+	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/mitm"
 	"github.com/haxii/fastproxy/superproxy"
 	"github.com/haxii/log"
 )
@@ -271,6 +282,177 @@ func TestCommon(t *testing.T) {
 	testProxyKeepConnectionAndClose(t)
 }
 
+// serveTestProxy serves a proxy with handler on port,
+// RewriteURL keeps the host unchanged if not set
+func serveTestProxy(port int, handler Handler) {
+	if handler.RewriteURL == nil {
+		handler.RewriteURL = func(userdata *UserData, hostWithPort string) string {
+			return hostWithPort
+		}
+	}
+	proxy := Proxy{
+		Logger:  &log.DefaultLogger{},
+		Handler: handler,
+	}
+	if err := proxy.Serve("tcp4", fmt.Sprintf("0.0.0.0:%d", port)); err != nil {
+		panic(err)
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "%s", r.URL.Path[1:])
+	})
+	go nethttp.ListenAndServe(":9992", mux)
+	go serveTestProxy(5070, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5070")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	paths := []string{"first", "second", "third"}
+	pipelinedReqs := ""
+	for _, path := range paths {
+		pipelinedReqs += "GET http://127.0.0.1:9992/" + path + " HTTP/1.1\r\nHost: 127.0.0.1:9992\r\n\r\n"
+	}
+	if _, err := conn.Write([]byte(pipelinedReqs)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, path := range paths {
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != path {
+			t.Fatalf("expected response %s, got %s", path, body)
+		}
+	}
+}
+
+// makeTestCertAuthority makes a new cert authority as well as the cert pool trusting it
+func makeTestCertAuthority(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	caCertPEM, caKeyPEM, err := mitm.MakeMITMCertAuthority("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+	rootCA := x509.NewCertPool()
+	rootCA.AppendCertsFromPEM(caCertPEM)
+	return &ca, rootCA
+}
+
+func TestDecryptHTTPSWithoutSNI(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	hijackerPool := &fakeResponseHijackerPool{
+		response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+	}
+	go serveTestProxy(5072, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		HijackerPool:      hijackerPool,
+		MITMCertAuthority: ca,
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5072")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:9443 HTTP/1.1\r\n\r\n")
+	tunnelResp := make([]byte, len(httpTunnelMadeOKayBytes))
+	if _, err := io.ReadFull(conn, tunnelResp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(tunnelResp, httpTunnelMadeOKayBytes) {
+		t.Fatalf("expected tunnel response %q, got %q", httpTunnelMadeOKayBytes, tunnelResp)
+	}
+
+	// go client sends no SNI for IP literals
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: rootCA, ServerName: "127.0.0.1"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: 127.0.0.1:9443\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("expected body %s, got %s", "ok", body)
+	}
+	if hijackerPool.host != "127.0.0.1:9443" {
+		t.Fatalf("expected host %s, got %s", "127.0.0.1:9443", hijackerPool.host)
+	}
+}
+
+func TestRewriteStatus(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.WriteHeader(nethttp.StatusInternalServerError)
+		fmt.Fprintf(w, "internal error details")
+	})
+	go nethttp.ListenAndServe(":9993", mux)
+	go serveTestProxy(5071, Handler{
+		RewriteStatus: func(host string, status int) (int, []byte, bool) {
+			if host == "127.0.0.1:9993" && status == http.StatusInternalServerError {
+				return http.StatusServiceUnavailable, []byte("under maintenance"), true
+			}
+			return status, nil, false
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	c := nethttp.Client{
+		Transport: &nethttp.Transport{
+			Proxy: func(r *nethttp.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:5071")
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	for i := 0; i < 2; i++ { // the 2nd one reuses the connection
+		resp, err := c.Get("http://127.0.0.1:9993/")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if string(body) != "under maintenance" {
+			t.Fatalf("expected body %s, got %s", "under maintenance", body)
+		}
+	}
+}
+
 func testProxyServe(t *testing.T, simpleFunc func(), reqString, expResult string) {
 	go simpleFunc()
 	time.Sleep(time.Millisecond * 10)
@@ -837,3 +1019,4093 @@ func (s *completeHijacker) OnResponse(respLine http.ResponseLine,
 	header http.Header, rawHeader []byte) io.Writer {
 	return bResp
 }
+
+func TestMaxConcurrentConns(t *testing.T) {
+	go serveTestProxy(5073, Handler{MaxConcurrentConns: 1})
+	go serveTestProxy(5074, Handler{MaxConcurrentConns: 1, DropOnConcurrencyLimit: true})
+	time.Sleep(time.Millisecond * 10)
+
+	// occupy the only connection slot of the proxy, then try a new one
+	testConcurrencyLimit := func(port int, expectRejected func(rejected []byte)) {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		holder, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		rejected, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expectRejected(rejected)
+
+		// the slot is released once the holder closed
+		holder.Close()
+		time.Sleep(time.Millisecond * 200)
+		conn, err = net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != nethttp.StatusBadRequest {
+			t.Fatalf("expected non-proxy request rejected with 400, got %d", resp.StatusCode)
+		}
+	}
+
+	testConcurrencyLimit(5073, func(rejected []byte) {
+		if !bytes.HasPrefix(rejected, []byte("HTTP/1.1 503")) {
+			t.Fatalf("expected 503 when concurrency limit exceeded, got %q", rejected)
+		}
+	})
+	testConcurrencyLimit(5074, func(rejected []byte) {
+		if len(rejected) > 0 {
+			t.Fatalf("expected connection dropped when concurrency limit exceeded, got %q", rejected)
+		}
+	})
+}
+
+func TestProxyVia(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "%s", strings.Join(r.Header["Via"], ", "))
+	})
+	go nethttp.ListenAndServe(":9994", mux)
+	go serveTestProxy(5075, Handler{ProxyName: "fastproxy"})
+	time.Sleep(time.Millisecond * 10)
+
+	testProxyVia := func(via string) *nethttp.Response {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5075")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		req := "GET http://127.0.0.1:9994/ HTTP/1.1\r\nHost: 127.0.0.1:9994\r\n"
+		if len(via) > 0 {
+			req += "Via: " + via + "\r\n"
+		}
+		if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return resp
+	}
+	expectResponse := func(resp *nethttp.Response, status int, body string) {
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("expected status %d, got %d", status, resp.StatusCode)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(body) > 0 && string(b) != body {
+			t.Fatalf("expected body %q, got %q", body, b)
+		}
+	}
+
+	resp := testProxyVia("")
+	if via := resp.Header.Get("Via"); via != "1.1 fastproxy" {
+		t.Fatalf("unexpected response via %q", via)
+	}
+	expectResponse(resp, nethttp.StatusOK, "1.1 fastproxy")
+	resp = testProxyVia("1.0 fred")
+	expectResponse(resp, nethttp.StatusOK, "1.0 fred, 1.1 fastproxy")
+
+	// the request has already passed this proxy
+	resp = testProxyVia("1.0 fred, 1.1 fastproxy")
+	expectResponse(resp, http.StatusLoopDetected, "")
+}
+
+func TestEventLoggerOnDialFailure(t *testing.T) {
+	logger := &captureEventLogger{}
+	go serveTestProxy(5076, Handler{Logger: logger})
+	time.Sleep(time.Millisecond * 10)
+
+	// nothing listens on port 1
+	for _, req := range []string{
+		"CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n",
+		"GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5076")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+
+	events := logger.Events()
+	expectedMsgs := []string{"fail to make tunnel", "fail to forward http request"}
+	if len(events) != len(expectedMsgs) {
+		t.Fatalf("expected %d events, got %v", len(expectedMsgs), events)
+	}
+	for i, event := range events {
+		if event.level != "error" || event.msg != expectedMsgs[i] || event.err == nil {
+			t.Fatalf("unexpected event %v", event)
+		}
+		if event.fields["host"] != "127.0.0.1:1" {
+			t.Fatalf("unexpected host field in event %v", event)
+		}
+		if _, ok := event.fields["client"]; !ok {
+			t.Fatalf("no client field in event %v", event)
+		}
+	}
+}
+
+func TestInjectRequestID(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "%s", strings.Join(r.Header["X-Request-Id"], ","))
+	})
+	go nethttp.ListenAndServe(":9995", mux)
+	logger := &captureEventLogger{}
+	go serveTestProxy(5077, Handler{Logger: logger, InjectRequestID: true})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5077")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	testRequestID := func(clientRequestID string) string {
+		req := "GET http://127.0.0.1:9995/ HTTP/1.1\r\nHost: 127.0.0.1:9995\r\n"
+		if len(clientRequestID) > 0 {
+			req += "X-Request-Id: " + clientRequestID + "\r\n"
+		}
+		if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		upstreamRequestID, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return string(upstreamRequestID)
+	}
+
+	requestID := testRequestID("")
+	if len(requestID) != 32 {
+		t.Fatalf("unexpected request id injected %q", requestID)
+	}
+	// the request ID sent by client is reused rather than injected again
+	if upstreamRequestID := testRequestID("client-id"); upstreamRequestID != "client-id" {
+		t.Fatalf("expected client request id reused, got %q", upstreamRequestID)
+	}
+
+	events := logger.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v", events)
+	}
+	if events[0].fields["request_id"] != requestID {
+		t.Fatalf("expected request id %s logged, got %v", requestID, events[0])
+	}
+	if events[1].fields["request_id"] != "client-id" {
+		t.Fatalf("expected request id client-id logged, got %v", events[1])
+	}
+}
+
+func TestCloseDelimitedResponse(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:9996")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := nethttp.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				// stream the body without length declared, then close
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"))
+				for _, part := range []string{"streamed ", "until ", "close"} {
+					conn.Write([]byte(part))
+					time.Sleep(10 * time.Millisecond)
+				}
+			}(conn)
+		}
+	}()
+	go serveTestProxy(5078, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5078")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET http://127.0.0.1:9996/ HTTP/1.1\r\nHost: 127.0.0.1:9996\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "streamed until close" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if !resp.Close {
+		t.Fatal("expected connection close told to client")
+	}
+	// the client connection is closed by proxy as well
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection closed, got %v", err)
+	}
+}
+
+func TestURLProxyWithFakeSuperProxy(t *testing.T) {
+	var lock sync.Mutex
+	var tunnelTargets []string
+	// the fake super proxy answers every request with the target it's made for
+	superProxy, err := superproxy.NewFakeSuperProxy("fake-proxy:3128", superproxy.ProxyTypeHTTP,
+		func(targetHostWithPort string) (net.Conn, error) {
+			lock.Lock()
+			tunnelTargets = append(tunnelTargets, targetHostWithPort)
+			lock.Unlock()
+			proxyConn, targetConn := net.Pipe()
+			go func() {
+				defer targetConn.Close()
+				reader := bufio.NewReader(targetConn)
+				for {
+					req, err := nethttp.ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					body := targetHostWithPort + " " + req.RequestURI
+					fmt.Fprintf(targetConn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				}
+			}()
+			return proxyConn, nil
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go serveTestProxy(5079, Handler{
+		URLProxy: func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy {
+			if strings.HasPrefix(hostWithPort, "routed.example") {
+				return superProxy
+			}
+			return nil
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5079")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expectResponse := func(expBody string) {
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != expBody {
+			t.Fatalf("expected response %q, got %q", expBody, body)
+		}
+	}
+
+	// plain http request is forwarded to the super proxy in absolute form
+	if _, err := conn.Write([]byte("GET http://routed.example/path HTTP/1.1\r\nHost: routed.example\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectResponse("fake-proxy:3128 http://routed.example/path")
+
+	// https request is tunneled to target through the super proxy
+	if _, err := conn.Write([]byte("CONNECT routed.example:443 HTTP/1.1\r\nHost: routed.example:443\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected tunnel made, got status %d", resp.StatusCode)
+	}
+	if _, err := conn.Write([]byte("GET /tunneled HTTP/1.1\r\nHost: routed.example\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectResponse("routed.example:443 /tunneled")
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(tunnelTargets) != 2 || tunnelTargets[0] != "fake-proxy:3128" ||
+		tunnelTargets[1] != "routed.example:443" {
+		t.Fatalf("unexpected tunnels made %v", tunnelTargets)
+	}
+}
+
+func TestConnectWithEarlyData(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5080, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		HijackerPool: &fakeResponseHijackerPool{
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		},
+		MITMCertAuthority: ca,
+	})
+	go serveTestProxy(5081, Handler{})
+	// echo server for the tunnel
+	ln, err := net.Listen("tcp4", "127.0.0.1:9997")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	// decryption: CONNECT and the ClientHello are sent in the same segment
+	conn, err := net.Dial("tcp4", "127.0.0.1:5080")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tlsConn := tls.Client(&earlyDataConn{
+		Conn:    conn,
+		connect: []byte("CONNECT 127.0.0.1:9443 HTTP/1.1\r\nHost: 127.0.0.1:9443\r\n\r\n"),
+	}, &tls.Config{RootCAs: rootCA, ServerName: "127.0.0.1"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: 127.0.0.1:9443\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("expected body %s, got %s", "ok", body)
+	}
+
+	// tunnel: CONNECT and the data are sent in the same segment
+	conn, err = net.Dial("tcp4", "127.0.0.1:5081")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tunnelConn := &earlyDataConn{
+		Conn:    conn,
+		connect: []byte("CONNECT 127.0.0.1:9997 HTTP/1.1\r\nHost: 127.0.0.1:9997\r\n\r\n"),
+	}
+	if _, err := tunnelConn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(tunnelConn, echo); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(echo) != "ping" {
+		t.Fatalf("expected echo %s, got %s", "ping", echo)
+	}
+}
+
+func TestAddResponseHeaders(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("X-Existing", "upstream")
+		fmt.Fprintf(w, "ok")
+	})
+	go nethttp.ListenAndServe(":9998", mux)
+	go serveTestProxy(5082, Handler{
+		AddResponseHeaders: func(host string) map[string]string {
+			if host != "127.0.0.1:9998" {
+				return nil
+			}
+			return map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+				"X-Existing":                "proxy",
+			}
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5082")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET http://127.0.0.1:9998/ HTTP/1.1\r\nHost: 127.0.0.1:9998\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get("Strict-Transport-Security"); v != "max-age=31536000" {
+		t.Fatalf("unexpected Strict-Transport-Security header %q", v)
+	}
+	if v := resp.Header["X-Existing"]; len(v) != 1 || v[0] != "upstream" {
+		t.Fatalf("existing header should not be added again, got %q", v)
+	}
+}
+
+func TestUpstreamResponseHeaderTooLarge(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:9999")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// stream the headers endlessly until the proxy gives up
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
+		for {
+			if _, err := conn.Write([]byte("X-Large: " + strings.Repeat("a", 1024) + "\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		proxy := Proxy{
+			Logger:        &log.DefaultLogger{},
+			MaxHeaderSize: 2048,
+			Handler: Handler{
+				RewriteURL: func(userdata *UserData, hostWithPort string) string {
+					return hostWithPort
+				},
+			},
+		}
+		if err := proxy.Serve("tcp4", "0.0.0.0:5083"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5083")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET http://127.0.0.1:9999/ HTTP/1.1\r\nHost: 127.0.0.1:9999\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadGateway, resp.StatusCode)
+	}
+}
+
+func TestRawTunnelPorts(t *testing.T) {
+	// plain echo server, which never speaks TLS
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	target := ln.Addr().String()
+	_, port, _ := net.SplitHostPort(target)
+	ca, _ := makeTestCertAuthority(t)
+	go serveTestProxy(5084, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+		RawTunnelPorts:    []string{port},
+	})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5084")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	raw := "GET / HTTP/1.1\r\nHost: " + target + "\r\n\r\n"
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	echo := make([]byte, len(raw))
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(echo) != raw {
+		t.Fatalf("expected %q echoed, got %q", raw, echo)
+	}
+}
+
+func TestConnectResponseHeaders(t *testing.T) {
+	go serveTestProxy(5085, Handler{
+		ConnectResponseHeaders: map[string]string{
+			"Proxy-Agent": "fastproxy",
+			"X-Tunnel":    "raw",
+		},
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:9990")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5085")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:9990 HTTP/1.1\r\nHost: 127.0.0.1:9990\r\n\r\n")
+	expected := "HTTP/1.1 200 Connection Established\r\n" +
+		"Proxy-Agent: fastproxy\r\nX-Tunnel: raw\r\n\r\n"
+	tunnelResp := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, tunnelResp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(tunnelResp) != expected {
+		t.Fatalf("expected tunnel response %q, got %q", expected, tunnelResp)
+	}
+	// the tunnel works right after the headers
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(echo) != "ping" {
+		t.Fatalf("expected ping echoed, got %q", echo)
+	}
+}
+
+func TestSOCKS5RemoteResolution(t *testing.T) {
+	// a minimal SOCKS5 proxy records the requested target,
+	// then responds the http request itself
+	ln, err := net.Listen("tcp4", "127.0.0.1:1082")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	targetChan := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(reader, greeting); err != nil {
+			return
+		}
+		if _, err := reader.Discard(int(greeting[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+		// version, command, reserved and address type
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+		target := "not a domain"
+		if request[3] == 3 {
+			domainLen, _ := reader.ReadByte()
+			domain := make([]byte, int(domainLen)+2)
+			if _, err := io.ReadFull(reader, domain); err != nil {
+				return
+			}
+			target = fmt.Sprintf("%s:%d", domain[:domainLen],
+				int(domain[domainLen])<<8|int(domain[domainLen+1]))
+		}
+		targetChan <- target
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		if _, err := nethttp.ReadRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+	superProxy, err := superproxy.NewSuperProxy("127.0.0.1", 1082, superproxy.ProxyTypeSOCKS5, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go serveTestProxy(5086, Handler{
+		// local resolution always fails
+		LookupIP: func(userdata *UserData, domain string) net.IP {
+			return nil
+		},
+		URLProxy: func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy {
+			return superProxy
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5086")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET http://socks.invalid/ HTTP/1.1\r\nHost: socks.invalid\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("expected body %s, got %s", "ok", body)
+	}
+	if target := <-targetChan; target != "socks.invalid:80" {
+		t.Fatalf("expected domain target %s sent to SOCKS5 proxy, got %s", "socks.invalid:80", target)
+	}
+}
+
+func TestIdleRequestTimeout(t *testing.T) {
+	go func() {
+		proxy := Proxy{
+			Logger:             &log.DefaultLogger{},
+			ServerIdleDuration: 100 * time.Millisecond,
+			ServerReadTimeout:  100 * time.Millisecond,
+			Handler: Handler{
+				RewriteURL: func(userdata *UserData, hostWithPort string) string {
+					return hostWithPort
+				},
+				HijackerPool: &fakeResponseHijackerPool{
+					response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+				},
+			},
+		}
+		if err := proxy.Serve("tcp4", "0.0.0.0:5087"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	// idle keep-alive connection is responded with 408
+	conn, err := net.Dial("tcp4", "127.0.0.1:5087")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET http://127.0.0.1:9443/ HTTP/1.1\r\nHost: 127.0.0.1:9443\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	if resp, err = nethttp.ReadResponse(reader, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusRequestTimeout {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusRequestTimeout, resp.StatusCode)
+	}
+
+	// connection timed out in the middle of a request is closed silently
+	conn, err = net.Dial("tcp4", "127.0.0.1:5087")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET http://127.0.0.1:9443/")
+	if b, err := ioutil.ReadAll(conn); err != nil || len(b) > 0 {
+		t.Fatalf("expected connection closed without response, got %q and error %v", b, err)
+	}
+}
+
+func TestRequestLineTooLong(t *testing.T) {
+	go func() {
+		proxy := Proxy{
+			Logger:               &log.DefaultLogger{},
+			MaxRequestLineLength: 8192,
+			Handler: Handler{
+				RewriteURL: func(userdata *UserData, hostWithPort string) string {
+					return hostWithPort
+				},
+				HijackerPool: &fakeResponseHijackerPool{
+					response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+				},
+			},
+		}
+		if err := proxy.Serve("tcp4", "0.0.0.0:5088"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5088")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the request is rejected before being read completely
+	go fmt.Fprintf(conn, "GET http://127.0.0.1:9443/%s HTTP/1.1\r\nHost: 127.0.0.1:9443\r\n\r\n",
+		strings.Repeat("a", 100*1024))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusRequestURITooLong {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusRequestURITooLong, resp.StatusCode)
+	}
+}
+
+func TestClientURLProxy(t *testing.T) {
+	// the fake super proxies answer every request with their names
+	makeSuperProxy := func(name string) *superproxy.SuperProxy {
+		superProxy, err := superproxy.NewFakeSuperProxy(name+":3128", superproxy.ProxyTypeHTTP,
+			func(targetHostWithPort string) (net.Conn, error) {
+				proxyConn, targetConn := net.Pipe()
+				go func() {
+					defer targetConn.Close()
+					reader := bufio.NewReader(targetConn)
+					for {
+						if _, err := nethttp.ReadRequest(reader); err != nil {
+							return
+						}
+						fmt.Fprintf(targetConn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(name), name)
+					}
+				}()
+				return proxyConn, nil
+			})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return superProxy
+	}
+	proxyA, proxyB := makeSuperProxy("proxy-a"), makeSuperProxy("proxy-b")
+	go serveTestProxy(5089, Handler{
+		ClientURLProxy: func(clientAddr net.Addr, userdata *UserData,
+			hostWithPort string, path []byte) *superproxy.SuperProxy {
+			if clientAddr.(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)) {
+				return proxyA
+			}
+			return proxyB
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	testRoute := func(clientIP, expBody string) {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(clientIP)}}
+		conn, err := dialer.Dial("tcp4", "127.0.0.1:5089")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET http://routed.example/ HTTP/1.1\r\nHost: routed.example\r\n\r\n")
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != expBody {
+			t.Fatalf("expected client %s routed to %s, got %s", clientIP, expBody, body)
+		}
+	}
+	testRoute("127.0.0.1", "proxy-a")
+	testRoute("127.0.0.2", "proxy-b")
+}
+
+func TestDecryptedResponseWriteTimeout(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	const size = 32 << 20
+	hijackerPool := &fakeResponseHijackerPool{
+		response: fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s",
+			size, strings.Repeat("a", size)),
+	}
+	proxy := &Proxy{
+		Logger:             &log.DefaultLogger{},
+		ServerWriteTimeout: 200 * time.Millisecond,
+		Handler: Handler{
+			ShouldDecryptHost: func(userdata *UserData, host string) bool {
+				return true
+			},
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			HijackerPool:      hijackerPool,
+			MITMCertAuthority: ca,
+		},
+	}
+	go proxy.Serve("tcp4", "0.0.0.0:5145")
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5145")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:443 HTTP/1.1\r\nHost: 127.0.0.1:443\r\n\r\n")
+	tunnelResp := make([]byte, len(httpTunnelMadeOKayBytes))
+	if _, err := io.ReadFull(conn, tunnelResp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: rootCA, ServerName: "127.0.0.1"})
+	fmt.Fprint(tlsConn, "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+
+	// the client stops reading, the proxy gives up writing the response
+	// by the ServerWriteTimeout still applied after the tunnel made
+	time.Sleep(time.Second)
+	n, _ := io.Copy(ioutil.Discard, tlsConn)
+	if n >= size {
+		t.Fatalf("expected response cut off by the write timeout, got %d bytes", n)
+	}
+}
+
+// skipVerifyForwardOptions forwards to the test servers signed by the test authority
+func skipVerifyForwardOptions(userdata *UserData, host string) *client.RequestOptions {
+	return &client.RequestOptions{InsecureSkipVerify: true}
+}
+
+func TestWebSocketOverMITM(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5090, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+		ForwardOptions:    skipVerifyForwardOptions,
+	})
+	// wss echo server, greets the client right after the handshake
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(ca, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9444", &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		req, err := nethttp.ReadRequest(reader)
+		if err != nil || req.Header.Get("Upgrade") != "websocket" {
+			fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		accept := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+			"Connection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n\x81\x05hello",
+			base64.StdEncoding.EncodeToString(accept[:]))
+		io.Copy(conn, reader)
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5090")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:9444 HTTP/1.1\r\nHost: 127.0.0.1:9444\r\n\r\n")
+	tunnelResp := make([]byte, len(httpTunnelMadeOKayBytes))
+	if _, err := io.ReadFull(conn, tunnelResp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: rootCA, ServerName: "127.0.0.1"})
+	fmt.Fprintf(tlsConn, "GET /echo HTTP/1.1\r\nHost: 127.0.0.1:9444\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	reader := bufio.NewReader(tlsConn)
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %s", accept)
+	}
+
+	// frames are forwarded both ways after the handshake
+	expectFrame := func(expFrame string) {
+		frame := make([]byte, len(expFrame))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(frame) != expFrame {
+			t.Fatalf("expected frame %q, got %q", expFrame, frame)
+		}
+	}
+	expectFrame("\x81\x05hello")
+	// a masked text frame of "ping"
+	pingFrame := "\x81\x84\x01\x02\x03\x04\x71\x6b\x6d\x63"
+	for i := 0; i < 2; i++ {
+		if _, err := tlsConn.Write([]byte(pingFrame)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expectFrame(pingFrame)
+	}
+}
+
+// fakeResponseHijackerPool makes hijackers responding with the fake response,
+// it records the last host requested
+func TestBlockPrivateNetworks(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+	go nethttp.ListenAndServe(":9989", mux)
+	lookupIP := func(userdata *UserData, domain string) net.IP {
+		if domain == "rebind.test" {
+			return net.ParseIP("127.0.0.1")
+		}
+		return nil
+	}
+	go serveTestProxy(5091, Handler{
+		LookupIP:             lookupIP,
+		BlockPrivateNetworks: true,
+	})
+	// loopback is not blocked by the custom networks
+	go serveTestProxy(5092, Handler{
+		LookupIP:             lookupIP,
+		BlockPrivateNetworks: true,
+		BlockedNetworks:      mustParseCIDRs("10.0.0.0/8"),
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	// a domain resolved to loopback by LookupIP
+	testBlockPrivateNetworks(t, 5091, "GET http://rebind.test:9989/ HTTP/1.1\r\nHost: rebind.test:9989\r\n\r\n",
+		nethttp.StatusForbidden)
+	// a domain resolved to loopback locally
+	testBlockPrivateNetworks(t, 5091, "GET http://localhost:9989/ HTTP/1.1\r\nHost: localhost:9989\r\n\r\n",
+		nethttp.StatusForbidden)
+	testBlockPrivateNetworks(t, 5091, "GET http://127.0.0.1:9989/ HTTP/1.1\r\nHost: 127.0.0.1:9989\r\n\r\n",
+		nethttp.StatusForbidden)
+	testBlockPrivateNetworks(t, 5091, "CONNECT rebind.test:9989 HTTP/1.1\r\nHost: rebind.test:9989\r\n\r\n",
+		nethttp.StatusForbidden)
+	testBlockPrivateNetworks(t, 5092, "GET http://rebind.test:9989/ HTTP/1.1\r\nHost: rebind.test:9989\r\n\r\n",
+		nethttp.StatusOK)
+}
+
+func testBlockPrivateNetworks(t *testing.T, proxyPort int, raw string, expectedStatus int) {
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("expected status %d for %q, got %d", expectedStatus, raw, resp.StatusCode)
+	}
+}
+
+func TestDNSPinning(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		// the original host name is still sent
+		fmt.Fprintf(w, "%s", r.Host)
+	})
+	go nethttp.ListenAndServe("127.0.0.1:9988", mux)
+	p := &Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			BlockPrivateNetworks: true,
+			BlockedNetworks:      mustParseCIDRs("10.0.0.0/8"),
+		},
+	}
+	go p.Serve("tcp4", "0.0.0.0:5093")
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5093")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET http://localhost:9988/ HTTP/1.1\r\nHost: localhost:9988\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	if string(body) != "localhost:9988" {
+		t.Fatalf("unexpected host %q received by target", body)
+	}
+	// the addresses dialed are checked exactly as the ones resolved,
+	// even if rebound after the check
+	if p.client.PermitTargetIP == nil || p.client.PermitTargetIP(net.ParseIP("10.255.255.1")) {
+		t.Fatal("expected the blocked networks never dialed")
+	}
+	if !p.client.PermitTargetIP(net.ParseIP("127.0.0.1")) {
+		t.Fatal("expected the other networks dialed")
+	}
+}
+
+func TestUsageAccountedOnReturn(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:9987")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	p := &Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+		},
+	}
+	p.setup()
+
+	// serve the connection directly, so that the usage is checked right after
+	// the serving returned, rather than waiting for it being accounted
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.serveConn(proxyConn)
+		proxyConn.Close()
+	}()
+	raw := "GET http://127.0.0.1:9987/ HTTP/1.1\r\nHost: 127.0.0.1:9987\r\nConnection: close\r\n\r\n"
+	go clientConn.Write([]byte(raw))
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	counter := &countingReader{r: clientConn}
+	resp, err := nethttp.ReadResponse(bufio.NewReader(counter), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := p.Usage.GetIncomingSize(); n != uint64(len(raw)) {
+		t.Fatalf("expected incoming size %d, got %d", len(raw), n)
+	}
+	if n := p.Usage.GetOutgoingSize(); n != uint64(counter.n) {
+		t.Fatalf("expected outgoing size %d, got %d", counter.n, n)
+	}
+	if p.Stats.GetTotalConns() != 1 || p.Stats.GetActiveConns() != 0 || p.Stats.GetTotalRequests() != 1 {
+		t.Fatalf("unexpected stats %+v", p.Stats)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%v %s %s", r.TransferEncoding, r.Trailer.Get("X-Checksum"), body)
+	})
+	go nethttp.ListenAndServe("127.0.0.1:9986", mux)
+	go serveTestProxy(5095, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	testChunkedRequestBody(t, "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "[chunked]  hello world")
+	// chunk extensions and trailers
+	testChunkedRequestBody(t, "5;name=value\r\nhello\r\n0\r\nX-Checksum: 42\r\n\r\n", "[chunked] 42 hello")
+}
+
+func testChunkedRequestBody(t *testing.T, body, expectedResponse string) {
+	conn, err := net.Dial("tcp4", "127.0.0.1:5095")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	// pipelined twice, the chunked body must end at the exact last chunk
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("POST http://127.0.0.1:9986/ HTTP/1.1\r\nHost: 127.0.0.1:9986\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n" + body)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(respBody) != expectedResponse {
+			t.Fatalf("expected response %q, got %q", expectedResponse, respBody)
+		}
+	}
+}
+
+func TestBadGatewayOnDialFailure(t *testing.T) {
+	go serveTestProxy(5096, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	testBadGatewayOnDialFailure(t, "GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n", "GET")
+	testBadGatewayOnDialFailure(t, "CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n", "CONNECT")
+}
+
+func testBadGatewayOnDialFailure(t *testing.T, raw, method string) {
+	conn, err := net.Dial("tcp4", "127.0.0.1:5096")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), &nethttp.Request{Method: method})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadGateway, resp.StatusCode)
+	}
+	if len(body) == 0 || int64(len(body)) != resp.ContentLength {
+		t.Fatalf("unexpected body %q with content length %d", body, resp.ContentLength)
+	}
+}
+
+func TestTunnelFailureResponse(t *testing.T) {
+	deadSuperProxy, err := superproxy.NewSuperProxy("127.0.0.1", 1, superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go serveTestProxy(5097, Handler{
+		// not an IP literal, so the certificate is unable to be made
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return host == "not:ip"
+		},
+		LookupIP: func(userdata *UserData, domain string) net.IP {
+			if domain == "not:ip" {
+				return net.ParseIP("::1")
+			}
+			return nil
+		},
+		URLProxy: func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy {
+			if hostWithPort == "127.0.0.1:2" {
+				return deadSuperProxy
+			}
+			return nil
+		},
+		BlockPrivateNetworks: true,
+		BlockedNetworks:      mustParseCIDRs("127.0.0.3/32"),
+		TunnelFailureResponse: func(cause TunnelFailure, err error) (int, []byte) {
+			switch cause {
+			case TunnelFailureDial:
+				return nethttp.StatusServiceUnavailable, []byte("dial")
+			case TunnelFailureSuperProxy:
+				return nethttp.StatusBadGateway, []byte("super proxy")
+			case TunnelFailureDecrypt:
+				return nethttp.StatusInternalServerError, []byte("decrypt")
+			case TunnelFailureBlocked:
+				return nethttp.StatusUnavailableForLegalReasons, []byte("blocked")
+			}
+			return 0, nil
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	testTunnelFailureResponse(t, "127.0.0.1:1", nethttp.StatusServiceUnavailable, "dial")
+	testTunnelFailureResponse(t, "127.0.0.1:2", nethttp.StatusBadGateway, "super proxy")
+	testTunnelFailureResponse(t, "[not:ip]:443", nethttp.StatusInternalServerError, "decrypt")
+	testTunnelFailureResponse(t, "127.0.0.3:443", nethttp.StatusUnavailableForLegalReasons, "blocked")
+}
+
+func testTunnelFailureResponse(t *testing.T, hostWithPort string, expectedStatus int, expectedBody string) {
+	conn, err := net.Dial("tcp4", "127.0.0.1:5097")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", hostWithPort, hostWithPort); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != expectedStatus || string(body) != expectedBody {
+		t.Fatalf("expected %d %q for %s, got %d %q", expectedStatus, expectedBody,
+			hostWithPort, resp.StatusCode, body)
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:5098")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := &Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- proxy.ServeListener(ln) }()
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5098")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// a direct request is responded by the proxy
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1:5098\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadRequest, resp.StatusCode)
+	}
+	if err := proxy.ShutDown(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serving should end after shut down")
+	}
+}
+
+func TestMalformedRequestLine(t *testing.T) {
+	go serveTestProxy(5099, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	for _, raw := range []string{"garbage\r\n\r\n", "\x00\x01\x02\x03\r\n\r\n", "GET\r\n\r\n"} {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5099")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode != nethttp.StatusBadRequest {
+			t.Fatalf("expected status %d for %q, got %d", nethttp.StatusBadRequest, raw, resp.StatusCode)
+		}
+	}
+}
+
+func TestShouldDecryptSNI(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5100, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		ShouldDecryptSNI: func(userdata *UserData, connectHost, serverName string) bool {
+			return connectHost == "127.0.0.1" && serverName == "decrypt.test"
+		},
+		MITMCertAuthority: ca,
+	})
+	// the target server with a certificate not signed by the test authority
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"decrypt.test", "tunnel.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9445", &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	// the CONNECT host is the same, while the decision follows SNI
+	testShouldDecryptSNI(t, rootCA, "decrypt.test", true)
+	testShouldDecryptSNI(t, rootCA, "tunnel.test", false)
+}
+
+func testShouldDecryptSNI(t *testing.T, rootCA *x509.CertPool, serverName string, expectingDecrypted bool) {
+	conn, err := net.Dial("tcp4", "127.0.0.1:5100")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:9445 HTTP/1.1\r\nHost: 127.0.0.1:9445\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// only the certificates made by decryption are signed by the test authority
+	leaf := tlsConn.ConnectionState().PeerCertificates[0]
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: serverName, Roots: rootCA})
+	if decrypted := err == nil; decrypted != expectingDecrypted {
+		t.Fatalf("expected decrypted %v for %s, got %v", expectingDecrypted, serverName, decrypted)
+	}
+}
+
+func TestEnforceHostMatch(t *testing.T) {
+	ca, _ := makeTestCertAuthority(t)
+	handler := Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+		ForwardOptions:    skipVerifyForwardOptions,
+		EnforceHostMatch:  true,
+	}
+	go serveTestProxy(5101, handler)
+	handler.HostMatches = func(connectHost, host string) bool {
+		return host == connectHost || (connectHost == "127.0.0.1" && host == "localhost")
+	}
+	go serveTestProxy(5102, handler)
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(ca, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9446", &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	testEnforceHostMatch(t, 5101, "", "GET / HTTP/1.1\r\nHost: 127.0.0.1:9446\r\n\r\n", nethttp.StatusOK)
+	testEnforceHostMatch(t, 5101, "", "GET / HTTP/1.1\r\nHost: evil.test\r\n\r\n", nethttp.StatusMisdirectedRequest)
+	testEnforceHostMatch(t, 5101, "evil.test", "GET / HTTP/1.1\r\nHost: 127.0.0.1:9446\r\n\r\n", nethttp.StatusMisdirectedRequest)
+	testEnforceHostMatch(t, 5101, "", "GET https://evil.test/ HTTP/1.1\r\nHost: 127.0.0.1:9446\r\n\r\n", nethttp.StatusMisdirectedRequest)
+	testEnforceHostMatch(t, 5101, "", "GET / HTTP/1.1\r\nHost: localhost:9446\r\n\r\n", nethttp.StatusMisdirectedRequest)
+	// the custom matcher takes localhost as 127.0.0.1
+	testEnforceHostMatch(t, 5102, "", "GET / HTTP/1.1\r\nHost: localhost:9446\r\n\r\n", nethttp.StatusOK)
+	testEnforceHostMatch(t, 5102, "", "GET / HTTP/1.1\r\nHost: evil.test\r\n\r\n", nethttp.StatusMisdirectedRequest)
+}
+
+func testEnforceHostMatch(t *testing.T, proxyPort int, serverName, req string, expectingStatus int) {
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:9446 HTTP/1.1\r\nHost: 127.0.0.1:9446\r\n\r\n")
+	tunnelResp := make([]byte, len(httpTunnelMadeOKayBytes))
+	if _, err := io.ReadFull(conn, tunnelResp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	fmt.Fprint(tlsConn, req)
+	resp, err := nethttp.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != expectingStatus {
+		t.Fatalf("expected status %d for %q, got %d", expectingStatus, req, resp.StatusCode)
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5103, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+		ForwardOptions:    skipVerifyForwardOptions,
+		HostOverride: func(host string) (string, bool) {
+			switch host {
+			case "api.example.com:443":
+				return "127.0.0.1:9447", true
+			case "api.example.com:80":
+				return "127.0.0.1:9448", true
+			}
+			return "", false
+		},
+	})
+	// the servers only know the original host
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(ca, []string{"api.example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	handler := nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprintf(w, "Hello %s!", r.Host)
+	})
+	tlsLn, err := tls.Listen("tcp4", "127.0.0.1:9447", &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer tlsLn.Close()
+	go nethttp.Serve(tlsLn, handler)
+	ln, err := net.Listen("tcp4", "127.0.0.1:9448")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, handler)
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5103")
+	client := &nethttp.Client{
+		Timeout: 5 * time.Second,
+		Transport: &nethttp.Transport{
+			Proxy:           nethttp.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: rootCA},
+		},
+	}
+	for _, target := range []string{"https://api.example.com/", "http://api.example.com/"} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != "Hello api.example.com!" {
+			t.Fatalf("expected the original host sent to %s, got %q", target, body)
+		}
+	}
+}
+
+func TestForwardOptions(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5104, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+		ForwardOptions: func(userdata *UserData, host string) *client.RequestOptions {
+			if host == "insecure.test:9449" {
+				return &client.RequestOptions{InsecureSkipVerify: true}
+			}
+			return nil
+		},
+		HostOverride: func(host string) (string, bool) {
+			if strings.HasSuffix(host, ".test:9449") {
+				return "127.0.0.1:9449", true
+			}
+			return "", false
+		},
+	})
+	// the target server with an untrusted certificate
+	serverCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"insecure.test", "secure.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9449", &tls.Config{Certificates: []tls.Certificate{*serverCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, "Hello world!")
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5104")
+	httpClient := &nethttp.Client{
+		Timeout: 5 * time.Second,
+		Transport: &nethttp.Transport{
+			Proxy:           nethttp.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: rootCA},
+		},
+	}
+	resp, err := httpClient.Get("https://insecure.test:9449/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "Hello world!" {
+		t.Fatalf("expected the response of the insecure target, got %q", body)
+	}
+
+	// the certificate of target is still verified by default
+	resp, err = httpClient.Get("https://secure.test:9449/")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == nethttp.StatusOK {
+			t.Fatalf("expected failure verifying the untrusted target")
+		}
+	}
+}
+
+func TestRedirectPassThrough(t *testing.T) {
+	go serveTestProxy(5105, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+	})
+	targetHits := 0
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/from", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Location", "/to")
+		w.WriteHeader(nethttp.StatusFound)
+		fmt.Fprint(w, "moved")
+	})
+	mux.HandleFunc("/to", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		targetHits++
+		fmt.Fprint(w, "Hello world!")
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:9450")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, mux)
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5105")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+		CheckRedirect: func(req *nethttp.Request, via []*nethttp.Request) error {
+			return nethttp.ErrUseLastResponse
+		},
+	}
+	resp, err := httpClient.Get("http://127.0.0.1:9450/from")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the proxy must return the redirect to the client rather than follow it
+	if resp.StatusCode != nethttp.StatusFound {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusFound, resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != "/to" {
+		t.Fatalf("expected location %q, got %q", "/to", location)
+	}
+	if string(body) != "moved" {
+		t.Fatalf("expected body %q, got %q", "moved", body)
+	}
+	if targetHits != 0 {
+		t.Fatalf("expected the redirect target not requested, got %d hits", targetHits)
+	}
+}
+
+func TestRangeRequestPassThrough(t *testing.T) {
+	go serveTestProxy(5108, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+	})
+	content := strings.Repeat("0123456789", 100)
+	ln, err := net.Listen("tcp4", "127.0.0.1:9453")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		nethttp.ServeContent(w, r, "digits.txt", time.Time{}, strings.NewReader(content))
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5108")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	req, _ := nethttp.NewRequest("GET", "http://127.0.0.1:9453/", nil)
+	req.Header.Set("Range", "bytes=100-249")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusPartialContent, resp.StatusCode)
+	}
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "bytes 100-249/1000" {
+		t.Fatalf("expected content range %q, got %q", "bytes 100-249/1000", contentRange)
+	}
+	// the content length is the size of the partial body, not the whole one
+	if resp.ContentLength != 150 || len(body) != 150 {
+		t.Fatalf("expected 150 bytes, got content length %d with %d bytes",
+			resp.ContentLength, len(body))
+	}
+	if string(body) != content[100:250] {
+		t.Fatalf("unexpected partial body %q", body)
+	}
+}
+
+func TestEmitForwarded(t *testing.T) {
+	go serveTestProxy(5109, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+		EmitForwarded: true,
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:9454")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, strings.Join(r.Header["Forwarded"], "\n"))
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5109")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	req, _ := nethttp.NewRequest("GET", "http://127.0.0.1:9454/", nil)
+	req.Header.Set("Forwarded", `for="[2001:db8:cafe::17]"`)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the existing chain is kept, followed by the element of this proxy
+	expected := `for="[2001:db8:cafe::17]"` + "\n" +
+		`for=127.0.0.1;by=127.0.0.1;proto=http;host="127.0.0.1:9454"`
+	if string(body) != expected {
+		t.Fatalf("expected forwarded headers %q, got %q", expected, body)
+	}
+}
+
+func TestAutoDetectProtocol(t *testing.T) {
+	go serveTestProxy(5110, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+		AutoDetectProtocol: true,
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:9455")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, "Hello world!")
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	// socks5Dial makes the SOCKS5 handshake with command cmd
+	// to 127.0.0.1:port, the reply code is returned
+	socks5Dial := func(cmd byte, port int) (net.Conn, byte) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5110")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if reply[0] != 5 || reply[1] != 0 {
+			t.Fatalf("unexpected SOCKS5 method selection %v", reply[:2])
+		}
+		if _, err := conn.Write([]byte{5, cmd, 0, 1, 127, 0, 0, 1,
+			byte(port >> 8), byte(port)}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return conn, reply[1]
+	}
+
+	// SOCKS5 CONNECT tunnels to the target
+	conn, code := socks5Dial(1, 9455)
+	if code != 0 {
+		t.Fatalf("expected SOCKS5 success, got reply code %d", code)
+	}
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1:9455\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK || string(body) != "Hello world!" {
+		t.Fatalf("unexpected response through SOCKS5 tunnel %d %q", resp.StatusCode, body)
+	}
+
+	// the failure to connect the target is replied
+	conn, code = socks5Dial(1, 1)
+	conn.Close()
+	if code != 4 {
+		t.Fatalf("expected SOCKS5 host unreachable, got reply code %d", code)
+	}
+
+	// commands other than CONNECT are not supported
+	conn, code = socks5Dial(3, 9455)
+	conn.Close()
+	if code != 7 {
+		t.Fatalf("expected SOCKS5 command not supported, got reply code %d", code)
+	}
+
+	// HTTP clients are served on the same listener
+	proxyURL, _ := url.Parse("http://127.0.0.1:5110")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	resp, err = httpClient.Get("http://127.0.0.1:9455/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "Hello world!" {
+		t.Fatalf("unexpected response through HTTP proxy %q", body)
+	}
+}
+
+func TestSOCKS5BadDomain(t *testing.T) {
+	for _, domain := range []string{"", "a.test\r\nX-Injected: 1", "a .test", "a.test\x00", "a.t\xe9st"} {
+		client, server := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := readSOCKS5Connect(server, nil)
+			server.Close()
+			errc <- err
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		// the version byte is already read, then the greeting and request
+		request := append([]byte{1, 0, 5, 1, 0, 3, byte(len(domain))}, domain...)
+		request = append(request, 0, 80)
+		go client.Write(request)
+		reply, _ := ioutil.ReadAll(client)
+		client.Close()
+		if err := <-errc; err != errSOCKS5BadDomain {
+			t.Fatalf("expected error %q of domain %q, got %v", errSOCKS5BadDomain, domain, err)
+		}
+		if len(reply) != 12 || reply[3] != socks5GeneralFailure {
+			t.Fatalf("expected general failure of domain %q, got reply %v", domain, reply)
+		}
+	}
+}
+
+func TestServeSOCKS5(t *testing.T) {
+	var socksUser string
+	proxy := Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			SOCKS5Authenticate: func(user, pass string) bool {
+				return user == "alice" && pass == "secret"
+			},
+			URLProxy: func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy {
+				socksUser, _ = userdata.Get(UserDataSOCKS5UserKey).(string)
+				return nil
+			},
+		},
+	}
+	go proxy.ServeSOCKS5("tcp4", "0.0.0.0:5111")
+	ln, err := net.Listen("tcp4", "127.0.0.1:9456")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, "Hello world!")
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	// socks5Auth authenticates with user and pass, the auth status is returned
+	socks5Auth := func(user, pass string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5111")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte{5, 2, 0, 2}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if reply[0] != 5 || reply[1] != 2 {
+			t.Fatalf("expected username/password method selected, got %v", reply)
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return conn, reply[1]
+	}
+
+	conn, status := socks5Auth("alice", "wrong")
+	conn.Close()
+	if status == 0 {
+		t.Fatalf("expected authentication failure")
+	}
+
+	conn, status = socks5Auth("alice", "secret")
+	defer conn.Close()
+	if status != 0 {
+		t.Fatalf("expected authentication success, got status %d", status)
+	}
+	if _, err := conn.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 9456 >> 8, 9456 & 0xff}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reply[1] != 0 {
+		t.Fatalf("expected SOCKS5 success, got reply code %d", reply[1])
+	}
+	if socksUser != "alice" {
+		t.Fatalf("expected SOCKS5 user %q in user data, got %q", "alice", socksUser)
+	}
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1:9456\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "Hello world!" {
+		t.Fatalf("unexpected response through SOCKS5 tunnel %q", body)
+	}
+}
+
+func TestHandshakeFailureStats(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	p := &Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			ShouldDecryptHost: func(userdata *UserData, host string) bool {
+				return true
+			},
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			MITMCertAuthority: ca,
+		},
+	}
+	go p.Serve("tcp4", "0.0.0.0:5112")
+	time.Sleep(time.Millisecond * 10)
+
+	// handshake makes the tls handshake with config through the tunnel,
+	// the connection is closed without handshake if config is nil
+	handshake := func(config *tls.Config) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5112")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// the target is never connected before the handshake with client
+		if _, err := conn.Write([]byte("CONNECT 127.0.0.1:9457 HTTP/1.1\r\n" +
+			"Host: 127.0.0.1:9457\r\n\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != nethttp.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+		if config == nil {
+			return
+		}
+		if err := tls.Client(conn, config).Handshake(); err == nil {
+			t.Fatalf("expected the handshake failed")
+		}
+	}
+	waitStats := func(reason HandshakeFailure, n uint64) {
+		for i := 0; i < 100 && p.Stats.GetHandshakeFailures(reason) < n; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if got := p.Stats.GetHandshakeFailures(reason); got != n {
+			t.Fatalf("expected %d handshake failures of %s, got %d", n, reason, got)
+		}
+	}
+
+	// the fake certificate is not trusted by client
+	handshake(&tls.Config{ServerName: "example.test"})
+	waitStats(HandshakeFailureCertRejected, 1)
+
+	// the TLS version is not supported by proxy
+	handshake(&tls.Config{ServerName: "example.test", RootCAs: rootCA,
+		MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10})
+	waitStats(HandshakeFailureUnsupportedVersion, 1)
+
+	// client goes away before handshaking
+	handshake(nil)
+	waitStats(HandshakeFailureClientClosed, 1)
+
+	if n := p.Stats.GetHandshakeFailures(HandshakeFailureOther); n != 0 {
+		t.Fatalf("expected no other handshake failures, got %d", n)
+	}
+	if n := p.Stats.GetTunnelErrors(); n != 3 {
+		t.Fatalf("expected 3 tunnel errors, got %d", n)
+	}
+}
+
+func TestHeaderLargerThanBuffer(t *testing.T) {
+	go serveTestProxy(5113, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+	})
+	large := strings.Repeat("a", 10*1024)
+	ln, err := net.Listen("tcp4", "127.0.0.1:9458")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("X-Large", r.Header.Get("X-Large"))
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5113")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	// both headers are larger than the default read buffer of proxy
+	req, _ := nethttp.NewRequest("POST", "http://127.0.0.1:9458/", strings.NewReader("body"))
+	req.Header.Set("X-Large", large)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.Header.Get("X-Large") != large {
+		t.Fatalf("large header not forwarded, got %d bytes", len(resp.Header.Get("X-Large")))
+	}
+	if string(body) != "body" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestAutoContinue(t *testing.T) {
+	go serveTestProxy(5114, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+		AutoContinue: true,
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:9459")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r, err := nethttp.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				// the silent target never tells client to continue
+				if r.URL.Path != "/silent" {
+					fmt.Fprint(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+				}
+				body, _ := ioutil.ReadAll(r.Body)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			}(conn)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	for _, path := range []string{"/continue", "/silent"} {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5114")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST http://127.0.0.1:9459%s HTTP/1.1\r\nHost: 127.0.0.1:9459\r\n"+
+			"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n", path)
+		br := bufio.NewReader(conn)
+		// the body is sent only after told to continue, like the real clients
+		interim, err := nethttp.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if interim.StatusCode != nethttp.StatusContinue {
+			t.Fatalf("expected status %d for %s, got %d", nethttp.StatusContinue, path, interim.StatusCode)
+		}
+		fmt.Fprint(conn, "hello")
+		resp, err := nethttp.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode != nethttp.StatusOK {
+			t.Fatalf("expected exactly one 100 Continue for %s, got status %d after it", path, resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != "hello" {
+			t.Fatalf("expected body %q, got %q", "hello", body)
+		}
+		conn.Close()
+	}
+}
+
+func TestMITMCertGenerationLimit(t *testing.T) {
+	ca, _ := makeTestCertAuthority(t)
+	p := &Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			ShouldDecryptHost: func(userdata *UserData, host string) bool {
+				return true
+			},
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			LookupIP: func(userdata *UserData, domain string) net.IP {
+				return net.IPv4(127, 0, 0, 1)
+			},
+			MITMCertAuthority:        ca,
+			MITMCertCacheSize:        2,
+			MITMCertGenerationLimit:  2,
+			MITMCertGenerationWindow: time.Hour,
+		},
+	}
+	go p.Serve("tcp4", "0.0.0.0:5115")
+
+	// the target serves a cert signed by another authority
+	targetCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"target.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9460", &tls.Config{Certificates: []tls.Certificate{*targetCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	// decrypted reports whether the tls connection to host is decrypted by proxy
+	decrypted := func(host string) bool {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5115")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s:9460 HTTP/1.1\r\nHost: %s:9460\r\n\r\n", host, host)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != nethttp.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return tlsConn.ConnectionState().PeerCertificates[0].CheckSignatureFrom(ca.Leaf) == nil
+	}
+
+	// a flood of unique hosts, only the certs within the limit are signed
+	for i := 0; i < 6; i++ {
+		host := fmt.Sprintf("fuzz%d.test", i)
+		if decrypted(host) != (i < 2) {
+			t.Fatalf("unexpected decryption of %s", host)
+		}
+	}
+	if n := p.mitmCertCache.Len(); n != 2 {
+		t.Fatalf("expected 2 certs cached, got %d", n)
+	}
+	// the hosts cached are still decrypted beyond the limit
+	if !decrypted("fuzz0.test") {
+		t.Fatalf("expected the host cached decrypted")
+	}
+}
+
+func TestMITMCipherSuites(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5116, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+		MITMCipherSuites:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	handshake := func(suite uint16) error {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5116")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// the target is never connected before the handshake with client
+		fmt.Fprint(conn, "CONNECT 127.0.0.1:9461 HTTP/1.1\r\nHost: 127.0.0.1:9461\r\n\r\n")
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != nethttp.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+		return tls.Client(conn, &tls.Config{
+			RootCAs:      rootCA,
+			ServerName:   "127.0.0.1",
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{suite},
+		}).Handshake()
+	}
+	if err := handshake(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := handshake(tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA); err == nil {
+		t.Fatalf("expected handshake error when client offers only the suites excluded")
+	}
+}
+
+func TestRoutingBody(t *testing.T) {
+	// the mutations are routed to the upstream proxy, others direct
+	go serveTestProxy(5118, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+		ProxyName: "upstream",
+	})
+	upstream, err := superproxy.NewSuperProxy("127.0.0.1", 5118, superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go serveTestProxy(5117, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+		RoutingBodySize: 64,
+		URLProxy: func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy {
+			body, _ := userdata.Get(UserDataRequestBodyKey).([]byte)
+			var operation struct {
+				OperationName string `json:"operationName"`
+			}
+			if json.Unmarshal(body, &operation) == nil && operation.OperationName == "Mutation" {
+				return upstream
+			}
+			return nil
+		},
+	})
+	ln, err := net.Listen("tcp4", "127.0.0.1:9462")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Via", r.Header.Get("Via"))
+		w.Write(body)
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5117")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	for _, c := range []struct {
+		body     string
+		upstream bool
+	}{
+		{`{"operationName":"Mutation"}`, true},
+		{`{"operationName":"Query"}`, false},
+		// larger than the routing body size, streamed without routing
+		{`{"operationName":"Mutation","query":"` + strings.Repeat("a", 64) + `"}`, false},
+	} {
+		resp, err := httpClient.Post("http://127.0.0.1:9462/graphql", "application/json",
+			strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the body read ahead is still sent to target
+		if string(body) != c.body {
+			t.Fatalf("expected body %q, got %q", c.body, body)
+		}
+		if routed := strings.Contains(resp.Header.Get("X-Via"), "upstream"); routed != c.upstream {
+			t.Fatalf("expected routed to upstream %t for %s, got via %q",
+				c.upstream, c.body, resp.Header.Get("X-Via"))
+		}
+	}
+}
+
+func TestInvalidMITMCertAuthority(t *testing.T) {
+	// a leaf certificate is unable to sign the fake server certificates
+	notCA, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"ca.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	logger := &captureEventLogger{}
+	go serveTestProxy(5119, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: notCA,
+		Logger:            logger,
+	})
+	targetCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9463", &tls.Config{Certificates: []tls.Certificate{*targetCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, "target")
+	}))
+	time.Sleep(time.Millisecond * 10)
+
+	// tunneled to target without decryption rather than failed
+	proxyURL, _ := url.Parse("http://127.0.0.1:5119")
+	httpClient := &nethttp.Client{
+		Timeout: 5 * time.Second,
+		Transport: &nethttp.Transport{
+			Proxy:           nethttp.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := httpClient.Get("https://127.0.0.1:9463/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "target" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if !resp.TLS.PeerCertificates[0].Equal(targetCert.Leaf) {
+		t.Fatalf("expected the target certificate, got the one signed by proxy")
+	}
+	// the misconfiguration is logged on serving
+	for _, event := range logger.Events() {
+		if event.level == "error" && event.err != nil &&
+			strings.Contains(event.msg, "invalid mitm cert authority") {
+			return
+		}
+	}
+	t.Fatalf("expected the invalid cert authority logged, got %v", logger.Events())
+}
+
+func TestConnectIPv6Literal(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	hijackerPool := &fakeResponseHijackerPool{
+		response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+	}
+	// ::1 is tunneled to the local target, 2001:db8::2 decrypted
+	go serveTestProxy(5120, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return host == "2001:db8::2"
+		},
+		HijackerPool:      hijackerPool,
+		MITMCertAuthority: ca,
+	})
+	targetCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"::1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp6", "[::1]:0", &tls.Config{Certificates: []tls.Certificate{*targetCert}})
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	// connect makes the TLS connection to host through the tunnel
+	connect := func(host string, config *tls.Config) *tls.Conn {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5120")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		tunnelResp := make([]byte, len(httpTunnelMadeOKayBytes))
+		if _, err := io.ReadFull(conn, tunnelResp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(tunnelResp, httpTunnelMadeOKayBytes) {
+			t.Fatalf("expected tunnel response %q for %s, got %q", httpTunnelMadeOKayBytes, host, tunnelResp)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("unexpected error for %s: %s", host, err)
+		}
+		return tlsConn
+	}
+
+	tlsConn := connect(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if !tlsConn.ConnectionState().PeerCertificates[0].Equal(targetCert.Leaf) {
+		t.Fatalf("expected the target certificate through the tunnel")
+	}
+	tlsConn.Close()
+
+	// the fake certificate is verified by the IPv6 address
+	tlsConn = connect("[2001:db8::2]:443", &tls.Config{RootCAs: rootCA, ServerName: "2001:db8::2"})
+	defer tlsConn.Close()
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("2001:db8::2")) ||
+		len(cert.DNSNames) != 0 {
+		t.Fatalf("expected cert ip addresses [2001:db8::2], got %v %v", cert.IPAddresses, cert.DNSNames)
+	}
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: [2001:db8::2]\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("expected body %s, got %s", "ok", body)
+	}
+	if hijackerPool.host != "[2001:db8::2]:443" {
+		t.Fatalf("expected host %s, got %s", "[2001:db8::2]:443", hijackerPool.host)
+	}
+}
+
+// countingCertSigner signs as mitm.CertAuthoritySigner, counting the certs signed
+type countingCertSigner struct {
+	mitm.CertAuthoritySigner
+	lock   sync.Mutex
+	signed int
+}
+
+func (s *countingCertSigner) SignLeafCert(domainNames []string,
+	publicKey crypto.PublicKey) ([]byte, error) {
+	s.lock.Lock()
+	s.signed++
+	s.lock.Unlock()
+	return s.CertAuthoritySigner.SignLeafCert(domainNames, publicKey)
+}
+
+func TestMITMCertSigner(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	signer := &countingCertSigner{CertAuthoritySigner: mitm.CertAuthoritySigner{CertAuthority: ca}}
+	go serveTestProxy(5121, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		// the cert authority without private key is ignored with a signer
+		MITMCertAuthority: &tls.Certificate{Certificate: ca.Certificate, Leaf: ca.Leaf},
+		MITMCertSigner:    signer,
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5121")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:9465 HTTP/1.1\r\nHost: 127.0.0.1:9465\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if err := tls.Client(conn, &tls.Config{
+		RootCAs:    rootCA,
+		ServerName: "127.0.0.1",
+	}).Handshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signer.lock.Lock()
+	defer signer.lock.Unlock()
+	if signer.signed != 1 {
+		t.Fatalf("expected 1 cert signed by signer, got %d", signer.signed)
+	}
+}
+
+func TestStrictHeaderParsing(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	go nethttp.ListenAndServe("127.0.0.1:9465", mux)
+	go func() {
+		proxy := Proxy{
+			Logger:              &log.DefaultLogger{},
+			StrictHeaderParsing: true,
+			Handler: Handler{
+				RewriteURL: func(userdata *UserData, hostWithPort string) string {
+					return hostWithPort
+				},
+			},
+		}
+		if err := proxy.Serve("tcp4", "0.0.0.0:5122"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	statusOf := func(header string) int {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5122")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(conn, "GET http://127.0.0.1:9465/ HTTP/1.1\r\n"+header)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := statusOf("Host: 127.0.0.1:9465\r\n\r\n"); status != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, status)
+	}
+	for _, header := range []string{
+		"Host: 127.0.0.1:9465\nContent-Length: 0\r\n\r\n",
+		"Host: 127.0.0.1:9465\r\nX-Foo: a\rContent-Length: 0\r\n\r\n",
+		"Host: 127.0.0.1:9465\r\nX-Foo\x00: a\r\n\r\n",
+		"Host: 127.0.0.1:9465\r\nTransfer-Encoding : chunked\r\n\r\n",
+		"Host: 127.0.0.1:9465\r\nContent-Length: 5\r\nContent-Length: 10\r\n\r\n",
+		"Host: 127.0.0.1:9465\r\nContent-Length: -5\r\n\r\n",
+	} {
+		if status := statusOf(header); status != nethttp.StatusBadRequest {
+			t.Fatalf("expected status %d for %q, got %d", nethttp.StatusBadRequest, header, status)
+		}
+	}
+}
+
+func TestMalformedContentLength(t *testing.T) {
+	// upstream responding with the conflicting content lengths
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := nethttp.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n"+
+					"Content-Length: 12\r\n\r\nokHTTP/1.1 200")
+			}(conn)
+		}
+	}()
+	go serveTestProxy(5141, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	statusOf := func(header string) int {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5141")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\n%s\r\nok",
+			ln.Addr(), ln.Addr(), header)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, header := range []string{
+		"Content-Length: 2\r\nContent-Length: 10\r\n",
+		"Content-Length: abc\r\n",
+		"Content-Length: 2, 2\r\n",
+	} {
+		if status := statusOf(header); status != nethttp.StatusBadRequest {
+			t.Fatalf("expected status %d for %q, got %d", nethttp.StatusBadRequest, header, status)
+		}
+	}
+	if status := statusOf("Content-Length: 2\r\n"); status != nethttp.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadGateway, status)
+	}
+}
+
+func TestMaxChunkSize(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:9466")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := nethttp.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				chunk := strings.Repeat("a", 16)
+				if req.URL.Path == "/large" {
+					chunk = strings.Repeat("a", 64)
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+					"%x\r\n%s\r\n0\r\n\r\n", len(chunk), chunk)
+			}(conn)
+		}
+	}()
+	go func() {
+		proxy := Proxy{
+			Logger:       &log.DefaultLogger{},
+			MaxChunkSize: 32,
+			Handler: Handler{
+				RewriteURL: func(userdata *UserData, hostWithPort string) string {
+					return hostWithPort
+				},
+			},
+		}
+		if err := proxy.Serve("tcp4", "0.0.0.0:5123"); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	get := func(path string) ([]byte, error) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5123")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET http://127.0.0.1:9466%s HTTP/1.1\r\nHost: 127.0.0.1:9466\r\n\r\n", path)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+	if body, err := get("/small"); err != nil || string(body) != strings.Repeat("a", 16) {
+		t.Fatalf("unexpected body %q with error %v", body, err)
+	}
+	// the response is cut off before the oversized chunk
+	if body, err := get("/large"); err == nil {
+		t.Fatalf("expected error reading the oversized chunk, got body %q", body)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	// sink server discarding everything
+	ln, err := net.Listen("tcp4", "127.0.0.1:9467")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	sinkConns := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sinkConns <- conn
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	p := &Proxy{
+		Logger:          &log.DefaultLogger{},
+		ConnStatsWindow: time.Second,
+		Handler: Handler{
+			ShouldDecryptHost: func(userdata *UserData, host string) bool {
+				return false
+			},
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+		},
+	}
+	go p.Serve("tcp4", "0.0.0.0:5124")
+	time.Sleep(time.Millisecond * 10)
+	if stats := p.ActiveConnStats(); len(stats) != 0 {
+		t.Fatalf("expected no conn stats, got %d", len(stats))
+	}
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5124")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:9467 HTTP/1.1\r\nHost: 127.0.0.1:9467\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	// 10KB every 50ms, i.e. 200KB/s
+	chunk := make([]byte, 10<<10)
+	for i := 0; i < 30; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	stats := p.ActiveConnStats()
+	if len(stats) != 1 {
+		t.Fatalf("expected conn stats of 1 connection, got %d", len(stats))
+	}
+	if rate := stats[0].ReadRate(); rate < 120<<10 || rate > 280<<10 {
+		t.Fatalf("expected read rate about 200KB/s, got %.0f", rate)
+	}
+	if n := stats[0].BytesRead(); n < 30*uint64(len(chunk)) {
+		t.Fatalf("expected at least %d bytes read, got %d", 30*len(chunk), n)
+	}
+	if n := stats[0].BytesWritten(); n != uint64(len(httpTunnelMadeOKayBytes)) {
+		t.Fatalf("expected %d bytes written, got %d", len(httpTunnelMadeOKayBytes), n)
+	}
+	// the stalled transfer drops to zero once out of the window
+	time.Sleep(1200 * time.Millisecond)
+	if rate := stats[0].ReadRate(); rate != 0 {
+		t.Fatalf("expected zero read rate for the stalled transfer, got %.0f", rate)
+	}
+
+	// the tunnel ends once both sides closed
+	conn.Close()
+	(<-sinkConns).Close()
+	for i := 0; i < 100 && len(p.ActiveConnStats()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := p.ActiveConnStats(); len(stats) != 0 {
+		t.Fatalf("expected conn stats removed after closed, got %d", len(stats))
+	}
+}
+
+func TestShouldBlockHost(t *testing.T) {
+	go serveTestProxy(5125, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return false
+		},
+		ShouldBlockHost: func(userdata *UserData, hostWithPort string) bool {
+			return strings.HasPrefix(hostWithPort, "blocked.example.com:")
+		},
+		RewriteURL: func(userdata *UserData, hostWithPort string) string {
+			if strings.HasPrefix(hostWithPort, "unavailable.example.com:") {
+				return ""
+			}
+			return hostWithPort
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	send := func(raw string) (int, string) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5125")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(conn, raw)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), &nethttp.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", raw, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status, body := send("CONNECT blocked.example.com:443 HTTP/1.1\r\nHost: blocked.example.com:443\r\n\r\n")
+	if status != nethttp.StatusForbidden || body != "Access to the target host is forbidden.\n" {
+		t.Fatalf("expected 403 for blocked CONNECT, got %d %q", status, body)
+	}
+	status, _ = send("GET http://blocked.example.com/ HTTP/1.1\r\nHost: blocked.example.com\r\n\r\n")
+	if status != nethttp.StatusForbidden {
+		t.Fatalf("expected 403 for blocked request, got %d", status)
+	}
+	// no upstream available is still told apart from blocked
+	status, _ = send("CONNECT unavailable.example.com:443 HTTP/1.1\r\nHost: unavailable.example.com:443\r\n\r\n")
+	if status != http.StatusSessionUnavailable {
+		t.Fatalf("expected %d for session unavailable, got %d", http.StatusSessionUnavailable, status)
+	}
+}
+
+func TestBadGatewayOnDialFailureOverMITM(t *testing.T) {
+	ca, rootCA := makeTestCertAuthority(t)
+	go serveTestProxy(5126, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			return true
+		},
+		MITMCertAuthority: ca,
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5126")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: rootCA, ServerName: "127.0.0.1"})
+	// the decrypted request is forwarded the same way as a plain one
+	fmt.Fprint(tlsConn, "GET / HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	resp, err = nethttp.ReadResponse(bufio.NewReader(tlsConn), &nethttp.Request{Method: "GET"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadGateway, resp.StatusCode)
+	}
+	if string(body) != "Fail to forward the request to the target host.\n" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestDecryptDecisionCache(t *testing.T) {
+	var lock sync.Mutex
+	calls := make(map[string]int)
+	go serveTestProxy(5127, Handler{
+		ShouldDecryptHost: func(userdata *UserData, host string) bool {
+			lock.Lock()
+			calls[host]++
+			lock.Unlock()
+			return false
+		},
+		DecryptDecisionCacheTTL: 200 * time.Millisecond,
+	})
+	ln, err := net.Listen("tcp4", "0.0.0.0:9477")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	connect := func(host string) {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5127")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), &nethttp.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode != nethttp.StatusOK {
+			t.Fatalf("expected status %d for %s, got %d", nethttp.StatusOK, host, resp.StatusCode)
+		}
+	}
+	expectCalls := func(host string, expected int) {
+		lock.Lock()
+		defer lock.Unlock()
+		if calls[host] != expected {
+			t.Fatalf("expected %d decisions of %s, got %d", expected, host, calls[host])
+		}
+	}
+	for i := 0; i < 3; i++ {
+		connect("127.0.0.1:9477")
+	}
+	connect("127.0.0.2:9477")
+	expectCalls("127.0.0.1", 1)
+	expectCalls("127.0.0.2", 1)
+
+	// decided again once expired
+	time.Sleep(250 * time.Millisecond)
+	connect("127.0.0.1:9477")
+	expectCalls("127.0.0.1", 2)
+}
+
+func TestAuditLog(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(nethttp.StatusCreated)
+		w.Write([]byte("audited"))
+	})
+	go nethttp.ListenAndServe("127.0.0.1:9478", mux)
+	records := make(chan *AuditRecord, 1)
+	handler := Handler{
+		AuditLog: func(record *AuditRecord) {
+			records <- record
+		},
+		AuditHeaders: []string{"authorization", "X-Trace", "Content-Type", "Set-Cookie"},
+	}
+	go serveTestProxy(5128, handler)
+	handler.AuditRedactRequestLine = true
+	go serveTestProxy(5146, handler)
+	time.Sleep(time.Millisecond * 10)
+
+	audit := func(proxyAddr string) *AuditRecord {
+		conn, err := net.Dial("tcp4", proxyAddr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(conn, "GET http://127.0.0.1:9478/audit?q=1 HTTP/1.1\r\nHost: 127.0.0.1:9478\r\n"+
+			"Authorization: Basic dXNlcjpwYXNz\r\nX-Trace: abc\r\nAccept: */*\r\n\r\n")
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		select {
+		case record := <-records:
+			return record
+		case <-time.After(5 * time.Second):
+			t.Fatal("no audit record logged")
+		}
+		return nil
+	}
+
+	// the request line recorded as is by default
+	record := audit("127.0.0.1:5128")
+	if record.RequestLine != "GET http://127.0.0.1:9478/audit?q=1 HTTP/1.1" {
+		t.Fatalf("unexpected request line %q", record.RequestLine)
+	}
+	if record.StatusLine != "HTTP/1.1 201 Created" {
+		t.Fatalf("unexpected status line %q", record.StatusLine)
+	}
+	if record.Host != "127.0.0.1:9478" || len(record.RequestID) == 0 || record.ClientAddr == nil {
+		t.Fatalf("unexpected audit record %+v", record)
+	}
+	expectedRequestHeaders := []AuditHeader{
+		{Name: "Authorization", Value: AuditRedacted},
+		{Name: "X-Trace", Value: "abc"},
+	}
+	if !reflect.DeepEqual(record.RequestHeaders, expectedRequestHeaders) {
+		t.Fatalf("expected request headers %v, got %v", expectedRequestHeaders, record.RequestHeaders)
+	}
+	expectedResponseHeaders := []AuditHeader{
+		{Name: "Content-Type", Value: "text/plain"},
+		{Name: "Set-Cookie", Value: AuditRedacted},
+	}
+	if !reflect.DeepEqual(record.ResponseHeaders, expectedResponseHeaders) {
+		t.Fatalf("expected response headers %v, got %v", expectedResponseHeaders, record.ResponseHeaders)
+	}
+
+	// the query redacted once opted in
+	record = audit("127.0.0.1:5146")
+	if record.RequestLine != "GET http://127.0.0.1:9478/audit?"+AuditRedacted+" HTTP/1.1" {
+		t.Fatalf("unexpected redacted request line %q", record.RequestLine)
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	// the target responds once the request ends with a half-close
+	ln, err := net.Listen("tcp4", "127.0.0.1:9479")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "got %d bytes", len(request))
+			}()
+		}
+	}()
+	go serveTestProxy(5129, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5129")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:9479 HTTP/1.1\r\nHost: 127.0.0.1:9479\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	fmt.Fprint(conn, "half-closed request")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the response direction still completes
+	response, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(response) != "got 19 bytes" {
+		t.Fatalf("unexpected response %q", response)
+	}
+}
+
+func TestMaxTunnelDuration(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:9480")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	go serveTestProxy(5130, Handler{MaxTunnelDuration: 200 * time.Millisecond})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5130")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:9480 HTTP/1.1\r\nHost: 127.0.0.1:9480\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	// the tunnel is kept active till closed by the proxy
+	buf := make([]byte, 4)
+	for {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("expected the tunnel closed after 200ms, took %s", d)
+	}
+}
+
+func TestEmitUpstreamHeader(t *testing.T) {
+	superProxy, err := superproxy.NewFakeSuperProxy("fake-proxy:3128", superproxy.ProxyTypeHTTP,
+		func(targetHostWithPort string) (net.Conn, error) {
+			proxyConn, targetConn := net.Pipe()
+			go func() {
+				defer targetConn.Close()
+				reader := bufio.NewReader(targetConn)
+				for {
+					if _, err := nethttp.ReadRequest(reader); err != nil {
+						return
+					}
+					fmt.Fprint(targetConn, "HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\nproxied")
+				}
+			}()
+			return proxyConn, nil
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("direct"))
+	})
+	go nethttp.ListenAndServe("127.0.0.1:9481", mux)
+	logger := &captureEventLogger{}
+	go serveTestProxy(5131, Handler{
+		Logger: logger,
+		URLProxy: func(userdata *UserData, hostWithPort string, path []byte) *superproxy.SuperProxy {
+			if strings.HasPrefix(hostWithPort, "routed.example") {
+				return superProxy
+			}
+			return nil
+		},
+		EmitUpstreamHeader: true,
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5131")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expectUpstream := func(raw, expBody, expUpstream string) {
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expBody {
+			t.Fatalf("expected response %q, got %q", expBody, body)
+		}
+		if upstream := resp.Header.Get(UpstreamHeader); upstream != expUpstream {
+			t.Fatalf("expected upstream %q, got %q", expUpstream, upstream)
+		}
+	}
+	expectUpstream("GET http://routed.example/path HTTP/1.1\r\nHost: routed.example\r\n\r\n",
+		"proxied", "fake-proxy:3128")
+	expectUpstream("GET http://127.0.0.1:9481/ HTTP/1.1\r\nHost: 127.0.0.1:9481\r\n\r\n",
+		"direct", UpstreamDirect)
+
+	// the tunnel is logged with the upstream instead
+	if _, err := conn.Write([]byte("CONNECT routed.example:443 HTTP/1.1\r\nHost: routed.example:443\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK || len(resp.Header.Get(UpstreamHeader)) > 0 {
+		t.Fatalf("unexpected tunnel made message %v", resp)
+	}
+	for _, event := range logger.Events() {
+		if event.msg == "tunnel started" {
+			if event.fields["upstream"] != "fake-proxy:3128" {
+				t.Fatalf("unexpected upstream field in event %v", event)
+			}
+			return
+		}
+	}
+	t.Fatal("no tunnel started event logged")
+}
+
+func TestTunnelFallbackProxies(t *testing.T) {
+	deadProxy, err := superproxy.NewFakeSuperProxy("dead-proxy:3128", superproxy.ProxyTypeHTTP,
+		func(targetHostWithPort string) (net.Conn, error) {
+			return nil, errors.New("proxy down")
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	liveProxy, err := superproxy.NewFakeSuperProxy("live-proxy:3128", superproxy.ProxyTypeHTTP,
+		func(targetHostWithPort string) (net.Conn, error) {
+			proxyConn, targetConn := net.Pipe()
+			go func() {
+				// echo a ping then end the tunnel
+				defer targetConn.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(targetConn, buf); err == nil {
+					targetConn.Write(buf)
+				}
+			}()
+			return proxyConn, nil
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go serveTestProxy(5132, Handler{
+		ClientURLProxy: func(clientAddr net.Addr, userdata *UserData,
+			hostWithPort string, path []byte) *superproxy.SuperProxy {
+			return deadProxy
+		},
+		TunnelFallbackProxies: func(userdata *UserData, hostWithPort string) []*superproxy.SuperProxy {
+			return []*superproxy.SuperProxy{liveProxy}
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5132")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "CONNECT fallback.test:443 HTTP/1.1\r\nHost: fallback.test:443\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("expected ping echoed by the live proxy, got %q", buf)
+	}
+	if n := deadProxy.InFlight(); n != 0 {
+		t.Fatalf("expected the dead proxy's token pushed back, %d in flight", n)
+	}
+	if n := liveProxy.InFlight(); n != 1 {
+		t.Fatalf("expected the live proxy's token held by the tunnel, %d in flight", n)
+	}
+	conn.Close()
+
+	for i := 0; i < 100 && liveProxy.InFlight() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := liveProxy.InFlight(); n != 0 {
+		t.Fatalf("expected the live proxy's token pushed back, %d in flight", n)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	// the backend answers the source IP of the connections
+	ln, err := net.Listen("tcp4", "0.0.0.0:9482")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := nethttp.ReadRequest(reader); err != nil {
+						return
+					}
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(ip), ip)
+				}
+			}()
+		}
+	}()
+	go serveTestProxy(5133, Handler{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)},
+		LocalAddrFor: func(userdata *UserData, hostWithPort string) *net.TCPAddr {
+			if hostWithPort == "127.0.0.4:9482" {
+				return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 3)}
+			}
+			return nil
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	for target, sourceIP := range map[string]string{
+		"127.0.0.1:9482": "127.0.0.2",
+		"127.0.0.4:9482": "127.0.0.3",
+	} {
+		for _, tunnel := range []bool{false, true} {
+			conn, err := net.Dial("tcp4", "127.0.0.1:5133")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(conn)
+			if tunnel {
+				fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+				resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if resp.StatusCode != nethttp.StatusOK {
+					t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+				}
+				fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+			} else {
+				fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+			}
+			resp, err := nethttp.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(body) != sourceIP {
+				t.Fatalf("expected %s bound to %s with tunnel %t, got %s", target, sourceIP, tunnel, body)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestProxyConnectionKeepAlive(t *testing.T) {
+	// the backend answers whether Proxy-Connection forwarded
+	ln, err := net.Listen("tcp4", "127.0.0.1:9483")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					req, err := nethttp.ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					body := "stripped"
+					if len(req.Header.Get("Proxy-Connection")) > 0 {
+						body = "forwarded"
+					}
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				}
+			}()
+		}
+	}()
+	go serveTestProxy(5134, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5134")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		fmt.Fprint(conn, "GET http://127.0.0.1:9483/ HTTP/1.0\r\nHost: 127.0.0.1:9483\r\n"+
+			"Proxy-Connection: keep-alive\r\n\r\n")
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error of request %d: %s", i, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != "stripped" {
+			t.Fatal("expected Proxy-Connection never forwarded")
+		}
+		if resp.Header.Get("Connection") != "keep-alive" {
+			t.Fatalf("expected client told the connection kept alive, got %q", resp.Header.Get("Connection"))
+		}
+	}
+
+	// HTTP/1.0 is not persistent by default
+	conn, err = net.Dial("tcp4", "127.0.0.1:5134")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader = bufio.NewReader(conn)
+	fmt.Fprint(conn, "GET http://127.0.0.1:9483/ HTTP/1.0\r\nHost: 127.0.0.1:9483\r\n\r\n")
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection closed after the response, got %v", err)
+	}
+}
+
+func TestH2CTunnel(t *testing.T) {
+	// the backend echoes the h2c connections after the preface,
+	// and answers the HTTP/1.x requests with their method
+	ln, err := net.Listen("tcp4", "127.0.0.1:9484")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if b, err := reader.Peek(len(h2cPreface)); err == nil && bytes.Equal(b, h2cPreface) {
+					reader.Discard(len(b))
+					conn.Write([]byte("h2c:"))
+					io.Copy(conn, reader)
+					return
+				}
+				req, err := nethttp.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(req.Method), req.Method)
+			}()
+		}
+	}()
+	var targetCalled int32
+	go serveTestProxy(5135, Handler{
+		H2CTarget: func(clientAddr net.Addr) string {
+			atomic.AddInt32(&targetCalled, 1)
+			return "127.0.0.1:9484"
+		},
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5135")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(h2cPreface)
+	conn.Write([]byte("frames"))
+	buf := make([]byte, len("h2c:frames"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buf) != "h2c:frames" {
+		t.Fatalf("expected h2c tunneled with the preface, got %q", buf)
+	}
+
+	// the HTTP/1.x requests are still served, even starting like the preface
+	conn, err = net.Dial("tcp4", "127.0.0.1:5135")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "POST http://127.0.0.1:9484/ HTTP/1.1\r\nHost: 127.0.0.1:9484\r\nContent-Length: 0\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "POST" {
+		t.Fatalf("expected POST request forwarded, got %q", body)
+	}
+	if n := atomic.LoadInt32(&targetCalled); n != 1 {
+		t.Fatalf("expected h2c target asked once, got %d", n)
+	}
+}
+
+func TestForwardSingleFraming(t *testing.T) {
+	// the backend answers the framing headers forwarded and the body
+	ln, err := net.Listen("tcp4", "127.0.0.1:9485")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := textproto.NewReader(bufio.NewReader(conn))
+				if _, err := reader.ReadLine(); err != nil {
+					return
+				}
+				header, err := reader.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				body, err := ioutil.ReadAll(httputil.NewChunkedReader(reader.R))
+				if err != nil {
+					return
+				}
+				result := fmt.Sprintf("%q %q %s", header["Content-Length"],
+					header["Transfer-Encoding"], body)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(result), result)
+			}()
+		}
+	}()
+	go serveTestProxy(5136, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5136")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "POST http://127.0.0.1:9485/ HTTP/1.1\r\nHost: 127.0.0.1:9485\r\n"+
+		"Content-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := `[] ["chunked"] hello`; string(body) != expected {
+		t.Fatalf("expected only Transfer-Encoding forwarded as %s, got %s", expected, body)
+	}
+}
+
+func TestForwardConflictingContentLength(t *testing.T) {
+	// the backend answers the Content-Length headers forwarded and the body
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				reader := textproto.NewReader(bufio.NewReader(conn))
+				if _, err := reader.ReadLine(); err != nil {
+					return
+				}
+				header, err := reader.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				body := make([]byte, 5)
+				if _, err := io.ReadFull(reader.R, body); err != nil {
+					return
+				}
+				result := fmt.Sprintf("%q %s", header["Content-Length"], body)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(result), result)
+			}()
+		}
+	}()
+	go serveTestProxy(5142, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	post := func(contentLengths string) *nethttp.Response {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5142")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\n%s\r\nhelloworld",
+			ln.Addr(), ln.Addr(), contentLengths)
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return resp
+	}
+
+	// the conflicting values are refused without forwarding anything
+	resp := post("Content-Length: 5\r\nContent-Length: 10\r\n")
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadRequest, resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 0 {
+		t.Fatalf("expected nothing forwarded, got %d connections", n)
+	}
+
+	// the identical values are merged into one
+	resp = post("Content-Length: 5\r\ncontent-length: 5\r\n")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := `["5"] hello`; string(body) != expected {
+		t.Fatalf("expected a single Content-Length forwarded as %s, got %s", expected, body)
+	}
+}
+
+func TestHijackedResponseDrainBody(t *testing.T) {
+	hijackerPool := &fakeResponseHijackerPool{
+		response: "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nfaked\n",
+	}
+	go serveTestProxy(5137, Handler{HijackerPool: hijackerPool})
+	time.Sleep(time.Millisecond * 10)
+
+	readResponse := func(reader *bufio.Reader) {
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != "faked\n" {
+			t.Fatalf("expected the faked response, got %q", body)
+		}
+	}
+
+	// the bodies unread by hijacker are drained before the next request
+	conn, err := net.Dial("tcp4", "127.0.0.1:5137")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "POST http://127.0.0.1:9486/ HTTP/1.1\r\nHost: 127.0.0.1:9486\r\n"+
+		"Content-Length: 37\r\n\r\nGET http://127.0.0.1:9487/ HTTP/1.1\r\n")
+	readResponse(reader)
+	fmt.Fprint(conn, "POST http://127.0.0.1:9488/ HTTP/1.1\r\nHost: 127.0.0.1:9488\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	readResponse(reader)
+	fmt.Fprint(conn, "GET http://127.0.0.1:9489/ HTTP/1.1\r\nHost: 127.0.0.1:9489\r\n\r\n")
+	readResponse(reader)
+	if hijackerPool.host != "127.0.0.1:9489" {
+		t.Fatalf("expected the last request parsed for 127.0.0.1:9489, got %s", hijackerPool.host)
+	}
+
+	// the connection is closed instead when the body is too large
+	// or never sent by the client expecting 100 Continue
+	for _, framing := range []string{
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", DefaultMaxDrainBodySize+1),
+		"Transfer-Encoding: chunked\r\n\r\n" +
+			fmt.Sprintf("%x\r\n%s\r\n", DefaultMaxDrainBodySize, strings.Repeat("a", DefaultMaxDrainBodySize)),
+		"Content-Length: 5\r\nExpect: 100-continue\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp4", "127.0.0.1:5137")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		go fmt.Fprint(conn, "POST http://127.0.0.1:9486/ HTTP/1.1\r\nHost: 127.0.0.1:9486\r\n"+framing)
+		readResponse(reader)
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection closed after the response, got %v", err)
+		}
+	}
+}
+
+func TestRejectUnchunkedTransferEncoding(t *testing.T) {
+	go serveTestProxy(5138, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5138")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "POST http://127.0.0.1:9490/ HTTP/1.1\r\nHost: 127.0.0.1:9490\r\n"+
+		"Transfer-Encoding: gzip\r\nContent-Length: 5\r\n\r\nhello")
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusBadRequest, resp.StatusCode)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection closed after the response, got %v", err)
+	}
+}
+
+func TestMITMCertGenerationLimitConcurrent(t *testing.T) {
+	ca, _ := makeTestCertAuthority(t)
+	p := &Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: Handler{
+			ShouldDecryptHost: func(userdata *UserData, host string) bool {
+				return true
+			},
+			RewriteURL: func(userdata *UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			LookupIP: func(userdata *UserData, domain string) net.IP {
+				return net.IPv4(127, 0, 0, 1)
+			},
+			MITMCertAuthority:        ca,
+			MITMCertCacheSize:        10,
+			MITMCertGenerationLimit:  3,
+			MITMCertGenerationWindow: time.Hour,
+		},
+	}
+	go p.Serve("tcp4", "0.0.0.0:5140")
+
+	// the target serves a cert signed by another authority
+	targetCert, err := mitm.SignLeafCertUsingCertAuthority(nil, []string{"target.test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ln, err := tls.Listen("tcp4", "127.0.0.1:9492", &tls.Config{Certificates: []tls.Certificate{*targetCert}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	// the concurrent CONNECT requests beyond the limit are tunneled rather
+	// than failing the handshake, even when they pass the limit check at once
+	var wg sync.WaitGroup
+	var decrypted int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp4", "127.0.0.1:5140")
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "CONNECT %s:9492 HTTP/1.1\r\nHost: %s:9492\r\n\r\n", host, host)
+			br := bufio.NewReader(conn)
+			resp, err := nethttp.ReadResponse(br, nil)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			resp.Body.Close()
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+			if err := tlsConn.Handshake(); err != nil {
+				t.Errorf("unexpected handshake error of %s: %s", host, err)
+				return
+			}
+			if tlsConn.ConnectionState().PeerCertificates[0].CheckSignatureFrom(ca.Leaf) == nil {
+				atomic.AddInt32(&decrypted, 1)
+			}
+		}(fmt.Sprintf("fuzz%d.test", i))
+	}
+	wg.Wait()
+	if decrypted != 3 {
+		t.Fatalf("expected 3 hosts decrypted, got %d", decrypted)
+	}
+}
+
+type fakeResponseHijackerPool struct {
+	response string
+	host     string
+}
+
+func (p *fakeResponseHijackerPool) Get(clientAddr net.Addr,
+	host string, method, path []byte, userdata *UserData) Hijacker {
+	p.host = host
+	return &fakeResponseHijacker{response: p.response}
+}
+
+func (p *fakeResponseHijackerPool) Put(Hijacker) {}
+
+type fakeResponseHijacker struct {
+	response string
+}
+
+func (h *fakeResponseHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	return nil
+}
+
+func (h *fakeResponseHijacker) OnResponse(respLine http.ResponseLine,
+	header http.Header, rawHeader []byte) io.Writer {
+	return nil
+}
+
+func (h *fakeResponseHijacker) HijackResponse() io.Reader {
+	return strings.NewReader(h.response)
+}
+
+// earlyDataConn sends the CONNECT request along with the first write,
+// then skips the tunnel made message before the first read
+type earlyDataConn struct {
+	net.Conn
+	connect []byte
+	reader  *bufio.Reader
+}
+
+func (c *earlyDataConn) Write(b []byte) (int, error) {
+	if c.connect != nil {
+		_, err := c.Conn.Write(append(c.connect, b...))
+		c.connect = nil
+		return len(b), err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *earlyDataConn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
+		resp, err := nethttp.ReadResponse(c.reader, &nethttp.Request{Method: "CONNECT"})
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != nethttp.StatusOK {
+			return 0, fmt.Errorf("tunnel failed with status %d", resp.StatusCode)
+		}
+	}
+	return c.reader.Read(b)
+}
+
+type captureEvent struct {
+	level  string
+	msg    string
+	err    error
+	fields map[string]interface{}
+}
+
+// captureEventLogger records all the events logged
+type captureEventLogger struct {
+	lock   sync.Mutex
+	events []captureEvent
+}
+
+func (l *captureEventLogger) Events() []captureEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]captureEvent(nil), l.events...)
+}
+
+func (l *captureEventLogger) log(level, msg string, err error, fields []LogField) {
+	event := captureEvent{level: level, msg: msg, err: err, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		event.fields[f.Key] = f.Value
+	}
+	l.lock.Lock()
+	l.events = append(l.events, event)
+	l.lock.Unlock()
+}
+
+func (l *captureEventLogger) Debug(msg string, fields ...LogField) {
+	l.log("debug", msg, nil, fields)
+}
+
+func (l *captureEventLogger) Info(msg string, fields ...LogField) {
+	l.log("info", msg, nil, fields)
+}
+
+func (l *captureEventLogger) Warn(msg string, fields ...LogField) {
+	l.log("warn", msg, nil, fields)
+}
+
+func (l *captureEventLogger) Error(msg string, err error, fields ...LogField) {
+	l.log("error", msg, err, fields)
+}
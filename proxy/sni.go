@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// DefaultClientHelloMaxSize used when Handler.ClientHelloMaxSize not set
+const DefaultClientHelloMaxSize = 64 * 1024
+
+const (
+	tlsRecordHeaderLen = 5
+	// tlsMaxRecordLen max length of a plaintext record fragment, RFC 5246 6.2.1
+	tlsMaxRecordLen = 16384
+	// clientHelloReadSize bytes read at most at a time for the ClientHello
+	clientHelloReadSize = 4096
+)
+
+var (
+	errNotClientHello      = errors.New("not a tls client hello")
+	errClientHelloTooLarge = errors.New("tls client hello too large")
+)
+
+// readClientHello reads the TLS ClientHello from r, which may span several
+// records and reads, then parses its server name, an empty name is returned
+// if client sends no SNI, see RFC 5246 7.4.1.2 and RFC 6066 3.
+//
+// The bytes buffered are returned for replaying even if an error occurs, at
+// most maxSize bytes are buffered, or errClientHelloTooLarge is returned.
+// Reading stops as soon as the input turns out not a ClientHello.
+func readClientHello(r io.Reader, maxSize int) (serverName string, buffered []byte, err error) {
+	// msg the handshake message carried by the records parsed,
+	// next the offset of the record not parsed yet
+	var msg []byte
+	next := 0
+	for {
+		for len(buffered)-next >= tlsRecordHeaderLen {
+			// record header: type, version and length
+			header := buffered[next : next+tlsRecordHeaderLen]
+			recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+			if header[0] != 0x16 || recordLen > tlsMaxRecordLen { // handshake
+				return "", buffered, errNotClientHello
+			}
+			if len(buffered)-next < tlsRecordHeaderLen+recordLen {
+				break
+			}
+			msg = append(msg, buffered[next+tlsRecordHeaderLen:next+tlsRecordHeaderLen+recordLen]...)
+			next += tlsRecordHeaderLen + recordLen
+		}
+		if len(msg) >= 4 {
+			if msg[0] != 0x01 { // client_hello
+				return "", buffered, errNotClientHello
+			}
+			msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if len(msg) >= 4+msgLen {
+				serverName, err = parseClientHelloServerName(msg[:4+msgLen])
+				return serverName, buffered, err
+			}
+			if 4+msgLen > maxSize {
+				return "", buffered, errClientHelloTooLarge
+			}
+		}
+		if len(buffered) >= maxSize {
+			return "", buffered, errClientHelloTooLarge
+		}
+
+		readSize := maxSize - len(buffered)
+		if readSize > clientHelloReadSize {
+			readSize = clientHelloReadSize
+		}
+		if cap(buffered)-len(buffered) < readSize {
+			b := make([]byte, len(buffered), 2*cap(buffered)+readSize)
+			copy(b, buffered)
+			buffered = b
+		}
+		n, err := r.Read(buffered[len(buffered) : len(buffered)+readSize])
+		buffered = buffered[:len(buffered)+n]
+		if err != nil && n == 0 {
+			return "", buffered, err
+		}
+	}
+}
+
+// parseClientHelloServerName parses the server name of the ClientHello message
+func parseClientHelloServerName(msg []byte) (string, error) {
+	// handshake type and length
+	if len(msg) < 4 || msg[0] != 0x01 { // client_hello
+		return "", errNotClientHello
+	}
+	msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+msgLen {
+		return "", errNotClientHello
+	}
+	s := clientHelloReader(msg[4 : 4+msgLen])
+	// client version and random
+	if !s.skip(2 + 32) {
+		return "", errNotClientHello
+	}
+	// session id, cipher suites and compression methods
+	if !s.skipVector(1) || !s.skipVector(2) || !s.skipVector(1) {
+		return "", errNotClientHello
+	}
+	if len(s) == 0 {
+		// no extensions
+		return "", nil
+	}
+	extensions, ok := s.readVector(2)
+	if !ok {
+		return "", errNotClientHello
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.readUint16()
+		if !ok {
+			return "", errNotClientHello
+		}
+		extData, ok := extensions.readVector(2)
+		if !ok {
+			return "", errNotClientHello
+		}
+		if extType != 0 { // server_name
+			continue
+		}
+		names, ok := extData.readVector(2)
+		if !ok {
+			return "", errNotClientHello
+		}
+		for len(names) > 0 {
+			nameType := names[0]
+			names = names[1:]
+			name, ok := names.readVector(2)
+			if !ok {
+				return "", errNotClientHello
+			}
+			if nameType == 0 { // host_name
+				return string(name), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// clientHelloReader consumes the ClientHello message fields
+type clientHelloReader []byte
+
+func (s *clientHelloReader) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *clientHelloReader) readUint16() (uint16, bool) {
+	if len(*s) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*s)
+	*s = (*s)[2:]
+	return v, true
+}
+
+// readVector reads a vector with lenBytes bytes length prefixed
+func (s *clientHelloReader) readVector(lenBytes int) (clientHelloReader, bool) {
+	if len(*s) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*s)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	*s = (*s)[lenBytes:]
+	if len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *clientHelloReader) skipVector(lenBytes int) bool {
+	_, ok := s.readVector(lenBytes)
+	return ok
+}
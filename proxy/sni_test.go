@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadClientHello(t *testing.T) {
+	testReadClientHello(t, "www.example.com")
+	testReadClientHello(t, "")
+
+	// read stops once the input turns out not a client hello
+	reader := bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, buffered, err := readClientHello(iotest.OneByteReader(reader), DefaultClientHelloMaxSize)
+	if err != errNotClientHello {
+		t.Fatalf("unexpected error %v, expecting %v", err, errNotClientHello)
+	}
+	if string(buffered) != "GET /" {
+		t.Fatalf("expected GET / buffered, got %q", buffered)
+	}
+}
+
+func testReadClientHello(t *testing.T, serverName string) {
+	clientHello := makeTestClientHello(t, serverName)
+
+	// the client hello in a single record
+	name, buffered, err := readClientHello(bytes.NewReader(clientHello), DefaultClientHelloMaxSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if name != serverName {
+		t.Fatalf("expected server name %q, got %q", serverName, name)
+	}
+	if !bytes.Equal(buffered, clientHello) {
+		t.Fatalf("expected the client hello buffered for replaying")
+	}
+
+	// the client hello split into records of 100 bytes, read byte by byte
+	msg := clientHello[5:]
+	var split []byte
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > 100 {
+			n = 100
+		}
+		split = append(split, 0x16, 0x03, 0x01, byte(n>>8), byte(n))
+		split = append(split, msg[:n]...)
+		msg = msg[n:]
+	}
+	// the bytes following the client hello may be read and buffered
+	input := append(append([]byte(nil), split...), "trailing"...)
+	name, buffered, err = readClientHello(iotest.OneByteReader(bytes.NewReader(input)), DefaultClientHelloMaxSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if name != serverName {
+		t.Fatalf("expected server name %q, got %q", serverName, name)
+	}
+	if !bytes.Equal(buffered, split) {
+		t.Fatalf("expected the split client hello buffered for replaying")
+	}
+
+	// too large client hello
+	name, buffered, err = readClientHello(iotest.HalfReader(bytes.NewReader(split)), 200)
+	if err != errClientHelloTooLarge {
+		t.Fatalf("unexpected error %v, expecting %v", err, errClientHelloTooLarge)
+	}
+	if len(name) > 0 || len(buffered) > 200 || !bytes.Equal(buffered, split[:len(buffered)]) {
+		t.Fatalf("expected at most 200 bytes buffered without server name, got %d bytes with %q",
+			len(buffered), name)
+	}
+
+	// client hello truncated
+	_, buffered, err = readClientHello(bytes.NewReader(split[:len(split)-1]), DefaultClientHelloMaxSize)
+	if err != io.EOF {
+		t.Fatalf("unexpected error %v, expecting %v", err, io.EOF)
+	}
+	if !bytes.Equal(buffered, split[:len(split)-1]) {
+		t.Fatalf("expected the truncated client hello buffered for replaying")
+	}
+}
+
+// makeTestClientHello makes the record of the ClientHello sent by a tls client
+func makeTestClientHello(t *testing.T, serverName string) []byte {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		// the handshake never completes, only the ClientHello is sent
+		clientConn.SetDeadline(time.Now().Add(time.Second))
+		tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		clientConn.Close()
+	}()
+	serverConn.SetDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(serverConn, record[5:]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return record
+}
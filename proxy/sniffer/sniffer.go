@@ -0,0 +1,169 @@
+// Package sniffer provides a ready-to-use traffic capture for proxy.Handler,
+// recording every request and response pair sniffed by the proxy.
+package sniffer
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/proxy"
+)
+
+// DefaultMaxBodySize max bytes of each body captured when no MaxBodySize set
+const DefaultMaxBodySize = 1 << 20
+
+// Exchange a request and response pair captured by Recorder
+type Exchange struct {
+	// RequestID unique ID of the request, see proxy.UserDataRequestIDKey
+	RequestID string
+	// ClientAddr address of the client sending the request
+	ClientAddr net.Addr
+	// Start when the request started being forwarded
+	Start time.Time
+	// End when the response was sent to the client
+	End time.Time
+
+	// Method, Host with port and Path with query of the request,
+	// the request URL is the Host followed by the Path
+	Method string
+	Host   string
+	Path   string
+
+	// RequestHeader the raw request header, nil if not sniffed
+	RequestHeader []byte
+	// RequestBody the raw request body as transferred, e.g. still chunked,
+	// at most MaxBodySize bytes
+	RequestBody []byte
+	// RequestBodySize size of the whole request body
+	RequestBodySize int64
+
+	// StatusCode status code of the response, 0 if no response sniffed,
+	// e.g. failed to forward the request
+	StatusCode int
+	// ResponseHeader the raw response header, nil if not sniffed
+	ResponseHeader []byte
+	// ResponseBody the raw response body as transferred, e.g. still chunked
+	// or compressed, at most MaxBodySize bytes
+	ResponseBody []byte
+	// ResponseBodySize size of the whole response body
+	ResponseBodySize int64
+}
+
+// Recorder is a proxy.HijackerPool capturing the requests and responses
+// forwarded, the exchanges are sent to Sink after the responses are sent
+// to the clients. The traffic is never modified.
+type Recorder struct {
+	// Sink receives every exchange captured, which is owned by sink then.
+	// It's called by the proxy serving go routines, so that it should not
+	// block for long. Nothing is captured if not set
+	Sink func(exchange *Exchange)
+
+	// MaxBodySize max bytes of each request and response body captured,
+	// the rest is counted but dropped. DefaultMaxBodySize is used if not set,
+	// negative means no bodies captured
+	MaxBodySize int
+}
+
+// Get makes a new recording hijacker for the request
+func (r *Recorder) Get(clientAddr net.Addr, host string, method, path []byte,
+	userdata *proxy.UserData) proxy.Hijacker {
+	h := &recorder{
+		maxBodySize: r.MaxBodySize,
+		exchange: &Exchange{
+			ClientAddr: clientAddr,
+			Start:      time.Now(),
+			Method:     string(method),
+			Host:       host,
+			Path:       string(path),
+		},
+	}
+	if h.maxBodySize == 0 {
+		h.maxBodySize = DefaultMaxBodySize
+	}
+	if userdata != nil {
+		if id, ok := userdata.Get(proxy.UserDataRequestIDKey).(string); ok {
+			h.exchange.RequestID = id
+		}
+	}
+	return h
+}
+
+// Put sends the exchange captured by h to Sink
+func (r *Recorder) Put(h proxy.Hijacker) {
+	rh, ok := h.(*recorder)
+	if !ok || r.Sink == nil {
+		return
+	}
+	rh.lock.Lock()
+	exchange := rh.exchange
+	rh.exchange = nil
+	rh.lock.Unlock()
+	if exchange == nil {
+		return
+	}
+	exchange.End = time.Now()
+	r.Sink(exchange)
+}
+
+// recorder the hijacker capturing an exchange, the bodies are written
+// while forwarding, which could run in another go routine
+type recorder struct {
+	maxBodySize int
+
+	lock     sync.Mutex
+	exchange *Exchange
+}
+
+func (h *recorder) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.exchange == nil {
+		return nil
+	}
+	h.exchange.RequestHeader = append([]byte(nil), rawHeader...)
+	return &bodyWriter{h: h, body: &h.exchange.RequestBody, size: &h.exchange.RequestBodySize}
+}
+
+func (h *recorder) OnResponse(statusLine http.ResponseLine,
+	header http.Header, rawHeader []byte) io.Writer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.exchange == nil {
+		return nil
+	}
+	h.exchange.StatusCode = statusLine.GetStatusCode()
+	h.exchange.ResponseHeader = append([]byte(nil), rawHeader...)
+	return &bodyWriter{h: h, body: &h.exchange.ResponseBody, size: &h.exchange.ResponseBodySize}
+}
+
+func (h *recorder) HijackResponse() io.Reader {
+	return nil
+}
+
+// bodyWriter captures the body of the exchange up to max body size,
+// never failing the forwarding
+type bodyWriter struct {
+	h    *recorder
+	body *[]byte
+	size *int64
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	w.h.lock.Lock()
+	defer w.h.lock.Unlock()
+	if w.h.exchange == nil {
+		// already sent to sink
+		return len(p), nil
+	}
+	*w.size += int64(len(p))
+	if room := w.h.maxBodySize - len(*w.body); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		*w.body = append(*w.body, p[:room]...)
+	}
+	return len(p), nil
+}
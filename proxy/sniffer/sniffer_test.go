@@ -0,0 +1,89 @@
+package sniffer
+
+import (
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/proxy"
+	"github.com/haxii/log"
+)
+
+func serveTestProxy(port int, recorder *Recorder) {
+	p := proxy.Proxy{
+		Logger: &log.DefaultLogger{},
+		Handler: proxy.Handler{
+			ShouldDecryptHost: func(userdata *proxy.UserData, host string) bool {
+				return false
+			},
+			RewriteURL: func(userdata *proxy.UserData, hostWithPort string) string {
+				return hostWithPort
+			},
+			HijackerPool: recorder,
+		},
+	}
+	if err := p.Serve("tcp4", fmt.Sprintf("0.0.0.0:%d", port)); err != nil {
+		panic(err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)+len("pong ")))
+		w.WriteHeader(nethttp.StatusAccepted)
+		fmt.Fprintf(w, "pong %s", body)
+	})
+	go nethttp.ListenAndServe("127.0.0.1:9468", mux)
+	exchanges := make(chan *Exchange, 2)
+	recorder := &Recorder{
+		Sink:        func(exchange *Exchange) { exchanges <- exchange },
+		MaxBodySize: 8,
+	}
+	go serveTestProxy(5126, recorder)
+	time.Sleep(time.Millisecond * 10)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:5126")
+	httpClient := &nethttp.Client{
+		Timeout:   5 * time.Second,
+		Transport: &nethttp.Transport{Proxy: nethttp.ProxyURL(proxyURL)},
+	}
+	resp, err := httpClient.Post("http://127.0.0.1:9468/echo?a=b", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var exchange *Exchange
+	select {
+	case exchange = <-exchanges:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no exchange captured")
+	}
+	if exchange.Method != "POST" || exchange.Host+exchange.Path != "127.0.0.1:9468/echo?a=b" {
+		t.Fatalf("unexpected request %s %s%s captured", exchange.Method, exchange.Host, exchange.Path)
+	}
+	if len(exchange.RequestID) == 0 || exchange.ClientAddr == nil || exchange.End.Before(exchange.Start) {
+		t.Fatalf("unexpected exchange captured %+v", exchange)
+	}
+	if !strings.HasPrefix(string(exchange.RequestHeader), "Host: 127.0.0.1:9468\r\n") ||
+		string(exchange.RequestBody) != "ping" || exchange.RequestBodySize != 4 {
+		t.Fatalf("unexpected request header %q and body %q captured",
+			exchange.RequestHeader, exchange.RequestBody)
+	}
+	if exchange.StatusCode != nethttp.StatusAccepted ||
+		!strings.Contains(string(exchange.ResponseHeader), "Content-Length: 9\r\n") {
+		t.Fatalf("unexpected response %d %q captured", exchange.StatusCode, exchange.ResponseHeader)
+	}
+	// the body is captured up to the max body size
+	if string(exchange.ResponseBody) != "pong pin" || exchange.ResponseBodySize != 9 {
+		t.Fatalf("unexpected response body %q of size %d captured",
+			exchange.ResponseBody, exchange.ResponseBodySize)
+	}
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
+)
+
+const (
+	socks4Version = 4
+	socks5Version = 5
+)
+
+const (
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+)
+
+// socks5PasswordVersion version of the username/password sub-negotiation
+const socks5PasswordVersion = 1
+
+const socks5Connect = 1
+
+const (
+	socks5IP4    = 1
+	socks5Domain = 3
+	socks5IP6    = 4
+)
+
+// SOCKS5 reply codes, see RFC 1928 section 6
+const (
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5NotAllowed          = 2
+	socks5HostUnreachable     = 4
+	socks5CommandUnsupported  = 7
+	socks5AddrTypeUnsupported = 8
+)
+
+// socks4Rejected SOCKS4 reply code of the rejected request
+const socks4Rejected = 0x5b
+
+var (
+	errSOCKS4Unsupported         = errors.New("SOCKS4 not supported")
+	errSOCKS5AuthUnsupported     = errors.New("no supported SOCKS5 authentication method")
+	errSOCKS5AuthFailed          = errors.New("SOCKS5 authentication failed")
+	errSOCKS5CommandUnsupported  = errors.New("SOCKS5 command not supported")
+	errSOCKS5AddrTypeUnsupported = errors.New("SOCKS5 address type not supported")
+	errSOCKS5BadVersion          = errors.New("bad SOCKS5 request version")
+	errSOCKS5BadDomain           = errors.New("bad SOCKS5 domain name")
+)
+
+// detectProtocol reads the first byte of c to tell the SOCKS clients from
+// the HTTP ones, the SOCKS5 CONNECT requests are served as HTTP CONNECT
+// requests after the handshake, see socksConn. The connection returned is
+// served as HTTP, nil means nothing to serve. Only SOCKS5 is accepted
+// when served by ServeSOCKS5.
+func (p *Proxy) detectProtocol(c net.Conn) (net.Conn, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, util.ErrWrapper(err, "fail to read the first byte")
+	}
+	switch version[0] {
+	case socks5Version:
+		hostWithPort, user, err := readSOCKS5Connect(c, p.Handler.SOCKS5Authenticate)
+		if err != nil {
+			p.Stats.addBadRequest()
+			return nil, util.ErrWrapper(err, "fail to make SOCKS5 handshake")
+		}
+		sc := newSOCKSConn(c, hostWithPort)
+		sc.user = user
+		return sc, nil
+	case socks4Version:
+		p.Stats.addBadRequest()
+		c.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return nil, errSOCKS4Unsupported
+	}
+	if p.socks5Only {
+		p.Stats.addBadRequest()
+		return nil, errSOCKS5BadVersion
+	}
+	return &bufferedConn{Conn: c, replay: version[:]}, nil
+}
+
+// readSOCKS5Connect makes the SOCKS5 handshake following the version byte,
+// the client is authenticated by username and password if authenticate is
+// set, otherwise no authentication required. The target host with port of
+// the CONNECT command and the username are returned, the other commands
+// are replied as not supported.
+func readSOCKS5Connect(c net.Conn, authenticate func(user, pass string) bool) (string, string, error) {
+	// greeting: number of methods, methods
+	var buf [255]byte
+	if _, err := io.ReadFull(c, buf[:1]); err != nil {
+		return "", "", err
+	}
+	methods := buf[:buf[0]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(socks5AuthNone)
+	if authenticate != nil {
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		c.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", "", errSOCKS5AuthUnsupported
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", "", err
+	}
+	var user string
+	if authenticate != nil {
+		var err error
+		if user, err = readSOCKS5Password(c, authenticate); err != nil {
+			return "", "", err
+		}
+	}
+
+	// request: version, command, reserved, address type
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != socks5Version {
+		return "", "", errSOCKS5BadVersion
+	}
+	if buf[1] != socks5Connect {
+		writeSOCKS5Reply(c, socks5CommandUnsupported)
+		return "", "", errSOCKS5CommandUnsupported
+	}
+	var host string
+	switch buf[3] {
+	case socks5IP4, socks5IP6:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == socks5IP6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socks5Domain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return "", "", err
+		}
+		domain := buf[:buf[0]]
+		if _, err := io.ReadFull(c, domain); err != nil {
+			return "", "", err
+		}
+		if !isValidSOCKS5Domain(domain) {
+			// never copied into the CONNECT request made of it
+			writeSOCKS5Reply(c, socks5GeneralFailure)
+			return "", "", errSOCKS5BadDomain
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(c, socks5AddrTypeUnsupported)
+		return "", "", errSOCKS5AddrTypeUnsupported
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), user, nil
+}
+
+// isValidSOCKS5Domain is domain a non-empty host name of at most 255 printable
+// ASCII characters without whitespace, which is safe in a request line
+func isValidSOCKS5Domain(domain []byte) bool {
+	if len(domain) == 0 || len(domain) > 255 {
+		return false
+	}
+	for _, b := range domain {
+		if b <= ' ' || b >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// readSOCKS5Password reads the username/password sub-negotiation of RFC 1929,
+// the username is returned if authenticated
+func readSOCKS5Password(c net.Conn, authenticate func(user, pass string) bool) (string, error) {
+	// version, username length, username, password length, password
+	var buf [255]byte
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5PasswordVersion {
+		return "", errSOCKS5BadVersion
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(c, buf[:1]); err != nil {
+		return "", err
+	}
+	pass := buf[:buf[0]]
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return "", err
+	}
+	if !authenticate(string(user), string(pass)) {
+		c.Write([]byte{socks5PasswordVersion, socks5GeneralFailure})
+		return "", errSOCKS5AuthFailed
+	}
+	if _, err := c.Write([]byte{socks5PasswordVersion, socks5Succeeded}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// writeSOCKS5Reply writes the SOCKS5 reply of code,
+// the bound address is always reported as 0.0.0.0:0
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5ReplyCode the SOCKS5 reply code of the response status
+func socks5ReplyCode(status int) byte {
+	switch status {
+	case http.StatusOK:
+		return socks5Succeeded
+	case http.StatusForbidden:
+		return socks5NotAllowed
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFailure
+}
+
+// socksConn a SOCKS client connection served as an HTTP CONNECT request:
+// the CONNECT request made of the SOCKS request is read firstly, then the
+// first response written, i.e. the tunnel message or an error response, is
+// translated into the SOCKS reply. Nothing is written after a failure reply.
+type socksConn struct {
+	net.Conn
+	request []byte
+	replied bool
+	failed  bool
+
+	// user the username authenticated with, empty if no authentication
+	user string
+}
+
+func newSOCKSConn(c net.Conn, hostWithPort string) *socksConn {
+	return &socksConn{
+		Conn: c,
+		request: []byte("CONNECT " + hostWithPort + " HTTP/1.1\r\n" +
+			"Host: " + hostWithPort + "\r\n\r\n"),
+	}
+}
+
+func (c *socksConn) Read(b []byte) (int, error) {
+	if len(c.request) > 0 {
+		n := copy(b, c.request)
+		c.request = c.request[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	if c.replied {
+		if c.failed {
+			return len(b), nil
+		}
+		return c.Conn.Write(b)
+	}
+	c.replied = true
+	code := socks5ReplyCode(responseStatus(b))
+	c.failed = code != socks5Succeeded
+	if err := writeSOCKS5Reply(c.Conn, code); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksConn) CloseWrite() error {
+	return transport.CloseWrite(c.Conn)
+}
+
+// responseStatus the status code of the raw response, 0 if malformed
+func responseStatus(rawResponse []byte) int {
+	if !bytes.HasPrefix(rawResponse, []byte("HTTP/")) {
+		return 0
+	}
+	i := bytes.IndexByte(rawResponse, ' ')
+	if i < 0 || len(rawResponse) < i+4 {
+		return 0
+	}
+	status, err := strconv.Atoi(string(rawResponse[i+1 : i+4]))
+	if err != nil {
+		return 0
+	}
+	return status
+}
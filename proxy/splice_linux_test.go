@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+func TestTunnelSpliced(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	ln, err := net.Listen("tcp4", "127.0.0.1:9491")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the early data sent along with CONNECT comes first
+		hello := make([]byte, 5)
+		if _, err := io.ReadFull(conn, hello); err != nil || string(hello) != "hello" {
+			return
+		}
+		conn.Write(data)
+	}()
+	go serveTestProxy(5139, Handler{})
+	time.Sleep(time.Millisecond * 10)
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:5139")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	splicedBefore := transport.SplicedBytes()
+	fmt.Fprint(conn, "CONNECT 127.0.0.1:9491 HTTP/1.1\r\nHost: 127.0.0.1:9491\r\n\r\nhello")
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected status %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	received, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("unexpected %d bytes received", len(received))
+	}
+	// the tunnel between the wrapped connections is spliced
+	if n := transport.SplicedBytes() - splicedBefore; n < uint64(len(data)) {
+		t.Fatalf("expected %d bytes spliced at least, got %d", len(data), n)
+	}
+}
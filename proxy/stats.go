@@ -0,0 +1,129 @@
+package proxy
+
+import "sync/atomic"
+
+// Stats live counters of the proxy, read them by the getters, which are safe
+// calling concurrently with the serving
+//
+// The latency histograms are made with DefaultLatencyBuckets when serving if
+// not set, set them by NewHistogram before serving for the other buckets.
+type Stats struct {
+	// ActiveConns client connections being served
+	ActiveConns int64
+	// TotalConns client connections accepted
+	TotalConns uint64
+	// TotalRequests requests read from clients, including the decrypted ones
+	TotalRequests uint64
+
+	// RejectedConns connections rejected by the concurrency limits
+	// or ShouldAllowConnection
+	RejectedConns uint64
+	// BadRequests malformed or oversized requests responded with 400,
+	// 414 or 431 by proxy itself
+	BadRequests uint64
+	// UpstreamErrors http requests failed forwarding to target
+	UpstreamErrors uint64
+	// TunnelErrors CONNECT requests failed to tunnel or decrypt
+	TunnelErrors uint64
+	// HandshakeFailures TLS handshakes with the decrypted clients failed,
+	// by the reason, also counted as TunnelErrors
+	HandshakeFailures [numHandshakeFailures]uint64
+
+	// ConnectLatency durations making the tunnels of CONNECT requests not
+	// decrypted, till connected to the target or super proxy
+	ConnectLatency *Histogram
+	// HandshakeLatency durations of the TLS handshakes with the decrypted
+	// clients succeeded
+	HandshakeLatency *Histogram
+	// FirstByteLatency durations from forwarding the http requests, both
+	// plain and decrypted, till the upstream responses started
+	FirstByteLatency *Histogram
+}
+
+// GetActiveConns returns ActiveConns
+func (s *Stats) GetActiveConns() int64 {
+	return atomic.LoadInt64(&s.ActiveConns)
+}
+
+// GetTotalConns returns TotalConns
+func (s *Stats) GetTotalConns() uint64 {
+	return atomic.LoadUint64(&s.TotalConns)
+}
+
+// GetTotalRequests returns TotalRequests
+func (s *Stats) GetTotalRequests() uint64 {
+	return atomic.LoadUint64(&s.TotalRequests)
+}
+
+// GetRejectedConns returns RejectedConns
+func (s *Stats) GetRejectedConns() uint64 {
+	return atomic.LoadUint64(&s.RejectedConns)
+}
+
+// GetBadRequests returns BadRequests
+func (s *Stats) GetBadRequests() uint64 {
+	return atomic.LoadUint64(&s.BadRequests)
+}
+
+// GetUpstreamErrors returns UpstreamErrors
+func (s *Stats) GetUpstreamErrors() uint64 {
+	return atomic.LoadUint64(&s.UpstreamErrors)
+}
+
+// GetTunnelErrors returns TunnelErrors
+func (s *Stats) GetTunnelErrors() uint64 {
+	return atomic.LoadUint64(&s.TunnelErrors)
+}
+
+// GetHandshakeFailures returns HandshakeFailures of the reason
+func (s *Stats) GetHandshakeFailures(reason HandshakeFailure) uint64 {
+	if reason < 0 || reason >= numHandshakeFailures {
+		return 0
+	}
+	return atomic.LoadUint64(&s.HandshakeFailures[reason])
+}
+
+func (s *Stats) initLatency() {
+	if s.ConnectLatency == nil {
+		s.ConnectLatency = NewHistogram()
+	}
+	if s.HandshakeLatency == nil {
+		s.HandshakeLatency = NewHistogram()
+	}
+	if s.FirstByteLatency == nil {
+		s.FirstByteLatency = NewHistogram()
+	}
+}
+
+func (s *Stats) connStarted() {
+	atomic.AddInt64(&s.ActiveConns, 1)
+	atomic.AddUint64(&s.TotalConns, 1)
+}
+
+func (s *Stats) connEnded() {
+	atomic.AddInt64(&s.ActiveConns, -1)
+}
+
+func (s *Stats) addRequest() {
+	atomic.AddUint64(&s.TotalRequests, 1)
+}
+
+func (s *Stats) addRejectedConn() {
+	atomic.AddUint64(&s.RejectedConns, 1)
+}
+
+func (s *Stats) addBadRequest() {
+	atomic.AddUint64(&s.BadRequests, 1)
+}
+
+func (s *Stats) addUpstreamError() {
+	atomic.AddUint64(&s.UpstreamErrors, 1)
+}
+
+func (s *Stats) addTunnelError() {
+	atomic.AddUint64(&s.TunnelErrors, 1)
+}
+
+func (s *Stats) addHandshakeFailure(reason HandshakeFailure) {
+	atomic.AddUint64(&s.HandshakeFailures[reason], 1)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// errHostBlocked the failure of TunnelFailureBlocked for Handler.ShouldBlockHost
+var errHostBlocked = errors.New("target host blocked by policy")
+
+// errTunnelRetry the tunnel failed is retried with Handler.TunnelFallbackProxies
+var errTunnelRetry = errors.New("tunnel failed, retrying with the fallback")
+
+// TunnelFailure cause of a failed CONNECT request
+type TunnelFailure int
+
+const (
+	// TunnelFailureDial fail to dial the target host, 502 by default
+	TunnelFailureDial TunnelFailure = iota
+	// TunnelFailureTimeout dialing the target host timed out, 504 by default
+	TunnelFailureTimeout
+	// TunnelFailureSuperProxy super proxy fails to make the tunnel, 502 by default
+	TunnelFailureSuperProxy
+	// TunnelFailureDecrypt fail to set up the https decryption, 502 by default
+	TunnelFailureDecrypt
+	// TunnelFailureBlocked target blocked by policy, e.g. the private
+	// networks blocked by BlockPrivateNetworks or the hosts blocked by
+	// ShouldBlockHost, 403 by default
+	TunnelFailureBlocked
+)
+
+// Status default response status of the tunnel failure
+func (f TunnelFailure) Status() int {
+	switch f {
+	case TunnelFailureTimeout:
+		return http.StatusGatewayTimeout
+	case TunnelFailureBlocked:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// message default response body of the tunnel failure
+func (f TunnelFailure) message() string {
+	switch f {
+	case TunnelFailureTimeout:
+		return "Timed out connecting to the target host.\n"
+	case TunnelFailureSuperProxy:
+		return "Fail to connect to the target host via super proxy.\n"
+	case TunnelFailureDecrypt:
+		return "Fail to decrypt the target host.\n"
+	case TunnelFailureBlocked:
+		return "Access to the target host is forbidden.\n"
+	}
+	return "Fail to connect to the target host.\n"
+}
+
+// tunnelMakingFailure the tunnel failure of err returned by making the tunnel
+func tunnelMakingFailure(err error, viaSuperProxy bool) TunnelFailure {
+	if err == transport.ErrDialTimeout {
+		return TunnelFailureTimeout
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return TunnelFailureTimeout
+	}
+	if viaSuperProxy {
+		return TunnelFailureSuperProxy
+	}
+	return TunnelFailureDial
+}
+
+// makeTunnelFailedBytes makes the CONNECT failure response of cause, using
+// Handler.TunnelFailureResponse if provided, otherwise the default one
+func (p *Proxy) makeTunnelFailedBytes(cause TunnelFailure, fail error) []byte {
+	status, body := 0, []byte(nil)
+	if p.Handler.TunnelFailureResponse != nil {
+		status, body = p.Handler.TunnelFailureResponse(cause, fail)
+	}
+	if status == 0 {
+		status, body = cause.Status(), []byte(cause.message())
+	}
+	b := http.NewResponseBuilder(status)
+	defer b.Release()
+	b.AddHeader("Connection", "close")
+	b.AddHeader("Content-Type", "text/plain")
+	b.SetBody(body)
+	return append([]byte(nil), b.Bytes()...)
+}
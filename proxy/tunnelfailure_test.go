@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/transport"
+)
+
+func TestTunnelMakingFailure(t *testing.T) {
+	testTunnelMakingFailure(t, transport.ErrDialTimeout, false, TunnelFailureTimeout, http.StatusGatewayTimeout)
+	testTunnelMakingFailure(t, transport.ErrDialTimeout, true, TunnelFailureTimeout, http.StatusGatewayTimeout)
+	testTunnelMakingFailure(t, timeoutError{}, true, TunnelFailureTimeout, http.StatusGatewayTimeout)
+	testTunnelMakingFailure(t, errors.New("connection refused"), false, TunnelFailureDial, http.StatusBadGateway)
+	testTunnelMakingFailure(t, errors.New("connection refused"), true, TunnelFailureSuperProxy, http.StatusBadGateway)
+}
+
+func testTunnelMakingFailure(t *testing.T, err error, viaSuperProxy bool, expectedCause TunnelFailure, expectedStatus int) {
+	cause := tunnelMakingFailure(err, viaSuperProxy)
+	if cause != expectedCause {
+		t.Fatalf("expected cause %d of %s, got %d", expectedCause, err, cause)
+	}
+	if cause.Status() != expectedStatus {
+		t.Fatalf("expected status %d of cause %d, got %d", expectedStatus, cause, cause.Status())
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,38 @@
+package proxy
+
+// UpstreamHeader the response header naming the upstream serving the request,
+// i.e. the super proxy host with port or UpstreamDirect, see
+// Handler.EmitUpstreamHeader
+const UpstreamHeader = "X-Fastproxy-Upstream"
+
+// UpstreamDirect the upstream of the requests sent to the targets directly
+const UpstreamDirect = "DIRECT"
+
+// upstreamOf the super proxy host with port req sent to, UpstreamDirect if none
+func upstreamOf(req *Request) string {
+	if superProxy := req.GetProxy(); superProxy != nil {
+		return superProxy.HostWithPort()
+	}
+	return UpstreamDirect
+}
+
+// responseHeadersAdder the headers added to the response to req, i.e. the
+// AddResponseHeaders with UpstreamHeader if EmitUpstreamHeader set
+func (p *Proxy) responseHeadersAdder(req *Request) func(host string) map[string]string {
+	addResponseHeaders := p.Handler.AddResponseHeaders
+	if !p.Handler.EmitUpstreamHeader {
+		return addResponseHeaders
+	}
+	upstream := upstreamOf(req)
+	return func(host string) map[string]string {
+		// never modify the headers returned, which could be shared
+		headers := make(map[string]string)
+		if addResponseHeaders != nil {
+			for key, value := range addResponseHeaders(host) {
+				headers[key] = value
+			}
+		}
+		headers[UpstreamHeader] = upstream
+		return headers
+	}
+}
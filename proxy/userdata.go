@@ -63,6 +63,8 @@ func (d *UserData) Reset() {
 		if vc, ok := v.(io.Closer); ok {
 			vc.Close()
 		}
+		// never keep the value referenced by the pooled user data
+		args[i].value = nil
 	}
 	*d = (*d)[:0]
 }
@@ -5,6 +5,8 @@ import (
 	"net"
 	"sync/atomic"
 	"time"
+
+	"github.com/haxii/fastproxy/transport"
 )
 
 // GracefulNetListener is a graceful shutdown listener
@@ -110,3 +112,20 @@ func (c *gracefulConn) Close() error {
 
 	return nil
 }
+
+func (c *gracefulConn) CloseWrite() error {
+	return transport.CloseWrite(c.Conn)
+}
+
+// NetConn implements transport.WrappedConn
+func (c *gracefulConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered implements transport.WrappedConn
+func (c *gracefulConn) Buffered() int {
+	return 0
+}
+
+// Spliced implements transport.WrappedConn
+func (c *gracefulConn) Spliced(n int64, read bool) {}
@@ -88,7 +88,15 @@ func (s *Server) ListenAndServe() error {
 	}
 }
 
+// backoff delays of the temporary accept errors, e.g. EMFILE,
+// doubled on each consecutive error up to the max delay
+var (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+)
+
 func (s *Server) acceptConn(ln net.Listener, lastPerIPErrorTime *time.Time) (net.Conn, error) {
+	var retryDelay time.Duration
 	for {
 		c, err := ln.Accept()
 		if err != nil {
@@ -96,8 +104,13 @@ func (s *Server) acceptConn(ln net.Listener, lastPerIPErrorTime *time.Time) (net
 				panic("BUG: net.Listener returned non-nil conn and non-nil error")
 			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				s.Logger.Error(s.ServiceName, netErr, "Temporary error when accepting new connections")
-				time.Sleep(time.Second)
+				if retryDelay == 0 {
+					retryDelay = minAcceptRetryDelay
+				} else if retryDelay *= 2; retryDelay > maxAcceptRetryDelay {
+					retryDelay = maxAcceptRetryDelay
+				}
+				s.Logger.Error(s.ServiceName, netErr, "Temporary error when accepting new connections, retrying in %s", retryDelay)
+				time.Sleep(retryDelay)
 				continue
 			}
 			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
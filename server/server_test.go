@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haxii/log"
+)
+
+func TestServerAcceptTemporaryErrors(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	permanentErr := errors.New("permanent error")
+	ln := &fakeListener{results: []fakeAcceptResult{
+		{err: temporaryError{}},
+		{err: temporaryError{}},
+		{err: temporaryError{}},
+		{conn: serverConn},
+		{err: permanentErr},
+	}}
+	served := make(chan net.Conn, 1)
+	s := &Server{
+		Listener: ln,
+		ConnHandler: func(c net.Conn) error {
+			served <- c
+			return nil
+		},
+		Logger: &log.DefaultLogger{},
+	}
+	startTime := time.Now()
+	if err := s.ListenAndServe(); err != permanentErr {
+		t.Fatalf("expected error %s, got %v", permanentErr, err)
+	}
+	// retried after 5ms, 10ms and 20ms
+	if d := time.Since(startTime); d < 35*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected backoff duration %s", d)
+	}
+	select {
+	case c := <-served:
+		if c != serverConn {
+			t.Fatalf("unexpected connection served")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("connection accepted after temporary errors is not served")
+	}
+}
+
+type fakeAcceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// fakeListener returns the accept results in order
+type fakeListener struct {
+	results []fakeAcceptResult
+}
+
+func (ln *fakeListener) Accept() (net.Conn, error) {
+	if len(ln.results) == 0 {
+		return nil, errors.New("no more results")
+	}
+	r := ln.results[0]
+	ln.results = ln.results[1:]
+	return r.conn, r.err
+}
+
+func (ln *fakeListener) Close() error { return nil }
+
+func (ln *fakeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
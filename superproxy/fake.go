@@ -0,0 +1,36 @@
+package superproxy
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+// NewFakeSuperProxy makes an in-memory super proxy for testing purpose, which
+// never connects to a real proxy server. Instead, makeTunnel is called to make
+// the tunnel to the target host, e.g. by returning an end of net.Pipe and
+// serving the other end as the target. Plain HTTP requests forwarded to a fake
+// HTTP proxy are sent to the connection made with the proxy's own hostWithPort.
+func NewFakeSuperProxy(hostWithPort string, proxyType ProxyType,
+	makeTunnel func(targetHostWithPort string) (net.Conn, error)) (*SuperProxy, error) {
+	if len(hostWithPort) == 0 {
+		return nil, errors.New("nil host provided")
+	}
+	if makeTunnel == nil {
+		return nil, errors.New("nil tunnel maker provided")
+	}
+	s := &SuperProxy{
+		proxyType: proxyType,
+		connManager: transport.ConnManager{
+			MaxConns:            1024,
+			MaxIdleConnDuration: 10 * time.Second,
+		},
+		fakeTunnel: makeTunnel,
+	}
+	s.hostWithPort = hostWithPort
+	s.hostWithPortBytes = []byte(hostWithPort)
+	s.SetMaxConcurrency(DefaultMaxConcurrency)
+	return s, nil
+}
@@ -0,0 +1,133 @@
+package superproxy
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultStickyBalancerReplicas virtual nodes of each super proxy
+// on the hash ring when no replicas set
+const DefaultStickyBalancerReplicas = 160
+
+// StickyBalancer selects the super proxy by a key, e.g. the client IP, using
+// consistent hashing, so that the same key is always routed to the same super
+// proxy, and only the keys of a super proxy added or removed are remapped.
+//
+// It is safe calling StickyBalancer methods from concurrently running go routines.
+type StickyBalancer struct {
+	replicas int
+
+	lock    sync.RWMutex
+	proxies []*SuperProxy
+	ring    []uint32
+	nodes   map[uint32]*SuperProxy
+}
+
+// NewStickyBalancer makes a sticky balancer over proxies with replicas virtual
+// nodes for each super proxy, DefaultStickyBalancerReplicas is used if not set
+func NewStickyBalancer(replicas int, proxies ...*SuperProxy) *StickyBalancer {
+	if replicas <= 0 {
+		replicas = DefaultStickyBalancerReplicas
+	}
+	b := &StickyBalancer{
+		replicas: replicas,
+		nodes:    make(map[uint32]*SuperProxy),
+	}
+	for _, p := range proxies {
+		b.Add(p)
+	}
+	return b
+}
+
+// Add adds the super proxy into balancer, nothing changes if it's already added
+func (b *StickyBalancer) Add(p *SuperProxy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, proxy := range b.proxies {
+		if proxy == p {
+			return
+		}
+	}
+	b.proxies = append(b.proxies, p)
+	b.rebuild()
+}
+
+// Remove removes the super proxy from balancer
+func (b *StickyBalancer) Remove(p *SuperProxy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, proxy := range b.proxies {
+		if proxy == p {
+			b.proxies = append(b.proxies[:i], b.proxies[i+1:]...)
+			b.rebuild()
+			return
+		}
+	}
+}
+
+// Proxies returns the super proxies in the balancer by the order added
+func (b *StickyBalancer) Proxies() []*SuperProxy {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]*SuperProxy(nil), b.proxies...)
+}
+
+// Get returns the super proxy the key sticks to, nil if no super proxies
+func (b *StickyBalancer) Get(key string) *SuperProxy {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if len(b.ring) == 0 {
+		return nil
+	}
+	h := stickyHash(key)
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.nodes[b.ring[i]]
+}
+
+// GetByClientAddr returns the super proxy the client IP sticks to,
+// the client port is ignored
+func (b *StickyBalancer) GetByClientAddr(clientAddr net.Addr) *SuperProxy {
+	if clientAddr == nil {
+		return b.Get("")
+	}
+	if tcpAddr, ok := clientAddr.(*net.TCPAddr); ok {
+		return b.Get(tcpAddr.IP.String())
+	}
+	host, _, err := net.SplitHostPort(clientAddr.String())
+	if err != nil {
+		return b.Get(clientAddr.String())
+	}
+	return b.Get(host)
+}
+
+// rebuild rebuilds the hash ring with the virtual nodes of every super proxy,
+// the nodes of a super proxy never change with the others added or removed
+func (b *StickyBalancer) rebuild() {
+	b.ring = b.ring[:0]
+	b.nodes = make(map[uint32]*SuperProxy, len(b.proxies)*b.replicas)
+	for _, p := range b.proxies {
+		name := p.HostWithPort() + "@" + p.Username() + "#"
+		for i := 0; i < b.replicas; i++ {
+			h := stickyHash(name + strconv.Itoa(i))
+			if _, ok := b.nodes[h]; ok {
+				// hash collision, the first one wins
+				continue
+			}
+			b.nodes[h] = p
+			b.ring = append(b.ring, h)
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+}
+
+func stickyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
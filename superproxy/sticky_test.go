@@ -0,0 +1,72 @@
+package superproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestStickyBalancer(t *testing.T) {
+	proxies := make([]*SuperProxy, 0, 5)
+	for i := 0; i < 5; i++ {
+		p, err := NewSuperProxy(fmt.Sprintf("10.0.0.%d", i+1), uint16(3128), ProxyTypeHTTP, "", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		proxies = append(proxies, p)
+	}
+	b := NewStickyBalancer(0)
+	if b.Get("192.168.1.1") != nil {
+		t.Fatalf("expected no proxy from empty balancer")
+	}
+	for _, p := range proxies[:4] {
+		b.Add(p)
+	}
+
+	// stickiness
+	clients := 1000
+	selected := make([]*SuperProxy, clients)
+	counts := make(map[*SuperProxy]int)
+	for i := 0; i < clients; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(192, 168, byte(i>>8), byte(i)), Port: 10000 + i}
+		selected[i] = b.GetByClientAddr(addr)
+		counts[selected[i]]++
+		addr.Port++
+		if b.GetByClientAddr(addr) != selected[i] {
+			t.Fatalf("client %s is not sticky", addr.IP)
+		}
+	}
+	if len(counts) != 4 {
+		t.Fatalf("expected clients spread over 4 proxies, got %d", len(counts))
+	}
+
+	// only the clients of the new proxy are remapped
+	b.Add(proxies[4])
+	remapped := 0
+	for i := 0; i < clients; i++ {
+		p := b.GetByClientAddr(&net.TCPAddr{IP: net.IPv4(192, 168, byte(i>>8), byte(i))})
+		if p != selected[i] {
+			if p != proxies[4] {
+				t.Fatalf("client remapped to %s other than the new proxy", p.HostWithPort())
+			}
+			remapped++
+		}
+	}
+	if remapped == 0 || remapped > clients/3 {
+		t.Fatalf("unexpected %d of %d clients remapped on proxy added", remapped, clients)
+	}
+
+	// only the clients of the removed proxy are remapped
+	b.Remove(proxies[4])
+	b.Remove(proxies[0])
+	for i := 0; i < clients; i++ {
+		p := b.GetByClientAddr(&net.TCPAddr{IP: net.IPv4(192, 168, byte(i>>8), byte(i))})
+		if selected[i] == proxies[0] {
+			if p == proxies[0] {
+				t.Fatalf("client mapped to the removed proxy")
+			}
+		} else if p != selected[i] {
+			t.Fatalf("client of %s remapped on another proxy removed", selected[i].HostWithPort())
+		}
+	}
+}
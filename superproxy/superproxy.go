@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/haxii/fastproxy/bufiopool"
@@ -30,6 +32,13 @@ const (
 
 //SuperProxy chaining proxy
 type SuperProxy struct {
+	// tokenWaits times AcquireToken blocked, tokensInFlight tokens acquired
+	// and maxConcurrency the total tokens, they are the first fields for
+	// 64-bit alignment of the atomic operations
+	tokenWaits     uint64
+	tokensInFlight int64
+	maxConcurrency int64
+
 	hostWithPort      string
 	hostWithPortBytes []byte
 
@@ -55,8 +64,27 @@ type SuperProxy struct {
 	//usage
 	Usage usage.ProxyUsage
 
-	//concurrency chan
-	concurrencyChan chan struct{}
+	// tokenLock guards the tokens, tokenReturned signals
+	// the token waiters when tokens pushed back or more tokens added
+	tokenLock     sync.Mutex
+	tokenReturned *sync.Cond
+
+	// Dialer dials the connection to super proxy, e.g. for custom routing,
+	// unix sockets or mocks, network is always "tcp" and addr is the proxy's
+	// host with port. transport.Dial is used if not set.
+	//
+	// Dialer should be set before the super proxy is used, changing it while
+	// the super proxy is in use by other go routines is not safe.
+	Dialer func(network, addr string) (net.Conn, error)
+
+	// LocalAddr the local address the connections to super proxy are bound
+	// to when dialed by transport, e.g. `192.0.2.10:0` choosing the egress IP
+	// on a multi-homed host. The system chooses it if not set. Like Dialer, it
+	// should be set before the super proxy is used.
+	LocalAddr *net.TCPAddr
+
+	// fakeTunnel makes tunnels for a fake super proxy, see NewFakeSuperProxy
+	fakeTunnel func(targetHostWithPort string) (net.Conn, error)
 }
 
 // NewSuperProxy new a super proxy
@@ -127,22 +155,39 @@ func (p *SuperProxy) HTTPProxyAuthHeaderWithCRLF() []byte {
 	return p.authHeaderWithCRLF
 }
 
+// Dial connects to the super proxy, the connection is encrypted
+// for a HTTPS proxy
+func (p *SuperProxy) Dial() (net.Conn, error) {
+	if p.fakeTunnel != nil {
+		return p.fakeTunnel(p.hostWithPort)
+	}
+	dialer := p.Dialer
+	if dialer == nil {
+		if p.proxyType == ProxyTypeHTTPS {
+			return transport.DialTLSLocal(p.hostWithPort, p.tlsConfig, p.LocalAddr)
+		}
+		return transport.DialLocal(p.hostWithPort, p.LocalAddr)
+	}
+	c, err := dialer("tcp", p.hostWithPort)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("dialer returned a nil connection")
+	}
+	if p.proxyType == ProxyTypeHTTPS {
+		c = tls.Client(c, p.tlsConfig)
+	}
+	return c, nil
+}
+
 // MakeTunnel makes a TCP tunnel by making a connect request to proxy
 func (p *SuperProxy) MakeTunnel(pool *bufiopool.Pool,
 	targetHostWithPort string) (net.Conn, error) {
-	var (
-		c   net.Conn
-		err error
-	)
-	switch p.proxyType {
-	case ProxyTypeHTTP:
-		fallthrough
-	case ProxyTypeSOCKS5:
-		c, err = transport.Dial(p.hostWithPort)
-	case ProxyTypeHTTPS:
-		c, err = transport.DialTLS(p.hostWithPort, p.tlsConfig)
+	if p.fakeTunnel != nil {
+		return p.fakeTunnel(targetHostWithPort)
 	}
-
+	c, err := p.Dial()
 	if err != nil {
 		return nil, err
 	}
@@ -172,32 +217,71 @@ func (p *SuperProxy) MakeTunnel(pool *bufiopool.Pool,
 			return nil, errors.New("proxy: target port number out of range: " + targetPortStr)
 		}
 		if err = p.connectSOCKS5Proxy(c, targetHost, targetPort); err != nil {
+			c.Close()
 			return nil, err
 		}
 	}
 	return c, nil
 }
 
-// SetMaxConcurrency sets max concurrency,
-// n should > 0
+// SetMaxConcurrency sets max concurrency, n should > 0.
+//
+// It's safe to change the max concurrency while the super proxy is in use,
+// the waiters are woken up when it grows, while shrinking takes effect as
+// the tokens in flight are pushed back.
 func (p *SuperProxy) SetMaxConcurrency(n int) {
 	if n <= 0 {
 		return
 	}
-	p.concurrencyChan = make(chan struct{}, n)
-	for n > 0 {
-		p.concurrencyChan <- struct{}{}
-		n--
+	p.tokenLock.Lock()
+	if p.tokenReturned == nil {
+		p.tokenReturned = sync.NewCond(&p.tokenLock)
 	}
+	atomic.StoreInt64(&p.maxConcurrency, int64(n))
+	p.tokenReturned.Broadcast()
+	p.tokenLock.Unlock()
 }
 
-// AcquireToken acquire a token from concurrencyChan,
-// block here if concurrencyChan is empty
+// AcquireToken acquire a token,
+// block here if all the tokens are in flight
 func (p *SuperProxy) AcquireToken() {
-	<-p.concurrencyChan
+	p.tokenLock.Lock()
+	if p.tokenReturned == nil {
+		p.tokenReturned = sync.NewCond(&p.tokenLock)
+	}
+	if p.tokensInFlight >= p.maxConcurrency {
+		atomic.AddUint64(&p.tokenWaits, 1)
+		for p.tokensInFlight >= p.maxConcurrency {
+			p.tokenReturned.Wait()
+		}
+	}
+	atomic.AddInt64(&p.tokensInFlight, 1)
+	p.tokenLock.Unlock()
 }
 
-// PushBackToken push a token back to concurrencyChan
+// PushBackToken push an acquired token back
 func (p *SuperProxy) PushBackToken() {
-	p.concurrencyChan <- struct{}{}
+	p.tokenLock.Lock()
+	atomic.AddInt64(&p.tokensInFlight, -1)
+	if p.tokenReturned != nil {
+		p.tokenReturned.Signal()
+	}
+	p.tokenLock.Unlock()
+}
+
+// Capacity max concurrency of the super proxy, i.e. the total tokens
+func (p *SuperProxy) Capacity() int {
+	return int(atomic.LoadInt64(&p.maxConcurrency))
+}
+
+// InFlight number of tokens acquired but not pushed back yet, which is
+// close to Capacity when the super proxy is saturated, it may exceed
+// Capacity for a while after the max concurrency shrunk
+func (p *SuperProxy) InFlight() int {
+	return int(atomic.LoadInt64(&p.tokensInFlight))
+}
+
+// TokenWaits times AcquireToken blocked for no tokens available
+func (p *SuperProxy) TokenWaits() uint64 {
+	return atomic.LoadUint64(&p.tokenWaits)
 }
@@ -1,12 +1,16 @@
 package superproxy
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -247,3 +251,204 @@ func testSuperProxyConcurrency(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 }
+
+// test the token accounting of super proxy
+func TestSuperProxyTokenAccounting(t *testing.T) {
+	superProxy, err := NewSuperProxy("proxy.invalid", uint16(3128), ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	superProxy.SetMaxConcurrency(2)
+	if superProxy.Capacity() != 2 || superProxy.InFlight() != 0 {
+		t.Fatalf("unexpected capacity %d and in flight %d", superProxy.Capacity(), superProxy.InFlight())
+	}
+	superProxy.AcquireToken()
+	superProxy.AcquireToken()
+	if superProxy.InFlight() != 2 {
+		t.Fatalf("expected 2 tokens in flight, got %d", superProxy.InFlight())
+	}
+	if superProxy.TokenWaits() != 0 {
+		t.Fatalf("expected no token waits, got %d", superProxy.TokenWaits())
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		superProxy.AcquireToken()
+		close(acquired)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if superProxy.TokenWaits() != 1 {
+		t.Fatalf("expected 1 token wait, got %d", superProxy.TokenWaits())
+	}
+	superProxy.PushBackToken()
+	<-acquired
+	if superProxy.InFlight() != 2 {
+		t.Fatalf("expected 2 tokens in flight, got %d", superProxy.InFlight())
+	}
+	superProxy.PushBackToken()
+	superProxy.PushBackToken()
+	if superProxy.InFlight() != 0 {
+		t.Fatalf("expected no tokens in flight, got %d", superProxy.InFlight())
+	}
+}
+
+// test the max concurrency changed while tokens in flight
+func TestSuperProxySetMaxConcurrencyUnderLoad(t *testing.T) {
+	superProxy, err := NewSuperProxy("proxy.invalid", uint16(3128), ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	superProxy.SetMaxConcurrency(4)
+	// waitBlocked waits until AcquireToken blocked n times in total
+	waitBlocked := func(n uint64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for superProxy.TokenWaits() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d token waits, got %d", n, superProxy.TokenWaits())
+			}
+			runtime.Gosched()
+		}
+	}
+
+	// all the tokens are in flight when shrunk
+	var holders sync.WaitGroup
+	holding := make(chan struct{})
+	releaseHolders := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		holders.Add(1)
+		go func() {
+			defer holders.Done()
+			superProxy.AcquireToken()
+			holding <- struct{}{}
+			<-releaseHolders
+			superProxy.PushBackToken()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-holding
+	}
+	superProxy.SetMaxConcurrency(1)
+	// shrink under load, the in flight tokens are never blocked
+	if superProxy.InFlight() != 4 {
+		t.Fatalf("expected 4 tokens in flight, got %d", superProxy.InFlight())
+	}
+
+	// the waiters acquire one at a time after the tokens in flight returned
+	var lock sync.Mutex
+	current, max := 0, 0
+	var waiters sync.WaitGroup
+	acquired := make(chan struct{})
+	releaseWaiter := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		waiters.Add(1)
+		go func() {
+			defer waiters.Done()
+			superProxy.AcquireToken()
+			lock.Lock()
+			current++
+			if current > max {
+				max = current
+			}
+			lock.Unlock()
+			acquired <- struct{}{}
+			<-releaseWaiter
+			lock.Lock()
+			current--
+			lock.Unlock()
+			superProxy.PushBackToken()
+		}()
+	}
+	waitBlocked(4)
+	close(releaseHolders)
+	holders.Wait()
+	for i := 0; i < 4; i++ {
+		<-acquired
+		releaseWaiter <- struct{}{}
+	}
+	waiters.Wait()
+	if max != 1 {
+		t.Fatalf("expected max concurrency 1 after shrunk, got %d", max)
+	}
+	if superProxy.Capacity() != 1 || superProxy.InFlight() != 0 {
+		t.Fatalf("unexpected capacity %d and in flight %d", superProxy.Capacity(), superProxy.InFlight())
+	}
+
+	// grow wakes up the waiters
+	superProxy.AcquireToken()
+	tokenWaits := superProxy.TokenWaits()
+	growAcquired := make(chan struct{})
+	go func() {
+		superProxy.AcquireToken()
+		close(growAcquired)
+	}()
+	waitBlocked(tokenWaits + 1)
+	superProxy.SetMaxConcurrency(2)
+	select {
+	case <-growAcquired:
+	case <-time.After(time.Second):
+		t.Fatalf("waiter not woken up after max concurrency grown")
+	}
+	if superProxy.InFlight() != 2 {
+		t.Fatalf("expected 2 tokens in flight, got %d", superProxy.InFlight())
+	}
+}
+
+// test super proxy dials through the custom dialer
+func TestSuperProxyDialer(t *testing.T) {
+	// a fake http proxy accepts the connect request, then echoes
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != "CONNECT" || req.Host != "example.com:80" {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		io.Copy(conn, conn)
+	}()
+
+	superProxy, err := NewSuperProxy("proxy.invalid", uint16(3128), ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var dialedNetwork, dialedAddr string
+	superProxy.Dialer = func(network, addr string) (net.Conn, error) {
+		dialedNetwork, dialedAddr = network, addr
+		return net.Dial("tcp4", ln.Addr().String())
+	}
+	conn, err := superProxy.MakeTunnel(bufiopool.New(1, 1), "example.com:80")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer conn.Close()
+	if dialedNetwork != "tcp" || dialedAddr != "proxy.invalid:3128" {
+		t.Fatalf("unexpected dial to %s %s", dialedNetwork, dialedAddr)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	result := make([]byte, 4)
+	if _, err = io.ReadFull(conn, result); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(result) != "ping" {
+		t.Fatalf("unexpected result: %s", result)
+	}
+
+	// dial error is returned as is
+	dialErr := errors.New("no route")
+	superProxy.Dialer = func(network, addr string) (net.Conn, error) {
+		return nil, dialErr
+	}
+	if _, err = superProxy.MakeTunnel(bufiopool.New(1, 1), "example.com:80"); err != dialErr {
+		t.Fatalf("expected dial error, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package superproxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// socks5UDPHeaderLen length of the UDP request header before the address
+const socks5UDPHeaderLen = 3
+
+var (
+	// ErrSOCKS5UDPFragmented a fragmented SOCKS5 UDP datagram received, which
+	// can't be reassembled, the datagram should be dropped
+	ErrSOCKS5UDPFragmented = errors.New("proxy: fragmented SOCKS5 UDP datagram not supported")
+
+	errSOCKS5UDPShortDatagram = errors.New("proxy: SOCKS5 UDP datagram too short")
+)
+
+// ParseSOCKS5UDPDatagram parses the SOCKS5 UDP datagram of UDP ASSOCIATE, see
+// RFC 1928 7, returns the target host with port and the data carried.
+//
+// Fragmentation is not supported, ErrSOCKS5UDPFragmented is returned for
+// a datagram with a non-zero FRAG, whose data is never parsed.
+func ParseSOCKS5UDPDatagram(datagram []byte) (targetWithPort string, data []byte, err error) {
+	if len(datagram) < socks5UDPHeaderLen+1 {
+		return "", nil, errSOCKS5UDPShortDatagram
+	}
+	if datagram[2] != 0 {
+		return "", nil, ErrSOCKS5UDPFragmented
+	}
+	b := datagram[socks5UDPHeaderLen+1:]
+	var host string
+	switch datagram[socks5UDPHeaderLen] {
+	case socks5IP4:
+		if len(b) < net.IPv4len {
+			return "", nil, errSOCKS5UDPShortDatagram
+		}
+		host, b = net.IP(b[:net.IPv4len]).String(), b[net.IPv4len:]
+	case socks5IP6:
+		if len(b) < net.IPv6len {
+			return "", nil, errSOCKS5UDPShortDatagram
+		}
+		host, b = net.IP(b[:net.IPv6len]).String(), b[net.IPv6len:]
+	case socks5Domain:
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return "", nil, errSOCKS5UDPShortDatagram
+		}
+		host, b = string(b[1:1+int(b[0])]), b[1+int(b[0]):]
+	default:
+		return "", nil, errors.New("proxy: got unknown address type " +
+			strconv.Itoa(int(datagram[socks5UDPHeaderLen])) + " in SOCKS5 UDP datagram")
+	}
+	if len(b) < 2 {
+		return "", nil, errSOCKS5UDPShortDatagram
+	}
+	port := int(b[0])<<8 | int(b[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), b[2:], nil
+}
+
+// AppendSOCKS5UDPDatagram appends the SOCKS5 UDP datagram carrying data to
+// the target into dst, the datagram is never fragmented, i.e. FRAG is 0
+func AppendSOCKS5UDPDatagram(dst []byte, targetHost string, targetPort int, data []byte) ([]byte, error) {
+	dst = append(dst, 0, 0 /* reserved */, 0 /* FRAG */)
+	if ip := net.ParseIP(targetHost); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, socks5IP4)
+			ip = ip4
+		} else {
+			dst = append(dst, socks5IP6)
+		}
+		dst = append(dst, ip...)
+	} else {
+		if len(targetHost) > 255 {
+			return dst, errors.New("proxy: destination host name too long: " + targetHost)
+		}
+		dst = append(dst, socks5Domain, byte(len(targetHost)))
+		dst = append(dst, targetHost...)
+	}
+	dst = append(dst, byte(targetPort>>8), byte(targetPort))
+	return append(dst, data...), nil
+}
@@ -0,0 +1,52 @@
+package superproxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSOCKS5UDPDatagram(t *testing.T) {
+	testSOCKS5UDPDatagram(t, "10.0.0.1", 53, "10.0.0.1:53")
+	testSOCKS5UDPDatagram(t, "::1", 443, "[::1]:443")
+	testSOCKS5UDPDatagram(t, "www.example.com", 8080, "www.example.com:8080")
+
+	// fragmented datagram is rejected rather than parsed
+	datagram, err := AppendSOCKS5UDPDatagram(nil, "10.0.0.1", 53, []byte("query"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	datagram[2] = 1
+	if _, data, err := ParseSOCKS5UDPDatagram(datagram); err != ErrSOCKS5UDPFragmented || data != nil {
+		t.Fatalf("expected error %s without data, got %v, %q", ErrSOCKS5UDPFragmented, err, data)
+	}
+
+	// malformed datagrams
+	for _, datagram := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 0, socks5IP4, 10, 0, 0},
+		{0, 0, 0, socks5Domain, 10, 'a'},
+		{0, 0, 0, socks5IP4, 10, 0, 0, 1, 0},
+		{0, 0, 0, 9, 10, 0, 0, 1, 0, 53},
+	} {
+		if _, _, err := ParseSOCKS5UDPDatagram(datagram); err == nil {
+			t.Fatalf("expected error for datagram %v", datagram)
+		}
+	}
+}
+
+func testSOCKS5UDPDatagram(t *testing.T, host string, port int, expTarget string) {
+	datagram, err := AppendSOCKS5UDPDatagram(nil, host, port, []byte("hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(datagram[:3], []byte{0, 0, 0}) {
+		t.Fatalf("expected header with FRAG 0, got %v", datagram[:3])
+	}
+	target, data, err := ParseSOCKS5UDPDatagram(datagram)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if target != expTarget || string(data) != "hello" {
+		t.Fatalf("expected %s with data hello, got %s with data %q", expTarget, target, data)
+	}
+}
@@ -171,6 +171,15 @@ func (c *ConnManager) CloseConn(cc *Conn) {
 	releaseClientConn(cc)
 }
 
+// DetachConn removes the connection from manager without closing it, the
+// caller takes over the connection, e.g. a connection switched protocols
+func (c *ConnManager) DetachConn(cc *Conn) net.Conn {
+	c.decConnsCount()
+	conn := cc.c
+	releaseClientConn(cc)
+	return conn
+}
+
 func (c *ConnManager) decConnsCount() {
 	c.connsLock.Lock()
 	c.connsCount--
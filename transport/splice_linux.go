@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	spliceFlagMove     = 0x1
+	spliceFlagNonblock = 0x2
+
+	// spliceMaxChunk bytes moved by a splice at most, the default pipe capacity
+	spliceMaxChunk = 64 << 10
+)
+
+// forwardSplice forwards src to dst using splice(2) through a pipe, so that
+// the bytes are never copied into user space. It's only handled when both
+// ends are TCP connections, or wrapped ones without bytes read ahead, see
+// WrappedConn, otherwise nothing is done and false returned.
+// The idle duration is applied to the read deadline of src before every splice
+func forwardSplice(dst io.Writer, src io.Reader, idle time.Duration) (int64, bool, error) {
+	dstUnwrapped, dstWrappers := unwrapConn(dst)
+	dstConn, ok := dstUnwrapped.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	srcUnwrapped, srcWrappers := unwrapConn(src)
+	srcConn, ok := srcUnwrapped.(*net.TCPConn)
+	if !ok || bufferedOf(src) > 0 {
+		return 0, false, nil
+	}
+	srcRaw, err := srcConn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstRaw, err := dstConn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	var written int64
+	for {
+		if idle > 0 {
+			if err := srcConn.SetReadDeadline(time.Now().Add(idle)); err != nil {
+				return written, true, err
+			}
+		}
+		// socket to pipe, the pipe is always drained before, never blocks
+		var n int64
+		var spliceErr error
+		if err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = splice(int(fd), pipe[1], spliceMaxChunk)
+			return spliceErr != syscall.EAGAIN
+		}); err != nil {
+			return written, true, err
+		}
+		if spliceErr != nil {
+			return written, true, spliceErr
+		}
+		if n == 0 {
+			// EOF
+			return written, true, nil
+		}
+		for _, w := range srcWrappers {
+			w.Spliced(n, true)
+		}
+		// pipe to socket, till the pipe drained
+		for n > 0 {
+			var m int64
+			if err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = splice(pipe[0], int(fd), int(n))
+				return spliceErr != syscall.EAGAIN
+			}); err != nil {
+				return written, true, err
+			}
+			if spliceErr != nil {
+				return written, true, spliceErr
+			}
+			written += m
+			n -= m
+			atomic.AddUint64(&splicedBytes, uint64(m))
+			for _, w := range dstWrappers {
+				w.Spliced(m, false)
+			}
+		}
+	}
+}
+
+// splice moves at most n bytes from rfd to wfd without blocking
+func splice(rfd, wfd, n int) (int64, error) {
+	for {
+		m, err := syscall.Splice(rfd, nil, wfd, nil, n, spliceFlagMove|spliceFlagNonblock)
+		if err != syscall.EINTR {
+			return m, err
+		}
+	}
+}
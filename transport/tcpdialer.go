@@ -23,6 +23,10 @@ import (
 //   - foobar.com:8080
 type DialFunc func(addr string) (net.Conn, error)
 
+// localDialFunc a DialFunc binding the connection to localAddr if not nil,
+// dialing the addresses permitted by permit only if not nil
+type localDialFunc func(addr string, localAddr *net.TCPAddr, permit func(ip net.IP) bool) (net.Conn, error)
+
 // dial dials the given TCP addr using tcp4.
 //
 // This function has the following additional features comparing to net.Dial:
@@ -46,8 +50,13 @@ type DialFunc func(addr string) (net.Conn, error)
 //     * foobar.baz:443
 //     * foo.bar:80
 //     * aaa.com:8080
-func dial(addr string, isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
-	conn, err := getDialer(DefaultDialTimeout, false)(addr)
+//
+// The connection is bound to localAddr if not nil, e.g. for choosing the
+// egress IP on a multi-homed host. Only the addresses permitted by permit
+// are dialed if not nil.
+func dial(addr string, isTLS bool, tlsConfig *tls.Config, localAddr *net.TCPAddr,
+	permit func(ip net.IP) bool) (net.Conn, error) {
+	conn, err := getDialer(DefaultDialTimeout, false)(addr, localAddr, permit)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +69,7 @@ func dial(addr string, isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
 	return conn, nil
 }
 
-func getDialer(timeout time.Duration, dualStack bool) DialFunc {
+func getDialer(timeout time.Duration, dualStack bool) localDialFunc {
 	if timeout <= 0 {
 		timeout = DefaultDialTimeout
 	}
@@ -89,8 +98,8 @@ var (
 	dialerStd       = &tcpDialer{}
 	dialerDualStack = &tcpDialer{DualStack: true}
 
-	dialMap          = make(map[int]DialFunc)
-	dialDualStackMap = make(map[int]DialFunc)
+	dialMap          = make(map[int]localDialFunc)
+	dialDualStackMap = make(map[int]localDialFunc)
 	dialMapLock      sync.Mutex
 )
 
@@ -110,32 +119,47 @@ const maxDialConcurrency = 1000
 // ErrDialTimeout is returned when TCP dialing is timed out.
 var ErrDialTimeout = errors.New("dialing to the given TCP address timed out")
 
+// ErrNoPermittedAddr is returned when none of the TCP addresses resolved is
+// permitted to dial, see DialPermitted.
+var ErrNoPermittedAddr = errors.New("no permitted TCP address to dial")
+
 // DefaultDialTimeout is timeout used by Dial and DialDualStack
 // for establishing TCP connections.
 const DefaultDialTimeout = 5 * time.Second
 
-func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
+func (d *tcpDialer) init() {
 	d.once.Do(func() {
 		d.concurrencyCh = make(chan struct{}, maxDialConcurrency)
 		d.tcpAddrsMap = make(map[string]*tcpAddrEntry)
 		go d.tcpAddrsClean()
 	})
+}
 
-	return func(addr string) (net.Conn, error) {
+func (d *tcpDialer) newDial(timeout time.Duration) localDialFunc {
+	d.init()
+
+	return func(addr string, localAddr *net.TCPAddr, permit func(ip net.IP) bool) (net.Conn, error) {
 		addrs, idx, err := d.getTCPAddrs(addr)
 		if err != nil {
 			return nil, err
 		}
-		network := "tcp4"
-		if d.DualStack {
-			network = "tcp"
+		if permit != nil {
+			if addrs = permittedTCPAddrs(addrs, permit); len(addrs) == 0 {
+				return nil, ErrNoPermittedAddr
+			}
 		}
-
 		var conn net.Conn
 		n := uint32(len(addrs))
 		deadline := time.Now().Add(timeout)
 		for n > 0 {
-			conn, err = tryDial(network, &addrs[idx%n], deadline, d.concurrencyCh)
+			tcpAddr := &addrs[idx%n]
+			// the IPv6 addresses are only resolved from the IPv6
+			// literals unless dual stack
+			network := "tcp4"
+			if d.DualStack || tcpAddr.IP.To4() == nil {
+				network = "tcp"
+			}
+			conn, err = tryDial(network, localAddr, tcpAddr, deadline, d.concurrencyCh)
 			if err == nil {
 				return conn, nil
 			}
@@ -149,7 +173,8 @@ func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
 	}
 }
 
-func tryDial(network string, addr *net.TCPAddr, deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
+func tryDial(network string, localAddr, addr *net.TCPAddr, deadline time.Time,
+	concurrencyCh chan struct{}) (net.Conn, error) {
 	timeout := -time.Since(deadline)
 	if timeout <= 0 {
 		return nil, ErrDialTimeout
@@ -184,7 +209,7 @@ func tryDial(network string, addr *net.TCPAddr, deadline time.Time, concurrencyC
 	ch := chv.(chan dialResult)
 	go func() {
 		var dr dialResult
-		dr.conn, dr.err = net.DialTCP(network, nil, addr)
+		dr.conn, dr.err = net.DialTCP(network, localAddr, addr)
 		ch <- dr
 		<-concurrencyCh
 	}()
@@ -208,6 +233,17 @@ func tryDial(network string, addr *net.TCPAddr, deadline time.Time, concurrencyC
 	return conn, err
 }
 
+// permittedTCPAddrs the addrs permitted by permit, addrs cached is never modified
+func permittedTCPAddrs(addrs []net.TCPAddr, permit func(ip net.IP) bool) []net.TCPAddr {
+	permitted := make([]net.TCPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if permit(addr.IP) {
+			permitted = append(permitted, addr)
+		}
+	}
+	return permitted
+}
+
 var dialResultChanPool sync.Pool
 
 type dialResult struct {
@@ -288,11 +324,16 @@ func resolveTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, error) {
 		return nil, err
 	}
 
-	ips, err := net.LookupIP(host)
+	ips, err := lookupIP(host)
 	if err != nil {
 		return nil, err
 	}
 
+	// the IPv6 literal is always dialed, e.g. the target of CONNECT [::1]:443
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		dualStack = true
+	}
+
 	n := len(ips)
 	addrs := make([]net.TCPAddr, 0, n)
 	for i := 0; i < n; i++ {
@@ -311,4 +352,7 @@ func resolveTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, error) {
 	return addrs, nil
 }
 
+// lookupIP resolves the host dialed, replaced by tests
+var lookupIP = net.LookupIP
+
 var errNoDNSEntries = errors.New("couldn't find DNS entries for the given domain. Try using DialDualStack")
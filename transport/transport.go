@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
@@ -12,30 +13,198 @@ import (
 
 //DialTLS dial tls without pool
 func DialTLS(addr string, tlsConfig *tls.Config) (net.Conn, error) {
-	return dial(addr, true, tlsConfig)
+	return dial(addr, true, tlsConfig, nil, nil)
 }
 
 //Dial dial without pool
 func Dial(addr string) (net.Conn, error) {
-	return dial(addr, false, nil)
+	return dial(addr, false, nil, nil, nil)
+}
+
+// DialLocal Dial from localAddr, e.g. `192.0.2.10:0` for the egress IP,
+// the system chooses the source address if nil
+func DialLocal(addr string, localAddr *net.TCPAddr) (net.Conn, error) {
+	return dial(addr, false, nil, localAddr, nil)
+}
+
+// DialTLSLocal DialTLS from localAddr, see DialLocal
+func DialTLSLocal(addr string, tlsConfig *tls.Config, localAddr *net.TCPAddr) (net.Conn, error) {
+	return dial(addr, true, tlsConfig, localAddr, nil)
+}
+
+// DialPermitted DialLocal to the resolved addresses permitted by permit only,
+// e.g. refusing the private networks, which are checked exactly as dialed
+// rather than resolved again. ErrNoPermittedAddr is returned if none permitted,
+// all permitted if permit is nil
+func DialPermitted(addr string, localAddr *net.TCPAddr, permit func(ip net.IP) bool) (net.Conn, error) {
+	return dial(addr, false, nil, localAddr, permit)
+}
+
+// DialTLSPermitted DialTLSLocal to the permitted addresses only, see DialPermitted
+func DialTLSPermitted(addr string, tlsConfig *tls.Config, localAddr *net.TCPAddr,
+	permit func(ip net.IP) bool) (net.Conn, error) {
+	return dial(addr, true, tlsConfig, localAddr, permit)
+}
+
+// LookupTCPAddrs returns the TCP addresses of addr resolved and cached by the
+// dialer for DefaultDNSCacheDuration, which are dialed then
+func LookupTCPAddrs(addr string) ([]net.TCPAddr, error) {
+	dialerStd.init()
+	addrs, _, err := dialerStd.getTCPAddrs(addr)
+	return addrs, err
+}
+
+// CloseWrite half-closes w if supported, e.g. a TCP or TLS connection, so that
+// the peer reads EOF while w is still readable, nothing done otherwise
+func CloseWrite(w io.Writer) error {
+	if c, ok := w.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// WrappedConn is implemented by the connection wrappers, e.g. counting the
+// bytes, which Forward splices through as the wrapped connections
+type WrappedConn interface {
+	// NetConn returns the wrapped connection
+	NetConn() net.Conn
+	// Buffered returns the number of bytes read ahead by the wrapper, which
+	// are read before the wrapped connection
+	Buffered() int
+	// Spliced tells n bytes are spliced from the wrapped connection if read,
+	// or to it otherwise
+	Spliced(n int64, read bool)
+}
+
+// unwrapConn returns the connection underlying the wrappers of c, along with
+// the wrappers from the outermost
+func unwrapConn(c interface{}) (interface{}, []WrappedConn) {
+	var wrappers []WrappedConn
+	for {
+		w, ok := c.(WrappedConn)
+		if !ok {
+			return c, wrappers
+		}
+		wrappers = append(wrappers, w)
+		c = w.NetConn()
+	}
+}
+
+// bufferedOf returns the number of bytes read ahead by the wrappers of c
+func bufferedOf(c interface{}) int {
+	_, wrappers := unwrapConn(c)
+	n := 0
+	for _, w := range wrappers {
+		n += w.Buffered()
+	}
+	return n
+}
+
+var splicedBytes uint64
+
+// SplicedBytes returns the total bytes forwarded by splicing so far
+func SplicedBytes() uint64 {
+	return atomic.LoadUint64(&splicedBytes)
 }
 
 // Forward forward remote and local connection
 // It returns the number of bytes write to dst
 // and the first error encountered while writing, if any.
+// The bytes are spliced without copying into user space
+// when both are TCP connections on Linux, or wrapped ones,
+// see WrappedConn.
 func Forward(dst io.Writer, src io.Reader, idle time.Duration) (int64, error) {
-	buffer := bytebufferpool.Get()
-	defer bytebufferpool.Put(buffer)
 	var err, e error
-	var wn int64
-	if wn, e = buffer.CopyWithIdleDuration(dst, src, idle); e != nil {
+	var wn, n int64
+	var spliced bool
+	buffer := bytebufferpool.Get()
+	// the bytes read ahead by wrappers are never spliced, copied firstly
+	if wn, e = forwardBuffered(dst, src); e == nil {
+		if n, spliced, e = forwardSplice(dst, src, idle); !spliced {
+			if r, ok := src.(deadlineReader); ok && idle > 0 {
+				n, e = forwardWithDeadline(dst, r, buffer, idle)
+			} else {
+				n, e = buffer.CopyWithIdleDuration(dst, src, idle)
+			}
+		}
+		wn += n
+	}
+	// the buffer is still read into by the copying goroutine left
+	// when idle time out, which is never reused then
+	if e == nil || e.Error() != errIdleTimeout {
+		bytebufferpool.Put(buffer)
+	}
+	if e != nil {
 		errStr := e.Error()
 		if !(strings.Contains(errStr, "broken pipe") ||
 			strings.Contains(errStr, "reset by peer") ||
 			strings.Contains(errStr, "i/o timeout") ||
-			strings.Contains(errStr, "idle time out")) {
+			strings.Contains(errStr, errIdleTimeout)) {
 			err = e
 		}
 	}
 	return wn, err
 }
+
+// errIdleTimeout the error of CopyWithIdleDuration when idle time out
+const errIdleTimeout = "idle time out"
+
+// deadlineReader is implemented by the connections, e.g. net.Conn
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// forwardWithDeadline copies src to dst through buffer, the idle duration is
+// applied to the read deadline of src before every read as forwardSplice does,
+// so that nothing is left reading src when returned
+func forwardWithDeadline(dst io.Writer, src deadlineReader,
+	buffer *bytebufferpool.ByteBuffer, idle time.Duration) (int64, error) {
+	if cap(buffer.B) < 32*1024 {
+		buffer.B = make([]byte, 32*1024)
+	}
+	b := buffer.B[:cap(buffer.B)]
+	var written int64
+	for {
+		if err := src.SetReadDeadline(time.Now().Add(idle)); err != nil {
+			return written, err
+		}
+		nr, er := src.Read(b)
+		if nr > 0 {
+			nw, ew := dst.Write(b[:nr])
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return written, nil
+		}
+		if er != nil {
+			return written, er
+		}
+	}
+}
+
+// forwardBuffered copies the bytes read ahead by the wrappers of src to dst
+func forwardBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	var wn int64
+	var b [4096]byte
+	for bufferedOf(src) > 0 {
+		n, err := src.Read(b[:])
+		if n > 0 {
+			m, e := dst.Write(b[:n])
+			wn += int64(m)
+			if e != nil {
+				return wn, e
+			}
+		}
+		if err != nil {
+			return wn, err
+		}
+	}
+	return wn, nil
+}
@@ -1,12 +1,19 @@
 package transport
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/cert"
 )
 
@@ -73,3 +80,327 @@ func TestTransportDialTLS(t *testing.T) {
 		t.Fatalf("expected result is %s, but get unexpected result: %s", "HTTP/1.1 400", string(result))
 	}
 }
+
+// tcpConnPair returns both ends of a loopback TCP connection
+func tcpConnPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+// plainConn hides the TCP connection type, so that it's forwarded by buffer
+type plainConn struct {
+	net.Conn
+}
+
+// forwardTCPConns forwards size bytes written to a TCP connection into
+// another one, src and dst are wrapped by wrap if provided
+func forwardTCPConns(tb testing.TB, size int, wrap func(net.Conn) net.Conn) {
+	srcWriter, srcConn := tcpConnPair(tb)
+	dstConn, dstReader := tcpConnPair(tb)
+	defer srcConn.Close()
+	defer dstReader.Close()
+	var src, dst net.Conn = srcConn, dstConn
+	if wrap != nil {
+		src, dst = wrap(srcConn), wrap(dstConn)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	go func() {
+		srcWriter.Write(data)
+		srcWriter.Close()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(dstReader)
+		received <- b
+	}()
+	n, err := Forward(dst, src, time.Second)
+	dstConn.Close()
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	if n != int64(len(data)) {
+		tb.Fatalf("expected %d bytes forwarded, got %d", len(data), n)
+	}
+	if b := <-received; !bytes.Equal(b, data) {
+		tb.Fatalf("unexpected %d bytes received", len(b))
+	}
+}
+
+func TestForwardTCPConns(t *testing.T) {
+	forwardTCPConns(t, 1<<20, nil)
+	forwardTCPConns(t, 1<<20, func(c net.Conn) net.Conn { return &plainConn{c} })
+}
+
+// wrappedConn reads the bytes ahead before conn, and counts the spliced
+type wrappedConn struct {
+	net.Conn
+	ahead   []byte
+	spliced int64
+}
+
+func (c *wrappedConn) Read(b []byte) (int, error) {
+	if len(c.ahead) > 0 {
+		n := copy(b, c.ahead)
+		c.ahead = c.ahead[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *wrappedConn) NetConn() net.Conn          { return c.Conn }
+func (c *wrappedConn) Buffered() int              { return len(c.ahead) }
+func (c *wrappedConn) Spliced(n int64, read bool) { c.spliced += n }
+
+func TestForwardWrappedConns(t *testing.T) {
+	srcWriter, srcConn := tcpConnPair(t)
+	dstConn, dstReader := tcpConnPair(t)
+	defer srcConn.Close()
+	defer dstReader.Close()
+	src := &wrappedConn{Conn: srcConn, ahead: []byte("ahead")}
+	dst := &wrappedConn{Conn: dstConn}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	go func() {
+		srcWriter.Write(data)
+		srcWriter.Close()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(dstReader)
+		received <- b
+	}()
+	splicedBefore := SplicedBytes()
+	n, err := Forward(dst, src, time.Second)
+	dstConn.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != int64(len("ahead")+len(data)) {
+		t.Fatalf("expected %d bytes forwarded, got %d", len("ahead")+len(data), n)
+	}
+	if b := <-received; !bytes.Equal(b, append([]byte("ahead"), data...)) {
+		t.Fatalf("unexpected %d bytes received", len(b))
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// the bytes read ahead are copied, the rest spliced and still counted
+	if src.spliced != int64(len(data)) || dst.spliced != int64(len(data)) {
+		t.Fatalf("expected %d bytes spliced, got %d read and %d written", len(data), src.spliced, dst.spliced)
+	}
+	if SplicedBytes()-splicedBefore < uint64(len(data)) {
+		t.Fatalf("expected %d bytes spliced at least, got %d", len(data), SplicedBytes()-splicedBefore)
+	}
+}
+
+func TestForwardIdle(t *testing.T) {
+	testForwardIdle(t, nil)
+	testForwardIdle(t, func(c net.Conn) net.Conn { return &plainConn{c} })
+}
+
+func testForwardIdle(t *testing.T, wrap func(net.Conn) net.Conn) {
+	srcWriter, srcConn := tcpConnPair(t)
+	dstConn, dstReader := tcpConnPair(t)
+	defer srcWriter.Close()
+	defer srcConn.Close()
+	defer dstConn.Close()
+	defer dstReader.Close()
+	var src, dst net.Conn = srcConn, dstConn
+	if wrap != nil {
+		src, dst = wrap(srcConn), wrap(dstConn)
+	}
+	// nothing sent by src, forwarding ends once idle
+	start := time.Now()
+	n, err := Forward(dst, src, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing forwarded, got %d bytes", n)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("expected forwarding ended when idle, took %s", d)
+	}
+}
+
+func TestForwardIdleWithoutDeadline(t *testing.T) {
+	// the reader without deadlines is left blocked when idle
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	var buffer bytes.Buffer
+	n, err := Forward(&buffer, pr, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing forwarded, got %d bytes", n)
+	}
+	// the buffers from the pool are never read into by the reader left
+	for i := 0; i < 4; i++ {
+		b := bytebufferpool.Get()
+		b.B = append(b.B[:0], make([]byte, 32*1024)...)
+		bytebufferpool.Put(b)
+	}
+	pw.Write([]byte("late"))
+}
+
+// limitedWriter fails writing after n bytes written
+type limitedWriter struct {
+	n int
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriterFull
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestForwardWriteError(t *testing.T) {
+	n, err := Forward(&limitedWriter{n: 10}, strings.NewReader("0123456789abcdef"), time.Second)
+	if err != errWriterFull {
+		t.Fatalf("expected error %q, got %v", errWriterFull, err)
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 bytes forwarded, got %d", n)
+	}
+}
+
+func TestDialLocal(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		conn.Close()
+		accepted <- conn.RemoteAddr()
+	}()
+	localAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	conn, err := DialLocal(ln.Addr().String(), localAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	remoteAddr, ok := (<-accepted).(*net.TCPAddr)
+	if !ok {
+		t.Fatal("expected a tcp connection accepted")
+	}
+	if !remoteAddr.IP.Equal(localAddr.IP) {
+		t.Fatalf("expected connection from %s, got %s", localAddr.IP, remoteAddr.IP)
+	}
+}
+
+func TestDialPermitted(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "permitted.test" {
+			return []net.IP{net.ParseIP("10.255.255.1"), net.ParseIP("127.0.0.1")}, nil
+		}
+		return net.LookupIP(host)
+	}
+	defer func() { lookupIP = net.LookupIP }()
+	isLoopback := func(ip net.IP) bool { return ip.IsLoopback() }
+
+	// the addresses resolved and cached are the ones dialed
+	addrs, err := LookupTCPAddrs("permitted.test:" + port)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses resolved, got %v", addrs)
+	}
+	// every permitted address is tried, never the others
+	for i := 0; i < 3; i++ {
+		conn, err := DialPermitted("permitted.test:"+port, nil, isLoopback)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Fatalf("unexpected address %s dialed", ip)
+		}
+		conn.Close()
+	}
+	if _, err := DialPermitted("permitted.test:"+port, nil, func(ip net.IP) bool {
+		return false
+	}); err != ErrNoPermittedAddr {
+		t.Fatalf("expected error %q, got %v", ErrNoPermittedAddr, err)
+	}
+}
+
+func TestDialIPv6Literal(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	conn, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Fatalf("expected %s dialed, got %s", net.IPv6loopback, ip)
+	}
+}
+
+func BenchmarkForward(b *testing.B) {
+	const size = 16 << 20
+	b.Run("Splice", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			forwardTCPConns(b, size, nil)
+		}
+	})
+	b.Run("Buffered", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			forwardTCPConns(b, size, func(c net.Conn) net.Conn { return &plainConn{c} })
+		}
+	})
+}
@@ -46,8 +46,9 @@ func (uri *URI) PathWithQueryFragment() []byte {
 	}
 	if len(uri.host) == 0 {
 		uri.pathWithQueryFragment = uri.full
-	} else if hostIndex := bytes.Index(uri.full, uri.host); hostIndex > 0 {
-		uri.pathWithQueryFragment = uri.full[hostIndex+len(uri.host):]
+	} else if hostIndex := bytes.Index(uri.full[len(uri.scheme):], uri.host); hostIndex >= 0 {
+		// search host after scheme, which may contains the host itself, e.g. http://h/
+		uri.pathWithQueryFragment = uri.full[len(uri.scheme)+hostIndex+len(uri.host):]
 	}
 	if len(uri.pathWithQueryFragment) == 0 {
 		uri.pathWithQueryFragment = uri.path
@@ -56,6 +57,14 @@ func (uri *URI) PathWithQueryFragment() []byte {
 	return uri.pathWithQueryFragment
 }
 
+// IsAbsoluteForm whether the request target is in absolute-form, e.g.
+// `http://www.example.com/path` which is sent to proxies, other than the
+// origin-form `/path` sent to origin servers, or the authority-form
+// `www.example.com:443` sent with CONNECT
+func (uri *URI) IsAbsoluteForm() bool {
+	return !uri.isTLS && len(uri.host) > 0
+}
+
 //Path ...
 func (uri *URI) Path() []byte {
 	return uri.path
@@ -97,6 +106,7 @@ func (uri *URI) Parse(isTLS bool, reqURI []byte) {
 		return
 	}
 	uri.Reset()
+	uri.isTLS = isTLS
 	uri.full = reqURI
 	fragmentIndex := bytes.IndexByte(reqURI, '#')
 	if fragmentIndex >= 0 {
@@ -251,10 +261,13 @@ func (h *HostInfo) ParseHostWithPort(host string, isTLS bool) {
 	if len(host) == 0 {
 		return
 	}
+	// clean the previous parsed host, especially the ip
+	h.reset()
 
 	// separate domain and port
 	if !hasPortFuncByte(host) {
-		h.domain = host
+		// IPv6 literals are bracketed, e.g. [::1]
+		h.domain = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
 		if isTLS {
 			h.port = "443"
 		} else {
@@ -278,8 +291,8 @@ func (h *HostInfo) ParseHostWithPort(host string, isTLS bool) {
 		h.ip = ip
 	}
 
-	// host and target with port
-	h.hostWithPort = h.domain + ":" + h.port
+	// host and target with port, IPv6 literals are bracketed
+	h.hostWithPort = net.JoinHostPort(h.domain, h.port)
 	h.targetWithPort = h.hostWithPort
 }
 
@@ -289,5 +302,15 @@ func (h *HostInfo) SetIP(ip net.IP) {
 		return
 	}
 	h.ip = ip
-	h.targetWithPort = ip.String() + ":" + h.port
+	h.targetWithPort = net.JoinHostPort(ip.String(), h.port)
+}
+
+// SetTarget set ip and port connected instead of the host, e.g. a host
+// overridden, the domain, port and hostWithPort are kept
+func (h *HostInfo) SetTarget(ip net.IP, port string) {
+	if ip == nil || len(port) == 0 {
+		return
+	}
+	h.ip = ip
+	h.targetWithPort = net.JoinHostPort(ip.String(), port)
 }
@@ -64,6 +64,31 @@ func TestParse(t *testing.T) {
 	testURIParse(t, u, false, "www.example.com/path/to/resource",
 		"", "www.example.com", "www.example.com:80",
 		"/path/to/resource", "/path/to/resource", "", "")
+	testURIParse(t, u, false, "www.example.com/path/to/resource?q=xx",
+		"", "www.example.com", "www.example.com:80",
+		"/path/to/resource?q=xx", "/path/to/resource", "?q=xx", "")
+	testURIParse(t, u, false, "http://h/path?q=xx#frag",
+		"http", "h", "h:80",
+		"/path?q=xx#frag", "/path", "?q=xx", "#frag")
+	testURIParse(t, u, false, "http://http:8080/path?q=xx",
+		"http", "http:8080", "http:8080",
+		"/path?q=xx", "/path", "?q=xx", "")
+}
+
+func TestIsAbsoluteForm(t *testing.T) {
+	u := &URI{}
+	u.Parse(false, []byte("http://www.example.com/path"))
+	if !u.IsAbsoluteForm() {
+		t.Fatal("expected absolute-form")
+	}
+	u.Parse(false, []byte("/path"))
+	if u.IsAbsoluteForm() {
+		t.Fatal("expected origin-form")
+	}
+	u.Parse(true, []byte("www.example.com:443"))
+	if u.IsAbsoluteForm() {
+		t.Fatal("expected authority-form")
+	}
 }
 
 func testURIParse(t *testing.T, u *URI, isConnect bool, uri,
@@ -110,6 +135,10 @@ func TestHostInfo(t *testing.T) {
 	testHostInfo(t, "localhost:8080", false, "localhost", "8080", "localhost:8080", "localhost:8080", "localhost", "", hostInfo)
 	testHostInfo(t, "localhost:445", true, "localhost", "445", "localhost:445", "localhost:445", "localhost", "", hostInfo)
 
+	testHostInfo(t, "[2001:db8::1]:443", true, "2001:db8::1", "443", "[2001:db8::1]:443", "[2001:db8::1]:443", "2001:db8::1", "", hostInfo)
+	testHostInfo(t, "[::1]", true, "::1", "443", "[::1]:443", "[::1]:443", "::1", "", hostInfo)
+	testHostInfo(t, "localhost:8080", false, "localhost", "8080", "localhost:8080", "[::1]:8080", "::1", "::1", hostInfo)
+
 	testHostInfo(t, ":::::", true, "", "", "", "", "", "", hostInfo)
 	testHostInfo(t, ":::::", false, "", "", "", "", "", "", hostInfo)
 
@@ -145,3 +174,25 @@ func testHostInfo(t *testing.T, host string, isTLS bool, domain, port, hostWithP
 	h.reset()
 
 }
+
+func TestHostInfoSetTarget(t *testing.T) {
+	h := &HostInfo{}
+	h.ParseHostWithPort("api.example.com", true)
+	h.SetTarget(net.ParseIP("127.0.0.1"), "8443")
+	if h.HostWithPort() != "api.example.com:443" || h.Port() != "443" {
+		t.Fatalf("expected host api.example.com:443 kept, got %s", h.HostWithPort())
+	}
+	if !h.IP().Equal(net.ParseIP("127.0.0.1")) || h.TargetWithPort() != "127.0.0.1:8443" {
+		t.Fatalf("expected target 127.0.0.1:8443, got %s", h.TargetWithPort())
+	}
+	h.SetTarget(net.ParseIP("::1"), "8443")
+	if h.TargetWithPort() != "[::1]:8443" {
+		t.Fatalf("expected target [::1]:8443, got %s", h.TargetWithPort())
+	}
+	// nothing changes without ip or port
+	h.SetTarget(nil, "80")
+	h.SetTarget(net.ParseIP("10.0.0.1"), "")
+	if h.TargetWithPort() != "[::1]:8443" {
+		t.Fatalf("expected target [::1]:8443, got %s", h.TargetWithPort())
+	}
+}
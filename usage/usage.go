@@ -5,6 +5,9 @@ import (
 )
 
 // ProxyUsage a struct for counting the size of the data incoming and outgoing
+//
+// The sizes are added atomically right in the serving go routines, never
+// deferred into new ones, so a request is fully accounted once served.
 type ProxyUsage struct {
 	Incoming uint64 //byte size
 	Outgoing uint64 //byte size
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CountingReader wraps a reader and atomically accumulates the bytes read,
+// it is safe to get the count while reading in another go routine
+type CountingReader struct {
+	r io.Reader
+	n uint64
+}
+
+// NewCountingReader makes a counting reader reading from r
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+// Read reads from the underlying reader and counts the bytes read
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&c.n, uint64(n))
+	}
+	return n, err
+}
+
+// Count returns the bytes read so far
+func (c *CountingReader) Count() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// Add counts n bytes read bypassing the reader, e.g. spliced
+func (c *CountingReader) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+// CountingWriter wraps a writer and atomically accumulates the bytes written,
+// it is safe to get the count while writing in another go routine
+type CountingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+// NewCountingWriter makes a counting writer writing into w
+func NewCountingWriter(w io.Writer) *CountingWriter {
+	return &CountingWriter{w: w}
+}
+
+// Write writes into the underlying writer and counts the bytes written
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		atomic.AddUint64(&c.n, uint64(n))
+	}
+	return n, err
+}
+
+// Count returns the bytes written so far
+func (c *CountingWriter) Count() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// Add counts n bytes written bypassing the writer, e.g. spliced
+func (c *CountingWriter) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCountingReader(t *testing.T) {
+	r := NewCountingReader(strings.NewReader("hello world"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := r.Count(); n != 5 {
+		t.Fatalf("expected count 5, got %d", n)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := r.Count(); n != 11 {
+		t.Fatalf("expected count 11, got %d", n)
+	}
+}
+
+type shortWriter struct{}
+
+var errShortWriter = errors.New("short writer")
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, errShortWriter
+}
+
+func TestCountingWriter(t *testing.T) {
+	w := NewCountingWriter(ioutil.Discard)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Write([]byte("0123456789"))
+		}()
+	}
+	wg.Wait()
+	if n := w.Count(); n != 100 {
+		t.Fatalf("expected count 100, got %d", n)
+	}
+
+	// partially written bytes are counted as well
+	w = NewCountingWriter(shortWriter{})
+	if _, err := w.Write([]byte("0123")); err != errShortWriter {
+		t.Fatalf("expected error %s, got %s", errShortWriter, err)
+	}
+	if n := w.Count(); n != 2 {
+		t.Fatalf("expected count 2, got %d", n)
+	}
+}
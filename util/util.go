@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net"
+	"time"
 )
 
 // WriteWithValidation write p into w and validate the written data length
@@ -22,6 +24,40 @@ func WriteWithValidation(w io.Writer, p []byte) (int, error) {
 	return wn, nil
 }
 
+// writeFull write p into a streaming writer like net.Conn,
+// retrying the short writes until all written or an error occurs
+func writeFull(w io.Writer, p []byte) (int, error) {
+	if w == nil {
+		return 0, nil
+	}
+	written := 0
+	for written < len(p) {
+		wn, err := w.Write(p[written:])
+		written += wn
+		if err != nil {
+			return written, err
+		}
+		if wn == 0 {
+			// no progress made, avoid looping forever
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// WriteWithDeadline write p fully into conn before the deadline, the write
+// deadline of conn is set to restored afterwards, zero means no deadline
+func WriteWithDeadline(conn net.Conn, p []byte, deadline, restored time.Time) (int, error) {
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	wn, err := writeFull(conn, p)
+	if e := conn.SetWriteDeadline(restored); e != nil && err == nil {
+		err = e
+	}
+	return wn, err
+}
+
 // ErrWrapper wrap the error message except io.EOF
 func ErrWrapper(err error, msg string, args ...interface{}) error {
 	if err == nil {
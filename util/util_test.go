@@ -2,7 +2,10 @@ package util
 
 import (
 	"io"
+	"io/ioutil"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
 )
@@ -25,3 +28,101 @@ func testWriteWithValidation(t *testing.T, w io.Writer, testString string, expEr
 		t.Fatalf("expected write length is %d, but it is %d ", expWriteLength, n)
 	}
 }
+
+func TestWriteWithDeadline(t *testing.T) {
+	// nobody reads the pipe, the write blocks until the deadline
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	start := time.Now()
+	n, err := WriteWithDeadline(c1, []byte("HTTP/1.1 200 OK\r\n\r\n"), start.Add(50*time.Millisecond), time.Time{})
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected write length is 0, but it is %d", n)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected write to time out soon, but it takes %s", d)
+	}
+
+	// the deadline is cleared after writing
+	go io.Copy(ioutil.Discard, c2)
+	time.Sleep(100 * time.Millisecond)
+	n, err = WriteWithDeadline(c1, []byte("1234"), time.Now().Add(200*time.Millisecond), time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected write length is 4, but it is %d", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := c1.Write([]byte("1234")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the deadline restored is kept after writing
+	_, err = WriteWithDeadline(c1, []byte("1234"), time.Now().Add(time.Second),
+		time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := c1.Write([]byte("1234")); err == nil {
+		t.Fatal("expected write to time out by the deadline restored")
+	}
+}
+
+// trickleWriter accepts at most 3 bytes per write
+type trickleWriter struct {
+	b     []byte
+	calls int
+}
+
+func (w *trickleWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+type stuckWriter struct{}
+
+func (stuckWriter) Write(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestWriteFull(t *testing.T) {
+	n, err := writeFull(nil, []byte("12"))
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing written to nil writer, got %d, %v", n, err)
+	}
+
+	w := &trickleWriter{}
+	n, err = writeFull(w, []byte("1234567890"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 10 || string(w.b) != "1234567890" {
+		t.Fatalf("expected 1234567890 written, but %q written with length %d", w.b, n)
+	}
+	if w.calls != 4 {
+		t.Fatalf("expected 4 writes, but %d", w.calls)
+	}
+	// a short write is a failure with validation
+	if _, err := WriteWithValidation(&trickleWriter{}, []byte("1234")); err != io.ErrShortWrite {
+		t.Fatalf("expected error: %s, but get unexpected error: %s", io.ErrShortWrite, err)
+	}
+
+	// fixed buffer keeps the short buffer error
+	bytebuffer := bytebufferpool.MakeFixedSizeByteBuffer(5)
+	bytebuffer.Reset()
+	if n, err := writeFull(bytebuffer, []byte("123456789")); err != io.ErrShortBuffer || n != 5 {
+		t.Fatalf("expected short buffer error with length 5, got %d, %v", n, err)
+	}
+
+	if _, err := writeFull(stuckWriter{}, []byte("1234")); err != io.ErrShortWrite {
+		t.Fatalf("expected error: %s, but get unexpected error: %s", io.ErrShortWrite, err)
+	}
+}